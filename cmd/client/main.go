@@ -2,45 +2,119 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"websocket-demo/internal/auth"
+
 	"github.com/gorilla/websocket"
 )
 
 type ClientMessage struct {
-	Type    string `json:"type"`
-	To      string `json:"to,omitempty"`
-	Content string `json:"content,omitempty"`
-	UserID  string `json:"userId,omitempty"`
+	Type     string `json:"type"`
+	To       string `json:"to,omitempty"`
+	Content  string `json:"content,omitempty"`
+	UserID   string `json:"userId,omitempty"`
+	DeviceID string `json:"deviceId,omitempty"`
+	ClientID string `json:"clientId,omitempty"`
+	Event    string `json:"event,omitempty"`
+
+	GroupID string `json:"groupId,omitempty"`
+	Member  string `json:"member,omitempty"`
+	Role    string `json:"role,omitempty"`
+
+	ConversationID string `json:"conversationId,omitempty"`
+	Before         string `json:"before,omitempty"`
+	Limit          int    `json:"limit,omitempty"`
+
+	UpTo         string `json:"upTo,omitempty"`
+	ReadReceipts *bool  `json:"readReceipts,omitempty"`
 }
 
 type ServerMessage struct {
-	Type    string `json:"type"`
-	From    string `json:"from,omitempty"`
-	Content string `json:"content,omitempty"`
-	Error   string `json:"error,omitempty"`
+	Type      string `json:"type"`
+	ID        string `json:"id,omitempty"`
+	ClientID  string `json:"clientId,omitempty"`
+	From      string `json:"from,omitempty"`
+	To        string `json:"to,omitempty"`
+	GroupID   string `json:"groupId,omitempty"`
+	Content   string `json:"content,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Error     *Error `json:"error,omitempty"`
+	Event     string `json:"event,omitempty"`
+	TTL       int64  `json:"ttl,omitempty"`
+	Version   int    `json:"version,omitempty"`
+
+	Messages []ServerMessage `json:"messages,omitempty"`
+	HasMore  bool            `json:"hasMore,omitempty"`
+	Cursor   string          `json:"cursor,omitempty"`
+	ReadUpTo string          `json:"readUpTo,omitempty"`
+
+	ReadReceipts *bool `json:"readReceipts,omitempty"`
+}
+
+// Error is a protocol v2 error
+type Error struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	Retryable  bool   `json:"retryable"`
+	RequestID  string `json:"requestId,omitempty"`
+	RetryAfter int64  `json:"retryAfter,omitempty"`
 }
 
 func main() {
 	userID := flag.String("user", "", "User ID (required)")
 	gatewayURL := flag.String("gateway", "ws://localhost:8080/ws", "Gateway WebSocket URL")
+	deviceID := flag.String("device", "", "Device ID (defaults to one per connection)")
+	token := flag.String("token", "", "Bearer token for the gateway")
+	devKey := flag.String("dev-key", "", "HMAC dev key file used to mint a token for -user")
+	audience := flag.String("audience", "", "Audience claim for minted dev tokens")
+	caFile := flag.String("ca", "", "CA file trusted for wss:// gateways (default: system roots)")
+	certFile := flag.String("cert", "", "Client certificate file for gateways that authenticate by certificate")
+	keyFile := flag.String("key", "", "Client certificate private key file")
 	flag.Parse()
 
 	if *userID == "" {
 		log.Fatal("User ID is required (use -user flag)")
 	}
 
+	if *token == "" && *devKey != "" {
+		minted, err := mintDevToken(*devKey, *userID, *audience)
+		if err != nil {
+			log.Fatalf("Failed to mint dev token: %v", err)
+		}
+		*token = minted
+	}
+
+	var header http.Header
+	if *token != "" {
+		header = http.Header{"Authorization": []string{"Bearer " + *token}}
+	}
+
+	tlsConfig, err := clientTLSConfig(*caFile, *certFile, *keyFile)
+	if err != nil {
+		log.Fatalf("Failed to load TLS files: %v", err)
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	dialer.Subprotocols = []string{"chat.v2"}
+
 	// Connect to gateway
 	log.Printf("Connecting to %s as user %s...", *gatewayURL, *userID)
 
-	conn, _, err := websocket.DefaultDialer.Dial(*gatewayURL, nil)
+	conn, _, err := dialer.Dial(*gatewayURL, header)
 	if err != nil {
 		log.Fatalf("Failed to connect: %v", err)
 	}
@@ -50,8 +124,9 @@ func main() {
 
 	// Register user
 	registerMsg := ClientMessage{
-		Type:   "register",
-		UserID: *userID,
+		Type:     "register",
+		UserID:   *userID,
+		DeviceID: *deviceID,
 	}
 
 	if err := conn.WriteJSON(registerMsg); err != nil {
@@ -63,19 +138,133 @@ func main() {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	// Start message receiver
-	go receiveMessages(conn)
+	received := &lastReceived{ids: make(map[string]string)}
+	go receiveMessages(conn, *userID, received)
 
 	// Start heartbeat
 	go sendHeartbeat(conn)
 
 	// Start interactive mode
-	go interactiveMode(conn, *userID)
+	go interactiveMode(conn, *userID, received)
 
 	<-sigChan
 	log.Println("Shutting down...")
 }
 
-func receiveMessages(conn *websocket.Conn) {
+// mintDevToken signs a one-hour HS256 token for userID with the dev key
+func mintDevToken(keyFile, userID, audience string) (string, error) {
+	secret, err := os.ReadFile(keyFile)
+	if err != nil {
+		return "", err
+	}
+
+	claims := &auth.Claims{
+		Subject:   userID,
+		IssuedAt:  time.Now().Unix(),
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}
+	if audience != "" {
+		claims.Audience = auth.Audience{audience}
+	}
+
+	return auth.Sign(claims, "HS256", bytes.TrimSpace(secret))
+}
+
+// clientTLSConfig builds the TLS settings for wss:// gateways from an
+// optional CA file and client certificate; nil uses the defaults
+func clientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// lastReceived remembers the newest message from each user, so "read <userId>"
+// can mark the conversation read without typing a message ID
+type lastReceived struct {
+	mu  sync.Mutex
+	ids map[string]string
+}
+
+func (l *lastReceived) set(from, id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ids[from] = id
+}
+
+func (l *lastReceived) get(from string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ids[from]
+}
+
+// typingIndicators tracks who is typing, hiding each indicator once its TTL
+// passes without a fresh typing_start
+type typingIndicators struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
+
+func (t *typingIndicators) start(from string, ttl time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if timer, ok := t.timers[from]; ok {
+		// Still typing, just extend the indicator
+		timer.Reset(ttl)
+		return
+	}
+
+	fmt.Printf("\n✎ %s is typing...\n> ", from)
+	t.timers[from] = time.AfterFunc(ttl, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.timers, from)
+		fmt.Printf("\n✎ %s stopped typing\n> ", from)
+	})
+}
+
+func (t *typingIndicators) stop(from string, announce bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	timer, ok := t.timers[from]
+	if !ok {
+		return
+	}
+	timer.Stop()
+	delete(t.timers, from)
+	if announce {
+		fmt.Printf("\n✎ %s stopped typing\n> ", from)
+	}
+}
+
+func receiveMessages(conn *websocket.Conn, userID string, received *lastReceived) {
+	typing := &typingIndicators{timers: make(map[string]*time.Timer)}
+
 	for {
 		var msg ServerMessage
 		if err := conn.ReadJSON(&msg); err != nil {
@@ -85,20 +274,100 @@ func receiveMessages(conn *websocket.Conn) {
 
 		switch msg.Type {
 		case "registered":
-			fmt.Println("\n✓ Successfully registered")
+			fmt.Printf("\n✓ Successfully registered (protocol v%d)\n", msg.Version)
 			fmt.Println("\nCommands:")
 			fmt.Println("  send <userId> <message>  - Send a message to a user")
+			fmt.Println("  gsend <groupId> <message> - Send a message to a group")
+			fmt.Println("  group <create|join|leave> <groupId>")
+			fmt.Println("  group <add|remove> <groupId> <userId> [role]")
+			fmt.Println("  history <userId> [before] - Show conversation history")
+			fmt.Println("  read <userId> [messageId] - Mark a conversation read")
+			fmt.Println("  receipts [on|off]         - Show or change read receipt sharing")
+			fmt.Println("  typing <userId> [stop]    - Show or clear a typing indicator")
+			fmt.Println("  signal <userId> <event> [payload] - Send an ephemeral signal")
 			fmt.Println("  quit                      - Exit the client")
 			fmt.Print("\n> ")
 
 		case "pong":
 			// Heartbeat response, no need to print
 
+		case "typing_start":
+			ttl := time.Duration(msg.TTL) * time.Millisecond
+			if ttl <= 0 {
+				ttl = 6 * time.Second
+			}
+			typing.start(msg.From, ttl)
+
+		case "typing_stop":
+			typing.stop(msg.From, true)
+
+		case "signal":
+			fmt.Printf("\n⚡ %s from %s: %s\n> ", msg.Event, msg.From, msg.Content)
+
 		case "message":
-			fmt.Printf("\n📨 Message from %s: %s\n> ", msg.From, msg.Content)
+			// A message ends the sender's typing indicator
+			typing.stop(msg.From, false)
+
+			if msg.GroupID != "" {
+				fmt.Printf("\n👥 [%s] %s: %s\n> ", msg.GroupID, msg.From, msg.Content)
+			} else if msg.From == userID {
+				// Sent from another of our devices
+				fmt.Printf("\n📤 You -> %s: %s\n> ", msg.To, msg.Content)
+			} else {
+				received.set(msg.From, msg.ID)
+				fmt.Printf("\n📨 Message from %s: %s\n> ", msg.From, msg.Content)
+			}
+
+		case "read":
+			if msg.ReadUpTo != "" {
+				fmt.Printf("\n✓ Marked read up to %s\n> ", msg.ReadUpTo)
+			} else {
+				fmt.Printf("\n👁 %s read your messages up to %s\n> ", msg.From, msg.ID)
+			}
+
+		case "settings":
+			if msg.ReadReceipts != nil {
+				fmt.Printf("\n✓ Read receipts: %v\n> ", *msg.ReadReceipts)
+			}
+
+		case "ack":
+			fmt.Printf("\n✓ Message %s %s\n> ", msg.ClientID, msg.Status)
+
+		case "broadcast":
+			fmt.Printf("\n📢 %s: %s\n> ", msg.From, msg.Content)
+
+		case "group_updated":
+			fmt.Printf("\n✓ %s %s\n> ", msg.Content, msg.GroupID)
+
+		case "history":
+			fmt.Println()
+			for _, m := range msg.Messages {
+				ts := time.UnixMilli(m.Timestamp).Format("2006-01-02 15:04:05")
+				fmt.Printf("  [%s] %s -> %s: %s (%s)\n", ts, m.From, m.To, m.Content, m.Status)
+			}
+			if msg.ReadUpTo != "" {
+				fmt.Printf("  (you have read up to %s)\n", msg.ReadUpTo)
+			}
+			if msg.HasMore {
+				fmt.Printf("  ... more available, use: history <userId> %s\n", msg.Cursor)
+			}
+			fmt.Print("> ")
 
 		case "error":
-			fmt.Printf("\n❌ Error: %s\n> ", msg.Error)
+			e := msg.Error
+			if e == nil {
+				fmt.Printf("\n❌ Error\n> ")
+				continue
+			}
+			request := ""
+			if e.RequestID != "" {
+				request = " [" + e.RequestID + "]"
+			}
+			if e.RetryAfter > 0 {
+				fmt.Printf("\n⏳ %s%s, retry in %dms\n> ", e.Message, request, e.RetryAfter)
+			} else {
+				fmt.Printf("\n❌ Error (%s)%s: %s\n> ", e.Code, request, e.Message)
+			}
 
 		default:
 			fmt.Printf("\n📩 %s: %s\n> ", msg.Type, msg.Content)
@@ -119,10 +388,12 @@ func sendHeartbeat(conn *websocket.Conn) {
 	}
 }
 
-func interactiveMode(conn *websocket.Conn, userID string) {
+func interactiveMode(conn *websocket.Conn, userID string, received *lastReceived) {
 	scanner := bufio.NewScanner(os.Stdin)
 	fmt.Print("> ")
 
+	seq := 0
+
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		if line == "" {
@@ -144,16 +415,161 @@ func interactiveMode(conn *websocket.Conn, userID string) {
 			to := parts[1]
 			content := parts[2]
 
+			seq++
 			msg := ClientMessage{
-				Type:    "message",
-				To:      to,
-				Content: content,
+				Type:     "message",
+				To:       to,
+				Content:  content,
+				ClientID: fmt.Sprintf("%s-%d", userID, seq),
 			}
 
 			if err := conn.WriteJSON(msg); err != nil {
 				fmt.Printf("Failed to send message: %v\n", err)
 			} else {
-				fmt.Printf("✓ Message sent to %s\n", to)
+				fmt.Printf("→ Message %s queued for %s\n", msg.ClientID, to)
+			}
+
+		case "gsend":
+			if len(parts) < 3 {
+				fmt.Println("Usage: gsend <groupId> <message>")
+				fmt.Print("> ")
+				continue
+			}
+
+			seq++
+			msg := ClientMessage{
+				Type:     "message",
+				GroupID:  parts[1],
+				Content:  parts[2],
+				ClientID: fmt.Sprintf("%s-%d", userID, seq),
+			}
+
+			if err := conn.WriteJSON(msg); err != nil {
+				fmt.Printf("Failed to send message: %v\n", err)
+			}
+
+		case "group":
+			args := strings.Fields(line)
+			if len(args) < 3 {
+				fmt.Println("Usage: group <create|join|leave|add|remove> <groupId> [userId] [role]")
+				fmt.Print("> ")
+				continue
+			}
+
+			msg := ClientMessage{
+				Type:    "group_" + args[1],
+				GroupID: args[2],
+			}
+			if len(args) > 3 {
+				msg.Member = args[3]
+			}
+			if len(args) > 4 {
+				msg.Role = args[4]
+			}
+
+			if err := conn.WriteJSON(msg); err != nil {
+				fmt.Printf("Failed to send group command: %v\n", err)
+			}
+
+		case "history":
+			if len(parts) < 2 {
+				fmt.Println("Usage: history <userId> [before]")
+				fmt.Print("> ")
+				continue
+			}
+
+			msg := ClientMessage{
+				Type:           "history",
+				ConversationID: parts[1],
+				Limit:          20,
+			}
+			if len(parts) == 3 {
+				msg.Before = parts[2]
+			}
+
+			if err := conn.WriteJSON(msg); err != nil {
+				fmt.Printf("Failed to request history: %v\n", err)
+			}
+
+		case "read":
+			if len(parts) < 2 {
+				fmt.Println("Usage: read <userId> [messageId]")
+				fmt.Print("> ")
+				continue
+			}
+
+			upTo := received.get(parts[1])
+			if len(parts) == 3 {
+				upTo = parts[2]
+			}
+			if upTo == "" {
+				fmt.Printf("No messages from %s to mark read\n", parts[1])
+				fmt.Print("> ")
+				continue
+			}
+
+			msg := ClientMessage{
+				Type:           "read",
+				ConversationID: parts[1],
+				UpTo:           upTo,
+			}
+
+			if err := conn.WriteJSON(msg); err != nil {
+				fmt.Printf("Failed to mark read: %v\n", err)
+			}
+
+		case "receipts":
+			msg := ClientMessage{Type: "settings"}
+			if len(parts) > 1 {
+				if parts[1] != "on" && parts[1] != "off" {
+					fmt.Println("Usage: receipts [on|off]")
+					fmt.Print("> ")
+					continue
+				}
+				enabled := parts[1] == "on"
+				msg.ReadReceipts = &enabled
+			}
+
+			if err := conn.WriteJSON(msg); err != nil {
+				fmt.Printf("Failed to update settings: %v\n", err)
+			}
+
+		case "typing":
+			args := strings.Fields(line)
+			if len(args) < 2 || (len(args) > 2 && args[2] != "stop") {
+				fmt.Println("Usage: typing <userId> [stop]")
+				fmt.Print("> ")
+				continue
+			}
+
+			msg := ClientMessage{Type: "typing_start", To: args[1]}
+			if len(args) > 2 {
+				msg.Type = "typing_stop"
+			}
+
+			if err := conn.WriteJSON(msg); err != nil {
+				fmt.Printf("Failed to send typing indicator: %v\n", err)
+			}
+
+		case "signal":
+			if len(parts) < 3 {
+				fmt.Println("Usage: signal <userId> <event> [payload]")
+				fmt.Print("> ")
+				continue
+			}
+
+			rest := strings.SplitN(parts[2], " ", 2)
+			msg := ClientMessage{
+				Type:  "signal",
+				To:    parts[1],
+				Event: rest[0],
+			}
+			if len(rest) > 1 {
+				msg.Content = rest[1]
+			}
+
+			if err := conn.WriteJSON(msg); err != nil {
+				fmt.Printf("Failed to send signal: %v\n", err)
 			}
 
 		case "quit", "exit":
@@ -162,6 +578,13 @@ func interactiveMode(conn *websocket.Conn, userID string) {
 		default:
 			fmt.Println("Unknown command. Available commands:")
 			fmt.Println("  send <userId> <message>")
+			fmt.Println("  gsend <groupId> <message>")
+			fmt.Println("  group <create|join|leave|add|remove> <groupId> [userId] [role]")
+			fmt.Println("  history <userId> [before]")
+			fmt.Println("  read <userId> [messageId]")
+			fmt.Println("  receipts [on|off]")
+			fmt.Println("  typing <userId> [stop]")
+			fmt.Println("  signal <userId> <event> [payload]")
 			fmt.Println("  quit")
 		}
 
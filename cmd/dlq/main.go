@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"websocket-demo/internal/router"
+
+	"github.com/IBM/sarama"
+)
+
+// fetchTimeout bounds how long to wait for a message that should already exist
+const fetchTimeout = 10 * time.Second
+
+func main() {
+	// 命令行参数 / Command line flags
+	kafkaBrokers := flag.String("kafka", "localhost:9092", "Kafka brokers (comma-separated)")
+	topic := flag.String("topic", router.KafkaDLQTopic, "Dead-letter topic")
+	limit := flag.Int("limit", 100, "Max messages to list")
+	replayTo := flag.String("to", "", "Replay to this topic instead of each message's original topic")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: dlq [flags] <command>
+
+Commands:
+  list                              List dead-lettered messages
+  inspect <partition:offset>        Show a message's headers and payload
+  replay <partition:offset>... | all
+                                    Republish messages to their original topic
+
+Replayed messages stay in the DLQ; Kafka topics are append-only.
+
+Flags:
+`)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config := sarama.NewConfig()
+	config.Version = sarama.V3_0_0_0
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+
+	client, err := sarama.NewClient(strings.Split(*kafkaBrokers, ","), config)
+	if err != nil {
+		log.Fatalf("Failed to connect to Kafka: %v", err)
+	}
+	defer client.Close()
+
+	dlq := &dlqTool{client: client, topic: *topic}
+
+	switch args[0] {
+	case "list":
+		err = dlq.list(*limit)
+
+	case "inspect":
+		if len(args) != 2 {
+			log.Fatal("Usage: dlq inspect <partition:offset>")
+		}
+		err = dlq.inspect(args[1])
+
+	case "replay":
+		if len(args) < 2 {
+			log.Fatal("Usage: dlq replay <partition:offset>... | all")
+		}
+		err = dlq.replay(args[1:], *replayTo)
+
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatalf("%s failed: %v", args[0], err)
+	}
+}
+
+// dlqTool reads and replays messages on the dead-letter topic
+type dlqTool struct {
+	client sarama.Client
+	topic  string
+}
+
+// list prints a summary line per dead-lettered message, oldest first
+func (d *dlqTool) list(limit int) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "POSITION\tFAILED AT\tATTEMPTS\tORIGINAL TOPIC\tFROM\tTO\tREASON")
+
+	count := 0
+	err := d.scan(func(msg *sarama.ConsumerMessage) bool {
+		routed, err := router.DecodeMessage(msg.Value)
+		if err != nil {
+			routed = &router.Message{}
+		}
+
+		fmt.Fprintf(w, "%d:%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			msg.Partition, msg.Offset,
+			formatMillis(router.HeaderValue(msg.Headers, router.KafkaHeaderFailedAt)),
+			router.HeaderValue(msg.Headers, router.KafkaHeaderAttempt),
+			router.HeaderValue(msg.Headers, router.KafkaHeaderOriginalTopic),
+			routed.From, routed.To,
+			router.HeaderValue(msg.Headers, router.KafkaHeaderDLQReason))
+
+		count++
+		return count < limit
+	})
+	if err != nil {
+		return err
+	}
+
+	w.Flush()
+	fmt.Printf("%d message(s)\n", count)
+	return nil
+}
+
+// inspect prints one message's headers and payload
+func (d *dlqTool) inspect(ref string) error {
+	partition, offset, err := parseRef(ref)
+	if err != nil {
+		return err
+	}
+
+	msg, err := d.fetch(partition, offset)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Position:  %d:%d\n", msg.Partition, msg.Offset)
+	fmt.Printf("Timestamp: %s\n", msg.Timestamp.Format(time.RFC3339))
+	fmt.Printf("Key:       %s\n", msg.Key)
+	fmt.Println("Headers:")
+	for _, h := range msg.Headers {
+		fmt.Printf("  %s: %s\n", h.Key, h.Value)
+	}
+
+	// protobuf 消息以 JSON 格式显示 / Protobuf envelopes are shown as JSON
+	fmt.Println("Payload:")
+	payload, err := router.DecodeMessage(msg.Value)
+	if err != nil {
+		// 无法解析的消息原样输出 / Print undecodable payloads as-is
+		fmt.Printf("  %q\n", msg.Value)
+		return nil
+	}
+	pretty, _ := json.MarshalIndent(payload, "  ", "  ")
+	fmt.Printf("  %s\n", pretty)
+
+	return nil
+}
+
+// replay republishes messages with their retry and DLQ headers removed, so
+// the gateway retries them from scratch
+func (d *dlqTool) replay(refs []string, to string) error {
+	producer, err := sarama.NewSyncProducerFromClient(d.client)
+	if err != nil {
+		return fmt.Errorf("failed to create producer: %w", err)
+	}
+	defer producer.Close()
+
+	count := 0
+	send := func(msg *sarama.ConsumerMessage) error {
+		target := to
+		if target == "" {
+			target = router.HeaderValue(msg.Headers, router.KafkaHeaderOriginalTopic)
+		}
+		if target == "" {
+			return fmt.Errorf("message %d:%d has no %s header, use -to", msg.Partition, msg.Offset, router.KafkaHeaderOriginalTopic)
+		}
+
+		_, _, err := producer.SendMessage(&sarama.ProducerMessage{
+			Topic:   target,
+			Key:     sarama.ByteEncoder(msg.Key),
+			Value:   sarama.ByteEncoder(msg.Value),
+			Headers: router.ReplayHeaders(msg.Headers),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to replay %d:%d: %w", msg.Partition, msg.Offset, err)
+		}
+
+		fmt.Printf("Replayed %d:%d to %s\n", msg.Partition, msg.Offset, target)
+		count++
+		return nil
+	}
+
+	if len(refs) == 1 && refs[0] == "all" {
+		var sendErr error
+		err := d.scan(func(msg *sarama.ConsumerMessage) bool {
+			sendErr = send(msg)
+			return sendErr == nil
+		})
+		if err == nil {
+			err = sendErr
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, ref := range refs {
+			partition, offset, err := parseRef(ref)
+			if err != nil {
+				return err
+			}
+
+			msg, err := d.fetch(partition, offset)
+			if err != nil {
+				return err
+			}
+
+			if err := send(msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	fmt.Printf("%d message(s) replayed\n", count)
+	return nil
+}
+
+// scan calls fn for every message currently in the topic, partition by
+// partition, until fn returns false
+func (d *dlqTool) scan(fn func(msg *sarama.ConsumerMessage) bool) error {
+	partitions, err := d.client.Partitions(d.topic)
+	if err != nil {
+		return fmt.Errorf("failed to get partitions of %s: %w", d.topic, err)
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(d.client)
+	if err != nil {
+		return fmt.Errorf("failed to create consumer: %w", err)
+	}
+	defer consumer.Close()
+
+	for _, partition := range partitions {
+		oldest, err := d.client.GetOffset(d.topic, partition, sarama.OffsetOldest)
+		if err != nil {
+			return fmt.Errorf("failed to get oldest offset of partition %d: %w", partition, err)
+		}
+		newest, err := d.client.GetOffset(d.topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return fmt.Errorf("failed to get newest offset of partition %d: %w", partition, err)
+		}
+		if oldest >= newest {
+			continue
+		}
+
+		more, err := scanPartition(consumer, d.topic, partition, oldest, newest, fn)
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// scanPartition reads [from, to) from one partition. It returns false once fn
+// asks to stop.
+func scanPartition(consumer sarama.Consumer, topic string, partition int32, from, to int64, fn func(msg *sarama.ConsumerMessage) bool) (bool, error) {
+	pc, err := consumer.ConsumePartition(topic, partition, from)
+	if err != nil {
+		return false, fmt.Errorf("failed to consume partition %d: %w", partition, err)
+	}
+	defer pc.Close()
+
+	for {
+		select {
+		case msg := <-pc.Messages():
+			if !fn(msg) {
+				return false, nil
+			}
+			if msg.Offset >= to-1 {
+				return true, nil
+			}
+
+		case err := <-pc.Errors():
+			return false, fmt.Errorf("failed to read partition %d: %w", partition, err)
+
+		case <-time.After(fetchTimeout):
+			// 事务标记等占用的偏移量不会产生消息 / Offsets used by control records yield no message
+			return true, nil
+		}
+	}
+}
+
+// fetch reads the message at partition:offset
+func (d *dlqTool) fetch(partition int32, offset int64) (*sarama.ConsumerMessage, error) {
+	consumer, err := sarama.NewConsumerFromClient(d.client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer: %w", err)
+	}
+	defer consumer.Close()
+
+	var found *sarama.ConsumerMessage
+	_, err = scanPartition(consumer, d.topic, partition, offset, offset+1, func(msg *sarama.ConsumerMessage) bool {
+		found = msg
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil || found.Offset != offset {
+		return nil, fmt.Errorf("no message at %d:%d", partition, offset)
+	}
+
+	return found, nil
+}
+
+// parseRef parses a "partition:offset" message position
+func parseRef(ref string) (int32, int64, error) {
+	p, o, ok := strings.Cut(ref, ":")
+	if !ok {
+		return 0, 0, errors.New("message position must be partition:offset")
+	}
+
+	partition, err := strconv.ParseInt(p, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid partition %q", p)
+	}
+	offset, err := strconv.ParseInt(o, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid offset %q", o)
+	}
+
+	return int32(partition), offset, nil
+}
+
+// formatMillis formats a Unix millisecond header value
+func formatMillis(value string) string {
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return "-"
+	}
+	return time.UnixMilli(ms).Format(time.RFC3339)
+}
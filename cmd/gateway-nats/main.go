@@ -0,0 +1,178 @@
+//go:build nats
+
+// Gateway using NATS JetStream for cross-gateway routing.
+// Build with: go build -tags nats ./cmd/gateway-nats
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"websocket-demo/internal/auth"
+	"websocket-demo/internal/gateway"
+	"websocket-demo/internal/offline"
+	"websocket-demo/internal/router"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func main() {
+	// 命令行参数 / Command line flags
+	gatewayID := flag.String("id", "gateway-01", "Gateway ID")
+	port := flag.Int("port", 8080, "HTTP server port")
+	redisAddr := flag.String("redis", "localhost:6379", "Redis address")
+	natsURL := flag.String("nats", router.DefaultNatsConfig().URL, "NATS server URL")
+	natsEmbedded := flag.Bool("nats-embedded", false, "Run an in-process NATS server instead of connecting to -nats")
+	natsStore := flag.String("nats-store", "", "JetStream storage directory for -nats-embedded (default: temp dir)")
+	offlineMax := flag.Int64("offline-max", offline.DefaultConfig().MaxPerUser, "Max queued offline messages per user")
+	offlineTTL := flag.Duration("offline-ttl", offline.DefaultConfig().TTL, "TTL of a user's offline message queue")
+	adminToken := flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token for /admin endpoints (empty disables)")
+	jwtKey := flag.String("jwt-key", "", "JWT verification key: PEM public key or certificate file (RS*/ES*)")
+	jwtHMACSecret := flag.String("jwt-hmac-secret", "", "JWT HMAC secret file (HS*), at least 32 bytes")
+	jwksFile := flag.String("jwks", "", "JWT verification keys as a JWKS file")
+	jwtAudience := flag.String("jwt-audience", "", "Required JWT audience (empty skips the check)")
+	jwtIssuer := flag.String("jwt-issuer", "", "Required JWT issuer (empty skips the check)")
+	allowedOrigins := flag.String("allowed-origins", "", "Comma-separated browser origins allowed to connect, e.g. https://*.example.com (empty allows all)")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file; serves wss:// and reloads the file when it changes")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA file for client certificates; a verified certificate's CN is the user ID")
+	queueSize := flag.Int("send-queue", gateway.DefaultQueueConfig().Size, "Max queued outbound frames per connection")
+	writeTimeout := flag.Duration("write-timeout", gateway.DefaultQueueConfig().WriteTimeout, "Deadline for each WebSocket write")
+	overflow := flag.String("overflow", string(gateway.DefaultQueueConfig().Overflow), "Send queue overflow policy: drop-oldest or disconnect")
+	flag.Parse()
+
+	if policy := gateway.OverflowPolicy(*overflow); policy != gateway.OverflowDropOldest && policy != gateway.OverflowDisconnect {
+		log.Fatalf("Invalid -overflow %q (use drop-oldest or disconnect)", *overflow)
+	}
+
+	log.Printf("Starting Gateway %s on port %d (NATS mode)", *gatewayID, *port)
+
+	// 创建 Redis 客户端（仅用于 Presence 管理）
+	// Create Redis client (only for Presence management)
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: *redisAddr,
+	})
+	defer redisClient.Close()
+
+	// 测试 Redis 连接 / Test Redis connection
+	ctx := context.Background()
+	if err := redisClient.Ping(ctx).Err(); err != nil {
+		log.Fatalf("Failed to connect to Redis: %v", err)
+	}
+	log.Println("Connected to Redis")
+
+	// 按需启动内嵌 NATS 服务器 / Optionally start an embedded NATS server
+	natsConfig := router.DefaultNatsConfig()
+	natsConfig.URL = *natsURL
+	if *natsEmbedded {
+		ns, err := router.StartEmbeddedNats(*natsStore)
+		if err != nil {
+			log.Fatalf("Failed to start embedded NATS: %v", err)
+		}
+		defer ns.Shutdown()
+
+		natsConfig.URL = ns.ClientURL()
+		log.Printf("Embedded NATS server listening on %s", natsConfig.URL)
+	}
+
+	// 创建 NATS Router（替代 Redis Pub/Sub）
+	// Create NATS Router (replaces Redis Pub/Sub)
+	natsRouter, err := router.NewNatsRouter(*gatewayID, natsConfig)
+	if err != nil {
+		log.Fatalf("Failed to create NATS router: %v", err)
+	}
+	defer natsRouter.Stop()
+
+	// 加载 JWT 校验密钥（未配置则不启用认证）
+	// Load JWT verification keys (authentication is disabled without them)
+	verifier, err := auth.NewVerifierFromConfig(auth.Config{
+		KeyFile:        *jwtKey,
+		HMACSecretFile: *jwtHMACSecret,
+		JWKSFile:       *jwksFile,
+		Audience:       *jwtAudience,
+		Issuer:         *jwtIssuer,
+	})
+	if err != nil {
+		log.Fatalf("Failed to load JWT keys: %v", err)
+	}
+	if verifier == nil {
+		log.Println("JWT authentication disabled, trusting register frames")
+	}
+
+	// 浏览器 Origin 白名单 / Browser origin allowlist
+	origins, err := gateway.ParseOriginAllowlist(strings.Split(*allowedOrigins, ","))
+	if err != nil {
+		log.Fatalf("Invalid -allowed-origins: %v", err)
+	}
+
+	// 离线消息队列（存储在 Redis 中）/ Offline message queue (stored in Redis)
+	offlineStore := offline.NewRedisStore(redisClient, offline.Config{
+		MaxPerUser: *offlineMax,
+		TTL:        *offlineTTL,
+	})
+	opts := []gateway.Option{
+		gateway.WithOfflineStore(offlineStore),
+		gateway.WithAdminToken(*adminToken),
+		gateway.WithVerifier(verifier),
+		gateway.WithQueueConfig(gateway.QueueConfig{
+			Size:         *queueSize,
+			WriteTimeout: *writeTimeout,
+			Overflow:     gateway.OverflowPolicy(*overflow),
+			CloseCode:    gateway.DefaultQueueConfig().CloseCode,
+		}),
+		gateway.WithOriginAllowlist(origins),
+	}
+
+	// TLS（证书变更时自动重新加载），可选客户端证书认证
+	// TLS (reloaded when the certificate changes), optionally with client certificate auth
+	if *tlsCert != "" || *tlsKey != "" {
+		reloader, err := gateway.NewTLSReloader(gateway.TLSConfig{
+			CertFile:     *tlsCert,
+			KeyFile:      *tlsKey,
+			ClientCAFile: *tlsClientCA,
+		})
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		opts = append(opts, gateway.WithTLS(reloader))
+	} else if *tlsClientCA != "" {
+		log.Fatal("-tls-client-ca requires -tls-cert and -tls-key")
+	}
+
+	// 创建 Gateway 服务器（使用 NATS Router）
+	// Create Gateway server (using NATS Router)
+	server := gateway.NewServerWithRouter(*gatewayID, *port, redisClient, natsRouter, opts...)
+
+	// 启动服务器 / Start server
+	serverCtx, serverCancel := context.WithCancel(context.Background())
+	defer serverCancel()
+
+	go func() {
+		if err := server.Start(serverCtx); err != nil {
+			log.Fatalf("Server error: %v", err)
+		}
+	}()
+
+	// 等待中断信号 / Wait for interrupt signal
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	<-sigChan
+
+	log.Println("Received shutdown signal, gracefully stopping...")
+
+	// 优雅关闭 / Graceful shutdown
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+
+	if err := server.Stop(shutdownCtx); err != nil {
+		log.Printf("Error during shutdown: %v", err)
+	}
+
+	log.Println("Gateway stopped")
+}
@@ -6,10 +6,15 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"websocket-demo/internal/auth"
 	"websocket-demo/internal/gateway"
+	"websocket-demo/internal/offline"
+	"websocket-demo/internal/router"
+	"websocket-demo/internal/store"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -18,29 +23,168 @@ func main() {
 	// Parse command-line flags
 	gatewayID := flag.String("id", "", "Gateway ID (required)")
 	port := flag.Int("port", 8080, "HTTP port")
+	backend := flag.String("backend", "redis", "State and routing backend: redis, or memory for a standalone gateway")
 	redisAddr := flag.String("redis", "localhost:6379", "Redis address")
+	advertise := flag.String("advertise", "", "HTTP address published in the gateway registry (default hostname:port)")
+	routerKind := flag.String("router", "pubsub", "Cross-gateway routing over Redis: pubsub or streams")
+	streamMaxLen := flag.Int64("stream-maxlen", router.DefaultStreamConfig().MaxLen, "Approximate max entries per gateway stream (-router streams)")
+	offlineMax := flag.Int64("offline-max", offline.DefaultConfig().MaxPerUser, "Max queued offline messages per user")
+	offlineTTL := flag.Duration("offline-ttl", offline.DefaultConfig().TTL, "TTL of a user's offline message queue")
+	postgresDSN := flag.String("postgres", "", "PostgreSQL DSN for message persistence (empty disables)")
+	adminToken := flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token for /admin endpoints (empty disables)")
+	jwtKey := flag.String("jwt-key", "", "JWT verification key: PEM public key or certificate file (RS*/ES*)")
+	jwtHMACSecret := flag.String("jwt-hmac-secret", "", "JWT HMAC secret file (HS*), at least 32 bytes")
+	jwksFile := flag.String("jwks", "", "JWT verification keys as a JWKS file")
+	jwtAudience := flag.String("jwt-audience", "", "Required JWT audience (empty skips the check)")
+	jwtIssuer := flag.String("jwt-issuer", "", "Required JWT issuer (empty skips the check)")
+	allowedOrigins := flag.String("allowed-origins", "", "Comma-separated browser origins allowed to connect, e.g. https://*.example.com (empty allows all)")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file; serves wss:// and reloads the file when it changes")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA file for client certificates; a verified certificate's CN is the user ID")
+	queueSize := flag.Int("send-queue", gateway.DefaultQueueConfig().Size, "Max queued outbound frames per connection")
+	writeTimeout := flag.Duration("write-timeout", gateway.DefaultQueueConfig().WriteTimeout, "Deadline for each WebSocket write")
+	overflow := flag.String("overflow", string(gateway.DefaultQueueConfig().Overflow), "Send queue overflow policy: drop-oldest or disconnect")
+	limitMessages := flag.String("limit-messages", gateway.DefaultRateLimitConfig().Messages.String(), "Message rate limits per connection and per user (rate:burst,rate:burst; 0:0 disables)")
+	limitPings := flag.String("limit-pings", gateway.DefaultRateLimitConfig().Pings.String(), "Ping rate limits per connection and per user")
+	limitSignals := flag.String("limit-signals", gateway.DefaultRateLimitConfig().Signals.String(), "Typing and signal rate limits per connection and per user")
+	limitOther := flag.String("limit-other", gateway.DefaultRateLimitConfig().Others.String(), "Rate limits per connection and per user for every other frame (register, history, sync, read, settings, groups)")
+	maxViolations := flag.Int("max-violations", gateway.DefaultRateLimitConfig().MaxViolations, "Rate limit violations per minute before a connection is closed (0 never closes)")
 	flag.Parse()
 
+	if policy := gateway.OverflowPolicy(*overflow); policy != gateway.OverflowDropOldest && policy != gateway.OverflowDisconnect {
+		log.Fatalf("Invalid -overflow %q (use drop-oldest or disconnect)", *overflow)
+	}
+
+	rateLimits := gateway.DefaultRateLimitConfig()
+	rateLimits.MaxViolations = *maxViolations
+	for _, l := range []struct {
+		flag   string
+		value  string
+		limits *gateway.FrameLimits
+	}{
+		{"-limit-messages", *limitMessages, &rateLimits.Messages},
+		{"-limit-pings", *limitPings, &rateLimits.Pings},
+		{"-limit-signals", *limitSignals, &rateLimits.Signals},
+		{"-limit-other", *limitOther, &rateLimits.Others},
+	} {
+		limits, err := gateway.ParseFrameLimits(l.value)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", l.flag, err)
+		}
+		*l.limits = limits
+	}
+
 	if *gatewayID == "" {
 		log.Fatal("Gateway ID is required (use -id flag)")
 	}
 
-	// Create Redis client
-	redisClient := redis.NewClient(&redis.Options{
-		Addr: *redisAddr,
-	})
+	if *routerKind != "pubsub" && *routerKind != "streams" {
+		log.Fatalf("Invalid -router %q (use pubsub or streams)", *routerKind)
+	}
+
+	if *backend != "redis" && *backend != "memory" {
+		log.Fatalf("Invalid -backend %q (use redis or memory)", *backend)
+	}
 
 	ctx := context.Background()
 
-	// Test Redis connection
-	if err := redisClient.Ping(ctx).Err(); err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+	// Load JWT verification keys (authentication is disabled without them)
+	verifier, err := auth.NewVerifierFromConfig(auth.Config{
+		KeyFile:        *jwtKey,
+		HMACSecretFile: *jwtHMACSecret,
+		JWKSFile:       *jwksFile,
+		Audience:       *jwtAudience,
+		Issuer:         *jwtIssuer,
+	})
+	if err != nil {
+		log.Fatalf("Failed to load JWT keys: %v", err)
+	}
+	if verifier == nil {
+		log.Println("JWT authentication disabled, trusting register frames")
 	}
 
-	log.Println("Connected to Redis")
+	origins, err := gateway.ParseOriginAllowlist(strings.Split(*allowedOrigins, ","))
+	if err != nil {
+		log.Fatalf("Invalid -allowed-origins: %v", err)
+	}
 
 	// Create and start server
-	server := gateway.NewServer(*gatewayID, *port, redisClient)
+	offlineConfig := offline.Config{
+		MaxPerUser: *offlineMax,
+		TTL:        *offlineTTL,
+	}
+	opts := []gateway.Option{
+		gateway.WithAdminToken(*adminToken),
+		gateway.WithVerifier(verifier),
+		gateway.WithQueueConfig(gateway.QueueConfig{
+			Size:         *queueSize,
+			WriteTimeout: *writeTimeout,
+			Overflow:     gateway.OverflowPolicy(*overflow),
+			CloseCode:    gateway.DefaultQueueConfig().CloseCode,
+		}),
+		gateway.WithAdvertiseAddr(*advertise),
+		gateway.WithRateLimits(rateLimits),
+		gateway.WithOriginAllowlist(origins),
+	}
+
+	// Serve TLS, optionally authenticating service clients by certificate
+	if *tlsCert != "" || *tlsKey != "" {
+		reloader, err := gateway.NewTLSReloader(gateway.TLSConfig{
+			CertFile:     *tlsCert,
+			KeyFile:      *tlsKey,
+			ClientCAFile: *tlsClientCA,
+		})
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		opts = append(opts, gateway.WithTLS(reloader))
+	} else if *tlsClientCA != "" {
+		log.Fatal("-tls-client-ca requires -tls-cert and -tls-key")
+	}
+
+	// Connect to PostgreSQL for message persistence
+	if *postgresDSN != "" {
+		messageStore, err := store.OpenPostgres(ctx, *postgresDSN)
+		if err != nil {
+			log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+		}
+		defer messageStore.Close()
+
+		log.Println("Connected to PostgreSQL")
+		opts = append(opts, gateway.WithMessageStore(messageStore))
+	}
+
+	var server *gateway.Server
+	if *backend == "memory" {
+		// Presence, routing, offline queues and groups live in this process only
+		log.Println("Using in-memory backend, messages are not routed to other gateway processes")
+		server = gateway.NewMemoryServer(*gatewayID, *port, gateway.NewMemoryBackend(offlineConfig), opts...)
+	} else {
+		// Create Redis client
+		redisClient := redis.NewClient(&redis.Options{
+			Addr: *redisAddr,
+		})
+
+		// Test Redis connection
+		if err := redisClient.Ping(ctx).Err(); err != nil {
+			log.Fatalf("Failed to connect to Redis: %v", err)
+		}
+
+		log.Println("Connected to Redis")
+
+		opts = append(opts, gateway.WithOfflineStore(offline.NewRedisStore(redisClient, offlineConfig)))
+
+		if *routerKind == "streams" {
+			// Redis Streams give at-least-once routing across subscriber restarts
+			streamConfig := router.DefaultStreamConfig()
+			streamConfig.MaxLen = *streamMaxLen
+			streamRouter := router.NewStreamRouter(redisClient, *gatewayID, streamConfig)
+
+			server = gateway.NewServerWithRouter(*gatewayID, *port, redisClient, streamRouter, opts...)
+		} else {
+			server = gateway.NewServer(*gatewayID, *port, redisClient, opts...)
+		}
+	}
 
 	// Handle graceful shutdown
 	sigChan := make(chan os.Signal, 1)
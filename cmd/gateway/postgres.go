@@ -0,0 +1,4 @@
+package main
+
+// Register the "postgres" database/sql driver used by store.OpenPostgres
+import _ "github.com/lib/pq"
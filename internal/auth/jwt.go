@@ -0,0 +1,267 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // Register SHA-256 for crypto.SHA256
+	_ "crypto/sha512" // Register SHA-384/512 for crypto.SHA384 and crypto.SHA512
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidToken is returned for malformed tokens or bad signatures
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrTokenExpired is returned when exp is in the past or nbf in the future
+	ErrTokenExpired = errors.New("token expired or not yet valid")
+	// ErrInvalidClaims is returned when audience, issuer or subject do not match
+	ErrInvalidClaims = errors.New("invalid token claims")
+)
+
+// Claims are the JWT claims used by the gateway
+type Claims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+}
+
+// HasRole reports whether the claims grant a role
+func (c *Claims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Audience accepts both the string and array forms of the aud claim
+type Audience []string
+
+// UnmarshalJSON decodes a single audience string or a list of them
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// Contains reports whether aud is one of the audiences
+func (a Audience) Contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// header is the JOSE header of a JWT
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// Verifier validates signed JWTs against a key set
+type Verifier struct {
+	keys     *KeySet
+	audience string        // Required aud value (empty skips the check)
+	issuer   string        // Required iss value (empty skips the check)
+	leeway   time.Duration // Allowed clock skew for exp and nbf
+	now      func() time.Time
+}
+
+// NewVerifier creates a verifier for tokens signed by keys
+func NewVerifier(keys *KeySet, audience, issuer string) *Verifier {
+	return &Verifier{
+		keys:     keys,
+		audience: audience,
+		issuer:   issuer,
+		leeway:   30 * time.Second,
+		now:      time.Now,
+	}
+}
+
+// Verify checks the token's signature, expiry, audience and issuer and returns its claims
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: expected 3 segments", ErrInvalidToken)
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, fmt.Errorf("%w: bad header: %v", ErrInvalidToken, err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature encoding", ErrInvalidToken)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	if !v.verifySignature(h, signed, signature) {
+		return nil, fmt.Errorf("%w: signature verification failed", ErrInvalidToken)
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: bad claims: %v", ErrInvalidToken, err)
+	}
+
+	if err := v.validateClaims(&claims); err != nil {
+		return nil, err
+	}
+
+	return &claims, nil
+}
+
+// verifySignature tries each candidate key for the header's kid and alg
+func (v *Verifier) verifySignature(h header, signed, signature []byte) bool {
+	for _, key := range v.keys.candidates(h.Kid) {
+		if verifyWithKey(h.Alg, key, signed, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateClaims checks time-based and identity claims
+func (v *Verifier) validateClaims(c *Claims) error {
+	now := v.now()
+
+	if c.ExpiresAt == 0 {
+		return fmt.Errorf("%w: missing exp", ErrInvalidClaims)
+	}
+	if now.After(time.Unix(c.ExpiresAt, 0).Add(v.leeway)) {
+		return ErrTokenExpired
+	}
+	if c.NotBefore != 0 && now.Add(v.leeway).Before(time.Unix(c.NotBefore, 0)) {
+		return ErrTokenExpired
+	}
+
+	if c.Subject == "" {
+		return fmt.Errorf("%w: missing sub", ErrInvalidClaims)
+	}
+	if v.audience != "" && !c.Audience.Contains(v.audience) {
+		return fmt.Errorf("%w: audience mismatch", ErrInvalidClaims)
+	}
+	if v.issuer != "" && c.Issuer != v.issuer {
+		return fmt.Errorf("%w: issuer mismatch", ErrInvalidClaims)
+	}
+
+	return nil
+}
+
+// verifyWithKey verifies a signature for one algorithm and key.
+// The key type must match the algorithm family, which rules out
+// algorithm-confusion attacks such as HS256 signed with an RSA public key.
+func verifyWithKey(alg string, key interface{}, signed, signature []byte) bool {
+	hashFunc, ok := algHash(alg)
+	if !ok {
+		return false
+	}
+
+	switch k := key.(type) {
+	case []byte:
+		if !strings.HasPrefix(alg, "HS") {
+			return false
+		}
+		mac := hmac.New(hashFunc.New, k)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return false
+		}
+		return rsa.VerifyPKCS1v15(k, hashFunc, digest(hashFunc.New(), signed), signature) == nil
+
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return false
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(k, digest(hashFunc.New(), signed), r, s)
+	}
+
+	return false
+}
+
+// Sign creates an HMAC-signed token. It is meant for development and tests;
+// production tokens should come from an identity provider.
+func Sign(claims *Claims, alg string, secret []byte) (string, error) {
+	hashFunc, ok := algHash(alg)
+	if !ok || !strings.HasPrefix(alg, "HS") {
+		return "", fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+
+	headerJSON, err := json.Marshal(header{Alg: alg, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	mac := hmac.New(hashFunc.New, secret)
+	mac.Write([]byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// algHash maps a JWS algorithm to its hash function
+func algHash(alg string) (crypto.Hash, bool) {
+	switch alg {
+	case "HS256", "RS256", "ES256":
+		return crypto.SHA256, true
+	case "HS384", "RS384", "ES384":
+		return crypto.SHA384, true
+	case "HS512", "RS512", "ES512":
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
+func digest(h hash.Hash, data []byte) []byte {
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
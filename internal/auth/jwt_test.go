@@ -0,0 +1,296 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	testNow    = time.Unix(1_700_000_000, 0)
+	testSecret = []byte("0123456789abcdef0123456789abcdef")
+)
+
+func testClaims() *Claims {
+	return &Claims{
+		Subject:   "alice",
+		Issuer:    "https://issuer.example",
+		Audience:  Audience{"chat"},
+		IssuedAt:  testNow.Unix(),
+		ExpiresAt: testNow.Add(time.Hour).Unix(),
+	}
+}
+
+// newTestVerifier creates a verifier whose clock is fixed at testNow
+func newTestVerifier(keys *KeySet, audience, issuer string) *Verifier {
+	v := NewVerifier(keys, audience, issuer)
+	v.now = func() time.Time { return testNow }
+	return v
+}
+
+// signToken signs claims with any supported algorithm; key is an HMAC
+// secret, *rsa.PrivateKey or *ecdsa.PrivateKey
+func signToken(t *testing.T, alg string, key interface{}, claims *Claims) string {
+	t.Helper()
+
+	headerJSON, err := json.Marshal(header{Alg: alg, Typ: "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	hashFunc, ok := algHash(alg)
+	if !ok {
+		hashFunc = crypto.SHA256
+	}
+	sum := digest(hashFunc.New(), []byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(hashFunc.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, hashFunc, sum)
+	case *ecdsa.PrivateKey:
+		r, s, signErr := ecdsa.Sign(rand.Reader, k, sum)
+		err = signErr
+		size := (k.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	default:
+		t.Fatalf("unsupported key %T", key)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := NewKeySet()
+	keys.Add("hmac", testSecret)
+	keys.Add("rsa", &rsaKey.PublicKey)
+	keys.Add("ec", &ecKey.PublicKey)
+	v := newTestVerifier(keys, "", "")
+
+	for _, tc := range []struct {
+		alg string
+		key interface{}
+	}{
+		{"HS256", testSecret},
+		{"HS512", testSecret},
+		{"RS256", rsaKey},
+		{"ES256", ecKey},
+	} {
+		token := signToken(t, tc.alg, tc.key, testClaims())
+		claims, err := v.Verify(token)
+		if err != nil {
+			t.Errorf("%s: Verify() error = %v", tc.alg, err)
+			continue
+		}
+		if claims.Subject != "alice" {
+			t.Errorf("%s: Subject = %q, want alice", tc.alg, claims.Subject)
+		}
+	}
+}
+
+func TestVerifyRejectsAlgorithmConfusion(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+
+	keys := NewKeySet()
+	keys.Add("", &rsaKey.PublicKey)
+	v := newTestVerifier(keys, "", "")
+
+	// HS256 keyed with the public key, which an attacker knows
+	for _, secret := range [][]byte{pubPEM, pubDER} {
+		token := signToken(t, "HS256", secret, testClaims())
+		if _, err := v.Verify(token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("HS256 with the RSA public key: err = %v, want ErrInvalidToken", err)
+		}
+	}
+
+	// An RS256 header over an HMAC key set
+	hmacKeys := NewKeySet()
+	hmacKeys.Add("", testSecret)
+	token := signToken(t, "RS256", rsaKey, testClaims())
+	if _, err := newTestVerifier(hmacKeys, "", "").Verify(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("RS256 against an HMAC key: err = %v, want ErrInvalidToken", err)
+	}
+
+	// Unsigned tokens
+	claimsJSON, err := json.Marshal(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(claimsJSON) + "."
+	if _, err := newTestVerifier(hmacKeys, "", "").Verify(unsigned); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("alg none: err = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestVerifyTimeLeeway(t *testing.T) {
+	keys := NewKeySet()
+	keys.Add("", testSecret)
+	v := newTestVerifier(keys, "", "")
+
+	for _, tc := range []struct {
+		name    string
+		exp     time.Duration // Relative to testNow
+		nbf     time.Duration // Relative to testNow; 0 leaves nbf unset
+		wantErr error
+	}{
+		{"valid", time.Hour, 0, nil},
+		{"expired within leeway", -20 * time.Second, 0, nil},
+		{"expired beyond leeway", -time.Minute, 0, ErrTokenExpired},
+		{"nbf within leeway", time.Hour, 20 * time.Second, nil},
+		{"nbf beyond leeway", time.Hour, time.Minute, ErrTokenExpired},
+	} {
+		claims := testClaims()
+		claims.ExpiresAt = testNow.Add(tc.exp).Unix()
+		if tc.nbf != 0 {
+			claims.NotBefore = testNow.Add(tc.nbf).Unix()
+		}
+
+		_, err := v.Verify(signToken(t, "HS256", testSecret, claims))
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s: err = %v, want %v", tc.name, err, tc.wantErr)
+		}
+	}
+
+	// exp is required
+	claims := testClaims()
+	claims.ExpiresAt = 0
+	if _, err := v.Verify(signToken(t, "HS256", testSecret, claims)); !errors.Is(err, ErrInvalidClaims) {
+		t.Errorf("missing exp: err = %v, want ErrInvalidClaims", err)
+	}
+}
+
+func TestVerifyAudienceAndIssuer(t *testing.T) {
+	keys := NewKeySet()
+	keys.Add("", testSecret)
+	v := newTestVerifier(keys, "chat", "https://issuer.example")
+
+	for _, tc := range []struct {
+		name    string
+		edit    func(*Claims)
+		wantErr error
+	}{
+		{"match", func(c *Claims) {}, nil},
+		{"one of several audiences", func(c *Claims) { c.Audience = Audience{"billing", "chat"} }, nil},
+		{"wrong audience", func(c *Claims) { c.Audience = Audience{"billing"} }, ErrInvalidClaims},
+		{"missing audience", func(c *Claims) { c.Audience = nil }, ErrInvalidClaims},
+		{"wrong issuer", func(c *Claims) { c.Issuer = "https://evil.example" }, ErrInvalidClaims},
+		{"missing issuer", func(c *Claims) { c.Issuer = "" }, ErrInvalidClaims},
+		{"missing subject", func(c *Claims) { c.Subject = "" }, ErrInvalidClaims},
+	} {
+		claims := testClaims()
+		tc.edit(claims)
+
+		_, err := v.Verify(signToken(t, "HS256", testSecret, claims))
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s: err = %v, want %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestAudienceStringForm(t *testing.T) {
+	var c Claims
+	if err := json.Unmarshal([]byte(`{"sub":"alice","aud":"chat","exp":1}`), &c); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Audience.Contains("chat") {
+		t.Errorf("Audience = %v, want [chat]", c.Audience)
+	}
+}
+
+func TestLoadKeyFileRejectsNonPEM(t *testing.T) {
+	path := writeTempFile(t, "key", "0123456789abcdef0123456789abcdef0123456789abcdef")
+
+	if err := NewKeySet().LoadKeyFile(path); err == nil {
+		t.Error("LoadKeyFile() accepted a non-PEM file")
+	}
+}
+
+func TestLoadHMACSecretFile(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"empty", "", true},
+		{"whitespace", " \n", true},
+		{"short", "secret\n", true},
+		{"long enough", string(testSecret) + "\n", false},
+	} {
+		ks := NewKeySet()
+		err := ks.LoadHMACSecretFile(writeTempFile(t, "secret", tc.content))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestJWKOctKeys(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		k       string
+		wantErr bool
+	}{
+		{"empty", "", true},
+		{"short", base64.RawURLEncoding.EncodeToString([]byte("secret")), true},
+		{"long enough", base64.RawURLEncoding.EncodeToString(testSecret), false},
+	} {
+		_, err := jwk{Kty: "oct", K: tc.k}.publicKey()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func writeTempFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+// KeySet holds verification keys indexed by key ID. Keys are []byte (HMAC
+// secrets), *rsa.PublicKey or *ecdsa.PublicKey.
+type KeySet struct {
+	byKid map[string]interface{}
+	all   []interface{}
+}
+
+// NewKeySet creates an empty key set
+func NewKeySet() *KeySet {
+	return &KeySet{byKid: make(map[string]interface{})}
+}
+
+// Add adds a key under an optional key ID
+func (ks *KeySet) Add(kid string, key interface{}) {
+	if kid != "" {
+		ks.byKid[kid] = key
+	}
+	ks.all = append(ks.all, key)
+}
+
+// Len returns the number of keys in the set
+func (ks *KeySet) Len() int {
+	return len(ks.all)
+}
+
+// candidates returns the keys to try for a token's kid
+func (ks *KeySet) candidates(kid string) []interface{} {
+	if kid != "" {
+		if key, ok := ks.byKid[kid]; ok {
+			return []interface{}{key}
+		}
+	}
+	return ks.all
+}
+
+// MinHMACSecretLen is the minimum HMAC secret length in bytes, the output
+// size of SHA-256 as RFC 7518 requires for HS256
+const MinHMACSecretLen = 32
+
+// LoadKeyFile loads a PEM public key or certificate (RSA/ECDSA). HMAC secrets
+// are loaded with LoadHMACSecretFile instead, so a misplaced or corrupt PEM
+// file is never mistaken for a secret.
+func (ks *KeySet) LoadKeyFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("key file %s is not PEM encoded (HMAC secrets need -jwt-hmac-secret)", path)
+	}
+
+	key, err := parsePEMPublicKey(block)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	ks.Add("", key)
+	return nil
+}
+
+// LoadHMACSecretFile loads the file's trimmed contents as an HMAC secret of
+// at least MinHMACSecretLen bytes
+func (ks *KeySet) LoadHMACSecretFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read HMAC secret file: %w", err)
+	}
+
+	secret := bytes.TrimSpace(data)
+	if err := checkHMACSecret(secret); err != nil {
+		return fmt.Errorf("HMAC secret file %s: %w", path, err)
+	}
+
+	ks.Add("", secret)
+	return nil
+}
+
+// checkHMACSecret rejects secrets too short to resist brute force
+func checkHMACSecret(secret []byte) error {
+	if len(secret) < MinHMACSecretLen {
+		return fmt.Errorf("secret is %d bytes, need at least %d", len(secret), MinHMACSecretLen)
+	}
+	return nil
+}
+
+// LoadJWKSFile loads every supported key from a JWKS document on disk
+func (ks *KeySet) LoadJWKSFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read JWKS file: %w", err)
+	}
+
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	for _, k := range doc.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return fmt.Errorf("JWKS key %q: %w", k.Kid, err)
+		}
+		ks.Add(k.Kid, key)
+	}
+
+	return nil
+}
+
+// parsePEMPublicKey parses PKIX, PKCS#1 and certificate PEM blocks
+func parsePEMPublicKey(block *pem.Block) (interface{}, error) {
+	var pub interface{}
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub = key
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub = key
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		pub = cert.PublicKey
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+
+	switch pub.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %T", pub)
+}
+
+// jwk is a JSON Web Key (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// publicKey converts the JWK into a verification key
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "oct":
+		secret, err := decodeB64(k.K)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkHMACSecret(secret); err != nil {
+			return nil, err
+		}
+		return secret, nil
+
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeB64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := decodeB64(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// SubprotocolPrefix marks a bearer token carried in Sec-WebSocket-Protocol,
+// for browser clients that cannot set headers: new WebSocket(url, ["bearer.<jwt>"])
+const SubprotocolPrefix = "bearer."
+
+// ErrNoToken is returned when a request carries no bearer token
+var ErrNoToken = errors.New("no bearer token")
+
+// Config selects where verification keys are loaded from
+type Config struct {
+	KeyFile        string // PEM public key or certificate
+	HMACSecretFile string // HMAC secret for HS* tokens, at least MinHMACSecretLen bytes
+	JWKSFile       string // JWKS document on disk
+	Audience       string // Required aud claim (empty skips the check)
+	Issuer         string // Required iss claim (empty skips the check)
+}
+
+// NewVerifierFromConfig loads the configured keys. It returns nil when no key
+// source is configured, meaning authentication is disabled.
+func NewVerifierFromConfig(cfg Config) (*Verifier, error) {
+	if cfg.KeyFile == "" && cfg.HMACSecretFile == "" && cfg.JWKSFile == "" {
+		return nil, nil
+	}
+
+	keys := NewKeySet()
+	if cfg.KeyFile != "" {
+		if err := keys.LoadKeyFile(cfg.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.HMACSecretFile != "" {
+		if err := keys.LoadHMACSecretFile(cfg.HMACSecretFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.JWKSFile != "" {
+		if err := keys.LoadJWKSFile(cfg.JWKSFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if keys.Len() == 0 {
+		return nil, fmt.Errorf("no verification keys loaded")
+	}
+
+	return NewVerifier(keys, cfg.Audience, cfg.Issuer), nil
+}
+
+// TokenFromRequest extracts a bearer token from the Authorization header,
+// the access_token query parameter or a "bearer.<token>" subprotocol.
+// For the subprotocol form it also returns the subprotocol, which the
+// server must echo back during the upgrade.
+func TokenFromRequest(r *http.Request) (token, subprotocol string, err error) {
+	if h := r.Header.Get("Authorization"); h != "" {
+		if t, ok := strings.CutPrefix(h, "Bearer "); ok && t != "" {
+			return t, "", nil
+		}
+	}
+
+	if t := r.URL.Query().Get("access_token"); t != "" {
+		return t, "", nil
+	}
+
+	for _, p := range websocketSubprotocols(r) {
+		if t, ok := strings.CutPrefix(p, SubprotocolPrefix); ok && t != "" {
+			return t, p, nil
+		}
+	}
+
+	return "", "", ErrNoToken
+}
+
+// websocketSubprotocols returns the subprotocols offered by the client
+func websocketSubprotocols(r *http.Request) []string {
+	var protocols []string
+	for _, h := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(h, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				protocols = append(protocols, p)
+			}
+		}
+	}
+	return protocols
+}
@@ -0,0 +1,113 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"websocket-demo/internal/policy"
+)
+
+// Actions accepted by POST /admin/policy
+const (
+	policyActionBlock         = "block"
+	policyActionUnblock       = "unblock"
+	policyActionAddContact    = "add_contact"
+	policyActionRemoveContact = "remove_contact"
+	policyActionSetRules      = "set_rules"
+)
+
+// PolicyRequest is the body of POST /admin/policy
+type PolicyRequest struct {
+	Action       string `json:"action"`                 // "block", "unblock", "add_contact", "remove_contact" or "set_rules"
+	UserID       string `json:"userId"`                 // User whose policy state changes
+	Target       string `json:"target,omitempty"`       // Blocked user or contact
+	Tenant       string `json:"tenant,omitempty"`       // set_rules: the user's tenant
+	ContactsOnly bool   `json:"contactsOnly,omitempty"` // set_rules: accept messages only from contacts
+}
+
+// authorize asks the policy whether from may message to. Denials wrap
+// policy.ErrDenied; a policy that cannot decide fails the send.
+func (s *Server) authorize(ctx context.Context, from, to string) error {
+	if s.policy == nil {
+		return nil
+	}
+
+	decision, err := s.policy.CanMessage(ctx, from, to)
+	if err != nil {
+		return fmt.Errorf("failed to authorize %s -> %s: %w", from, to, err)
+	}
+	if decision.Allowed {
+		return nil
+	}
+
+	messagesDeniedTotal.WithLabelValues(decision.Reason).Inc()
+	log.Printf("[Handler] Policy denied %s -> %s: %s", from, to, decision.Reason)
+	return fmt.Errorf("%s -> %s (%s): %w", from, to, decision.Reason, policy.ErrDenied)
+}
+
+// handlePolicy changes block lists, contacts and rules for administrators.
+// Requests must carry "Authorization: Bearer <admin token or admin JWT>".
+// A cached policy drops the affected decisions on this gateway at once;
+// other gateways apply the change once their cached decisions expire.
+func (s *Server) handlePolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.isAdmin(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	manager, ok := s.policy.(policy.Manager)
+	if !ok {
+		http.Error(w, "policy does not support changes", http.StatusNotImplemented)
+		return
+	}
+
+	var req PolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == "" {
+		http.Error(w, "userId is required", http.StatusBadRequest)
+		return
+	}
+	if req.Target == "" && req.Action != policyActionSetRules {
+		http.Error(w, "target is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	var err error
+	switch req.Action {
+	case policyActionBlock:
+		err = manager.Block(ctx, req.UserID, req.Target)
+	case policyActionUnblock:
+		err = manager.Unblock(ctx, req.UserID, req.Target)
+	case policyActionAddContact:
+		err = manager.AddContact(ctx, req.UserID, req.Target)
+	case policyActionRemoveContact:
+		err = manager.RemoveContact(ctx, req.UserID, req.Target)
+	case policyActionSetRules:
+		err = manager.SetRules(ctx, req.UserID, policy.Rules{Tenant: req.Tenant, ContactsOnly: req.ContactsOnly})
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+
+	if errors.Is(err, policy.ErrReadOnly) {
+		http.Error(w, "policy does not support changes", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		log.Printf("[Server] Failed to apply policy %s for %s: %v", req.Action, req.UserID, err)
+		http.Error(w, "failed to update policy", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[Server] Policy %s applied for %s", req.Action, req.UserID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,117 @@
+package gateway
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"websocket-demo/internal/router"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// systemSender is the From of announcements made through the admin endpoint
+	systemSender = "system"
+
+	// adminRole is the JWT role allowed to use the admin endpoints
+	adminRole = "admin"
+)
+
+// AnnounceRequest is the body of POST /admin/announce
+type AnnounceRequest struct {
+	Content string `json:"content"`
+}
+
+// deliverBroadcast delivers a broadcast message to every local connection
+func (s *Server) deliverBroadcast(msg *router.Message) {
+	frame := ServerMessage{
+		Type:      msgTypeBroadcast,
+		ID:        msg.ID,
+		From:      msg.From,
+		Content:   msg.Content,
+		Timestamp: msg.Timestamp,
+	}
+
+	delivered := 0
+	s.connMgr.ForEach(func(conn *Connection) {
+		s.sendMessage(conn, frame)
+		delivered++
+	})
+	observeDelivery(msg, router.MessageTypeBroadcast)
+
+	log.Printf("[Handler] Broadcast %s from %s delivered to %d local connections", msg.ID, msg.From, delivered)
+}
+
+// Broadcast sends a message from sender to every connection on every gateway
+func (s *Server) Broadcast(ctx context.Context, from, content string) (*router.Message, error) {
+	msg := &router.Message{
+		ID:        uuid.New().String(),
+		From:      from,
+		Content:   content,
+		Type:      router.MessageTypeBroadcast,
+		Gateway:   s.gatewayID,
+		Timestamp: time.Now().UnixMilli(),
+	}
+
+	if err := s.router.BroadcastToAllGateways(ctx, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// handleAnnounce handles system announcements from administrators.
+// Requests must carry "Authorization: Bearer <admin token or admin JWT>".
+func (s *Server) handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.isAdmin(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req AnnounceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Content == "" {
+		http.Error(w, "content is required", http.StatusBadRequest)
+		return
+	}
+
+	msg, err := s.Broadcast(r.Context(), systemSender, req.Content)
+	if err != nil {
+		log.Printf("[Server] Failed to broadcast announcement: %v", err)
+		http.Error(w, "failed to broadcast", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[Server] Announcement %s broadcast to all gateways", msg.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"id": msg.ID})
+}
+
+// isAdmin accepts the configured admin token, or a valid JWT with the "admin" role
+func (s *Server) isAdmin(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return false
+	}
+
+	if s.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1 {
+		return true
+	}
+
+	if s.verifier != nil {
+		claims, err := s.verifier.Verify(token)
+		return err == nil && claims.HasRole(adminRole)
+	}
+
+	return false
+}
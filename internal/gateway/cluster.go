@@ -0,0 +1,267 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"websocket-demo/internal/presence"
+	"websocket-demo/internal/registry"
+)
+
+// presencePruneInterval is how often a gateway prunes expired sessions from
+// its presence index
+const presencePruneInterval = time.Minute
+
+// peerAddresser is implemented by routers that accept connections from other
+// gateways (the gRPC router); their address is published in the registry
+type peerAddresser interface {
+	AdvertiseAddr() string
+}
+
+// runRegistry heartbeats this gateway into the registry every
+// HeartbeatInterval, refreshing the cached set of live gateways and reaping
+// dead ones, until ctx is cancelled
+func (s *Server) runRegistry(ctx context.Context) {
+	ticker := time.NewTicker(registry.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		s.heartbeat(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// heartbeat runs one registry round. A gateway whose entry expired, e.g.
+// after losing Redis for longer than the registry TTL, may have been reaped,
+// so it registers its local connections' presence again.
+func (s *Server) heartbeat(ctx context.Context) {
+	_, err := s.registry.Lookup(ctx, s.gatewayID)
+	lapsed := errors.Is(err, registry.ErrGatewayNotFound)
+
+	if err := s.registry.Register(ctx, s.registryInfo()); err != nil {
+		if ctx.Err() == nil {
+			log.Printf("[Server] Failed to heartbeat gateway %s: %v", s.gatewayID, err)
+		}
+		return
+	}
+
+	if lapsed {
+		s.reclaimAllPresence(ctx)
+	}
+
+	gateways, err := s.registry.List(ctx)
+	if err != nil {
+		log.Printf("[Server] Failed to list gateways: %v", err)
+	} else {
+		live := make(map[string]bool, len(gateways))
+		for _, gw := range gateways {
+			live[gw.GatewayID] = true
+		}
+
+		s.liveMu.Lock()
+		s.liveGateways = live
+		s.liveMu.Unlock()
+	}
+
+	s.reapDeadGateways(ctx)
+
+	if time.Since(s.lastPrune) >= presencePruneInterval {
+		s.lastPrune = time.Now()
+
+		pruned, err := s.presenceMgr.PruneGateway(ctx, s.gatewayID)
+		if err != nil {
+			log.Printf("[Server] Failed to prune presence index: %v", err)
+		}
+		if pruned > 0 {
+			presencePrunedTotal.WithLabelValues().Add(float64(pruned))
+			log.Printf("[Server] Pruned %d users with expired sessions from the presence index", pruned)
+		}
+	}
+}
+
+// reclaimAllPresence registers the presence of every local connection again
+func (s *Server) reclaimAllPresence(ctx context.Context) {
+	s.connMgr.ForEach(func(conn *Connection) {
+		if conn.UserID != "" {
+			s.reclaimPresence(ctx, conn)
+		}
+	})
+}
+
+// reclaimPresence registers a local connection's session again after it was
+// reaped or expired. A session held by another connection on a live gateway
+// is left alone, since the device reconnected there.
+func (s *Server) reclaimPresence(ctx context.Context, conn *Connection) {
+	sessions, err := s.presenceMgr.Sessions(ctx, conn.UserID)
+	if err != nil && !errors.Is(err, presence.ErrUserOffline) {
+		log.Printf("[Server] Failed to look up presence of %s: %v", conn.UserID, err)
+		return
+	}
+
+	for _, session := range sessions {
+		if session.DeviceID != conn.DeviceID {
+			continue
+		}
+		if session.GatewayID == s.gatewayID && session.ConnID == conn.ID {
+			return
+		}
+		if s.isLiveGateway(ctx, session.GatewayID) {
+			log.Printf("[Handler] Presence of %s now belongs to another connection, not refreshing (connID: %s)", conn.UserID, conn.ID)
+			return
+		}
+	}
+
+	if err := s.presenceMgr.Register(ctx, conn.UserID, conn.DeviceID, s.gatewayID, conn.ID); err != nil {
+		log.Printf("[Server] Failed to register presence of %s again: %v", conn.UserID, err)
+		return
+	}
+
+	presenceReclaimedTotal.WithLabelValues().Inc()
+	log.Printf("[Server] Registered lost presence of %s again (connID: %s)", conn.UserID, conn.ID)
+}
+
+// registryInfo describes this gateway for the registry
+func (s *Server) registryInfo() registry.Info {
+	info := registry.Info{
+		GatewayID:   s.gatewayID,
+		Addr:        s.advertiseAddr,
+		StartedAt:   s.startedAt.Unix(),
+		Connections: s.connMgr.Count(),
+	}
+	if p, ok := s.router.(peerAddresser); ok {
+		info.PeerAddr = p.AdvertiseAddr()
+	}
+	return info
+}
+
+// reapDeadGateways removes the presence sessions of gateways that stopped
+// heartbeating. Every gateway reaps, but each dead entry is claimed by one.
+func (s *Server) reapDeadGateways(ctx context.Context) {
+	expired, err := s.registry.Expired(ctx)
+	if err != nil {
+		log.Printf("[Server] Failed to list expired gateways: %v", err)
+		return
+	}
+
+	for _, info := range expired {
+		if info.GatewayID == s.gatewayID {
+			continue
+		}
+
+		claimed, err := s.registry.Reap(ctx, info)
+		if err != nil {
+			log.Printf("[Server] %v", err)
+			continue
+		}
+		if !claimed {
+			// Another gateway reaped it, or it heartbeated again
+			continue
+		}
+
+		// Sessions registered after the entry expired belong to a restart
+		removed, err := s.presenceMgr.RemoveGateway(ctx, info.GatewayID, info.ExpiredAt())
+		if err != nil {
+			log.Printf("[Server] Failed to remove presence of dead gateway %s: %v", info.GatewayID, err)
+		}
+
+		gatewaysReapedTotal.WithLabelValues().Inc()
+		sessionsReapedTotal.WithLabelValues().Add(float64(removed))
+		log.Printf("[Server] Gateway %s missed heartbeats since %s, removed %d orphaned sessions",
+			info.GatewayID, time.Unix(info.Timestamp, 0).Format(time.RFC3339), removed)
+	}
+}
+
+// isLiveGateway reports whether a gateway is registered. Gateways missing
+// from the cached set are looked up, so one that joined since the last
+// heartbeat is not refused. Without a registry every gateway counts as live.
+func (s *Server) isLiveGateway(ctx context.Context, gatewayID string) bool {
+	if s.registry == nil || gatewayID == s.gatewayID {
+		return true
+	}
+
+	s.liveMu.RLock()
+	live := s.liveGateways[gatewayID]
+	s.liveMu.RUnlock()
+	if live {
+		return true
+	}
+
+	_, err := s.registry.Lookup(ctx, gatewayID)
+	if errors.Is(err, registry.ErrGatewayNotFound) {
+		return false
+	}
+	if err != nil {
+		// Routing must not stop because the registry is briefly unreachable
+		log.Printf("[Server] %v", err)
+		return true
+	}
+
+	s.liveMu.Lock()
+	if s.liveGateways == nil {
+		s.liveGateways = make(map[string]bool)
+	}
+	s.liveGateways[gatewayID] = true
+	s.liveMu.Unlock()
+
+	return true
+}
+
+// liveSessions returns a user's sessions on registered gateways. Sessions on
+// a gateway that is not registered are orphans of a crashed gateway that have
+// not been reaped yet; routing to them would lose the message. If none
+// remain the error wraps presence.ErrUserOffline.
+func (s *Server) liveSessions(ctx context.Context, userID string) ([]*presence.Info, error) {
+	sessions, err := s.presenceMgr.Sessions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	live := sessions[:0]
+	for _, session := range sessions {
+		if s.isLiveGateway(ctx, session.GatewayID) {
+			live = append(live, session)
+			continue
+		}
+		routesRefusedTotal.WithLabelValues().Inc()
+		log.Printf("[Server] Not routing to %s on unregistered gateway %s", userID, session.GatewayID)
+	}
+
+	if len(live) == 0 {
+		return nil, fmt.Errorf("user %s only on unregistered gateways: %w", userID, presence.ErrUserOffline)
+	}
+
+	return live, nil
+}
+
+// handleGateways lists the registered gateways
+func (s *Server) handleGateways(w http.ResponseWriter, r *http.Request) {
+	var gateways []*registry.Info
+
+	if s.registry == nil {
+		// Without a registry this gateway is the whole cluster
+		info := s.registryInfo()
+		info.Timestamp = time.Now().Unix()
+		gateways = []*registry.Info{&info}
+	} else {
+		var err error
+		gateways, err = s.registry.List(r.Context())
+		if err != nil {
+			log.Printf("[Server] %v", err)
+			http.Error(w, "failed to list gateways", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gateways)
+}
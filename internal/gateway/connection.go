@@ -1,29 +1,143 @@
 package gateway
 
 import (
+	"context"
+	"errors"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"websocket-demo/internal/router"
+
 	"github.com/gorilla/websocket"
 )
 
-// Connection represents a WebSocket connection
+// OverflowPolicy decides what happens when a connection's send queue is full
+type OverflowPolicy string
+
+const (
+	// OverflowDropOldest discards the oldest queued frame to make room
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	// OverflowDisconnect closes the connection with QueueConfig.CloseCode
+	OverflowDisconnect OverflowPolicy = "disconnect"
+)
+
+var (
+	// ErrQueueFull is returned by Send when a frame was rejected by the overflow policy
+	ErrQueueFull = errors.New("send queue full")
+	// ErrConnectionClosed is returned by Send after the connection is closed
+	ErrConnectionClosed = errors.New("connection closed")
+)
+
+// QueueConfig configures a connection's outbound queue
+type QueueConfig struct {
+	Size         int            // Max queued frames per connection
+	WriteTimeout time.Duration  // Deadline for each socket write
+	Overflow     OverflowPolicy // What to do when the queue is full
+	CloseCode    int            // Close code sent when evicting a slow consumer
+}
+
+// DefaultQueueConfig returns the default send queue settings
+func DefaultQueueConfig() QueueConfig {
+	return QueueConfig{
+		Size:         256,
+		WriteTimeout: 10 * time.Second,
+		Overflow:     OverflowDisconnect,
+		CloseCode:    websocket.CloseTryAgainLater,
+	}
+}
+
+// QueueCounters aggregates send queue drops and evictions across connections
+type QueueCounters struct {
+	Dropped atomic.Uint64 // Frames discarded by OverflowDropOldest or lost on eviction
+	Evicted atomic.Uint64 // Connections closed by OverflowDisconnect
+}
+
+// outFrame is a queued outbound WebSocket message
+type outFrame struct {
+	messageType int
+	data        []byte
+	seq         uint64    // Queue order, to requeue unsent messages in order
+	delivery    *delivery // Routed message carried by the frame (nil for other frames)
+}
+
+// delivery is a routed message queued on one or more of its recipient's
+// connections. The first frame written to a socket counts as delivered and
+// runs onWritten; frames never written are handed back by Unsent.
+type delivery struct {
+	msg       *router.Message // Copy addressed to the recipient, as queued offline
+	written   atomic.Bool
+	onWritten func()
+}
+
+// markWritten records that a frame carrying the message reached a socket
+func (d *delivery) markWritten() {
+	if d.written.CompareAndSwap(false, true) && d.onWritten != nil {
+		d.onWritten()
+	}
+}
+
+// Connection represents a WebSocket connection. All writes go through a
+// bounded queue drained by a single writer goroutine, so slow clients never
+// block the router or the read loop.
 type Connection struct {
 	ID       string
 	UserID   string
+	DeviceID string
 	Conn     *websocket.Conn
 	LastPing time.Time
 	mu       sync.Mutex
+
+	queue     QueueConfig
+	counters  *QueueCounters
+	send      chan outFrame
+	done      chan struct{}
+	closeOnce sync.Once
+	dropped   atomic.Uint64
+
+	sendMu     sync.Mutex    // Orders enqueues against Close
+	closed     bool          // Set under sendMu; no frame is queued after it
+	seq        uint64        // Last frame sequence number, under sendMu
+	space      chan struct{} // Signalled by the writer when it takes a frame
+	writerDone chan struct{} // Closed once the writer has exited and collected unsent frames
+	unsent     []outFrame    // Delivery frames that were never written, under sendMu
+
+	closeReason atomic.Pointer[string] // Why the gateway closed the connection, if it did
+
+	delivered recentIDs // IDs of messages already written, to drop duplicate copies
+
+	limits   *connLimits // Per-connection rate limits, set by the handler
+	protocol int         // Protocol version, set by the handler before the connection is shared
+	encoding string      // Frame encoding: "json" or "proto"
 }
 
-// NewConnection creates a new connection
-func NewConnection(id, userID string, conn *websocket.Conn) *Connection {
-	return &Connection{
+// NewConnection creates a new connection and starts its writer goroutine.
+// UserID and DeviceID are set once the client registers.
+func NewConnection(id string, conn *websocket.Conn, queue QueueConfig, counters *QueueCounters) *Connection {
+	if queue.Size <= 0 {
+		queue.Size = DefaultQueueConfig().Size
+	}
+	if counters == nil {
+		counters = &QueueCounters{}
+	}
+
+	c := &Connection{
 		ID:       id,
-		UserID:   userID,
 		Conn:     conn,
 		LastPing: time.Now(),
+		queue:    queue,
+		counters: counters,
+		send:     make(chan outFrame, queue.Size),
+		done:     make(chan struct{}),
+
+		space:      make(chan struct{}, 1),
+		writerDone: make(chan struct{}),
 	}
+
+	go c.writeLoop()
+
+	return c
 }
 
 // UpdatePing updates the last ping time
@@ -40,51 +154,355 @@ func (c *Connection) GetLastPing() time.Time {
 	return c.LastPing
 }
 
-// Send sends a message to the connection
+// Send queues a message for the writer goroutine without blocking.
+// When the queue is full the overflow policy either drops the oldest
+// frame or evicts the connection.
 func (c *Connection) Send(messageType int, data []byte) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	return c.Conn.WriteMessage(messageType, data)
+	return c.enqueue(outFrame{messageType: messageType, data: data})
+}
+
+// enqueue implements Send. A delivery frame rejected by OverflowDisconnect,
+// or dropped by OverflowDropOldest, is kept for Unsent; ErrConnectionClosed
+// means the frame was not taken at all.
+func (c *Connection) enqueue(frame outFrame) error {
+	c.sendMu.Lock()
+
+	if c.closed {
+		c.sendMu.Unlock()
+		return ErrConnectionClosed
+	}
+
+	c.seq++
+	frame.seq = c.seq
+
+	for {
+		select {
+		case c.send <- frame:
+			c.sendMu.Unlock()
+			return nil
+		default:
+		}
+
+		if c.queue.Overflow != OverflowDropOldest {
+			c.countDropped()
+			c.keepUnsent(frame)
+			c.sendMu.Unlock()
+			c.evict()
+			return ErrQueueFull
+		}
+
+		select {
+		case oldest := <-c.send:
+			c.countDropped()
+			c.keepUnsent(oldest)
+		default:
+		}
+	}
+}
+
+// countDropped records a frame dropped by the overflow policy
+func (c *Connection) countDropped() {
+	c.dropped.Add(1)
+	c.counters.Dropped.Add(1)
+	queueDroppedTotal.WithLabelValues().Inc()
+}
+
+// enqueueWait queues a frame, waiting for room in the queue for up to the
+// write timeout instead of applying the overflow policy. Bulk deliveries such
+// as the offline drain use it to keep pace with the client. It returns
+// ErrQueueFull if the queue stayed full, without closing the connection.
+func (c *Connection) enqueueWait(ctx context.Context, frame outFrame) error {
+	var timeout <-chan time.Time
+	if c.queue.WriteTimeout > 0 {
+		timer := time.NewTimer(c.queue.WriteTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		c.sendMu.Lock()
+		if c.closed {
+			c.sendMu.Unlock()
+			return ErrConnectionClosed
+		}
+		frame.seq = c.seq + 1
+		select {
+		case c.send <- frame:
+			c.seq = frame.seq
+			c.sendMu.Unlock()
+			return nil
+		default:
+		}
+		c.sendMu.Unlock()
+
+		select {
+		case <-c.space:
+		case <-c.done:
+			return ErrConnectionClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			return ErrQueueFull
+		}
+	}
 }
 
-// Close closes the connection
+// keepUnsent records a delivery frame that will not be written; sendMu must be held
+func (c *Connection) keepUnsent(frame outFrame) {
+	if frame.delivery != nil {
+		c.unsent = append(c.unsent, frame)
+	}
+}
+
+// Unsent closes the connection, waits for its writer to exit and returns the
+// routed messages never written to the socket, in queue order. Messages
+// another of the recipient's connections has written are left out.
+func (c *Connection) Unsent() []*router.Message {
+	c.Close()
+	<-c.writerDone
+
+	c.sendMu.Lock()
+	frames := c.unsent
+	c.unsent = nil
+	c.sendMu.Unlock()
+
+	sort.Slice(frames, func(i, j int) bool { return frames[i].seq < frames[j].seq })
+
+	var msgs []*router.Message
+	for _, frame := range frames {
+		if !frame.delivery.written.Load() {
+			msgs = append(msgs, frame.delivery.msg)
+		}
+	}
+	return msgs
+}
+
+// evict closes a connection that cannot keep up with its send queue
+func (c *Connection) evict() {
+	c.counters.Evicted.Add(1)
+	queueEvictionsTotal.WithLabelValues().Inc()
+	c.setCloseReason(disconnectSlowConsumer)
+	c.CloseWithCode(c.queue.CloseCode, "slow consumer")
+}
+
+// markDelivered records that a message is being written to the connection and
+// reports whether it is the first copy. The offline queue and live routing can
+// both carry a message while a client registers; only the first is written.
+func (c *Connection) markDelivered(msgID string) bool {
+	if msgID == "" {
+		return true
+	}
+	return c.delivered.add(msgID)
+}
+
+// unmarkDelivered forgets a message that could not be written after all
+func (c *Connection) unmarkDelivered(msgID string) {
+	c.delivered.remove(msgID)
+}
+
+// QueueDepth returns the number of frames waiting to be written
+func (c *Connection) QueueDepth() int {
+	return len(c.send)
+}
+
+// Dropped returns the number of frames this connection has dropped
+func (c *Connection) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+// writeLoop drains the send queue, applying a deadline to every write.
+// A frame counts as delivered once it is written; when the connection
+// closes, frames still queued are kept for Unsent.
+func (c *Connection) writeLoop() {
+	defer close(c.writerDone)
+
+	for {
+		select {
+		case frame := <-c.send:
+			select {
+			case c.space <- struct{}{}:
+			default:
+			}
+
+			if c.queue.WriteTimeout > 0 {
+				c.Conn.SetWriteDeadline(time.Now().Add(c.queue.WriteTimeout))
+			}
+			if err := c.Conn.WriteMessage(frame.messageType, frame.data); err != nil {
+				c.closeWithReason(disconnectWriteError)
+				c.discardQueued(frame)
+				return
+			}
+			if frame.delivery != nil {
+				frame.delivery.markWritten()
+			}
+
+		case <-c.done:
+			c.discardQueued()
+			return
+		}
+	}
+}
+
+// discardQueued keeps the given and all still queued delivery frames for
+// Unsent. The connection is closed, so nothing is queued after it.
+func (c *Connection) discardQueued(frames ...outFrame) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	for _, frame := range frames {
+		c.keepUnsent(frame)
+	}
+	for {
+		select {
+		case frame := <-c.send:
+			c.keepUnsent(frame)
+		default:
+			return
+		}
+	}
+}
+
+// CloseWithCode sends a close frame with the given code and closes the connection
+func (c *Connection) CloseWithCode(code int, reason string) {
+	deadline := time.Now().Add(time.Second)
+	c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+	c.Close()
+}
+
+// closeWithReason records why the gateway is closing the connection and closes it
+func (c *Connection) closeWithReason(reason string) {
+	c.setCloseReason(reason)
+	c.Close()
+}
+
+// setCloseReason records the close reason, keeping the first one set
+func (c *Connection) setCloseReason(reason string) {
+	c.closeReason.CompareAndSwap(nil, &reason)
+}
+
+// CloseReason returns why the gateway closed the connection, or "" if it did not
+func (c *Connection) CloseReason() string {
+	if reason := c.closeReason.Load(); reason != nil {
+		return *reason
+	}
+	return ""
+}
+
+// Close closes the connection and stops its writer
 func (c *Connection) Close() error {
-	return c.Conn.Close()
+	var err error
+	c.closeOnce.Do(func() {
+		c.sendMu.Lock()
+		c.closed = true
+		c.sendMu.Unlock()
+
+		close(c.done)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// recentIDsSize bounds how many delivered message IDs a connection remembers
+const recentIDsSize = 1024
+
+// recentIDs is a bounded set of the most recently added IDs
+type recentIDs struct {
+	mu    sync.Mutex
+	ids   map[string]int // ID -> its slot in order
+	order []string       // Ring buffer of IDs in insertion order
+	next  int
+}
+
+// add inserts an ID, evicting the oldest beyond recentIDsSize, and reports
+// whether it was absent
+func (r *recentIDs) add(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.ids[id]; ok {
+		return false
+	}
+	if r.ids == nil {
+		r.ids = make(map[string]int, recentIDsSize)
+		r.order = make([]string, recentIDsSize)
+	}
+
+	if old := r.order[r.next]; old != "" {
+		delete(r.ids, old)
+	}
+	r.order[r.next] = id
+	r.ids[id] = r.next
+	r.next = (r.next + 1) % recentIDsSize
+	return true
 }
 
-// ConnectionManager manages all active WebSocket connections
+// remove deletes an ID and clears its ring slot, so the slot cannot evict
+// the ID if it is added again later
+func (r *recentIDs) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if slot, ok := r.ids[id]; ok {
+		r.order[slot] = ""
+		delete(r.ids, id)
+	}
+}
+
+// ConnectionManager manages all active WebSocket connections.
+// A user may hold several connections, one per device.
 type ConnectionManager struct {
 	// Bidirectional mappings
-	userToConn sync.Map // userID -> *Connection
-	connToUser sync.Map // connID -> *Connection
+	userToConns map[string]map[string]*Connection // userID -> connID -> *Connection
+	connToUser  sync.Map                          // connID -> *Connection
 
-	mu sync.RWMutex
+	mu sync.RWMutex // Guards userToConns
 }
 
 // NewConnectionManager creates a new connection manager
 func NewConnectionManager() *ConnectionManager {
-	return &ConnectionManager{}
+	return &ConnectionManager{
+		userToConns: make(map[string]map[string]*Connection),
+	}
 }
 
 // Add adds a new connection
 func (cm *ConnectionManager) Add(conn *Connection) {
-	cm.userToConn.Store(conn.UserID, conn)
+	cm.mu.Lock()
+	conns, ok := cm.userToConns[conn.UserID]
+	if !ok {
+		conns = make(map[string]*Connection)
+		cm.userToConns[conn.UserID] = conns
+	}
+	conns[conn.ID] = conn
+	cm.mu.Unlock()
+
 	cm.connToUser.Store(conn.ID, conn)
 }
 
 // Remove removes a connection
 func (cm *ConnectionManager) Remove(conn *Connection) {
-	cm.userToConn.Delete(conn.UserID)
+	cm.mu.Lock()
+	if conns, ok := cm.userToConns[conn.UserID]; ok {
+		delete(conns, conn.ID)
+		if len(conns) == 0 {
+			delete(cm.userToConns, conn.UserID)
+		}
+	}
+	cm.mu.Unlock()
+
 	cm.connToUser.Delete(conn.ID)
 }
 
-// GetByUserID gets a connection by user ID
-func (cm *ConnectionManager) GetByUserID(userID string) (*Connection, bool) {
-	val, ok := cm.userToConn.Load(userID)
-	if !ok {
-		return nil, false
+// GetByUserID gets all of a user's local connections
+func (cm *ConnectionManager) GetByUserID(userID string) []*Connection {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	conns := make([]*Connection, 0, len(cm.userToConns[userID]))
+	for _, conn := range cm.userToConns[userID] {
+		conns = append(conns, conn)
 	}
-	return val.(*Connection), true
+	return conns
 }
 
 // GetByConnID gets a connection by connection ID
@@ -99,7 +517,7 @@ func (cm *ConnectionManager) GetByConnID(connID string) (*Connection, bool) {
 // Count returns the number of active connections
 func (cm *ConnectionManager) Count() int {
 	count := 0
-	cm.userToConn.Range(func(_, _ interface{}) bool {
+	cm.connToUser.Range(func(_, _ interface{}) bool {
 		count++
 		return true
 	})
@@ -108,7 +526,7 @@ func (cm *ConnectionManager) Count() int {
 
 // ForEach iterates over all connections
 func (cm *ConnectionManager) ForEach(fn func(*Connection)) {
-	cm.userToConn.Range(func(_, value interface{}) bool {
+	cm.connToUser.Range(func(_, value interface{}) bool {
 		fn(value.(*Connection))
 		return true
 	})
@@ -121,7 +539,7 @@ func (cm *ConnectionManager) CheckHealth(timeout time.Duration) int {
 
 	var toRemove []*Connection
 
-	cm.userToConn.Range(func(_, value interface{}) bool {
+	cm.connToUser.Range(func(_, value interface{}) bool {
 		conn := value.(*Connection)
 		if now.Sub(conn.GetLastPing()) > timeout {
 			toRemove = append(toRemove, conn)
@@ -130,7 +548,7 @@ func (cm *ConnectionManager) CheckHealth(timeout time.Duration) int {
 	})
 
 	for _, conn := range toRemove {
-		conn.Close()
+		conn.closeWithReason(disconnectHeartbeat)
 		cm.Remove(conn)
 		removed++
 	}
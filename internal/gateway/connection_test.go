@@ -0,0 +1,29 @@
+package gateway
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRecentIDsReaddAfterRemove(t *testing.T) {
+	var r recentIDs
+	r.add("m1")
+	r.remove("m1")
+	if !r.add("m1") {
+		t.Fatal("removed ID still reported as present")
+	}
+
+	// 旧槽位不能逐出重新添加的 ID / The old ring slot must not evict the re-added ID
+	for i := 0; i < recentIDsSize-1; i++ {
+		r.add(fmt.Sprintf("other-%d", i))
+	}
+	if r.add("m1") {
+		t.Fatal("re-added ID was evicted by its old ring slot")
+	}
+
+	// 超出容量后最旧的 ID 被逐出 / The oldest ID is evicted once the ring is full
+	r.add("last")
+	if !r.add("m1") {
+		t.Fatal("oldest ID was not evicted")
+	}
+}
@@ -0,0 +1,719 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"websocket-demo/internal/offline"
+	"websocket-demo/internal/policy"
+	"websocket-demo/internal/ratelimit"
+	"websocket-demo/internal/router"
+	"websocket-demo/internal/store"
+
+	"github.com/gorilla/websocket"
+)
+
+// readTimeout bounds every read by a test client. gorilla/websocket
+// connections are unusable after a read times out, so it is only used to
+// fail a test, never to wait for silence.
+const readTimeout = 5 * time.Second
+
+// startGateway serves a memory gateway on a local port until the test ends
+func startGateway(t *testing.T, gatewayID string, backend *MemoryBackend, opts ...Option) *Server {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewMemoryServer(gatewayID, 0, backend, opts...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := s.Serve(ctx, lis); err != nil {
+			t.Errorf("Serve(%s) error = %v", gatewayID, err)
+		}
+	}()
+
+	addr := lis.Addr().String()
+	waitHealthy(t, s, addr)
+
+	t.Cleanup(func() {
+		// A pooled keep-alive connection that never sent a request would
+		// hold up Shutdown for 5s
+		http.DefaultClient.CloseIdleConnections()
+
+		cancel()
+		stopCtx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+		defer stop()
+		s.Stop(stopCtx)
+		<-done
+	})
+
+	s.port = lis.Addr().(*net.TCPAddr).Port
+	return s
+}
+
+// waitHealthy polls /health until the gateway answers; TLS gateways are
+// polled without verifying their certificate
+func waitHealthy(t *testing.T, s *Server, addr string) {
+	t.Helper()
+
+	client, url := http.DefaultClient, "http://"+addr+"/health"
+	if s.tls != nil {
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+		url = "https://" + addr + "/health"
+		defer client.CloseIdleConnections()
+	}
+
+	deadline := time.Now().Add(readTimeout)
+	for time.Now().Before(deadline) {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("gateway at %s did not become healthy", addr)
+}
+
+// testClient is a JSON v1 client of a test gateway
+type testClient struct {
+	t  *testing.T
+	ws *websocket.Conn
+}
+
+// dial connects a client to a gateway started by startGateway
+func dial(t *testing.T, s *Server) *testClient {
+	t.Helper()
+
+	ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d/ws", s.port), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+
+	return &testClient{t: t, ws: ws}
+}
+
+// connect dials a gateway and registers userID
+func connect(t *testing.T, s *Server, userID string) *testClient {
+	t.Helper()
+
+	c := dial(t, s)
+	c.send(ClientMessage{Type: msgTypeRegister, UserID: userID})
+	c.expect("registered")
+	return c
+}
+
+func (c *testClient) send(msg ClientMessage) {
+	c.t.Helper()
+
+	if err := c.ws.WriteJSON(msg); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read returns the next frame
+func (c *testClient) read() serverMessageV1 {
+	c.t.Helper()
+
+	c.ws.SetReadDeadline(time.Now().Add(readTimeout))
+	var msg serverMessageV1
+	if err := c.ws.ReadJSON(&msg); err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return msg
+}
+
+// expect skips frames until one of the given type arrives
+func (c *testClient) expect(msgType string) serverMessageV1 {
+	c.t.Helper()
+
+	for {
+		msg := c.read()
+		if msg.Type == msgTypeError && msgType != msgTypeError {
+			c.t.Fatalf("expecting %q, got error %s: %s", msgType, msg.Code, msg.Error)
+		}
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+// sendMessage sends a direct message and returns the gateway's ack
+func (c *testClient) sendMessage(to, content string) serverMessageV1 {
+	c.t.Helper()
+
+	c.send(ClientMessage{Type: msgTypeMessage, To: to, Content: content, ClientID: content})
+	ack := c.expect(msgTypeAck)
+	if ack.ClientID != content {
+		c.t.Fatalf("ack for %q, want %q", ack.ClientID, content)
+	}
+	return ack
+}
+
+// waitConnections waits until userID has n connections on the gateway
+func waitConnections(t *testing.T, s *Server, userID string, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(readTimeout)
+	for len(s.connMgr.GetByUserID(userID)) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s has %d connections, want %d", userID, len(s.connMgr.GetByUserID(userID)), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// queueMessages pushes n direct messages to userID's offline queue
+func queueMessages(t *testing.T, backend *MemoryBackend, userID string, n int, content string) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		msg := &router.Message{
+			ID:        fmt.Sprintf("queued-%d", i),
+			From:      "system",
+			To:        userID,
+			Content:   content,
+			Type:      router.MessageTypeDirect,
+			Timestamp: time.Now().UnixMilli(),
+		}
+		if err := backend.Offline.Push(context.Background(), userID, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOfflineDrainLargerThanSendQueue(t *testing.T) {
+	backend := NewMemoryBackend(offline.DefaultConfig())
+	queue := DefaultQueueConfig()
+	queue.Size = 16
+	gw := startGateway(t, "gw1", backend, WithQueueConfig(queue))
+
+	const queued = 1000
+	queueMessages(t, backend, "bob", queued, "hello")
+
+	bob := connect(t, gw, "bob")
+	for i := 0; i < queued; i++ {
+		msg := bob.expect(msgTypeMessage)
+		if want := fmt.Sprintf("queued-%d", i); msg.ID != want {
+			t.Fatalf("message %d has ID %s, want %s", i, msg.ID, want)
+		}
+	}
+
+	if evicted := gw.queueCounters.Evicted.Load(); evicted != 0 {
+		t.Errorf("%d connections evicted during the drain", evicted)
+	}
+	left, err := backend.Offline.Drain(context.Background(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Errorf("%d messages left in the offline queue", len(left))
+	}
+}
+
+func TestOfflineDrainRequeuesForStalledClient(t *testing.T) {
+	backend := NewMemoryBackend(offline.DefaultConfig())
+	queue := DefaultQueueConfig()
+	queue.Size = 4
+	queue.WriteTimeout = 200 * time.Millisecond
+	gw := startGateway(t, "gw1", backend, WithQueueConfig(queue))
+
+	// Far more than the socket buffers hold, so a client that stops
+	// reading stalls the drain
+	const queued = 400
+	queueMessages(t, backend, "bob", queued, strings.Repeat("x", 64<<10))
+
+	bob := dial(t, gw)
+	bob.send(ClientMessage{Type: msgTypeRegister, UserID: "bob"})
+
+	// The gateway gives up on the drain and drops the connection, either
+	// evicting it from sendDeliveryWait or failing the socket write; both requeue
+	waitConnections(t, gw, "bob", 1)
+	waitConnections(t, gw, "bob", 0)
+
+	left, err := backend.Offline.Drain(context.Background(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(left) == 0 || len(left) == queued {
+		t.Fatalf("%d of %d messages requeued, want the undelivered tail", len(left), queued)
+	}
+	for i, msg := range left {
+		if want := fmt.Sprintf("queued-%d", queued-len(left)+i); msg.ID != want {
+			t.Fatalf("requeued message %d has ID %s, want %s", i, msg.ID, want)
+		}
+	}
+}
+
+func TestStalledRecipientMessagesAreAckedOrRequeued(t *testing.T) {
+	backend := NewMemoryBackend(offline.DefaultConfig())
+	queue := DefaultQueueConfig()
+	queue.Size = 64
+	queue.WriteTimeout = 200 * time.Millisecond
+	gw := startGateway(t, "gw1", backend, WithQueueConfig(queue), WithRateLimits(RateLimitConfig{}))
+
+	// bob never reads, so his socket and then his send queue fill up
+	connect(t, gw, "bob")
+	alice := connect(t, gw, "alice")
+
+	const sent = 400
+	content := strings.Repeat("x", 64<<10)
+	delivered := make(map[string]bool)
+	ids := make(map[string]bool)
+	for i := 0; i < sent; i++ {
+		clientID := fmt.Sprintf("c%d", i)
+		alice.send(ClientMessage{Type: msgTypeMessage, To: "bob", Content: content, ClientID: clientID})
+		for {
+			msg := alice.read()
+			if msg.Type != msgTypeAck {
+				t.Fatalf("alice got %q frame: %s", msg.Type, msg.Error)
+			}
+			if msg.Status == router.AckStatusDelivered {
+				delivered[msg.ID] = true
+				continue
+			}
+			if msg.ClientID != clientID {
+				t.Fatalf("ack for %q, want %q", msg.ClientID, clientID)
+			}
+			ids[msg.ID] = true
+			break
+		}
+	}
+
+	waitConnections(t, gw, "bob", 0)
+
+	left, err := backend.Offline.Drain(context.Background(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) == 0 {
+		t.Fatal("no messages requeued for the stalled recipient")
+	}
+	requeued := make(map[string]bool)
+	for _, msg := range left {
+		requeued[msg.ID] = true
+	}
+
+	// Acks for the frames bob's socket took may still be on their way
+	for len(delivered)+len(requeued) < sent {
+		msg := alice.expect(msgTypeAck)
+		if msg.Status == router.AckStatusDelivered {
+			delivered[msg.ID] = true
+		}
+	}
+
+	for id := range ids {
+		if delivered[id] == requeued[id] {
+			t.Errorf("message %s: delivered ack %v, requeued %v; want exactly one", id, delivered[id], requeued[id])
+		}
+	}
+}
+
+// postPolicy applies a policy change through the admin endpoint
+func postPolicy(t *testing.T, s *Server, token string, req PolicyRequest) int {
+	t.Helper()
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d/admin/policy", s.port), bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAdminPolicyInvalidatesCachedDecisions(t *testing.T) {
+	backend := NewMemoryBackend(offline.DefaultConfig())
+	cached := policy.NewCached(backend.Policy, time.Hour)
+	s := startGateway(t, "gw-1", backend, WithPolicy(cached), WithAdminToken("admin-secret"))
+
+	alice := connect(t, s, "alice")
+	bob := connect(t, s, "bob")
+
+	// 先缓存允许的决定 / Cache an allow decision first
+	alice.sendMessage("bob", "before")
+	bob.expect(msgTypeMessage)
+
+	if code := postPolicy(t, s, "wrong", PolicyRequest{Action: "block", UserID: "bob", Target: "alice"}); code != http.StatusUnauthorized {
+		t.Fatalf("policy change with a bad token = %d, want 401", code)
+	}
+	if code := postPolicy(t, s, "admin-secret", PolicyRequest{Action: "block", UserID: "bob"}); code != http.StatusBadRequest {
+		t.Fatalf("block without a target = %d, want 400", code)
+	}
+	if code := postPolicy(t, s, "admin-secret", PolicyRequest{Action: "block", UserID: "bob", Target: "alice"}); code != http.StatusNoContent {
+		t.Fatalf("block = %d, want 204", code)
+	}
+
+	// 缓存 TTL 为一小时，拒绝说明缓存已失效 / With an hour TTL, a denial means the cache was invalidated
+	alice.send(ClientMessage{Type: msgTypeMessage, To: "bob", Content: "after", ClientID: "after"})
+	if e := alice.expect(msgTypeError); e.Code != errCodePolicyDenied {
+		t.Fatalf("message after block got %s, want %s", e.Code, errCodePolicyDenied)
+	}
+
+	if code := postPolicy(t, s, "admin-secret", PolicyRequest{Action: "unblock", UserID: "bob", Target: "alice"}); code != http.StatusNoContent {
+		t.Fatalf("unblock = %d, want 204", code)
+	}
+	alice.sendMessage("bob", "unblocked")
+	if msg := bob.expect(msgTypeMessage); msg.Content != "unblocked" {
+		t.Fatalf("bob received %q, want %q", msg.Content, "unblocked")
+	}
+}
+
+func TestGroupRespectsPolicy(t *testing.T) {
+	backend := NewMemoryBackend(offline.DefaultConfig())
+	s := startGateway(t, "gw-1", backend)
+
+	alice := connect(t, s, "alice")
+	bob := connect(t, s, "bob")
+	carol := connect(t, s, "carol")
+
+	alice.send(ClientMessage{Type: msgTypeGroupCreate, GroupID: "team"})
+	alice.expect(msgTypeGroupUpdated)
+	for _, member := range []string{"bob", "carol"} {
+		alice.send(ClientMessage{Type: msgTypeGroupAdd, GroupID: "team", Member: member})
+		alice.expect(msgTypeGroupUpdated)
+	}
+
+	ctx := context.Background()
+	backend.Policy.Block(ctx, "carol", "alice")
+	backend.Policy.SetRules(ctx, "dave", policy.Rules{Tenant: "other"})
+
+	// 不能添加其他租户的用户 / A user of another tenant cannot be added
+	alice.send(ClientMessage{Type: msgTypeGroupAdd, GroupID: "team", Member: "dave"})
+	if e := alice.expect(msgTypeError); e.Code != errCodePolicyDenied {
+		t.Fatalf("group_add across tenants got %s, want %s", e.Code, errCodePolicyDenied)
+	}
+
+	// 屏蔽了发送者的成员收不到群消息 / A member who blocked the sender is skipped
+	alice.send(ClientMessage{Type: msgTypeMessage, GroupID: "team", Content: "from alice", ClientID: "a1"})
+	alice.expect(msgTypeAck)
+	if msg := bob.expect(msgTypeMessage); msg.Content != "from alice" {
+		t.Fatalf("bob received %q, want %q", msg.Content, "from alice")
+	}
+
+	bob.send(ClientMessage{Type: msgTypeMessage, GroupID: "team", Content: "from bob", ClientID: "b1"})
+	bob.expect(msgTypeAck)
+	if msg := carol.expect(msgTypeMessage); msg.Content != "from bob" {
+		t.Fatalf("carol's first group message is %q, want %q", msg.Content, "from bob")
+	}
+}
+
+func TestPingReclaimsReapedPresence(t *testing.T) {
+	backend := NewMemoryBackend(offline.DefaultConfig())
+	s := startGateway(t, "gw-1", backend)
+	ctx := context.Background()
+
+	alice := connect(t, s, "alice")
+	conn := s.connMgr.GetByUserID("alice")[0]
+
+	// 模拟心跳中断期间被其他 Gateway 回收 / Sessions reaped while the heartbeat lapsed
+	if removed, err := backend.Presence.RemoveGateway(ctx, "gw-1", time.Now().Add(time.Second)); err != nil || removed != 1 {
+		t.Fatalf("RemoveGateway = %d, %v, want 1 session removed", removed, err)
+	}
+
+	alice.send(ClientMessage{Type: msgTypePing})
+	alice.expect(msgTypePong)
+
+	session, err := backend.Presence.Get(ctx, "alice")
+	if err != nil {
+		t.Fatalf("alice has no presence after ping: %v", err)
+	}
+	if session.GatewayID != "gw-1" || session.ConnID != conn.ID {
+		t.Fatalf("presence after ping = %s/%s, want gw-1/%s", session.GatewayID, session.ConnID, conn.ID)
+	}
+
+	// 设备已在其他在线 Gateway 重连时不抢回 / A device that reconnected on a live gateway is left there
+	if err := backend.Presence.Register(ctx, "alice", conn.DeviceID, "gw-2", "conn-elsewhere"); err != nil {
+		t.Fatal(err)
+	}
+
+	alice.send(ClientMessage{Type: msgTypePing})
+	alice.expect(msgTypePong)
+
+	if session, _ := backend.Presence.Get(ctx, "alice"); session.GatewayID != "gw-2" {
+		t.Fatalf("presence moved back to %s, want gw-2", session.GatewayID)
+	}
+}
+
+// connectDevice dials a gateway and registers userID's device
+func connectDevice(t *testing.T, s *Server, userID, deviceID string) *testClient {
+	t.Helper()
+
+	c := dial(t, s)
+	c.send(ClientMessage{Type: msgTypeRegister, UserID: userID, DeviceID: deviceID})
+	c.expect("registered")
+	return c
+}
+
+// expectAck skips frames until an ack with the given status arrives
+func (c *testClient) expectAck(status string) serverMessageV1 {
+	c.t.Helper()
+
+	for {
+		ack := c.expect(msgTypeAck)
+		if ack.Status == status {
+			return ack
+		}
+	}
+}
+
+func TestCrossGatewayDirectMessage(t *testing.T) {
+	backend := NewMemoryBackend(offline.DefaultConfig())
+	gw1 := startGateway(t, "gw-1", backend)
+	gw2 := startGateway(t, "gw-2", backend)
+
+	alice := connect(t, gw1, "alice")
+	bob := connect(t, gw2, "bob")
+
+	sent := alice.sendMessage("bob", "hello")
+	if sent.Status != router.AckStatusSent {
+		t.Fatalf("first ack status = %q, want %q", sent.Status, router.AckStatusSent)
+	}
+
+	msg := bob.expect(msgTypeMessage)
+	if msg.ID != sent.ID || msg.From != "alice" || msg.Content != "hello" {
+		t.Fatalf("bob received %+v, want message %s from alice", msg.ServerMessage, sent.ID)
+	}
+
+	// bob 的 Gateway 写入 socket 后回送 delivered / bob's gateway acks delivery once written
+	delivered := alice.expectAck(router.AckStatusDelivered)
+	if delivered.ID != sent.ID || delivered.ClientID != "hello" {
+		t.Fatalf("delivered ack %s/%s, want %s/hello", delivered.ID, delivered.ClientID, sent.ID)
+	}
+}
+
+func TestCarbonsAcrossGateways(t *testing.T) {
+	backend := NewMemoryBackend(offline.DefaultConfig())
+	gw1 := startGateway(t, "gw-1", backend)
+	gw2 := startGateway(t, "gw-2", backend)
+
+	phone := connectDevice(t, gw1, "alice", "phone")
+	laptop := connectDevice(t, gw2, "alice", "laptop")
+	bob := connect(t, gw2, "bob")
+
+	sent := phone.sendMessage("bob", "from phone")
+	bob.expect(msgTypeMessage)
+
+	// 发送者的其他设备收到副本 / The sender's other device gets a copy
+	carbon := laptop.expect(msgTypeMessage)
+	if carbon.ID != sent.ID || carbon.From != "alice" || carbon.To != "bob" || carbon.Content != "from phone" {
+		t.Fatalf("laptop received %+v, want carbon of %s to bob", carbon.ServerMessage, sent.ID)
+	}
+
+	// 发送设备自己不会收到副本 / The sending device gets only its acks
+	if msg := phone.read(); msg.Type != msgTypeAck || msg.Status != router.AckStatusDelivered {
+		t.Fatalf("phone received %s %q, want the delivered ack", msg.Type, msg.Status)
+	}
+}
+
+func TestGroupFanOutAcrossGateways(t *testing.T) {
+	backend := NewMemoryBackend(offline.DefaultConfig())
+	gw1 := startGateway(t, "gw-1", backend)
+	gw2 := startGateway(t, "gw-2", backend)
+
+	alice := connect(t, gw1, "alice")
+	bob := connect(t, gw2, "bob")
+	carol := connect(t, gw1, "carol")
+
+	alice.send(ClientMessage{Type: msgTypeGroupCreate, GroupID: "team"})
+	alice.expect(msgTypeGroupUpdated)
+	for _, member := range []string{"bob", "carol", "dave"} {
+		alice.send(ClientMessage{Type: msgTypeGroupAdd, GroupID: "team", Member: member})
+		alice.expect(msgTypeGroupUpdated)
+	}
+
+	alice.send(ClientMessage{Type: msgTypeMessage, GroupID: "team", Content: "standup", ClientID: "g1"})
+	sent := alice.expectAck(router.AckStatusSent)
+
+	for name, c := range map[string]*testClient{"bob": bob, "carol": carol} {
+		msg := c.expect(msgTypeMessage)
+		if msg.ID != sent.ID || msg.GroupID != "team" || msg.Content != "standup" {
+			t.Fatalf("%s received %+v, want group message %s", name, msg.ServerMessage, sent.ID)
+		}
+	}
+
+	// 每个在线成员各一个 delivered / One delivered ack per online member
+	for i := 0; i < 2; i++ {
+		if ack := alice.expectAck(router.AckStatusDelivered); ack.ID != sent.ID {
+			t.Fatalf("delivered ack for %s, want %s", ack.ID, sent.ID)
+		}
+	}
+
+	// 离线成员上线后收到 / The offline member gets it on connecting
+	dave := connect(t, gw2, "dave")
+	if msg := dave.expect(msgTypeMessage); msg.ID != sent.ID || msg.GroupID != "team" {
+		t.Fatalf("dave received %+v, want group message %s", msg.ServerMessage, sent.ID)
+	}
+}
+
+func TestRerouteAfterUserMoves(t *testing.T) {
+	backend := NewMemoryBackend(offline.DefaultConfig())
+	gw1 := startGateway(t, "gw-1", backend)
+	gw2 := startGateway(t, "gw-2", backend)
+	gw3 := startGateway(t, "gw-3", backend)
+
+	alice := connect(t, gw1, "alice")
+	aliceConn := gw1.connMgr.GetByUserID("alice")[0]
+
+	// bob 从 gw-2 迁移到 gw-3 / bob moves from gw-2 to gw-3
+	old := connect(t, gw2, "bob")
+	old.ws.Close()
+	waitConnections(t, gw2, "bob", 0)
+	bob := connect(t, gw3, "bob")
+
+	// gw-1 按 bob 迁移前的 presence 路由到 gw-2 / gw-1 routes to gw-2 using bob's presence from before the move
+	msg := &router.Message{
+		ID:        "moved-1",
+		ClientID:  "c1",
+		From:      "alice",
+		To:        "bob",
+		Content:   "are you there",
+		Type:      router.MessageTypeDirect,
+		Gateway:   "gw-1",
+		ConnID:    aliceConn.ID,
+		Targets:   []string{"gw-2"},
+		Timestamp: time.Now().UnixMilli(),
+	}
+	if err := gw1.router.RouteToGateway(context.Background(), "gw-2", msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := bob.expect(msgTypeMessage); got.ID != msg.ID || got.Content != msg.Content {
+		t.Fatalf("bob received %+v, want rerouted message %s", got.ServerMessage, msg.ID)
+	}
+	if ack := alice.expectAck(router.AckStatusDelivered); ack.ID != msg.ID || ack.ClientID != "c1" {
+		t.Fatalf("delivered ack %s/%s, want %s/c1", ack.ID, ack.ClientID, msg.ID)
+	}
+}
+
+func TestOtherFramesAreRateLimited(t *testing.T) {
+	limits := RateLimitConfig{
+		Others: FrameLimits{PerConnection: ratelimit.Limit{Rate: 0.01, Burst: 3}},
+	}
+	gw := startGateway(t, "gw1", NewMemoryBackend(offline.DefaultConfig()), WithRateLimits(limits))
+
+	// register 也计入 other / register counts against the other bucket too
+	alice := connect(t, gw, "alice")
+	alice.send(ClientMessage{Type: msgTypeGroupCreate, GroupID: "team"})
+	alice.expect(msgTypeGroupUpdated)
+	alice.send(ClientMessage{Type: "bogus", ClientID: "b1"})
+	if msg := alice.expect(msgTypeError); msg.Code != errCodeUnknownType {
+		t.Fatalf("unknown frame got %s, want %s", msg.Code, errCodeUnknownType)
+	}
+
+	for _, msgType := range []string{msgTypeHistory, msgTypeSettings, "bogus"} {
+		alice.send(ClientMessage{Type: msgType, ClientID: msgType})
+		msg := alice.expect(msgTypeError)
+		if msg.Code != errCodeRateLimited || msg.ClientID != msgType || msg.RetryAfter <= 0 {
+			t.Fatalf("%s frame got %s (retry after %d), want %s", msgType, msg.Code, msg.RetryAfter, errCodeRateLimited)
+		}
+	}
+
+	// 其他类别有各自的桶 / Other classes keep their own buckets
+	connect(t, gw, "bob")
+	alice.sendMessage("bob", "still allowed")
+}
+
+func TestReadIsConfirmed(t *testing.T) {
+	gw := startGateway(t, "gw1", NewMemoryBackend(offline.DefaultConfig()), WithMessageStore(store.NewMemoryStore()))
+
+	alice := connect(t, gw, "alice")
+	bob := connect(t, gw, "bob")
+
+	sent := alice.sendMessage("bob", "hello")
+	bob.expect(msgTypeMessage)
+
+	// 第二次没有新读消息也会确认 / The repeat reads nothing new and is still confirmed
+	for _, clientID := range []string{"r1", "r2"} {
+		bob.send(ClientMessage{Type: msgTypeRead, ConversationID: "alice", UpTo: sent.ID, ClientID: clientID})
+		confirm := bob.expect(msgTypeRead)
+		if confirm.ClientID != clientID || confirm.ReadUpTo != sent.ID || confirm.To != "alice" {
+			t.Fatalf("read confirmation %+v, want %s up to %s with alice", confirm.ServerMessage, clientID, sent.ID)
+		}
+	}
+
+	receipt := alice.expect(msgTypeRead)
+	if receipt.ID != sent.ID || receipt.From != "bob" || receipt.ClientID != "" {
+		t.Fatalf("read receipt %+v, want %s read by bob", receipt.ServerMessage, sent.ID)
+	}
+}
+
+// failingRouter fails every RouteToGateway call to one gateway
+type failingRouter struct {
+	router.RouterInterface
+	gatewayID string
+}
+
+func (r *failingRouter) RouteToGateway(ctx context.Context, gatewayID string, msg *router.Message) error {
+	if gatewayID == r.gatewayID {
+		return fmt.Errorf("gateway %s unreachable", gatewayID)
+	}
+	return r.RouterInterface.RouteToGateway(ctx, gatewayID, msg)
+}
+
+func TestGroupBatchFailureQueuesOffline(t *testing.T) {
+	backend := NewMemoryBackend(offline.DefaultConfig())
+	gw1 := startGateway(t, "gw-1", backend, func(s *Server) {
+		s.router = &failingRouter{RouterInterface: s.router, gatewayID: "gw-2"}
+	})
+	gw2 := startGateway(t, "gw-2", backend)
+
+	alice := connect(t, gw1, "alice")
+	connect(t, gw2, "bob")
+
+	alice.send(ClientMessage{Type: msgTypeGroupCreate, GroupID: "team"})
+	alice.expect(msgTypeGroupUpdated)
+	alice.send(ClientMessage{Type: msgTypeGroupAdd, GroupID: "team", Member: "bob"})
+	alice.expect(msgTypeGroupUpdated)
+
+	alice.send(ClientMessage{Type: msgTypeMessage, GroupID: "team", Content: "standup", ClientID: "g1"})
+	sent := alice.expectAck(router.AckStatusSent)
+
+	// 路由失败的批次进入离线队列 / The member of the failed batch gets it from the offline queue
+	phone := connectDevice(t, gw2, "bob", "phone")
+	if msg := phone.expect(msgTypeMessage); msg.ID != sent.ID || msg.GroupID != "team" {
+		t.Fatalf("bob received %+v, want group message %s", msg.ServerMessage, sent.ID)
+	}
+}
+
+func TestGroupsDisabledWithoutStore(t *testing.T) {
+	backend := NewMemoryBackend(offline.DefaultConfig())
+	s := startGateway(t, "gw-1", backend, func(s *Server) { s.groupMgr = nil })
+	alice := connect(t, s, "alice")
+
+	for _, msg := range []ClientMessage{
+		{Type: msgTypeGroupCreate, GroupID: "team"},
+		{Type: msgTypeMessage, GroupID: "team", Content: "hi", ClientID: "g1"},
+	} {
+		alice.send(msg)
+		if e := alice.expect(msgTypeError); e.Code != errCodeNotSupported {
+			t.Fatalf("%s without a group store got %s, want %s", msg.Type, e.Code, errCodeNotSupported)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"websocket-demo/internal/group"
+	"websocket-demo/internal/policy"
+	"websocket-demo/internal/presence"
+	"websocket-demo/internal/router"
+
+	"github.com/google/uuid"
+)
+
+// errGroupsDisabled is returned for group messages on a gateway without a group store
+var errGroupsDisabled = errors.New("groups are not available")
+
+// handleGroupOp applies a group membership operation on behalf of userID
+func (s *Server) handleGroupOp(ctx context.Context, conn *Connection, userID string, msg *ClientMessage) {
+	if s.groupMgr == nil {
+		s.sendError(conn, msg, errCodeNotSupported, "Groups are not available")
+		return
+	}
+
+	if msg.GroupID == "" {
+		s.sendError(conn, msg, errCodeInvalidRequest, "GroupID is required")
+		return
+	}
+
+	var err error
+	switch msg.Type {
+	case msgTypeGroupCreate:
+		err = s.groupMgr.Create(ctx, userID, msg.GroupID, msg.Open != nil && *msg.Open)
+	case msgTypeGroupJoin:
+		err = s.groupMgr.Join(ctx, userID, msg.GroupID)
+	case msgTypeGroupLeave:
+		err = s.groupMgr.Leave(ctx, userID, msg.GroupID)
+	case msgTypeGroupUpdate:
+		if msg.Open == nil {
+			s.sendError(conn, msg, errCodeInvalidRequest, "Open is required")
+			return
+		}
+		err = s.groupMgr.SetOpen(ctx, userID, msg.GroupID, *msg.Open)
+	case msgTypeGroupAdd, msgTypeGroupRemove:
+		if msg.Member == "" {
+			s.sendError(conn, msg, errCodeInvalidRequest, "Member is required")
+			return
+		}
+		if msg.Type == msgTypeGroupAdd {
+			// Adding a member is subject to the same policy as messaging them
+			if err := s.authorize(ctx, userID, msg.Member); err != nil {
+				if errors.Is(err, policy.ErrDenied) {
+					s.sendError(conn, msg, errCodePolicyDenied, "Not allowed to add this user")
+				} else {
+					log.Printf("[Handler] Group %s by %s on %s failed: %v", msg.Type, userID, msg.GroupID, err)
+					s.sendError(conn, msg, errCodeInternal, "Group operation failed")
+				}
+				return
+			}
+			err = s.groupMgr.Add(ctx, userID, msg.GroupID, msg.Member, msg.Role)
+		} else {
+			err = s.groupMgr.Remove(ctx, userID, msg.GroupID, msg.Member)
+		}
+	}
+
+	if err != nil {
+		log.Printf("[Handler] Group %s by %s on %s failed: %v", msg.Type, userID, msg.GroupID, err)
+		code, message := groupError(err)
+		s.sendError(conn, msg, code, message)
+		return
+	}
+
+	log.Printf("[Handler] Group %s by %s on %s", msg.Type, userID, msg.GroupID)
+
+	s.sendMessage(conn, ServerMessage{
+		Type:     msgTypeGroupUpdated,
+		ClientID: msg.ClientID,
+		GroupID:  msg.GroupID,
+		Content:  msg.Type,
+	})
+}
+
+// routeGroupMessage sends a message to every member of a group the policy
+// lets the sender message. Online members are batched by gateway so each
+// gateway receives a single RouteToGateway call; offline members, and the
+// members of a batch that could not be routed, get a copy in the offline
+// store. It fails if no member could be reached either way.
+func (s *Server) routeGroupMessage(ctx context.Context, sender *Connection, groupID, clientID, content string) (*router.Message, error) {
+	if s.groupMgr == nil {
+		return nil, errGroupsDisabled
+	}
+
+	members, err := s.groupMgr.Members(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := members[sender.UserID]; !ok {
+		return nil, group.ErrNotMember
+	}
+
+	recipients := make([]string, 0, len(members))
+	for member := range members {
+		if member == sender.UserID {
+			continue
+		}
+		if err := s.authorize(ctx, sender.UserID, member); err != nil {
+			if !errors.Is(err, policy.ErrDenied) {
+				log.Printf("[Handler] Skipping group member %s of %s: %v", member, groupID, err)
+			}
+			continue
+		}
+		recipients = append(recipients, member)
+	}
+
+	msg := &router.Message{
+		ID:         uuid.New().String(),
+		ClientID:   clientID,
+		From:       sender.UserID,
+		Content:    content,
+		Type:       router.MessageTypeGroup,
+		Status:     router.AckStatusSent,
+		Gateway:    s.gatewayID,
+		ConnID:     sender.ID,
+		GroupID:    groupID,
+		Recipients: recipients,
+		Timestamp:  time.Now().UnixMilli(),
+	}
+
+	if err := s.persistMessage(ctx, msg); err != nil {
+		return nil, err
+	}
+
+	// Batch online members by the gateways holding their sessions
+	byGateway := make(map[string][]string)
+	reached := 0
+	for _, member := range recipients {
+		sessions, err := s.liveSessions(ctx, member)
+		if err != nil {
+			if errors.Is(err, presence.ErrUserOffline) && s.pushGroupCopy(ctx, msg, member) {
+				reached++
+			}
+			continue
+		}
+
+		for _, gatewayID := range presence.GatewayIDs(sessions) {
+			byGateway[gatewayID] = append(byGateway[gatewayID], member)
+		}
+	}
+
+	// A member whose batch fails gets the message on their next register
+	failed := make(map[string]bool)
+	for gatewayID, members := range byGateway {
+		batch := *msg
+		batch.Recipients = members
+		if err := s.router.RouteToGateway(ctx, gatewayID, &batch); err != nil {
+			log.Printf("[Handler] Failed to route group message %s to gateway %s: %v", msg.ID, gatewayID, err)
+			for _, member := range members {
+				failed[member] = true
+			}
+			continue
+		}
+		reached += len(members)
+	}
+	for member := range failed {
+		if s.pushGroupCopy(ctx, msg, member) {
+			reached++
+		}
+	}
+	if reached == 0 && len(recipients) > 0 {
+		return nil, fmt.Errorf("failed to route group message %s to any member", msg.ID)
+	}
+
+	log.Printf("[Handler] Group message %s from %s to %s fanned out to %d gateways",
+		msg.ID, sender.UserID, groupID, len(byGateway))
+
+	s.routeCarbon(ctx, msg)
+	return msg, nil
+}
+
+// pushGroupCopy queues a member's copy of a group message in the offline
+// store, reporting whether it was queued
+func (s *Server) pushGroupCopy(ctx context.Context, msg *router.Message, member string) bool {
+	if s.offlineStore == nil {
+		return false
+	}
+
+	queued := *msg
+	queued.To = member
+	queued.Recipients = nil
+	if err := s.offlineStore.Push(ctx, member, &queued); err != nil {
+		log.Printf("[Handler] Failed to queue group message %s for %s: %v", msg.ID, member, err)
+		return false
+	}
+	return true
+}
+
+// deliverGroupMessage delivers a group message to the local recipients in its batch
+func (s *Server) deliverGroupMessage(msg *router.Message) {
+	frame := messageFrame(msg)
+
+	for _, recipient := range msg.Recipients {
+		conns := s.connMgr.GetByUserID(recipient)
+		if len(conns) == 0 {
+			messagesFailedTotal.WithLabelValues(router.MessageTypeGroup).Inc()
+			log.Printf("[Handler] Group member %s not found locally", recipient)
+			continue
+		}
+
+		d := s.newDelivery(msg, recipient, router.MessageTypeGroup)
+		queued, duplicates := 0, 0
+		for _, conn := range conns {
+			if !conn.markDelivered(msg.ID) {
+				duplicates++
+				continue
+			}
+			if s.sendDelivery(conn, frame, d) {
+				queued++
+			}
+		}
+		if queued == 0 && duplicates == 0 {
+			s.queueGroupMessage(msg, recipient)
+		}
+	}
+}
+
+// queueGroupMessage queues a group message for a member whose connections all
+// closed before it arrived, so it is delivered when they register again
+func (s *Server) queueGroupMessage(msg *router.Message, member string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	queued := *msg
+	queued.To = member
+	queued.Recipients = nil
+	if err := s.queueUndelivered(ctx, &queued); err != nil {
+		messagesFailedTotal.WithLabelValues(router.MessageTypeGroup).Inc()
+		log.Printf("[Handler] Failed to queue group message %s for %s: %v", msg.ID, member, err)
+	}
+}
+
+// groupError maps group errors to client-facing error codes and messages
+func groupError(err error) (code, message string) {
+	switch {
+	case errors.Is(err, group.ErrGroupExists):
+		return errCodeAlreadyExists, "Group already exists"
+	case errors.Is(err, group.ErrGroupNotFound):
+		return errCodeNotFound, "Group not found"
+	case errors.Is(err, group.ErrNotMember):
+		return errCodeNotMember, "Not a group member"
+	case errors.Is(err, group.ErrPermissionDenied):
+		return errCodeForbidden, "Permission denied"
+	case errors.Is(err, group.ErrInvalidRole):
+		return errCodeInvalidRequest, fmt.Sprintf("Invalid role, use %q or %q", group.RoleAdmin, group.RoleMember)
+	default:
+		return errCodeInternal, "Group operation failed"
+	}
+}
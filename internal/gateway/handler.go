@@ -2,12 +2,20 @@ package gateway
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"sort"
+	"strconv"
 	"time"
 
+	"websocket-demo/internal/group"
+	"websocket-demo/internal/metrics"
+	"websocket-demo/internal/policy"
+	"websocket-demo/internal/presence"
 	"websocket-demo/internal/router"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
@@ -17,95 +25,229 @@ const (
 	heartbeatTimeout  = 90 * time.Second
 
 	// Message types
-	msgTypePing     = "ping"
-	msgTypePong     = "pong"
-	msgTypeMessage  = "message"
-	msgTypeRegister = "register"
-	msgTypeError    = "error"
+	msgTypePing      = "ping"
+	msgTypePong      = "pong"
+	msgTypeMessage   = "message"
+	msgTypeRegister  = "register"
+	msgTypeAck       = "ack"
+	msgTypeBroadcast = "broadcast"
+	msgTypeHistory   = "history"
+	msgTypeSync      = "sync"
+	msgTypeRead      = "read"
+	msgTypeSettings  = "settings"
+	msgTypeError     = "error"
+
+	// Group membership
+	msgTypeGroupCreate  = "group_create"
+	msgTypeGroupJoin    = "group_join"
+	msgTypeGroupLeave   = "group_leave"
+	msgTypeGroupAdd     = "group_add"
+	msgTypeGroupRemove  = "group_remove"
+	msgTypeGroupUpdate  = "group_update"
+	msgTypeGroupUpdated = "group_updated"
+
+	// Ephemeral signals, never stored or queued offline
+	msgTypeTypingStart = "typing_start"
+	msgTypeTypingStop  = "typing_stop"
+	msgTypeSignal      = "signal"
 )
 
 // ClientMessage represents a message from the client
 type ClientMessage struct {
-	Type    string `json:"type"`
-	To      string `json:"to,omitempty"`
-	Content string `json:"content,omitempty"`
-	UserID  string `json:"userId,omitempty"` // For registration
+	Type     string `json:"type"`
+	To       string `json:"to,omitempty"`
+	Content  string `json:"content,omitempty"`
+	UserID   string `json:"userId,omitempty"`   // For registration
+	DeviceID string `json:"deviceId,omitempty"` // For registration, defaults to the connection ID
+	Version  int    `json:"version,omitempty"`  // For registration: protocol version, if not negotiated by subprotocol
+	ClientID string `json:"clientId,omitempty"` // Sender-side ID, echoed back in acks, responses and errors
+	Event    string `json:"event,omitempty"`    // Application event name for "signal"
+
+	// Groups: set GroupID instead of To to message a group
+	GroupID string `json:"groupId,omitempty"`
+	Member  string `json:"member,omitempty"` // Target of group_add / group_remove
+	Role    string `json:"role,omitempty"`   // Role for group_add: "admin" or "member"
+	Open    *bool  `json:"open,omitempty"`   // group_create / group_update: anyone may join without being added
+
+	// History and sync queries
+	ConversationID string `json:"conversationId,omitempty"` // Peer user ID for direct chats
+	Before         string `json:"before,omitempty"`         // History cursor: message ID
+	BeforeTs       int64  `json:"beforeTs,omitempty"`       // History cursor: Unix ms
+	Since          int64  `json:"since,omitempty"`          // Sync watermark: Unix ms
+	AfterID        string `json:"afterId,omitempty"`        // Sync tie-breaker: last message ID seen
+	Limit          int    `json:"limit,omitempty"`
+
+	// Read receipts
+	UpTo         string `json:"upTo,omitempty"`         // Read: newest message ID read in the conversation
+	ReadReceipts *bool  `json:"readReceipts,omitempty"` // Settings: send read receipts to senders
 }
 
-// ServerMessage represents a message to the client
+// ServerMessage represents a message to the client. Errors are encoded in
+// the connection's protocol version (see encodeFrame).
 type ServerMessage struct {
-	Type    string `json:"type"`
-	From    string `json:"from,omitempty"`
-	Content string `json:"content,omitempty"`
-	Error   string `json:"error,omitempty"`
+	Type      string      `json:"type"`
+	ID        string      `json:"id,omitempty"`
+	ClientID  string      `json:"clientId,omitempty"`
+	From      string      `json:"from,omitempty"`
+	To        string      `json:"to,omitempty"`
+	GroupID   string      `json:"groupId,omitempty"`
+	Content   string      `json:"content,omitempty"`
+	Status    string      `json:"status,omitempty"` // Ack or delivery status: "sent", "queued", "delivered"
+	Timestamp int64       `json:"timestamp,omitempty"`
+	Err       *FrameError `json:"-"`
+
+	Event   string `json:"event,omitempty"`   // Application event name for "signal"
+	TTL     int64  `json:"ttl,omitempty"`     // Ms a typing_start stays shown without a refresh
+	Version int    `json:"version,omitempty"` // Registered: the connection's protocol version
+
+	// Batched history and sync responses
+	Messages  []ServerMessage `json:"messages,omitempty"`
+	HasMore   bool            `json:"hasMore,omitempty"`
+	Cursor    string          `json:"cursor,omitempty"`    // Pass as "before"/"afterId" for the next page
+	Watermark int64           `json:"watermark,omitempty"` // Pass as "since" for the next sync
+	ReadUpTo  string          `json:"readUpTo,omitempty"`  // History: the user's read marker in the conversation
+
+	ReadReceipts *bool `json:"readReceipts,omitempty"` // Settings response
 }
 
-// handleConnection handles a WebSocket connection
-func (s *Server) handleConnection(conn *websocket.Conn, connID string) {
+// handleConnection handles a WebSocket connection. authUserID is the user
+// authenticated during the upgrade by token or client certificate, or empty
+// when authentication is disabled. protocol is the version negotiated by
+// subprotocol, or 0 to let the register frame choose; encoding is the
+// negotiated frame encoding.
+func (s *Server) handleConnection(ws *websocket.Conn, connID, authUserID string, protocol int, encoding string) {
+	// All writes go through the connection's queue from here on
+	conn := NewConnection(connID, ws, s.queueConfig, &s.queueCounters)
+	conn.limits = newConnLimits(s.rateLimits)
+	conn.protocol = protocol
+	if conn.protocol == 0 {
+		conn.protocol = ProtocolV1
+	}
+	conn.encoding = encoding
 	defer conn.Close()
 
+	connectionsGauge.WithLabelValues().Inc()
+	defer connectionsGauge.WithLabelValues().Dec()
+
 	var userID string
-	var wsConn *Connection
+	var undrained []*router.Message // Offline messages the drain could not queue
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	// Read messages
 	for {
-		_, message, err := conn.ReadMessage()
+		messageType, message, err := ws.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("[Handler] WebSocket error: %v", err)
 			}
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				conn.setCloseReason(disconnectClientClose)
+			} else {
+				conn.setCloseReason(disconnectReadError)
+			}
 			break
 		}
 
-		var msg ClientMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
+		msg, err := decodeFrame(messageType, message)
+		if err != nil {
 			log.Printf("[Handler] Failed to unmarshal message: %v", err)
-			s.sendError(conn, "Invalid message format")
+			s.sendError(conn, nil, errCodeInvalidFrame, "Invalid message format")
+			continue
+		}
+
+		if !s.allowFrame(ctx, conn, userID, &msg) {
 			continue
 		}
 
 		switch msg.Type {
 		case msgTypeRegister:
-			// Register the connection
-			if msg.UserID == "" {
-				s.sendError(conn, "UserID is required for registration")
+			if userID != "" {
+				s.sendError(conn, &msg, errCodeAlreadyRegistered, "Already registered")
 				continue
 			}
 
-			userID = msg.UserID
-			wsConn = NewConnection(connID, userID, conn)
+			// A subprotocol fixes the version; otherwise register may choose it
+			if msg.Version != 0 && msg.Version != conn.protocol {
+				if protocol != 0 || !supportedProtocol(msg.Version) {
+					s.sendError(conn, &msg, errCodeUnsupportedVersion, fmt.Sprintf("Protocol version %d is not supported on this connection", msg.Version))
+					continue
+				}
+				conn.protocol = msg.Version
+			}
 
-			// Add to connection manager
-			s.connMgr.Add(wsConn)
+			// Register the connection; an authenticated identity always wins
+			if authUserID != "" {
+				if msg.UserID != "" && msg.UserID != authUserID {
+					s.sendError(conn, &msg, errCodeIdentityMismatch, "UserID does not match authenticated user")
+					continue
+				}
+				msg.UserID = authUserID
+			}
 
-			// Register presence in Redis
-			if err := s.presenceMgr.Register(ctx, userID, s.gatewayID, connID); err != nil {
-				log.Printf("[Handler] Failed to register presence: %v", err)
-				s.sendError(conn, "Failed to register")
+			if msg.UserID == "" {
+				s.sendError(conn, &msg, errCodeInvalidRequest, "UserID is required for registration")
 				continue
 			}
 
-			log.Printf("[Handler] User %s registered on gateway %s (connID: %s)", userID, s.gatewayID, connID)
+			deviceID := msg.DeviceID
+			if deviceID == "" {
+				deviceID = connID
+			}
+
+			userID = msg.UserID
+			conn.UserID = userID
+			conn.DeviceID = deviceID
+
+			// Add to connection manager
+			s.connMgr.Add(conn)
 
 			// Send confirmation
 			s.sendMessage(conn, ServerMessage{
 				Type:    "registered",
 				Content: "Successfully registered",
+				Version: conn.protocol,
 			})
 
+			// Deliver anything queued while the user was offline before
+			// publishing presence, so live messages cannot overtake it
+			if undrained, err = s.drainOfflineMessages(ctx, conn); err != nil {
+				continue
+			}
+
+			// Register presence in Redis
+			if err := s.presenceMgr.Register(ctx, userID, deviceID, s.gatewayID, connID); err != nil {
+				log.Printf("[Handler] Failed to register presence: %v", err)
+				s.sendError(conn, &msg, errCodeInternal, "Failed to register")
+				continue
+			}
+
+			registrationsTotal.WithLabelValues().Inc()
+			protocolsTotal.WithLabelValues(strconv.Itoa(conn.protocol), conn.encoding).Inc()
+			log.Printf("[Handler] User %s registered on gateway %s (device: %s, connID: %s, protocol: v%d %s)", userID, s.gatewayID, deviceID, connID, conn.protocol, conn.encoding)
+
+			// A sender that looked up presence before Register may have queued
+			// after the first drain; drain again so nothing is stranded.
+			// Copies also delivered live are dropped by message ID.
+			if undrained, err = s.drainOfflineMessages(ctx, conn); err != nil {
+				continue
+			}
+
 			// Start heartbeat checker
-			go s.heartbeatChecker(ctx, wsConn)
+			go s.heartbeatChecker(ctx, conn)
 
 		case msgTypePing:
 			// Update last ping time
-			if wsConn != nil {
-				wsConn.UpdatePing()
-
-				// Refresh presence TTL
-				if err := s.presenceMgr.Refresh(ctx, userID); err != nil {
+			if userID != "" {
+				conn.UpdatePing()
+
+				// Refresh presence TTL, registering again if the session was
+				// reaped or expired while this gateway could not heartbeat
+				err := s.presenceMgr.Refresh(ctx, userID, conn.DeviceID, s.gatewayID, connID)
+				if errors.Is(err, presence.ErrNoSession) || errors.Is(err, presence.ErrNotOwner) {
+					s.reclaimPresence(ctx, conn)
+				} else if err != nil {
 					log.Printf("[Handler] Failed to refresh presence: %v", err)
 				}
 			}
@@ -116,33 +258,134 @@ func (s *Server) handleConnection(conn *websocket.Conn, connID string) {
 		case msgTypeMessage:
 			// Route message to recipient
 			if userID == "" {
-				s.sendError(conn, "Not registered")
+				s.sendError(conn, &msg, errCodeNotRegistered, "Not registered")
 				continue
 			}
 
-			if msg.To == "" {
-				s.sendError(conn, "Recipient is required")
+			if msg.To == "" && msg.GroupID == "" {
+				s.sendError(conn, &msg, errCodeInvalidRequest, "Recipient is required")
 				continue
 			}
 
-			if err := s.routeMessage(ctx, userID, msg.To, msg.Content); err != nil {
+			var routed *router.Message
+			var err error
+			routeType := router.MessageTypeDirect
+			start := time.Now()
+			if msg.GroupID != "" {
+				routeType = router.MessageTypeGroup
+				routed, err = s.routeGroupMessage(ctx, conn, msg.GroupID, msg.ClientID, msg.Content)
+			} else {
+				routed, err = s.routeMessage(ctx, conn, msg.To, msg.ClientID, msg.Content)
+			}
+			metrics.ObserveSince(routeDuration.WithLabelValues(routeType), start)
+
+			if errors.Is(err, policy.ErrDenied) {
+				messagesFailedTotal.WithLabelValues(routeType).Inc()
+				s.sendError(conn, &msg, errCodePolicyDenied, "Not allowed to message this user")
+				continue
+			}
+			if errors.Is(err, errGroupsDisabled) {
+				messagesFailedTotal.WithLabelValues(routeType).Inc()
+				s.sendError(conn, &msg, errCodeNotSupported, "Groups are not available")
+				continue
+			}
+			if errors.Is(err, group.ErrNotMember) || errors.Is(err, group.ErrGroupNotFound) {
+				messagesFailedTotal.WithLabelValues(routeType).Inc()
+				code, message := groupError(err)
+				s.sendError(conn, &msg, code, message)
+				continue
+			}
+			if err != nil {
+				messagesFailedTotal.WithLabelValues(routeType).Inc()
 				log.Printf("[Handler] Failed to route message: %v", err)
-				s.sendError(conn, "Failed to send message")
+				s.sendError(conn, &msg, errCodeInternal, "Failed to send message")
 				continue
 			}
+			messagesRoutedTotal.WithLabelValues(routeType, routed.Status).Inc()
+
+			// Acknowledge that the message has been accepted and routed (or queued)
+			s.sendMessage(conn, ServerMessage{
+				Type:      msgTypeAck,
+				ID:        routed.ID,
+				ClientID:  routed.ClientID,
+				Status:    routed.Status,
+				Timestamp: routed.Timestamp,
+			})
+
+			if msg.GroupID != "" {
+				log.Printf("[Handler] Message %s routed: %s -> group %s", routed.ID, userID, msg.GroupID)
+			} else {
+				log.Printf("[Handler] Message %s routed: %s -> %s", routed.ID, userID, msg.To)
+			}
 
-			log.Printf("[Handler] Message routed: %s -> %s", userID, msg.To)
+		case msgTypeGroupCreate, msgTypeGroupJoin, msgTypeGroupLeave, msgTypeGroupAdd, msgTypeGroupRemove, msgTypeGroupUpdate:
+			if userID == "" {
+				s.sendError(conn, &msg, errCodeNotRegistered, "Not registered")
+				continue
+			}
+
+			s.handleGroupOp(ctx, conn, userID, &msg)
+
+		case msgTypeTypingStart, msgTypeTypingStop, msgTypeSignal:
+			if userID == "" {
+				s.sendError(conn, &msg, errCodeNotRegistered, "Not registered")
+				continue
+			}
+
+			s.handleSignal(ctx, conn, &msg)
+
+		case msgTypeHistory:
+			if userID == "" {
+				s.sendError(conn, &msg, errCodeNotRegistered, "Not registered")
+				continue
+			}
+
+			s.handleHistory(ctx, conn, userID, &msg)
+
+		case msgTypeSync:
+			if userID == "" {
+				s.sendError(conn, &msg, errCodeNotRegistered, "Not registered")
+				continue
+			}
+
+			s.handleSync(ctx, conn, userID, &msg)
+
+		case msgTypeRead:
+			if userID == "" {
+				s.sendError(conn, &msg, errCodeNotRegistered, "Not registered")
+				continue
+			}
+
+			s.handleRead(ctx, conn, userID, &msg)
+
+		case msgTypeSettings:
+			if userID == "" {
+				s.sendError(conn, &msg, errCodeNotRegistered, "Not registered")
+				continue
+			}
+
+			s.handleSettings(ctx, conn, userID, &msg)
 
 		default:
-			s.sendError(conn, "Unknown message type")
+			s.sendError(conn, &msg, errCodeUnknownType, "Unknown message type")
 		}
 	}
 
 	// Cleanup on disconnect
-	if wsConn != nil {
-		s.connMgr.Remove(wsConn)
+	reason := conn.CloseReason()
+	if reason == "" {
+		reason = disconnectReadError
+	}
+	disconnectsTotal.WithLabelValues(reason).Inc()
 
-		if err := s.presenceMgr.Remove(ctx, userID); err != nil {
+	if userID != "" {
+		s.connMgr.Remove(conn)
+		s.requeueOffline(conn, undrained)
+
+		err := s.presenceMgr.Remove(ctx, userID, conn.DeviceID, s.gatewayID, connID)
+		if errors.Is(err, presence.ErrNotOwner) {
+			log.Printf("[Handler] Presence of %s belongs to a newer connection, leaving it (connID: %s)", userID, connID)
+		} else if err != nil {
 			log.Printf("[Handler] Failed to remove presence: %v", err)
 		}
 
@@ -150,61 +393,415 @@ func (s *Server) handleConnection(conn *websocket.Conn, connID string) {
 	}
 }
 
-// routeMessage routes a message to the recipient
-func (s *Server) routeMessage(ctx context.Context, from, to, content string) error {
+// routeMessage assigns a message ID and routes the message to every gateway
+// holding a session of the recipient, queueing it in the offline store if the
+// recipient is not connected. A carbon copy goes to the sender's other devices.
+// The returned message's Status holds the ack status for the sender.
+func (s *Server) routeMessage(ctx context.Context, sender *Connection, to, clientID, content string) (*router.Message, error) {
+	if err := s.authorize(ctx, sender.UserID, to); err != nil {
+		return nil, err
+	}
+
+	msg := &router.Message{
+		ID:        uuid.New().String(),
+		ClientID:  clientID,
+		From:      sender.UserID,
+		To:        to,
+		Content:   content,
+		Type:      router.MessageTypeDirect,
+		Gateway:   s.gatewayID,
+		ConnID:    sender.ID,
+		Timestamp: time.Now().UnixMilli(),
+	}
+
 	// Check if recipient is online
-	presence, err := s.presenceMgr.Get(ctx, to)
+	sessions, err := s.liveSessions(ctx, to)
 	if err != nil {
+		if !errors.Is(err, presence.ErrUserOffline) || s.offlineStore == nil {
+			return nil, err
+		}
+
+		msg.Status = router.AckStatusQueued
+		if err := s.persistMessage(ctx, msg); err != nil {
+			return nil, err
+		}
+		if err := s.offlineStore.Push(ctx, to, msg); err != nil {
+			return nil, err
+		}
+		log.Printf("[Handler] User %s is offline, queued message %s", to, msg.ID)
+		s.routeCarbon(ctx, msg)
+		return msg, nil
+	}
+
+	msg.Status = router.AckStatusSent
+	if err := s.persistMessage(ctx, msg); err != nil {
+		return nil, err
+	}
+
+	// Route once to each gateway holding a session of the recipient; the list
+	// travels with the message so re-routing does not deliver it twice
+	msg.Targets = presence.GatewayIDs(sessions)
+	routed := 0
+	for _, gatewayID := range msg.Targets {
+		if err := s.router.RouteToGateway(ctx, gatewayID, msg); err != nil {
+			log.Printf("[Handler] Failed to route message %s to gateway %s: %v", msg.ID, gatewayID, err)
+			continue
+		}
+		routed++
+	}
+	if routed == 0 {
+		return nil, fmt.Errorf("failed to route message %s to any gateway", msg.ID)
+	}
+
+	s.routeCarbon(ctx, msg)
+	return msg, nil
+}
+
+// routeCarbon copies a sent message to the gateways holding the sender's other devices
+func (s *Server) routeCarbon(ctx context.Context, msg *router.Message) {
+	sessions, err := s.liveSessions(ctx, msg.From)
+	if err != nil {
+		return
+	}
+
+	var others []*presence.Info
+	for _, session := range sessions {
+		if session.ConnID != msg.ConnID {
+			others = append(others, session)
+		}
+	}
+
+	carbon := *msg
+	carbon.Type = router.MessageTypeCarbon
+
+	for _, gatewayID := range presence.GatewayIDs(others) {
+		if err := s.router.RouteToGateway(ctx, gatewayID, &carbon); err != nil {
+			log.Printf("[Handler] Failed to route carbon of %s to gateway %s: %v", msg.ID, gatewayID, err)
+		}
+	}
+}
+
+// persistMessage saves a message to the message store, if one is configured
+func (s *Server) persistMessage(ctx context.Context, msg *router.Message) error {
+	if s.messageStore == nil {
+		return nil
+	}
+	return s.messageStore.SaveMessage(ctx, msg)
+}
+
+// drainOfflineMessages delivers queued messages to a freshly registered
+// connection, waiting for room in its send queue rather than overflowing it.
+// If the connection stops accepting them, it returns the error and the
+// messages it did not take, for requeueOffline once the connection closes.
+func (s *Server) drainOfflineMessages(ctx context.Context, conn *Connection) ([]*router.Message, error) {
+	if s.offlineStore == nil {
+		return nil, nil
+	}
+
+	messages, err := s.offlineStore.Drain(ctx, conn.UserID)
+	if err != nil {
+		log.Printf("[Handler] Failed to drain offline messages for %s: %v", conn.UserID, err)
+		return nil, nil
+	}
+
+	for i, msg := range messages {
+		if err := s.deliverToConnection(ctx, conn, msg); err != nil {
+			log.Printf("[Handler] Stopped draining offline messages for %s after %d of %d: %v", conn.UserID, i, len(messages), err)
+
+			// A client too slow to take its backlog is evicted like any
+			// slow consumer; it gets the rest when it registers again
+			if errors.Is(err, ErrQueueFull) {
+				conn.evict()
+			}
+			return messages[i:], err
+		}
+	}
+
+	if len(messages) > 0 {
+		log.Printf("[Handler] Queued %d offline messages for %s", len(messages), conn.UserID)
+	}
+	return nil, nil
+}
+
+// requeueOffline puts the messages a closed connection never wrote to its
+// socket back in the user's offline queue, together with those its offline
+// drain did not get to, so nothing acked as delivered is requeued and nothing
+// unacked is lost
+func (s *Server) requeueOffline(conn *Connection, undrained []*router.Message) {
+	messages := append(conn.Unsent(), undrained...)
+	if len(messages) == 0 {
+		return
+	}
+	if s.offlineStore == nil {
+		messagesFailedTotal.WithLabelValues("offline").Add(float64(len(messages)))
+		log.Printf("[Handler] Dropped %d unsent messages for %s: no offline store", len(messages), conn.UserID)
+		return
+	}
+
+	// Live frames can be queued behind an interrupted drain
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].Timestamp < messages[j].Timestamp })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := s.offlineStore.Requeue(ctx, conn.UserID, messages); err != nil {
+		log.Printf("[Handler] Failed to requeue %d offline messages for %s: %v", len(messages), conn.UserID, err)
+		return
+	}
+	log.Printf("[Handler] Requeued %d unsent messages for %s", len(messages), conn.UserID)
+}
+
+// deliverMessage delivers a routed message to local connections. Direct
+// messages whose recipient is no longer connected here are re-routed.
+func (s *Server) deliverMessage(msg *router.Message) error {
+	switch msg.Type {
+	case router.MessageTypeAck:
+		// Record delivery even if the sender has since disconnected
+		s.recordAck(msg)
+		s.deliverAck(msg)
+
+	case router.MessageTypeCarbon:
+		s.deliverCarbon(msg)
+
+	case router.MessageTypeGroup:
+		s.deliverGroupMessage(msg)
+
+	case router.MessageTypeBroadcast:
+		s.deliverBroadcast(msg)
+
+	case router.MessageTypeSignal:
+		// Signals are best effort: never re-routed, queued or retried
+		s.deliverSignal(msg)
+
+	case router.MessageTypeRead:
+		s.deliverReadReceipt(msg)
+
+	default:
+		conns := s.connMgr.GetByUserID(msg.To)
+		if len(conns) == 0 {
+			log.Printf("[Handler] User %s not found locally", msg.To)
+			if err := s.rerouteMessage(msg); err != nil {
+				messagesFailedTotal.WithLabelValues(router.MessageTypeDirect).Inc()
+				return err
+			}
+			return nil
+		}
+
+		d := s.newDelivery(msg, msg.To, router.MessageTypeDirect)
+		queued, duplicates := 0, 0
+		for _, conn := range conns {
+			if !conn.markDelivered(msg.ID) {
+				duplicates++
+				continue
+			}
+			if s.sendDelivery(conn, messageFrame(msg), d) {
+				queued++
+			}
+		}
+		if queued == 0 {
+			if duplicates > 0 {
+				log.Printf("[Handler] Message %s already delivered to %s", msg.ID, msg.To)
+				return nil
+			}
+
+			// Every local connection has closed; treat the recipient as
+			// gone from this gateway
+			log.Printf("[Handler] No connection of %s accepted message %s", msg.To, msg.ID)
+			if err := s.rerouteMessage(msg); err != nil {
+				messagesFailedTotal.WithLabelValues(router.MessageTypeDirect).Inc()
+				return err
+			}
+			return nil
+		}
+		log.Printf("[Handler] Message %s queued for %s (%d devices)", msg.ID, msg.To, queued)
+	}
+
+	return nil
+}
+
+// deliverAck sends an ack to the connection that sent the original message,
+// or to all of the sender's local devices if that connection is gone
+func (s *Server) deliverAck(msg *router.Message) {
+	conns := s.connMgr.GetByUserID(msg.To)
+	if conn, ok := s.connMgr.GetByConnID(msg.ConnID); ok && conn.UserID == msg.To {
+		conns = []*Connection{conn}
+	}
+
+	for _, conn := range conns {
+		s.sendMessage(conn, ServerMessage{
+			Type:      msgTypeAck,
+			ID:        msg.ID,
+			ClientID:  msg.ClientID,
+			Status:    msg.Status,
+			Timestamp: msg.Timestamp,
+		})
+	}
+}
+
+// deliverCarbon shows a sent message on the sender's other local devices
+func (s *Server) deliverCarbon(msg *router.Message) {
+	for _, conn := range s.connMgr.GetByUserID(msg.From) {
+		if conn.ID == msg.ConnID {
+			continue
+		}
+		s.sendMessage(conn, messageFrame(msg))
+	}
+}
+
+// deliverToConnection queues an offline message on a connection, waiting for
+// room; it is acked to the sender once written to the socket
+func (s *Server) deliverToConnection(ctx context.Context, conn *Connection, msg *router.Message) error {
+	if !conn.markDelivered(msg.ID) {
+		log.Printf("[Handler] Message %s already delivered to %s", msg.ID, msg.To)
+		return nil
+	}
+
+	d := s.newDelivery(msg, msg.To, "offline")
+	if err := s.sendDeliveryWait(ctx, conn, messageFrame(msg), d); err != nil {
+		conn.unmarkDelivered(msg.ID)
 		return err
 	}
+	return nil
+}
 
-	msg := &router.Message{
-		From:    from,
-		To:      to,
-		Content: content,
-		Type:    "direct",
+// newDelivery tracks a routed message for one recipient. Once a frame carrying
+// it is written to any of the recipient's sockets, the delivery is recorded
+// and a "delivered" ack is routed to the sender.
+func (s *Server) newDelivery(msg *router.Message, recipient, msgType string) *delivery {
+	addressed := *msg
+	addressed.To = recipient
+	addressed.Recipients = nil
+
+	return &delivery{
+		msg: &addressed,
+		onWritten: func() {
+			observeDelivery(&addressed, msgType)
+			log.Printf("[Handler] Message %s delivered to %s", addressed.ID, recipient)
+
+			// Runs on the connection's writer; routing the ack must not stall it
+			go s.sendDeliveredAck(&addressed, recipient)
+		},
+	}
+}
+
+// messageFrame converts a routed message into a client frame
+func messageFrame(msg *router.Message) ServerMessage {
+	return ServerMessage{
+		Type:      msgTypeMessage,
+		ID:        msg.ID,
+		From:      msg.From,
+		To:        msg.To,
+		GroupID:   msg.GroupID,
+		Content:   msg.Content,
+		Timestamp: msg.Timestamp,
+	}
+}
+
+// recordAck updates the delivery state of an acked message in the message store
+func (s *Server) recordAck(ack *router.Message) {
+	if s.messageStore == nil || ack.Status != router.AckStatusDelivered {
+		return
 	}
 
-	// Route to the appropriate gateway
-	return s.router.RouteToGateway(ctx, presence.GatewayID, msg)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The ack's sender is the recipient of the original message
+	at := time.UnixMilli(ack.Timestamp)
+	if err := s.messageStore.MarkDelivered(ctx, ack.ID, ack.From, at); err != nil {
+		log.Printf("[Handler] Failed to mark message %s delivered: %v", ack.ID, err)
+	}
 }
 
-// deliverMessage delivers a message to a local connection
-func (s *Server) deliverMessage(msg *router.Message) {
-	conn, ok := s.connMgr.GetByUserID(msg.To)
-	if !ok {
-		log.Printf("[Handler] User %s not found locally", msg.To)
+// sendDeliveredAck routes a "delivered" ack for recipient back to the sender's gateway
+func (s *Server) sendDeliveredAck(msg *router.Message, recipient string) {
+	if msg.ID == "" || msg.Gateway == "" {
 		return
 	}
 
-	serverMsg := ServerMessage{
-		Type:    msgTypeMessage,
-		From:    msg.From,
-		Content: msg.Content,
+	ack := &router.Message{
+		ID:        msg.ID,
+		ClientID:  msg.ClientID,
+		From:      recipient,
+		To:        msg.From,
+		Type:      router.MessageTypeAck,
+		Status:    router.AckStatusDelivered,
+		Gateway:   s.gatewayID,
+		ConnID:    msg.ConnID,
+		Timestamp: time.Now().UnixMilli(),
 	}
 
-	s.sendMessage(conn.Conn, serverMsg)
-	log.Printf("[Handler] Message delivered to %s", msg.To)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := s.router.RouteToGateway(ctx, msg.Gateway, ack); err != nil {
+		log.Printf("[Handler] Failed to route delivered ack for %s: %v", msg.ID, err)
+	}
 }
 
-// sendMessage sends a message to the client
-func (s *Server) sendMessage(conn *websocket.Conn, msg ServerMessage) {
-	data, err := json.Marshal(msg)
+// sendMessage queues a message on the client's connection, encoded in the
+// connection's protocol version. It returns an error if the frame was not
+// queued; the failure is already logged.
+func (s *Server) sendMessage(conn *Connection, msg ServerMessage) error {
+	messageType, data, err := encodeFrame(conn.protocol, conn.encoding, msg)
 	if err != nil {
 		log.Printf("[Handler] Failed to marshal message: %v", err)
-		return
+		return err
 	}
 
-	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
-		log.Printf("[Handler] Failed to send message: %v", err)
+	if err := conn.Send(messageType, data); err != nil {
+		if err == ErrQueueFull {
+			log.Printf("[Handler] Send queue full for connection %s (user %s)", conn.ID, conn.UserID)
+		} else {
+			log.Printf("[Handler] Failed to send message: %v", err)
+		}
+		return err
 	}
+	return nil
+}
+
+// sendDelivery queues a routed message on one of the recipient's connections
+// and reports whether the connection took it. A frame the overflow policy
+// rejects still counts: the connection keeps it for requeueOffline.
+func (s *Server) sendDelivery(conn *Connection, msg ServerMessage, d *delivery) bool {
+	messageType, data, err := encodeFrame(conn.protocol, conn.encoding, msg)
+	if err != nil {
+		log.Printf("[Handler] Failed to marshal message: %v", err)
+		return false
+	}
+
+	err = conn.enqueue(outFrame{messageType: messageType, data: data, delivery: d})
+	if err == ErrQueueFull {
+		log.Printf("[Handler] Send queue full for connection %s (user %s)", conn.ID, conn.UserID)
+	}
+	return err != ErrConnectionClosed
+}
+
+// sendDeliveryWait is sendDelivery for bulk deliveries: it waits for room in
+// the send queue instead of applying the overflow policy, and returns an
+// error if the frame was not queued
+func (s *Server) sendDeliveryWait(ctx context.Context, conn *Connection, msg ServerMessage, d *delivery) error {
+	messageType, data, err := encodeFrame(conn.protocol, conn.encoding, msg)
+	if err != nil {
+		log.Printf("[Handler] Failed to marshal message: %v", err)
+		return err
+	}
+
+	return conn.enqueueWait(ctx, outFrame{messageType: messageType, data: data, delivery: d})
+}
+
+// sendError answers a client frame with an error; req is nil when the frame
+// could not be parsed
+func (s *Server) sendError(conn *Connection, req *ClientMessage, code, message string) {
+	s.sendFrameError(conn, newFrameError(req, code, message))
 }
 
-// sendError sends an error message to the client
-func (s *Server) sendError(conn *websocket.Conn, errMsg string) {
+// sendFrameError sends an error frame to the client
+func (s *Server) sendFrameError(conn *Connection, e *FrameError) {
+	errorsSentTotal.WithLabelValues(e.Code).Inc()
 	s.sendMessage(conn, ServerMessage{
-		Type:  msgTypeError,
-		Error: errMsg,
+		Type: msgTypeError,
+		Err:  e,
 	})
 }
 
@@ -218,7 +815,7 @@ func (s *Server) heartbeatChecker(ctx context.Context, conn *Connection) {
 		case <-ticker.C:
 			if time.Since(conn.GetLastPing()) > heartbeatTimeout {
 				log.Printf("[Handler] Connection timeout for user %s", conn.UserID)
-				conn.Close()
+				conn.closeWithReason(disconnectHeartbeat)
 				return
 			}
 
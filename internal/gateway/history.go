@@ -0,0 +1,127 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"websocket-demo/internal/router"
+	"websocket-demo/internal/store"
+)
+
+// handleHistory returns one page of a conversation, paging backwards from the cursor
+func (s *Server) handleHistory(ctx context.Context, conn *Connection, userID string, msg *ClientMessage) {
+	if s.messageStore == nil {
+		s.sendError(conn, msg, errCodeNotSupported, "History is not available")
+		return
+	}
+
+	if msg.ConversationID == "" && msg.GroupID == "" {
+		s.sendError(conn, msg, errCodeInvalidRequest, "ConversationID or GroupID is required")
+		return
+	}
+
+	// Group members only see what was sent after they joined
+	var since int64
+	if msg.GroupID != "" && s.groupMgr == nil {
+		s.sendError(conn, msg, errCodeNotSupported, "Groups are not available")
+		return
+	}
+	if msg.GroupID != "" {
+		joinedAt, err := s.groupMgr.JoinedAt(ctx, msg.GroupID, userID)
+		if err != nil {
+			s.sendError(conn, msg, errCodeNotMember, "Not a group member")
+			return
+		}
+		since = joinedAt.UnixMilli()
+	}
+
+	page, err := s.messageStore.History(ctx, store.HistoryQuery{
+		UserID:   userID,
+		PeerID:   msg.ConversationID,
+		GroupID:  msg.GroupID,
+		Before:   msg.Before,
+		BeforeTs: msg.BeforeTs,
+		Since:    since,
+		Limit:    msg.Limit,
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			s.sendError(conn, msg, errCodeNotFound, "Unknown history cursor")
+			return
+		}
+		log.Printf("[Handler] Failed to load history for %s: %v", userID, err)
+		s.sendError(conn, msg, errCodeInternal, "Failed to load history")
+		return
+	}
+
+	resp := ServerMessage{
+		Type:     msgTypeHistory,
+		ClientID: msg.ClientID,
+		Messages: toServerMessages(page.Messages),
+		HasMore:  page.HasMore,
+		ReadUpTo: page.ReadUpTo,
+	}
+
+	// The oldest message in the page is the cursor for the next (older) page
+	if len(page.Messages) > 0 {
+		resp.Cursor = page.Messages[0].ID
+	}
+
+	s.sendMessage(conn, resp)
+}
+
+// handleSync returns messages newer than the client's watermark
+func (s *Server) handleSync(ctx context.Context, conn *Connection, userID string, msg *ClientMessage) {
+	if s.messageStore == nil {
+		s.sendError(conn, msg, errCodeNotSupported, "Sync is not available")
+		return
+	}
+
+	page, err := s.messageStore.Sync(ctx, store.SyncQuery{
+		UserID:  userID,
+		Since:   msg.Since,
+		AfterID: msg.AfterID,
+		Limit:   msg.Limit,
+	})
+	if err != nil {
+		log.Printf("[Handler] Failed to sync messages for %s: %v", userID, err)
+		s.sendError(conn, msg, errCodeInternal, "Failed to sync messages")
+		return
+	}
+
+	resp := ServerMessage{
+		Type:      msgTypeSync,
+		ClientID:  msg.ClientID,
+		Messages:  toServerMessages(page.Messages),
+		HasMore:   page.HasMore,
+		Cursor:    msg.AfterID,
+		Watermark: msg.Since,
+	}
+
+	// The newest message in the page becomes the new watermark
+	if n := len(page.Messages); n > 0 {
+		resp.Cursor = page.Messages[n-1].ID
+		resp.Watermark = page.Messages[n-1].Timestamp
+	}
+
+	s.sendMessage(conn, resp)
+}
+
+// toServerMessages converts stored messages into client frames
+func toServerMessages(messages []*router.Message) []ServerMessage {
+	out := make([]ServerMessage, 0, len(messages))
+	for _, m := range messages {
+		out = append(out, ServerMessage{
+			Type:      msgTypeMessage,
+			ID:        m.ID,
+			From:      m.From,
+			To:        m.To,
+			GroupID:   m.GroupID,
+			Content:   m.Content,
+			Status:    m.Status,
+			Timestamp: m.Timestamp,
+		})
+	}
+	return out
+}
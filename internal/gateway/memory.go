@@ -0,0 +1,50 @@
+package gateway
+
+import (
+	"websocket-demo/internal/group"
+	"websocket-demo/internal/offline"
+	"websocket-demo/internal/policy"
+	"websocket-demo/internal/presence"
+	"websocket-demo/internal/ratelimit"
+	"websocket-demo/internal/router"
+)
+
+// MemoryBackend holds the state gateways in one process share: the routing
+// bus, presence, offline queues, groups, the authorization policy and
+// per-user rate limits. It replaces Redis for single-process deployments and
+// for multi-gateway tests.
+type MemoryBackend struct {
+	Bus      *router.MemoryBus
+	Presence *presence.MemoryManager
+	Offline  *offline.MemoryStore
+	Groups   *group.MemoryStore
+	Policy   *policy.MemoryPolicy
+	Limits   *ratelimit.MemoryLimiter
+}
+
+// NewMemoryBackend creates an empty in-memory backend
+func NewMemoryBackend(offlineConfig offline.Config) *MemoryBackend {
+	return &MemoryBackend{
+		Bus:      router.NewMemoryBus(),
+		Presence: presence.NewMemoryManager(),
+		Offline:  offline.NewMemoryStore(offlineConfig),
+		Groups:   group.NewMemoryStore(),
+		Policy:   policy.NewMemoryPolicy(),
+		Limits:   ratelimit.NewMemoryLimiter(),
+	}
+}
+
+// NewMemoryServer creates a gateway server that needs no external services.
+// Servers created with the same backend route messages to each other.
+func NewMemoryServer(gatewayID string, port int, backend *MemoryBackend, opts ...Option) *Server {
+	defaults := []Option{
+		WithPresence(backend.Presence),
+		WithOfflineStore(backend.Offline),
+		WithGroupStore(backend.Groups),
+		WithPolicy(backend.Policy),
+		WithUserLimiter(backend.Limits),
+	}
+
+	return NewServerWithRouter(gatewayID, port, nil, router.NewMemoryRouter(backend.Bus, gatewayID),
+		append(defaults, opts...)...)
+}
@@ -0,0 +1,86 @@
+package gateway
+
+import (
+	"time"
+
+	"websocket-demo/internal/metrics"
+	"websocket-demo/internal/router"
+)
+
+// Disconnect reasons reported by gateway_disconnects_total
+const (
+	disconnectClientClose  = "client_close"
+	disconnectReadError    = "read_error"
+	disconnectWriteError   = "write_error"
+	disconnectHeartbeat    = "heartbeat_timeout"
+	disconnectSlowConsumer = "slow_consumer"
+	disconnectShutdown     = "shutdown"
+	disconnectRateLimited  = "rate_limited"
+)
+
+var (
+	connectionsGauge = metrics.NewGaugeVec("gateway_connections",
+		"Open WebSocket connections.")
+	registrationsTotal = metrics.NewCounterVec("gateway_registrations_total",
+		"Successful user registrations.")
+	protocolsTotal = metrics.NewCounterVec("gateway_registrations_by_protocol_total",
+		"Successful user registrations by protocol version and frame encoding.", "version", "encoding")
+	disconnectsTotal = metrics.NewCounterVec("gateway_disconnects_total",
+		"Closed WebSocket connections by reason.", "reason")
+
+	messagesRoutedTotal = metrics.NewCounterVec("gateway_messages_routed_total",
+		"Client messages accepted and routed, by type and ack status.", "type", "status")
+	messagesFailedTotal = metrics.NewCounterVec("gateway_messages_failed_total",
+		"Client messages that could not be routed or delivered, by type.", "type")
+	messagesDeliveredTotal = metrics.NewCounterVec("gateway_messages_delivered_total",
+		"Messages written to local connections' send queues, by type.", "type")
+
+	routeDuration = metrics.NewHistogramVec("gateway_route_duration_seconds",
+		"Time to route a client message, including presence lookups and publishing.", nil, "type")
+	deliveryLatency = metrics.NewHistogramVec("gateway_delivery_latency_seconds",
+		"Time from a message being accepted to being delivered on this gateway.", nil, "type")
+
+	messagesReroutedTotal = metrics.NewCounterVec("gateway_messages_rerouted_total",
+		"Direct messages whose recipient was not connected on arrival, by outcome.", "outcome")
+
+	gatewaysReapedTotal = metrics.NewCounterVec("gateway_registry_reaped_total",
+		"Dead gateways removed from the registry by this gateway.")
+	sessionsReapedTotal = metrics.NewCounterVec("gateway_registry_reaped_sessions_total",
+		"Presence sessions of dead gateways removed by this gateway.")
+	presenceReclaimedTotal = metrics.NewCounterVec("gateway_presence_reclaimed_total",
+		"Presence sessions of local connections registered again after they were reaped or expired.")
+	presencePrunedTotal = metrics.NewCounterVec("gateway_presence_pruned_total",
+		"Users dropped from this gateway's presence index after their sessions expired.")
+	routesRefusedTotal = metrics.NewCounterVec("gateway_routes_refused_total",
+		"Sessions skipped when routing because their gateway is not registered.")
+
+	signalsRoutedTotal = metrics.NewCounterVec("gateway_signals_routed_total",
+		"Typing indicators and signals routed to the recipient's gateways, by kind.", "kind")
+	signalsDroppedTotal = metrics.NewCounterVec("gateway_signals_dropped_total",
+		"Typing indicators and signals not routed, by kind and reason.", "kind", "reason")
+
+	messagesDeniedTotal = metrics.NewCounterVec("gateway_messages_denied_total",
+		"Messages and signals refused by the authorization policy, by reason.", "reason")
+
+	rateLimitedTotal = metrics.NewCounterVec("gateway_rate_limited_total",
+		"Client frames rejected by a rate limit, by frame class and scope.", "class", "scope")
+
+	errorsSentTotal = metrics.NewCounterVec("gateway_errors_sent_total",
+		"Error frames sent to clients, by error code.", "code")
+
+	readReceiptsTotal = metrics.NewCounterVec("gateway_read_receipts_total",
+		"Read receipts for newly read messages, by outcome.", "outcome")
+
+	queueDroppedTotal = metrics.NewCounterVec("gateway_send_queue_dropped_total",
+		"Outbound frames dropped by the send queue overflow policy.")
+	queueEvictionsTotal = metrics.NewCounterVec("gateway_send_queue_evictions_total",
+		"Connections closed because their send queue was full.")
+)
+
+// observeDelivery records a message delivered to local connections
+func observeDelivery(msg *router.Message, msgType string) {
+	messagesDeliveredTotal.WithLabelValues(msgType).Inc()
+	if msg.Timestamp > 0 {
+		deliveryLatency.WithLabelValues(msgType).Observe(time.Since(time.UnixMilli(msg.Timestamp)).Seconds())
+	}
+}
@@ -0,0 +1,124 @@
+package gateway
+
+import (
+	"websocket-demo/internal/auth"
+	"websocket-demo/internal/group"
+	"websocket-demo/internal/offline"
+	"websocket-demo/internal/policy"
+	"websocket-demo/internal/presence"
+	"websocket-demo/internal/ratelimit"
+	"websocket-demo/internal/registry"
+	"websocket-demo/internal/store"
+)
+
+// Option configures optional Server components
+type Option func(*Server)
+
+// WithPresence sets the presence manager, replacing the Redis default
+func WithPresence(manager presence.Manager) Option {
+	return func(s *Server) {
+		s.presenceMgr = manager
+	}
+}
+
+// WithOfflineStore sets the store used to queue messages for offline users
+func WithOfflineStore(store offline.Store) Option {
+	return func(s *Server) {
+		s.offlineStore = store
+	}
+}
+
+// WithMessageStore sets the store that persists routed messages and delivery state
+func WithMessageStore(messageStore store.MessageStore) Option {
+	return func(s *Server) {
+		s.messageStore = messageStore
+	}
+}
+
+// WithGroupStore sets the store that holds group membership
+func WithGroupStore(groupStore group.Store) Option {
+	return func(s *Server) {
+		s.groupMgr = group.NewManager(groupStore)
+	}
+}
+
+// WithPolicy sets the authorization policy consulted before routing, replacing
+// the cached Redis default. A nil policy allows every message.
+func WithPolicy(p policy.Policy) Option {
+	return func(s *Server) {
+		s.policy = p
+	}
+}
+
+// WithAdminToken enables the /admin endpoints for requests bearing this token
+func WithAdminToken(token string) Option {
+	return func(s *Server) {
+		s.adminToken = token
+	}
+}
+
+// WithVerifier requires a valid bearer token on every WebSocket upgrade
+func WithVerifier(verifier *auth.Verifier) Option {
+	return func(s *Server) {
+		s.verifier = verifier
+	}
+}
+
+// WithOriginAllowlist restricts which browser origins may open WebSockets
+func WithOriginAllowlist(origins OriginAllowlist) Option {
+	return func(s *Server) {
+		s.origins = origins
+	}
+}
+
+// WithTLS serves HTTPS and WSS with certificates from the reloader
+func WithTLS(reloader *TLSReloader) Option {
+	return func(s *Server) {
+		s.tls = reloader
+	}
+}
+
+// WithCertUserMapper sets how verified client certificates map to user IDs
+// (default: the subject common name)
+func WithCertUserMapper(mapper CertUserMapper) Option {
+	return func(s *Server) {
+		s.certUser = mapper
+	}
+}
+
+// WithQueueConfig sets the per-connection send queue size, write timeout and overflow policy
+func WithQueueConfig(queue QueueConfig) Option {
+	return func(s *Server) {
+		s.queueConfig = queue
+	}
+}
+
+// WithRateLimits sets the per-connection and per-user frame limits
+func WithRateLimits(config RateLimitConfig) Option {
+	return func(s *Server) {
+		s.rateLimits = config
+	}
+}
+
+// WithUserLimiter sets the limiter holding per-user buckets, replacing the
+// Redis default. A nil limiter disables per-user limits.
+func WithUserLimiter(limiter ratelimit.Limiter) Option {
+	return func(s *Server) {
+		s.userLimiter = limiter
+	}
+}
+
+// WithRegistry sets the gateway registry, replacing the Redis default
+func WithRegistry(reg *registry.Registry) Option {
+	return func(s *Server) {
+		s.registry = reg
+	}
+}
+
+// WithAdvertiseAddr sets the HTTP address published in the registry
+// (default: hostname and listening port)
+func WithAdvertiseAddr(addr string) Option {
+	return func(s *Server) {
+		s.advertiseAddr = addr
+	}
+}
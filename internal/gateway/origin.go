@@ -0,0 +1,104 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// originPattern is one allowlist entry. Host may start with "*." to match
+// any subdomain (but not the domain itself); an empty scheme or port matches
+// any scheme or port.
+type originPattern struct {
+	scheme string
+	host   string
+	port   string
+}
+
+// parseOriginPattern parses one allowlist entry
+func parseOriginPattern(s string) (originPattern, error) {
+	var p originPattern
+
+	rest := strings.ToLower(strings.TrimSpace(s))
+	if scheme, after, ok := strings.Cut(rest, "://"); ok {
+		p.scheme = scheme
+		rest = after
+	}
+	rest = strings.TrimSuffix(rest, "/")
+
+	if host, port, ok := strings.Cut(rest, ":"); ok {
+		rest = host
+		p.port = port
+	}
+	p.host = rest
+
+	if p.host == "" || strings.Contains(p.host, "/") || strings.Contains(strings.TrimPrefix(p.host, "*."), "*") {
+		return originPattern{}, fmt.Errorf("invalid origin pattern %q", s)
+	}
+
+	return p, nil
+}
+
+// matches reports whether a parsed Origin header matches the pattern
+func (p originPattern) matches(origin *url.URL) bool {
+	if p.scheme != "" && p.scheme != strings.ToLower(origin.Scheme) {
+		return false
+	}
+	if p.port != "" && p.port != origin.Port() {
+		return false
+	}
+
+	host := strings.ToLower(origin.Hostname())
+	if suffix, ok := strings.CutPrefix(p.host, "*"); ok {
+		// "*.example.com" matches "a.example.com" and "a.b.example.com"
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return host == p.host
+}
+
+// OriginAllowlist is the set of browser origins allowed to open WebSockets.
+// An empty allowlist allows every origin.
+type OriginAllowlist []originPattern
+
+// ParseOriginAllowlist parses entries such as "https://app.example.com",
+// "https://*.example.com" or "http://localhost:3000"; empty entries are skipped
+func ParseOriginAllowlist(entries []string) (OriginAllowlist, error) {
+	var list OriginAllowlist
+	for _, entry := range entries {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		p, err := parseOriginPattern(entry)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, nil
+}
+
+// Allows reports whether a WebSocket upgrade request may proceed. Requests
+// without an Origin header come from non-browser clients and are allowed.
+func (l OriginAllowlist) Allows(r *http.Request) bool {
+	if len(l) == 0 {
+		return true
+	}
+
+	header := r.Header.Get("Origin")
+	if header == "" {
+		return true
+	}
+
+	origin, err := url.Parse(header)
+	if err != nil || origin.Host == "" {
+		return false
+	}
+
+	for _, p := range l {
+		if p.matches(origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"websocket-demo/internal/offline"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestOriginAllowlist(t *testing.T) {
+	allowlist, err := ParseOriginAllowlist([]string{
+		"https://app.example.com",
+		"https://*.Example.org",
+		"http://localhost:3000",
+		"chat.example.net",
+		"",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		origin string
+		allow  bool
+	}{
+		// 精确匹配, 不区分大小写 / Exact matches, case-insensitive
+		{"https://app.example.com", true},
+		{"HTTPS://APP.Example.COM", true},
+		{"https://app.example.com/", true},
+		{"https://example.com", false},
+		{"https://app.example.com.evil.com", false},
+		{"https://app.example.com@evil.com", false},
+
+		// 子域通配 / Wildcard subdomains
+		{"https://a.example.org", true},
+		{"https://a.b.EXAMPLE.org", true},
+		{"https://example.org", false},
+		{"https://evilexample.org", false},
+		{"https://a.example.org.evil.com", false},
+
+		// 协议与端口 / Scheme and port
+		{"http://app.example.com", false},
+		{"wss://app.example.com", false},
+		{"http://localhost:3000", true},
+		{"https://localhost:3000", false},
+		{"http://localhost:3001", false},
+		{"http://localhost", false},
+		{"https://app.example.com:8443", true}, // No port in the entry matches any
+		{"http://chat.example.net", true},      // No scheme or port matches any
+		{"https://chat.example.net:9000", true},
+
+		// 缺失或无效 / Missing or invalid
+		{"", true},
+		{"null", false},
+		{"://", false},
+		{"https://", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "/ws", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := allowlist.Allows(r); got != tt.allow {
+				t.Fatalf("Allows(%q) = %v, want %v", tt.origin, got, tt.allow)
+			}
+		})
+	}
+}
+
+func TestEmptyOriginAllowlistAllowsAll(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "/ws", nil)
+	r.Header.Set("Origin", "https://anything.example")
+	if !OriginAllowlist(nil).Allows(r) {
+		t.Fatal("empty allowlist rejected an origin")
+	}
+}
+
+func TestParseOriginAllowlistRejectsInvalidEntries(t *testing.T) {
+	for _, entry := range []string{"https://", "*", "https://a.*.example.com", "https://example.com/path", "**.example.com"} {
+		if _, err := ParseOriginAllowlist([]string{entry}); err == nil {
+			t.Errorf("ParseOriginAllowlist(%q) succeeded, want an error", entry)
+		}
+	}
+}
+
+func TestUpgradeChecksOrigin(t *testing.T) {
+	allowlist, err := ParseOriginAllowlist([]string{"https://app.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := startGateway(t, "gw1", NewMemoryBackend(offline.DefaultConfig()), WithOriginAllowlist(allowlist))
+	url := fmt.Sprintf("ws://127.0.0.1:%d/ws", gw.port)
+
+	for origin, status := range map[string]int{
+		"https://app.example.com":  http.StatusSwitchingProtocols,
+		"https://evil.example.com": http.StatusForbidden,
+		"":                         http.StatusSwitchingProtocols,
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		ws, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if ws != nil {
+			ws.Close()
+		}
+		if resp == nil {
+			t.Fatalf("origin %q: %v", origin, err)
+		}
+		if resp.StatusCode != status {
+			t.Fatalf("origin %q: status %d, want %d", origin, resp.StatusCode, status)
+		}
+	}
+}
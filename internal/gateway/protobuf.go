@@ -0,0 +1,271 @@
+package gateway
+
+import (
+	"websocket-demo/internal/wire"
+)
+
+// ClientFrame field numbers in proto/chat/v1/chat.proto
+const (
+	clientFieldType           = 1
+	clientFieldTo             = 2
+	clientFieldContent        = 3
+	clientFieldUserID         = 4
+	clientFieldDeviceID       = 5
+	clientFieldVersion        = 6
+	clientFieldClientID       = 7
+	clientFieldEvent          = 8
+	clientFieldGroupID        = 9
+	clientFieldMember         = 10
+	clientFieldRole           = 11
+	clientFieldConversationID = 12
+	clientFieldBefore         = 13
+	clientFieldBeforeTs       = 14
+	clientFieldSince          = 15
+	clientFieldAfterID        = 16
+	clientFieldLimit          = 17
+	clientFieldUpTo           = 18
+	clientFieldReadReceipts   = 19
+	clientFieldOpen           = 20
+)
+
+// ServerFrame field numbers in proto/chat/v1/chat.proto
+const (
+	serverFieldType         = 1
+	serverFieldID           = 2
+	serverFieldClientID     = 3
+	serverFieldFrom         = 4
+	serverFieldTo           = 5
+	serverFieldGroupID      = 6
+	serverFieldContent      = 7
+	serverFieldStatus       = 8
+	serverFieldTimestamp    = 9
+	serverFieldError        = 10
+	serverFieldEvent        = 11
+	serverFieldTTL          = 12
+	serverFieldVersion      = 13
+	serverFieldMessages     = 14
+	serverFieldHasMore      = 15
+	serverFieldCursor       = 16
+	serverFieldWatermark    = 17
+	serverFieldReadUpTo     = 18
+	serverFieldReadReceipts = 19
+)
+
+// Error field numbers in proto/chat/v1/chat.proto
+const (
+	errorFieldCode       = 1
+	errorFieldMessage    = 2
+	errorFieldRetryable  = 3
+	errorFieldRequestID  = 4
+	errorFieldRetryAfter = 5
+)
+
+// MarshalBinary encodes the frame as a protobuf ClientFrame
+func (m *ClientMessage) MarshalBinary() ([]byte, error) {
+	var b wire.Buffer
+	b.String(clientFieldType, m.Type)
+	b.String(clientFieldTo, m.To)
+	b.String(clientFieldContent, m.Content)
+	b.String(clientFieldUserID, m.UserID)
+	b.String(clientFieldDeviceID, m.DeviceID)
+	b.Int64(clientFieldVersion, int64(m.Version))
+	b.String(clientFieldClientID, m.ClientID)
+	b.String(clientFieldEvent, m.Event)
+	b.String(clientFieldGroupID, m.GroupID)
+	b.String(clientFieldMember, m.Member)
+	b.String(clientFieldRole, m.Role)
+	b.String(clientFieldConversationID, m.ConversationID)
+	b.String(clientFieldBefore, m.Before)
+	b.Int64(clientFieldBeforeTs, m.BeforeTs)
+	b.Int64(clientFieldSince, m.Since)
+	b.String(clientFieldAfterID, m.AfterID)
+	b.Int64(clientFieldLimit, int64(m.Limit))
+	b.String(clientFieldUpTo, m.UpTo)
+	b.OptionalBool(clientFieldReadReceipts, m.ReadReceipts)
+	b.OptionalBool(clientFieldOpen, m.Open)
+	return b.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a protobuf ClientFrame
+func (m *ClientMessage) UnmarshalBinary(data []byte) error {
+	*m = ClientMessage{}
+
+	r := wire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case clientFieldType:
+			m.Type = r.String()
+		case clientFieldTo:
+			m.To = r.String()
+		case clientFieldContent:
+			m.Content = r.String()
+		case clientFieldUserID:
+			m.UserID = r.String()
+		case clientFieldDeviceID:
+			m.DeviceID = r.String()
+		case clientFieldVersion:
+			m.Version = int(int32(r.Int64()))
+		case clientFieldClientID:
+			m.ClientID = r.String()
+		case clientFieldEvent:
+			m.Event = r.String()
+		case clientFieldGroupID:
+			m.GroupID = r.String()
+		case clientFieldMember:
+			m.Member = r.String()
+		case clientFieldRole:
+			m.Role = r.String()
+		case clientFieldConversationID:
+			m.ConversationID = r.String()
+		case clientFieldBefore:
+			m.Before = r.String()
+		case clientFieldBeforeTs:
+			m.BeforeTs = r.Int64()
+		case clientFieldSince:
+			m.Since = r.Int64()
+		case clientFieldAfterID:
+			m.AfterID = r.String()
+		case clientFieldLimit:
+			m.Limit = int(int32(r.Int64()))
+		case clientFieldUpTo:
+			m.UpTo = r.String()
+		case clientFieldReadReceipts:
+			v := r.Bool()
+			m.ReadReceipts = &v
+		case clientFieldOpen:
+			v := r.Bool()
+			m.Open = &v
+		default:
+			r.Skip()
+		}
+	}
+	return r.Err()
+}
+
+// MarshalBinary encodes the frame as a protobuf ServerFrame
+func (m *ServerMessage) MarshalBinary() ([]byte, error) {
+	var b wire.Buffer
+	m.appendFields(&b)
+	return b.Bytes(), nil
+}
+
+func (m *ServerMessage) appendFields(b *wire.Buffer) {
+	b.String(serverFieldType, m.Type)
+	b.String(serverFieldID, m.ID)
+	b.String(serverFieldClientID, m.ClientID)
+	b.String(serverFieldFrom, m.From)
+	b.String(serverFieldTo, m.To)
+	b.String(serverFieldGroupID, m.GroupID)
+	b.String(serverFieldContent, m.Content)
+	b.String(serverFieldStatus, m.Status)
+	b.Int64(serverFieldTimestamp, m.Timestamp)
+	if m.Err != nil {
+		b.Message(serverFieldError, m.Err.marshal())
+	}
+	b.String(serverFieldEvent, m.Event)
+	b.Int64(serverFieldTTL, m.TTL)
+	b.Int64(serverFieldVersion, int64(m.Version))
+	for i := range m.Messages {
+		var nested wire.Buffer
+		m.Messages[i].appendFields(&nested)
+		b.Message(serverFieldMessages, nested.Bytes())
+	}
+	b.Bool(serverFieldHasMore, m.HasMore)
+	b.String(serverFieldCursor, m.Cursor)
+	b.Int64(serverFieldWatermark, m.Watermark)
+	b.String(serverFieldReadUpTo, m.ReadUpTo)
+	b.OptionalBool(serverFieldReadReceipts, m.ReadReceipts)
+}
+
+// UnmarshalBinary decodes a protobuf ServerFrame
+func (m *ServerMessage) UnmarshalBinary(data []byte) error {
+	*m = ServerMessage{}
+
+	r := wire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case serverFieldType:
+			m.Type = r.String()
+		case serverFieldID:
+			m.ID = r.String()
+		case serverFieldClientID:
+			m.ClientID = r.String()
+		case serverFieldFrom:
+			m.From = r.String()
+		case serverFieldTo:
+			m.To = r.String()
+		case serverFieldGroupID:
+			m.GroupID = r.String()
+		case serverFieldContent:
+			m.Content = r.String()
+		case serverFieldStatus:
+			m.Status = r.String()
+		case serverFieldTimestamp:
+			m.Timestamp = r.Int64()
+		case serverFieldError:
+			m.Err = &FrameError{}
+			if err := m.Err.unmarshal(r.Bytes()); err != nil {
+				return err
+			}
+		case serverFieldEvent:
+			m.Event = r.String()
+		case serverFieldTTL:
+			m.TTL = r.Int64()
+		case serverFieldVersion:
+			m.Version = int(int32(r.Int64()))
+		case serverFieldMessages:
+			var nested ServerMessage
+			if err := nested.UnmarshalBinary(r.Bytes()); err != nil {
+				return err
+			}
+			m.Messages = append(m.Messages, nested)
+		case serverFieldHasMore:
+			m.HasMore = r.Bool()
+		case serverFieldCursor:
+			m.Cursor = r.String()
+		case serverFieldWatermark:
+			m.Watermark = r.Int64()
+		case serverFieldReadUpTo:
+			m.ReadUpTo = r.String()
+		case serverFieldReadReceipts:
+			v := r.Bool()
+			m.ReadReceipts = &v
+		default:
+			r.Skip()
+		}
+	}
+	return r.Err()
+}
+
+// marshal encodes the error as a protobuf Error
+func (e *FrameError) marshal() []byte {
+	var b wire.Buffer
+	b.String(errorFieldCode, e.Code)
+	b.String(errorFieldMessage, e.Message)
+	b.Bool(errorFieldRetryable, e.Retryable)
+	b.String(errorFieldRequestID, e.RequestID)
+	b.Int64(errorFieldRetryAfter, e.RetryAfter)
+	return b.Bytes()
+}
+
+// unmarshal decodes a protobuf Error
+func (e *FrameError) unmarshal(data []byte) error {
+	r := wire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case errorFieldCode:
+			e.Code = r.String()
+		case errorFieldMessage:
+			e.Message = r.String()
+		case errorFieldRetryable:
+			e.Retryable = r.Bool()
+		case errorFieldRequestID:
+			e.RequestID = r.String()
+		case errorFieldRetryAfter:
+			e.RetryAfter = r.Int64()
+		default:
+			r.Skip()
+		}
+	}
+	return r.Err()
+}
@@ -0,0 +1,295 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func boolPtr(v bool) *bool {
+	return &v
+}
+
+// goldenClientFrame is the frame in testdata/client_frame.txtpb
+var goldenClientFrame = ClientMessage{
+	Type:           msgTypeHistory,
+	To:             "bob",
+	Content:        "你好",
+	UserID:         "alice",
+	DeviceID:       "phone",
+	Version:        2,
+	ClientID:       "c-1",
+	Event:          "typing_start",
+	GroupID:        "team",
+	Member:         "carol",
+	Role:           "admin",
+	ConversationID: "bob",
+	Before:         "msg-9",
+	BeforeTs:       1700000000123,
+	Since:          1690000000000,
+	AfterID:        "msg-3",
+	Limit:          50,
+	UpTo:           "msg-8",
+	ReadReceipts:   boolPtr(false),
+	Open:           boolPtr(true),
+}
+
+// goldenServerFrame is the frame in testdata/server_frame.txtpb
+var goldenServerFrame = ServerMessage{
+	Type:      msgTypeHistory,
+	ID:        "msg-1",
+	ClientID:  "c-1",
+	From:      "alice",
+	To:        "bob",
+	GroupID:   "team",
+	Content:   "你好",
+	Status:    "delivered",
+	Timestamp: 1700000000123,
+	Err: &FrameError{
+		Code:       "rate_limited",
+		Message:    "Too many messages",
+		Retryable:  true,
+		RequestID:  "c-1",
+		RetryAfter: 250,
+	},
+	Event:   "typing_start",
+	TTL:     5000,
+	Version: 2,
+	Messages: []ServerMessage{
+		{Type: msgTypeMessage, ID: "msg-2", From: "bob", Content: "first", Timestamp: 1700000000200},
+		{Type: msgTypeMessage, ID: "msg-3", From: "alice", Content: "second", Timestamp: 1700000000300},
+	},
+	HasMore:      true,
+	Cursor:       "msg-2",
+	Watermark:    1700000000300,
+	ReadUpTo:     "msg-3",
+	ReadReceipts: boolPtr(false),
+}
+
+func TestClientFrameGolden(t *testing.T) {
+	golden := readGolden(t, "client_frame.binpb")
+
+	data, err := goldenClientFrame.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, golden) {
+		t.Fatalf("encoded\n% x\nwant (protoc)\n% x", data, golden)
+	}
+
+	var msg ClientMessage
+	if err := msg.UnmarshalBinary(golden); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(msg, goldenClientFrame) {
+		t.Fatalf("decoded %+v, want %+v", msg, goldenClientFrame)
+	}
+}
+
+func TestServerFrameGolden(t *testing.T) {
+	golden := readGolden(t, "server_frame.binpb")
+
+	data, err := goldenServerFrame.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, golden) {
+		t.Fatalf("encoded\n% x\nwant (protoc)\n% x", data, golden)
+	}
+
+	var msg ServerMessage
+	if err := msg.UnmarshalBinary(golden); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(msg, goldenServerFrame) {
+		t.Fatalf("decoded %+v, want %+v", msg, goldenServerFrame)
+	}
+}
+
+func TestFrameJSONNames(t *testing.T) {
+	client, err := json.Marshal(goldenClientFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := encodeJSONFrame(ProtocolV2, goldenServerFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// JSON 帧与 protojson 字段名一致 / JSON frames use the protojson field names
+	tests := []struct {
+		name   string
+		data   []byte
+		golden string
+	}{
+		{"client", client, "client_frame.json"},
+		{"server v2", server, "server_frame.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, want := jsonPaths(t, tt.data), jsonPaths(t, readGolden(t, tt.golden))
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("JSON fields %v, want (protojson) %v", got, want)
+			}
+		})
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	clients := []ClientMessage{
+		{},
+		{Type: msgTypeRegister, UserID: "alice", DeviceID: "phone", Version: 2},
+		{Type: msgTypeSettings, ReadReceipts: boolPtr(true)},
+		{Type: msgTypeGroupCreate, GroupID: "team", Open: boolPtr(false)},
+		{Type: msgTypeHistory, Version: -1, Limit: -20, BeforeTs: -1},
+		goldenClientFrame,
+	}
+	for _, want := range clients {
+		data, err := want.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg ClientMessage
+		if err := msg.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(msg, want) {
+			t.Fatalf("client frame round trip %+v, want %+v", msg, want)
+		}
+	}
+
+	servers := []ServerMessage{
+		{},
+		{Type: msgTypeError, Err: &FrameError{Code: errCodeNotRegistered}},
+		{Type: msgTypeHistory, Messages: []ServerMessage{{}, {ID: "m", Err: &FrameError{}}}},
+		{Type: "registered", Version: -1, Timestamp: -1},
+		goldenServerFrame,
+	}
+	for _, want := range servers {
+		data, err := want.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg ServerMessage
+		if err := msg.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(msg, want) {
+			t.Fatalf("server frame round trip %+v, want %+v", msg, want)
+		}
+	}
+}
+
+func TestFrameSkipsUnknownFields(t *testing.T) {
+	// 新版本可能添加的字段 / Fields a newer schema might add: 30 (string), 31 (varint), 32 (message)
+	unknown := []byte{0xf2, 0x01, 1, 'x', 0xf8, 0x01, 0x07, 0x82, 0x02, 2, 0x08, 0x01}
+
+	client, err := (&ClientMessage{Type: msgTypePing, ClientID: "c"}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg ClientMessage
+	if err := msg.UnmarshalBinary(append(unknown, client...)); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != msgTypePing || msg.ClientID != "c" {
+		t.Fatalf("decoded %+v, want ping c", msg)
+	}
+
+	// 嵌套的 Error 里也跳过 / Also inside the nested Error
+	var nested bytes.Buffer
+	nested.Write([]byte{0x0a, 1, 'x'})
+	nested.Write(unknown)
+	server := append([]byte{0x52, byte(nested.Len())}, nested.Bytes()...)
+	var frame ServerMessage
+	if err := frame.UnmarshalBinary(server); err != nil {
+		t.Fatal(err)
+	}
+	if frame.Err == nil || frame.Err.Code != "x" {
+		t.Fatalf("decoded error %+v, want code x", frame.Err)
+	}
+}
+
+func TestFrameMalformedInput(t *testing.T) {
+	client := readGolden(t, "client_frame.binpb")
+	server := readGolden(t, "server_frame.binpb")
+
+	tests := []struct {
+		name   string
+		data   []byte
+		server bool
+	}{
+		{"client truncated", client[:len(client)-1], false},
+		{"client truncated tag", []byte{0x98}, false},
+		{"client wrong wire type", []byte{0x0d, 1, 2, 3, 4}, false}, // type as fixed32
+		{"client varint overflow", []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, false},
+		{"server truncated", server[:len(server)-1], true},
+		{"server error truncated", []byte{0x52, 3, 0x0a, 5, 'x'}, true},
+		{"server nested message truncated", []byte{0x72, 2, 0x0a, 4}, true},
+		{"server field 0", []byte{0x00, 0x01}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if tt.server {
+				var msg ServerMessage
+				err = msg.UnmarshalBinary(tt.data)
+			} else {
+				var msg ClientMessage
+				err = msg.UnmarshalBinary(tt.data)
+			}
+			if err == nil {
+				t.Fatal("decoded malformed input without an error")
+			}
+		})
+	}
+}
+
+func readGolden(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// jsonPaths returns the sorted field paths of a JSON object, descending into
+// nested objects and arrays of objects
+func jsonPaths(t *testing.T, data []byte) []string {
+	t.Helper()
+
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	var walk func(prefix string, v any)
+	walk = func(prefix string, v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			for k, child := range v {
+				seen[prefix+k] = true
+				walk(prefix+k+".", child)
+			}
+		case []any:
+			for _, child := range v {
+				walk(prefix, child)
+			}
+		}
+	}
+	walk("", v)
+
+	paths := make([]string, 0, len(seen))
+	for p := range seen {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
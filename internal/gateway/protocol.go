@@ -0,0 +1,186 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Protocol versions. A connection speaks v1 unless the client negotiates a
+// newer version with a WebSocket subprotocol or the register frame.
+const (
+	ProtocolV1 = 1 // Errors are a string in "error", with an optional "code"
+	ProtocolV2 = 2 // Errors are an object with code, message, retryable and requestId
+
+	LatestProtocol = ProtocolV2
+)
+
+// Frame encodings, selected by the subprotocol suffix
+const (
+	encodingJSON  = "json"  // Text frames; the default, readable in browser devtools
+	encodingProto = "proto" // Binary frames: ClientFrame / ServerFrame in proto/chat/v1/chat.proto
+)
+
+// subprotocolPrefix names the chat subprotocols "chat.v<N>" and
+// "chat.v<N>.<encoding>", e.g. "chat.v2" or "chat.v2.proto"
+const subprotocolPrefix = "chat.v"
+
+// Error codes. Clients should switch on these rather than on messages.
+const (
+	errCodeInvalidFrame       = "invalid_frame"       // The frame is not valid JSON or protobuf
+	errCodeUnknownType        = "unknown_type"        // Unknown frame type
+	errCodeInvalidRequest     = "invalid_request"     // A required field is missing or invalid
+	errCodeUnsupportedVersion = "unsupported_version" // The requested protocol version is not supported
+	errCodeNotRegistered      = "not_registered"      // The frame requires a register first
+	errCodeAlreadyRegistered  = "already_registered"  // The connection is already registered
+	errCodeIdentityMismatch   = "identity_mismatch"   // register names a different user than the token or certificate
+	errCodeTooLarge           = "too_large"           // The frame's content exceeds its limit
+	errCodeNotSupported       = "not_supported"       // The feature is disabled on this gateway
+	errCodeNotFound           = "not_found"           // The group, message or cursor does not exist
+	errCodeAlreadyExists      = "already_exists"      // The group already exists
+	errCodeNotMember          = "not_member"          // The user is not a member of the group
+	errCodeForbidden          = "forbidden"           // The user's group role does not allow the operation
+	errCodePolicyDenied       = "policy_denied"       // The authorization policy refused the message
+	errCodeRateLimited        = "rate_limited"        // Too many frames; retry after RetryAfter ms
+	errCodeInternal           = "internal"            // The gateway or a backend failed; the request may be retried
+)
+
+// retryableCodes are the error codes worth retrying unchanged
+var retryableCodes = map[string]bool{
+	errCodeRateLimited: true,
+	errCodeInternal:    true,
+}
+
+// FrameError describes why a client frame failed
+type FrameError struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	Retryable  bool   `json:"retryable"`
+	RequestID  string `json:"requestId,omitempty"`  // clientId of the frame that failed
+	RetryAfter int64  `json:"retryAfter,omitempty"` // Ms to wait before retrying a rate limited frame
+}
+
+// newFrameError creates an error answering req, which may be nil when the
+// frame could not be parsed
+func newFrameError(req *ClientMessage, code, message string) *FrameError {
+	e := &FrameError{
+		Code:      code,
+		Message:   message,
+		Retryable: retryableCodes[code],
+	}
+	if req != nil {
+		e.RequestID = req.ClientID
+	}
+	return e
+}
+
+// supportedProtocol reports whether the gateway speaks a protocol version
+func supportedProtocol(version int) bool {
+	return version >= ProtocolV1 && version <= LatestProtocol
+}
+
+// parseSubprotocol parses "chat.v<N>" or "chat.v<N>.<encoding>"
+func parseSubprotocol(name string) (version int, encoding string, ok bool) {
+	rest, ok := strings.CutPrefix(name, subprotocolPrefix)
+	if !ok {
+		return 0, "", false
+	}
+
+	rest, encoding, _ = strings.Cut(rest, ".")
+	switch encoding {
+	case "":
+		encoding = encodingJSON
+	case encodingJSON, encodingProto:
+	default:
+		return 0, "", false
+	}
+
+	version, err := strconv.Atoi(rest)
+	if err != nil || !supportedProtocol(version) {
+		return 0, "", false
+	}
+	return version, encoding, true
+}
+
+// negotiateProtocol picks the newest chat subprotocol offered by the client,
+// the first offered among equals. It returns 0, JSON and an empty name if the
+// client offered none.
+func negotiateProtocol(r *http.Request) (version int, encoding, subprotocol string) {
+	encoding = encodingJSON
+	for _, h := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, name := range strings.Split(h, ",") {
+			name = strings.TrimSpace(name)
+			if v, e, ok := parseSubprotocol(name); ok && v > version {
+				version, encoding, subprotocol = v, e, name
+			}
+		}
+	}
+	return version, encoding, subprotocol
+}
+
+// decodeFrame decodes a client frame: text frames are JSON and binary frames
+// protobuf, whatever the connection negotiated
+func decodeFrame(messageType int, data []byte) (ClientMessage, error) {
+	var msg ClientMessage
+	var err error
+	if messageType == websocket.BinaryMessage {
+		err = msg.UnmarshalBinary(data)
+	} else {
+		err = json.Unmarshal(data, &msg)
+	}
+	return msg, err
+}
+
+// serverMessageV1 is the v1 wire format: errors are flattened into the
+// "error" string with the code, request ID and retry delay alongside
+type serverMessageV1 struct {
+	ServerMessage
+	Error      string `json:"error,omitempty"`
+	Code       string `json:"code,omitempty"`
+	RetryAfter int64  `json:"retryAfter,omitempty"`
+}
+
+// serverMessageV2 is the v2 wire format: errors are an object
+type serverMessageV2 struct {
+	ServerMessage
+	Error *FrameError `json:"error,omitempty"`
+}
+
+// encodeFrame marshals a frame for a connection, returning the WebSocket
+// message type to send it as. Protobuf frames always carry structured errors;
+// the protocol version selects the JSON error format.
+func encodeFrame(version int, encoding string, msg ServerMessage) (int, []byte, error) {
+	if encoding == encodingProto {
+		data, err := msg.MarshalBinary()
+		return websocket.BinaryMessage, data, err
+	}
+
+	data, err := encodeJSONFrame(version, msg)
+	return websocket.TextMessage, data, err
+}
+
+// encodeJSONFrame marshals a JSON frame in the format of a protocol version
+func encodeJSONFrame(version int, msg ServerMessage) ([]byte, error) {
+	switch version {
+	case ProtocolV2:
+		return json.Marshal(serverMessageV2{ServerMessage: msg, Error: msg.Err})
+
+	case ProtocolV1, 0:
+		frame := serverMessageV1{ServerMessage: msg}
+		if msg.Err != nil {
+			frame.Error = msg.Err.Message
+			frame.Code = msg.Err.Code
+			frame.RetryAfter = msg.Err.RetryAfter
+			if frame.ClientID == "" {
+				frame.ClientID = msg.Err.RequestID
+			}
+		}
+		return json.Marshal(frame)
+	}
+
+	return nil, fmt.Errorf("unsupported protocol version %d", version)
+}
@@ -0,0 +1,240 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"websocket-demo/internal/ratelimit"
+
+	"github.com/gorilla/websocket"
+)
+
+// Frame classes with their own rate limits, also used as metric labels
+const (
+	frameClassMessage = "message" // message
+	frameClassPing    = "ping"    // ping
+	frameClassSignal  = "signal"  // typing_start, typing_stop, signal
+	frameClassOther   = "other"   // Every other frame: register, history, sync, read, settings, group_*, unknown types
+)
+
+// FrameLimits are the token buckets for one frame class: one per connection,
+// and one per user shared by all of the user's connections on every gateway
+type FrameLimits struct {
+	PerConnection ratelimit.Limit
+	PerUser       ratelimit.Limit
+}
+
+// String formats the limits as "rate:burst,rate:burst" (connection, user)
+func (l FrameLimits) String() string {
+	return formatLimit(l.PerConnection) + "," + formatLimit(l.PerUser)
+}
+
+// ParseFrameLimits parses limits formatted by FrameLimits.String; "0:0"
+// disables a bucket
+func ParseFrameLimits(s string) (FrameLimits, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return FrameLimits{}, fmt.Errorf("invalid limits %q: want connection and user limits as rate:burst,rate:burst", s)
+	}
+
+	perConn, err := parseLimit(parts[0])
+	if err != nil {
+		return FrameLimits{}, err
+	}
+	perUser, err := parseLimit(parts[1])
+	if err != nil {
+		return FrameLimits{}, err
+	}
+
+	return FrameLimits{PerConnection: perConn, PerUser: perUser}, nil
+}
+
+func formatLimit(l ratelimit.Limit) string {
+	return strconv.FormatFloat(l.Rate, 'g', -1, 64) + ":" + strconv.Itoa(l.Burst)
+}
+
+func parseLimit(s string) (ratelimit.Limit, error) {
+	rate, burst, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return ratelimit.Limit{}, fmt.Errorf("invalid limit %q: want rate:burst", s)
+	}
+
+	r, err := strconv.ParseFloat(rate, 64)
+	if err != nil || r < 0 {
+		return ratelimit.Limit{}, fmt.Errorf("invalid rate in limit %q", s)
+	}
+	b, err := strconv.Atoi(burst)
+	if err != nil || b < 0 {
+		return ratelimit.Limit{}, fmt.Errorf("invalid burst in limit %q", s)
+	}
+
+	return ratelimit.Limit{Rate: r, Burst: b}, nil
+}
+
+// RateLimitConfig configures the rate limits applied to client frames.
+// Frames over a limit are rejected with a "rate_limited" error; a connection
+// rejected more than MaxViolations times within ViolationWindow is closed
+// with CloseCode. Zero limits disable the corresponding bucket.
+type RateLimitConfig struct {
+	Messages FrameLimits
+	Pings    FrameLimits
+	Signals  FrameLimits
+	Others   FrameLimits
+
+	MaxViolations   int
+	ViolationWindow time.Duration
+	CloseCode       int
+}
+
+// DefaultRateLimitConfig returns the default rate limits
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		Messages: FrameLimits{
+			PerConnection: ratelimit.Limit{Rate: 10, Burst: 20},
+			PerUser:       ratelimit.Limit{Rate: 20, Burst: 40},
+		},
+		Pings: FrameLimits{
+			PerConnection: ratelimit.Limit{Rate: 1, Burst: 5},
+			PerUser:       ratelimit.Limit{Rate: 5, Burst: 20},
+		},
+		Signals: FrameLimits{
+			PerConnection: ratelimit.Limit{Rate: 5, Burst: 10},
+			PerUser:       ratelimit.Limit{Rate: 10, Burst: 20},
+		},
+		Others: FrameLimits{
+			PerConnection: ratelimit.Limit{Rate: 5, Burst: 20},
+			PerUser:       ratelimit.Limit{Rate: 10, Burst: 40},
+		},
+		MaxViolations:   10,
+		ViolationWindow: time.Minute,
+		CloseCode:       websocket.ClosePolicyViolation,
+	}
+}
+
+// limits returns the limits of a frame class
+func (c RateLimitConfig) limits(class string) FrameLimits {
+	switch class {
+	case frameClassMessage:
+		return c.Messages
+	case frameClassPing:
+		return c.Pings
+	case frameClassSignal:
+		return c.Signals
+	}
+	return c.Others
+}
+
+// connLimits holds a connection's local buckets; nil buckets are disabled
+type connLimits struct {
+	messages   *ratelimit.Bucket
+	pings      *ratelimit.Bucket
+	signals    *ratelimit.Bucket
+	others     *ratelimit.Bucket
+	violations *ratelimit.Bucket // Drained by rejected frames; empty means disconnect
+}
+
+// newConnLimits creates a connection's buckets from the config
+func newConnLimits(config RateLimitConfig) *connLimits {
+	l := &connLimits{
+		messages: newBucket(config.Messages.PerConnection),
+		pings:    newBucket(config.Pings.PerConnection),
+		signals:  newBucket(config.Signals.PerConnection),
+		others:   newBucket(config.Others.PerConnection),
+	}
+	if config.MaxViolations > 0 && config.ViolationWindow > 0 {
+		l.violations = ratelimit.NewBucket(ratelimit.Limit{
+			Rate:  float64(config.MaxViolations) / config.ViolationWindow.Seconds(),
+			Burst: config.MaxViolations,
+		})
+	}
+	return l
+}
+
+func newBucket(limit ratelimit.Limit) *ratelimit.Bucket {
+	if !limit.Enabled() {
+		return nil
+	}
+	return ratelimit.NewBucket(limit)
+}
+
+// bucket returns the connection's bucket for a frame class
+func (l *connLimits) bucket(class string) *ratelimit.Bucket {
+	if l == nil {
+		return nil
+	}
+
+	switch class {
+	case frameClassMessage:
+		return l.messages
+	case frameClassPing:
+		return l.pings
+	case frameClassSignal:
+		return l.signals
+	}
+	return l.others
+}
+
+// frameClass maps a client frame type to its rate limit class
+func frameClass(msgType string) string {
+	switch msgType {
+	case msgTypeMessage:
+		return frameClassMessage
+	case msgTypePing:
+		return frameClassPing
+	case msgTypeTypingStart, msgTypeTypingStop, msgTypeSignal:
+		return frameClassSignal
+	}
+	return frameClassOther
+}
+
+// allowFrame applies the connection's and then the user's rate limit to a
+// client frame. Rejected frames are answered with a rate_limited error.
+// The per-user check fails open when the limiter is unavailable.
+func (s *Server) allowFrame(ctx context.Context, conn *Connection, userID string, msg *ClientMessage) bool {
+	class := frameClass(msg.Type)
+	if bucket := conn.limits.bucket(class); bucket != nil {
+		if res := bucket.Take(); !res.Allowed {
+			s.rejectFrame(conn, msg, class, "connection", res.RetryAfter)
+			return false
+		}
+	}
+
+	limit := s.rateLimits.limits(class).PerUser
+	if userID == "" || s.userLimiter == nil || !limit.Enabled() {
+		return true
+	}
+
+	res, err := s.userLimiter.Allow(ctx, class+":"+userID, limit)
+	if err != nil {
+		log.Printf("[Handler] %v", err)
+		return true
+	}
+	if !res.Allowed {
+		s.rejectFrame(conn, msg, class, "user", res.RetryAfter)
+		return false
+	}
+
+	return true
+}
+
+// rejectFrame tells the client to back off, and closes connections that keep
+// exceeding their limits
+func (s *Server) rejectFrame(conn *Connection, msg *ClientMessage, class, scope string, retryAfter time.Duration) {
+	rateLimitedTotal.WithLabelValues(class, scope).Inc()
+
+	e := newFrameError(msg, errCodeRateLimited, "Rate limit exceeded, retry later")
+	e.RetryAfter = retryAfter.Milliseconds() + 1
+	s.sendFrameError(conn, e)
+
+	if conn.limits == nil || conn.limits.violations == nil || conn.limits.violations.Take().Allowed {
+		return
+	}
+
+	log.Printf("[Handler] Closing connection %s of %s: repeatedly exceeded %s rate limit", conn.ID, conn.UserID, class)
+	conn.setCloseReason(disconnectRateLimited)
+	conn.CloseWithCode(s.rateLimits.CloseCode, "rate limit exceeded")
+}
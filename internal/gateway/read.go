@@ -0,0 +1,190 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"websocket-demo/internal/presence"
+	"websocket-demo/internal/router"
+	"websocket-demo/internal/store"
+)
+
+// Read receipt outcomes reported by gateway_read_receipts_total
+const (
+	readReceiptRouted   = "routed"   // Sent to the sender's online devices
+	readReceiptOffline  = "offline"  // Sender offline; they see it in history instead
+	readReceiptDisabled = "disabled" // Reader turned read receipts off
+)
+
+// handleRead marks a conversation read up to a message, confirms it to the
+// reader and tells the senders of the newly read messages, unless the reader
+// disabled read receipts
+func (s *Server) handleRead(ctx context.Context, conn *Connection, userID string, msg *ClientMessage) {
+	if s.messageStore == nil {
+		s.sendError(conn, msg, errCodeNotSupported, "Read receipts are not available")
+		return
+	}
+
+	if msg.ConversationID == "" && msg.GroupID == "" {
+		s.sendError(conn, msg, errCodeInvalidRequest, "ConversationID or GroupID is required")
+		return
+	}
+	if msg.UpTo == "" {
+		s.sendError(conn, msg, errCodeInvalidRequest, "UpTo is required")
+		return
+	}
+
+	if msg.GroupID != "" && s.groupMgr == nil {
+		s.sendError(conn, msg, errCodeNotSupported, "Groups are not available")
+		return
+	}
+	if msg.GroupID != "" {
+		isMember, err := s.groupMgr.IsMember(ctx, msg.GroupID, userID)
+		if err != nil || !isMember {
+			s.sendError(conn, msg, errCodeNotMember, "Not a group member")
+			return
+		}
+	}
+
+	now := time.Now()
+	read, err := s.messageStore.MarkReadUpTo(ctx, store.ReadQuery{
+		UserID:  userID,
+		PeerID:  msg.ConversationID,
+		GroupID: msg.GroupID,
+		UpTo:    msg.UpTo,
+		At:      now,
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			s.sendError(conn, msg, errCodeNotFound, "Unknown message")
+			return
+		}
+		log.Printf("[Handler] Failed to mark messages read for %s: %v", userID, err)
+		s.sendError(conn, msg, errCodeInternal, "Failed to mark messages read")
+		return
+	}
+
+	s.sendMessage(conn, ServerMessage{
+		Type:      msgTypeRead,
+		ClientID:  msg.ClientID,
+		To:        msg.ConversationID,
+		GroupID:   msg.GroupID,
+		ReadUpTo:  msg.UpTo,
+		Timestamp: now.UnixMilli(),
+	})
+	if len(read) == 0 {
+		return
+	}
+
+	enabled, err := s.messageStore.ReadReceipts(ctx, userID)
+	if err != nil {
+		// Fail closed: never reveal a read the user may have hidden
+		log.Printf("[Handler] Failed to load read receipt setting for %s: %v", userID, err)
+		return
+	}
+	if !enabled {
+		readReceiptsTotal.WithLabelValues(readReceiptDisabled).Inc()
+		return
+	}
+
+	for _, receipt := range readReceipts(read, userID, msg.GroupID, now) {
+		s.routeReadReceipt(ctx, receipt)
+	}
+}
+
+// readReceipts builds one receipt per sender, naming the newest of their
+// messages that was read
+func readReceipts(read []*router.Message, reader, groupID string, at time.Time) []*router.Message {
+	newest := make(map[string]*router.Message)
+	for _, m := range read {
+		if m.From == reader {
+			continue
+		}
+		if cur, ok := newest[m.From]; !ok || m.Timestamp > cur.Timestamp ||
+			(m.Timestamp == cur.Timestamp && m.ID > cur.ID) {
+			newest[m.From] = m
+		}
+	}
+
+	receipts := make([]*router.Message, 0, len(newest))
+	for sender, m := range newest {
+		receipts = append(receipts, &router.Message{
+			ID:        m.ID,
+			From:      reader,
+			To:        sender,
+			Type:      router.MessageTypeRead,
+			GroupID:   groupID,
+			Timestamp: at.UnixMilli(),
+		})
+	}
+	return receipts
+}
+
+// routeReadReceipt sends a receipt to the gateways of the sender's online
+// devices. Receipts are not queued: an offline sender sees the read status
+// in history.
+func (s *Server) routeReadReceipt(ctx context.Context, receipt *router.Message) {
+	sessions, err := s.liveSessions(ctx, receipt.To)
+	if errors.Is(err, presence.ErrUserOffline) {
+		readReceiptsTotal.WithLabelValues(readReceiptOffline).Inc()
+		return
+	}
+	if err != nil {
+		log.Printf("[Handler] Failed to look up presence for read receipt to %s: %v", receipt.To, err)
+		return
+	}
+
+	for _, gatewayID := range presence.GatewayIDs(sessions) {
+		if err := s.router.RouteToGateway(ctx, gatewayID, receipt); err != nil {
+			log.Printf("[Handler] Failed to route read receipt for %s to gateway %s: %v", receipt.ID, gatewayID, err)
+		}
+	}
+	readReceiptsTotal.WithLabelValues(readReceiptRouted).Inc()
+}
+
+// deliverReadReceipt shows a read receipt on the sender's local devices
+func (s *Server) deliverReadReceipt(msg *router.Message) {
+	for _, conn := range s.connMgr.GetByUserID(msg.To) {
+		s.sendMessage(conn, ServerMessage{
+			Type:      msgTypeRead,
+			ID:        msg.ID,
+			From:      msg.From,
+			To:        msg.To,
+			GroupID:   msg.GroupID,
+			Timestamp: msg.Timestamp,
+		})
+	}
+}
+
+// handleSettings updates the user's privacy settings when given and replies
+// with the current values
+func (s *Server) handleSettings(ctx context.Context, conn *Connection, userID string, msg *ClientMessage) {
+	if s.messageStore == nil {
+		s.sendError(conn, msg, errCodeNotSupported, "Settings are not available")
+		return
+	}
+
+	if msg.ReadReceipts != nil {
+		if err := s.messageStore.SetReadReceipts(ctx, userID, *msg.ReadReceipts); err != nil {
+			log.Printf("[Handler] Failed to update settings for %s: %v", userID, err)
+			s.sendError(conn, msg, errCodeInternal, "Failed to update settings")
+			return
+		}
+		log.Printf("[Handler] User %s set read receipts to %v", userID, *msg.ReadReceipts)
+	}
+
+	enabled, err := s.messageStore.ReadReceipts(ctx, userID)
+	if err != nil {
+		log.Printf("[Handler] Failed to load settings for %s: %v", userID, err)
+		s.sendError(conn, msg, errCodeInternal, "Failed to load settings")
+		return
+	}
+
+	s.sendMessage(conn, ServerMessage{
+		Type:         msgTypeSettings,
+		ClientID:     msg.ClientID,
+		ReadReceipts: &enabled,
+	})
+}
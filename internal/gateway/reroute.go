@@ -0,0 +1,108 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"websocket-demo/internal/presence"
+	"websocket-demo/internal/router"
+)
+
+// maxRerouteHops bounds how often a message follows its recipient to another
+// gateway, so stale presence cannot bounce it between gateways forever
+const maxRerouteHops = 2
+
+// Re-routing outcomes reported by gateway_messages_rerouted_total
+const (
+	rerouteForwarded = "forwarded" // Sent on to the recipient's new gateway
+	rerouteCovered   = "covered"   // The recipient's other gateways already have it
+	rerouteOffline   = "offline"   // Recipient went offline, queued for their next login
+	rerouteDropped   = "dropped"   // Hop limit reached or no offline store
+)
+
+// rerouteMessage handles a direct message whose recipient has no connection
+// here, usually because they reconnected elsewhere after the sender looked up
+// their presence. It forwards the message to gateways that now hold the
+// recipient and were not already sent it, or queues it offline if the
+// recipient has no live session left.
+func (s *Server) rerouteMessage(msg *router.Message) error {
+	if msg.Hops >= maxRerouteHops {
+		messagesReroutedTotal.WithLabelValues(rerouteDropped).Inc()
+		return fmt.Errorf("user %s after %d hops: %w", msg.To, msg.Hops, router.ErrRecipientNotLocal)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sessions, err := s.liveSessions(ctx, msg.To)
+	if err != nil && !errors.Is(err, presence.ErrUserOffline) {
+		return fmt.Errorf("failed to look up presence of %s: %w", msg.To, err)
+	}
+
+	// Presence can still list this gateway until the dropped session is removed
+	var current []string
+	for _, gatewayID := range presence.GatewayIDs(sessions) {
+		if gatewayID != s.gatewayID {
+			current = append(current, gatewayID)
+		}
+	}
+	if len(current) == 0 {
+		return s.queueUndelivered(ctx, msg)
+	}
+
+	sent := make(map[string]bool, len(msg.Targets))
+	for _, gatewayID := range msg.Targets {
+		sent[gatewayID] = true
+	}
+
+	var targets []string
+	for _, gatewayID := range current {
+		if !sent[gatewayID] {
+			targets = append(targets, gatewayID)
+		}
+	}
+	if len(targets) == 0 {
+		messagesReroutedTotal.WithLabelValues(rerouteCovered).Inc()
+		log.Printf("[Handler] Message %s already routed to the other gateways of %s", msg.ID, msg.To)
+		return nil
+	}
+
+	forwarded := *msg
+	forwarded.Hops++
+	forwarded.Targets = append(append([]string(nil), msg.Targets...), targets...)
+
+	routed := 0
+	for _, gatewayID := range targets {
+		if err := s.router.RouteToGateway(ctx, gatewayID, &forwarded); err != nil {
+			log.Printf("[Handler] Failed to reroute message %s to gateway %s: %v", msg.ID, gatewayID, err)
+			continue
+		}
+		routed++
+	}
+	if routed == 0 {
+		return fmt.Errorf("failed to reroute message %s to any gateway", msg.ID)
+	}
+
+	messagesReroutedTotal.WithLabelValues(rerouteForwarded).Inc()
+	log.Printf("[Handler] User %s moved, rerouted message %s to %v (hop %d)", msg.To, msg.ID, targets, forwarded.Hops)
+	return nil
+}
+
+// queueUndelivered stores a message for a recipient who went offline before it arrived
+func (s *Server) queueUndelivered(ctx context.Context, msg *router.Message) error {
+	if s.offlineStore == nil {
+		messagesReroutedTotal.WithLabelValues(rerouteDropped).Inc()
+		return fmt.Errorf("user %s: %w", msg.To, router.ErrRecipientNotLocal)
+	}
+
+	if err := s.offlineStore.Push(ctx, msg.To, msg); err != nil {
+		return fmt.Errorf("failed to queue message %s offline: %w", msg.ID, err)
+	}
+
+	messagesReroutedTotal.WithLabelValues(rerouteOffline).Inc()
+	log.Printf("[Handler] User %s went offline, queued message %s", msg.To, msg.ID)
+	return nil
+}
@@ -2,98 +2,198 @@ package gateway
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"sync"
 	"time"
 
+	"websocket-demo/internal/auth"
+	"websocket-demo/internal/group"
+	"websocket-demo/internal/metrics"
+	"websocket-demo/internal/offline"
+	"websocket-demo/internal/policy"
 	"websocket-demo/internal/presence"
+	"websocket-demo/internal/ratelimit"
+	"websocket-demo/internal/registry"
 	"websocket-demo/internal/router"
+	"websocket-demo/internal/store"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/redis/go-redis/v9"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for demo
-	},
-}
+// upgrader is copied per request; CheckOrigin is set from the server's allowlist
+var upgrader = websocket.Upgrader{}
 
 // Server represents the WebSocket gateway server
 type Server struct {
 	gatewayID   string
 	port        int
 	connMgr     *ConnectionManager
-	presenceMgr *presence.Manager
+	presenceMgr presence.Manager
 	router      router.RouterInterface // 使用接口支持多种路由实现 / Use interface to support multiple router implementations
 	httpServer  *http.Server
+
+	offlineStore offline.Store      // Queue for messages sent to offline users (nil disables)
+	messageStore store.MessageStore // Persistent message history (nil disables)
+	groupMgr     *group.Manager     // Group membership and roles (nil disables)
+	adminToken   string             // Bearer token for /admin endpoints (empty disables)
+	verifier     *auth.Verifier     // Validates bearer tokens on upgrade (nil trusts register frames)
+	policy       policy.Policy      // Who may message whom (nil allows everyone)
+	origins      OriginAllowlist    // Browser origins allowed to connect (empty allows all)
+	tls          *TLSReloader       // Serves TLS when set
+	certUser     CertUserMapper     // Maps verified client certificates to user IDs
+
+	queueConfig   QueueConfig   // Per-connection send queue settings
+	queueCounters QueueCounters // Drops and evictions across all connections
+
+	rateLimits  RateLimitConfig   // Per-connection and per-user frame limits
+	userLimiter ratelimit.Limiter // Per-user buckets shared across gateways (nil disables)
+
+	registry      *registry.Registry // Live gateways (nil disables heartbeats, reaping and route checks)
+	advertiseAddr string             // HTTP address published in the registry
+	startedAt     time.Time
+	stopRegistry  context.CancelFunc
+	registryWG    sync.WaitGroup
+	lastPrune     time.Time // Last presence index prune, owned by runRegistry
+
+	liveMu       sync.RWMutex
+	liveGateways map[string]bool // Gateways live in the registry at the last heartbeat
 }
 
 // NewServer creates a new gateway server with Redis Pub/Sub router
 // 创建使用 Redis Pub/Sub 路由器的新 Gateway 服务器
-func NewServer(gatewayID string, port int, redisClient *redis.Client) *Server {
-	presenceMgr := presence.NewManager(redisClient)
+func NewServer(gatewayID string, port int, redisClient *redis.Client, opts ...Option) *Server {
 	msgRouter := router.NewRouter(redisClient, gatewayID)
 
-	return &Server{
-		gatewayID:   gatewayID,
-		port:        port,
-		connMgr:     NewConnectionManager(),
-		presenceMgr: presenceMgr,
-		router:      msgRouter,
-	}
+	return NewServerWithRouter(gatewayID, port, redisClient, msgRouter, opts...)
 }
 
-// NewServerWithRouter creates a new gateway server with a custom router
+// NewServerWithRouter creates a new gateway server with a custom router.
+// Presence, offline messages and groups default to Redis; with a nil
+// redisClient they must be supplied as options (see NewMemoryServer).
 // 创建使用自定义路由器的新 Gateway 服务器
-func NewServerWithRouter(gatewayID string, port int, redisClient *redis.Client, customRouter router.RouterInterface) *Server {
-	presenceMgr := presence.NewManager(redisClient)
-
-	return &Server{
+func NewServerWithRouter(gatewayID string, port int, redisClient *redis.Client, customRouter router.RouterInterface, opts ...Option) *Server {
+	s := &Server{
 		gatewayID:   gatewayID,
 		port:        port,
 		connMgr:     NewConnectionManager(),
-		presenceMgr: presenceMgr,
 		router:      customRouter,
+		queueConfig: DefaultQueueConfig(),
+		rateLimits:  DefaultRateLimitConfig(),
+		startedAt:   time.Now(),
+		certUser:    CommonNameUser,
+	}
+
+	if redisClient != nil {
+		s.registry = registry.New(redisClient)
+		s.presenceMgr = presence.NewRedisManager(redisClient)
+		s.offlineStore = offline.NewRedisStore(redisClient, offline.DefaultConfig())
+		s.groupMgr = group.NewManager(group.NewRedisStore(redisClient))
+		s.policy = policy.NewCached(policy.NewRedisPolicy(redisClient), policy.DefaultCacheTTL)
+		s.userLimiter = ratelimit.NewRedisLimiter(redisClient)
+	}
+
+	for _, opt := range opts {
+		opt(s)
 	}
+
+	return s
 }
 
-// Start starts the server
+// Start starts the server on its configured port
 func (s *Server) Start(ctx context.Context) error {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		return fmt.Errorf("failed to start HTTP server: %w", err)
+	}
+
+	return s.Serve(ctx, lis)
+}
+
+// Serve starts the router and serves HTTP on lis until Stop is called.
+// Tests can pass a listener on port 0.
+func (s *Server) Serve(ctx context.Context, lis net.Listener) error {
 	// Start message router
 	if err := s.router.Start(ctx, s.deliverMessage); err != nil {
+		lis.Close()
 		return fmt.Errorf("failed to start router: %w", err)
 	}
 
 	// Start health check routine
 	go s.healthCheckLoop(ctx)
 
-	// Setup HTTP routes
-	mux := http.NewServeMux()
-	mux.HandleFunc("/ws", s.handleWebSocket)
-	mux.HandleFunc("/health", s.handleHealth)
-	mux.HandleFunc("/stats", s.handleStats)
+	// Join the gateway registry
+	if s.registry != nil {
+		if s.advertiseAddr == "" {
+			s.advertiseAddr = defaultAdvertiseAddr(lis)
+		}
+
+		registryCtx, cancel := context.WithCancel(ctx)
+		s.stopRegistry = cancel
+		s.registryWG.Add(1)
+		go func() {
+			defer s.registryWG.Done()
+			s.runRegistry(registryCtx)
+		}()
+	}
 
 	s.httpServer = &http.Server{
-		Addr:    fmt.Sprintf(":%d", s.port),
-		Handler: mux,
+		Handler: s.Handler(),
 	}
 
-	log.Printf("[Server] Gateway %s starting on port %d", s.gatewayID, s.port)
+	if s.tls != nil {
+		go s.tls.Run(ctx)
+		s.httpServer.TLSConfig = s.tls.TLSConfig()
+		lis = tls.NewListener(lis, s.httpServer.TLSConfig)
+		log.Printf("[Server] Gateway %s starting on %s (TLS)", s.gatewayID, lis.Addr())
+	} else {
+		log.Printf("[Server] Gateway %s starting on %s", s.gatewayID, lis.Addr())
+	}
 
-	if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	if err := s.httpServer.Serve(lis); err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("failed to start HTTP server: %w", err)
 	}
 
 	return nil
 }
 
+// Handler returns the gateway's HTTP routes
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", s.handleWebSocket)
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/stats", s.handleStats)
+	mux.HandleFunc("/gateways", s.handleGateways)
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/admin/announce", s.handleAnnounce)
+	mux.HandleFunc("/admin/policy", s.handlePolicy)
+
+	return mux
+}
+
 // Stop stops the server
 func (s *Server) Stop(ctx context.Context) error {
 	log.Printf("[Server] Shutting down gateway %s", s.gatewayID)
 
+	// Leave the registry so other gateways stop routing here
+	if s.stopRegistry != nil {
+		s.stopRegistry()
+		s.registryWG.Wait()
+
+		if err := s.registry.Deregister(ctx, s.gatewayID); err != nil {
+			log.Printf("[Server] Error deregistering: %v", err)
+		}
+	}
+
 	// Stop router
 	if err := s.router.Stop(); err != nil {
 		log.Printf("[Server] Error stopping router: %v", err)
@@ -101,7 +201,7 @@ func (s *Server) Stop(ctx context.Context) error {
 
 	// Close all connections
 	s.connMgr.ForEach(func(conn *Connection) {
-		conn.Close()
+		conn.closeWithReason(disconnectShutdown)
 	})
 
 	// Shutdown HTTP server
@@ -112,9 +212,60 @@ func (s *Server) Stop(ctx context.Context) error {
 	return nil
 }
 
-// handleWebSocket handles WebSocket upgrade requests
+// handleWebSocket handles WebSocket upgrade requests. A verified client
+// certificate authenticates the user named by its subject; otherwise, when a
+// verifier is configured, the bearer token is validated before upgrading and
+// the user ID is taken from its subject claim. A "chat.v<N>[.json|.proto]"
+// subprotocol selects the protocol version and frame encoding.
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	wsUpgrader := upgrader
+	wsUpgrader.CheckOrigin = func(r *http.Request) bool {
+		if s.origins.Allows(r) {
+			return true
+		}
+		log.Printf("[Server] Rejected WebSocket upgrade from origin %s", r.Header.Get("Origin"))
+		return false
+	}
+
+	var authUserID string
+
+	if leaf := clientCertificate(r); leaf != nil {
+		authUserID = s.certUser(leaf)
+		if authUserID == "" {
+			log.Printf("[Server] Rejected client certificate %q: no user ID", leaf.Subject)
+			http.Error(w, "client certificate does not name a user", http.StatusUnauthorized)
+			return
+		}
+	} else if s.verifier != nil {
+		token, subprotocol, err := auth.TokenFromRequest(r)
+		if err != nil {
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := s.verifier.Verify(token)
+		if err != nil {
+			log.Printf("[Server] Rejected WebSocket upgrade: %v", err)
+			http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		authUserID = claims.Subject
+
+		// Browsers require the token subprotocol to be echoed back
+		if subprotocol != "" {
+			wsUpgrader.Subprotocols = []string{subprotocol}
+		}
+	}
+
+	// Only one subprotocol can be echoed; a chat subprotocol wins over the
+	// token subprotocol, which browsers offer alongside it
+	protocol, encoding, subprotocol := negotiateProtocol(r)
+	if subprotocol != "" {
+		wsUpgrader.Subprotocols = []string{subprotocol}
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("[Server] Failed to upgrade connection: %v", err)
 		return
@@ -123,7 +274,15 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	connID := uuid.New().String()
 	log.Printf("[Server] New WebSocket connection: %s", connID)
 
-	s.handleConnection(conn, connID)
+	s.handleConnection(conn, connID, authUserID, protocol, encoding)
+}
+
+// clientCertificate returns the verified client certificate of a TLS request, if any
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
 }
 
 // handleHealth handles health check requests
@@ -132,10 +291,57 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "OK")
 }
 
+// Stats is the body of GET /stats
+type Stats struct {
+	GatewayID   string     `json:"gatewayId"`
+	Connections int        `json:"connections"`
+	Queue       QueueStats `json:"queue"`
+}
+
+// QueueStats summarizes the per-connection send queues
+type QueueStats struct {
+	Capacity int    `json:"capacity"` // Per-connection queue size
+	Depth    int    `json:"depth"`    // Frames queued across all connections
+	MaxDepth int    `json:"maxDepth"` // Deepest single queue
+	Dropped  uint64 `json:"dropped"`  // Frames dropped since start
+	Evicted  uint64 `json:"evicted"`  // Slow consumers disconnected since start
+}
+
 // handleStats handles stats requests
 func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	stats := Stats{
+		GatewayID:   s.gatewayID,
+		Connections: s.connMgr.Count(),
+		Queue: QueueStats{
+			Capacity: s.queueConfig.Size,
+			Dropped:  s.queueCounters.Dropped.Load(),
+			Evicted:  s.queueCounters.Evicted.Load(),
+		},
+	}
+
+	s.connMgr.ForEach(func(conn *Connection) {
+		depth := conn.QueueDepth()
+		stats.Queue.Depth += depth
+		if depth > stats.Queue.MaxDepth {
+			stats.Queue.MaxDepth = depth
+		}
+	})
+
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"gatewayId":"%s","connections":%d}`, s.gatewayID, s.connMgr.Count())
+	json.NewEncoder(w).Encode(stats)
+}
+
+// defaultAdvertiseAddr combines the hostname with the listener's port
+func defaultAdvertiseAddr(lis net.Listener) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+
+	if addr, ok := lis.Addr().(*net.TCPAddr); ok {
+		return net.JoinHostPort(host, strconv.Itoa(addr.Port))
+	}
+	return lis.Addr().String()
 }
 
 // healthCheckLoop periodically checks connection health
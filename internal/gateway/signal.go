@@ -0,0 +1,127 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"websocket-demo/internal/policy"
+	"websocket-demo/internal/presence"
+	"websocket-demo/internal/router"
+)
+
+const (
+	// typingTTL is how long a receiver shows a typing indicator without a
+	// fresh typing_start; typing clients repeat typing_start more often
+	typingTTL = 6 * time.Second
+
+	// signalMaxAge drops signals that reach the receiving gateway late,
+	// e.g. replayed by a durable router after a restart
+	signalMaxAge = typingTTL
+
+	// maxSignalContent bounds the payload of a generic signal
+	maxSignalContent = 4096
+)
+
+// Signal kinds used as the "kind" metric label
+const (
+	signalKindTyping = "typing"
+	signalKindSignal = "signal"
+)
+
+// handleSignal routes a typing indicator or generic signal to the recipient's
+// gateways. Signals are ephemeral: they are never persisted, queued offline,
+// acked or retried, and are dropped if the recipient is offline.
+func (s *Server) handleSignal(ctx context.Context, conn *Connection, msg *ClientMessage) {
+	kind := signalKindTyping
+	event := msg.Type
+	if msg.Type == msgTypeSignal {
+		kind = signalKindSignal
+		event = msg.Event
+	}
+
+	if msg.To == "" {
+		s.sendError(conn, msg, errCodeInvalidRequest, "Recipient is required")
+		return
+	}
+	if event == "" {
+		s.sendError(conn, msg, errCodeInvalidRequest, "Event is required")
+		return
+	}
+	if len(msg.Content) > maxSignalContent {
+		s.sendError(conn, msg, errCodeTooLarge, "Signal content too large")
+		return
+	}
+
+	if err := s.authorize(ctx, conn.UserID, msg.To); err != nil {
+		// Dropped silently like signals to offline users
+		if errors.Is(err, policy.ErrDenied) {
+			signalsDroppedTotal.WithLabelValues(kind, "denied").Inc()
+		} else {
+			log.Printf("[Handler] %v", err)
+		}
+		return
+	}
+
+	sessions, err := s.liveSessions(ctx, msg.To)
+	if errors.Is(err, presence.ErrUserOffline) {
+		signalsDroppedTotal.WithLabelValues(kind, "offline").Inc()
+		return
+	}
+	if err != nil {
+		log.Printf("[Handler] Failed to look up presence for signal to %s: %v", msg.To, err)
+		return
+	}
+
+	signal := &router.Message{
+		From:      conn.UserID,
+		To:        msg.To,
+		Type:      router.MessageTypeSignal,
+		Event:     event,
+		Content:   msg.Content,
+		Gateway:   s.gatewayID,
+		ConnID:    conn.ID,
+		Timestamp: time.Now().UnixMilli(),
+	}
+
+	for _, gatewayID := range presence.GatewayIDs(sessions) {
+		if err := s.router.RouteToGateway(ctx, gatewayID, signal); err != nil {
+			log.Printf("[Handler] Failed to route %s from %s to gateway %s: %v", event, conn.UserID, gatewayID, err)
+			continue
+		}
+	}
+	signalsRoutedTotal.WithLabelValues(kind).Inc()
+}
+
+// deliverSignal shows a signal on the recipient's local devices. Typing
+// indicators arrive as typing_start/typing_stop frames; typing_start carries
+// the TTL after which the receiver should hide the indicator on its own.
+func (s *Server) deliverSignal(msg *router.Message) {
+	if msg.Timestamp > 0 && time.Since(time.UnixMilli(msg.Timestamp)) > signalMaxAge {
+		return
+	}
+
+	frame := ServerMessage{
+		Type:      msgTypeSignal,
+		From:      msg.From,
+		To:        msg.To,
+		Event:     msg.Event,
+		Content:   msg.Content,
+		Timestamp: msg.Timestamp,
+	}
+
+	switch msg.Event {
+	case msgTypeTypingStart:
+		frame.Type = msgTypeTypingStart
+		frame.Event = ""
+		frame.TTL = typingTTL.Milliseconds()
+	case msgTypeTypingStop:
+		frame.Type = msgTypeTypingStop
+		frame.Event = ""
+	}
+
+	for _, conn := range s.connMgr.GetByUserID(msg.To) {
+		s.sendMessage(conn, frame)
+	}
+}
@@ -0,0 +1,155 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultTLSReloadInterval is how often certificate files are checked for changes
+const DefaultTLSReloadInterval = 30 * time.Second
+
+// TLSConfig selects the files the gateway serves TLS with
+type TLSConfig struct {
+	CertFile string // PEM certificate chain
+	KeyFile  string // PEM private key
+
+	// ClientCAFile enables client certificates: certificates signed by these
+	// CAs authenticate the connection as the user named by their subject.
+	// Clients without a certificate fall back to bearer tokens.
+	ClientCAFile string
+
+	ReloadInterval time.Duration // How often to check the files (default 30s)
+}
+
+// TLSReloader serves certificates that are reloaded when their files change
+// on disk, so renewed certificates apply without a restart
+type TLSReloader struct {
+	config  TLSConfig
+	current atomic.Pointer[tls.Config]
+	modTime time.Time // Newest modification time of the loaded files
+}
+
+// NewTLSReloader loads the configured files
+func NewTLSReloader(config TLSConfig) (*TLSReloader, error) {
+	if config.ReloadInterval <= 0 {
+		config.ReloadInterval = DefaultTLSReloadInterval
+	}
+
+	r := &TLSReloader{config: config}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSConfig returns the server configuration; each handshake uses the most
+// recently loaded certificate and client CAs
+func (r *TLSReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current.Load(), nil
+		},
+	}
+}
+
+// Run checks the files every ReloadInterval until ctx is cancelled. A failed
+// reload keeps serving the previous certificate.
+func (r *TLSReloader) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			modTime, err := r.newestModTime()
+			if err != nil {
+				log.Printf("[Server] Failed to check TLS files: %v", err)
+				continue
+			}
+			if !modTime.After(r.modTime) {
+				continue
+			}
+
+			if err := r.load(); err != nil {
+				log.Printf("[Server] Failed to reload TLS certificate, keeping the previous one: %v", err)
+				continue
+			}
+			log.Printf("[Server] Reloaded TLS certificate from %s", r.config.CertFile)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// load reads the certificate, key and client CAs
+func (r *TLSReloader) load() error {
+	modTime, err := r.newestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if r.config.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA file %s", r.config.ClientCAFile)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	r.current.Store(config)
+	r.modTime = modTime
+	return nil
+}
+
+// newestModTime returns the latest modification time of the configured files
+func (r *TLSReloader) newestModTime() (time.Time, error) {
+	var newest time.Time
+	for _, file := range []string{r.config.CertFile, r.config.KeyFile, r.config.ClientCAFile} {
+		if file == "" {
+			continue
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to stat %s: %w", file, err)
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// CertUserMapper maps a verified client certificate to a user ID; an empty
+// result rejects the certificate
+type CertUserMapper func(cert *x509.Certificate) string
+
+// CommonNameUser maps a client certificate to its subject common name
+func CommonNameUser(cert *x509.Certificate) string {
+	return cert.Subject.CommonName
+}
@@ -0,0 +1,332 @@
+package gateway
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"websocket-demo/internal/offline"
+
+	"github.com/gorilla/websocket"
+)
+
+// testCA issues certificates for TLS tests
+type testCA struct {
+	t    *testing.T
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newSerial returns a random certificate serial number
+func newSerial(t *testing.T) *big.Int {
+	t.Helper()
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serial
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          newSerial(t),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{t: t, cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key for commonName; server
+// certificates are valid for 127.0.0.1
+func (ca *testCA) issue(commonName string, server bool) (certPEM, keyPEM []byte) {
+	ca.t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: newSerial(ca.t),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// pool returns a pool trusting the CA
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// writeTLSFile writes a TLS file with a modification time after every earlier
+// write, so the reloader sees the change even on coarse file system clocks
+func writeTLSFile(t *testing.T, path string, data []byte, version int) {
+	t.Helper()
+
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Duration(version) * time.Second)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedName handshakes with the reloader's current configuration and
+// returns the common name of the certificate it served
+func servedName(t *testing.T, r *TLSReloader, roots *x509.CertPool) string {
+	t.Helper()
+
+	// Closing the pipe, not the TLS connections, which would block writing
+	// close_notify to a peer that no longer reads
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	go tls.Server(serverConn, r.TLSConfig()).Handshake()
+
+	client := tls.Client(clientConn, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"})
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	return client.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+// waitServedName polls until the reloader serves the named certificate
+func waitServedName(t *testing.T, r *TLSReloader, roots *x509.CertPool, name string) {
+	t.Helper()
+
+	deadline := time.Now().Add(readTimeout)
+	for servedName(t, r, roots) != name {
+		if time.Now().After(deadline) {
+			t.Fatalf("still serving %q, want %q", servedName(t, r, roots), name)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTLSReloaderPicksUpRotatedCertificate(t *testing.T) {
+	ca := newTestCA(t, "test-ca")
+	dir := t.TempDir()
+	config := TLSConfig{
+		CertFile:       filepath.Join(dir, "server.pem"),
+		KeyFile:        filepath.Join(dir, "server.key"),
+		ReloadInterval: 10 * time.Millisecond,
+	}
+
+	cert, key := ca.issue("server-v1", true)
+	writeTLSFile(t, config.CertFile, cert, 0)
+	writeTLSFile(t, config.KeyFile, key, 0)
+
+	r, err := NewTLSReloader(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	if name := servedName(t, r, ca.pool()); name != "server-v1" {
+		t.Fatalf("serving %q, want server-v1", name)
+	}
+
+	cert, key = ca.issue("server-v2", true)
+	writeTLSFile(t, config.KeyFile, key, 1)
+	writeTLSFile(t, config.CertFile, cert, 1)
+	waitServedName(t, r, ca.pool(), "server-v2")
+}
+
+func TestTLSReloaderKeepsCertificateOnBadReload(t *testing.T) {
+	ca := newTestCA(t, "test-ca")
+	dir := t.TempDir()
+	config := TLSConfig{
+		CertFile:       filepath.Join(dir, "server.pem"),
+		KeyFile:        filepath.Join(dir, "server.key"),
+		ReloadInterval: 10 * time.Millisecond,
+	}
+
+	cert, key := ca.issue("server-v1", true)
+	writeTLSFile(t, config.CertFile, cert, 0)
+	writeTLSFile(t, config.KeyFile, key, 0)
+
+	r, err := NewTLSReloader(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 证书与私钥不匹配, 然后是损坏的文件 / A certificate without its key, then a corrupt file
+	cert2, key2 := ca.issue("server-v2", true)
+	writeTLSFile(t, config.CertFile, cert2, 1)
+	if err := r.load(); err == nil {
+		t.Fatal("loaded a certificate with the wrong key")
+	}
+	if name := servedName(t, r, ca.pool()); name != "server-v1" {
+		t.Fatalf("serving %q after a failed reload, want server-v1", name)
+	}
+	writeTLSFile(t, config.CertFile, []byte("not a certificate"), 2)
+	if err := r.load(); err == nil {
+		t.Fatal("loaded a corrupt certificate")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	for i := 0; i < 5; i++ {
+		if name := servedName(t, r, ca.pool()); name != "server-v1" {
+			t.Fatalf("serving %q after a failed reload, want server-v1", name)
+		}
+		time.Sleep(config.ReloadInterval)
+	}
+
+	// 修复后下一次检查即生效 / Fixed files apply at the next check
+	writeTLSFile(t, config.KeyFile, key2, 3)
+	writeTLSFile(t, config.CertFile, cert2, 3)
+	waitServedName(t, r, ca.pool(), "server-v2")
+}
+
+func TestNewTLSReloaderRejectsBadFiles(t *testing.T) {
+	ca := newTestCA(t, "test-ca")
+	dir := t.TempDir()
+	cert, key := ca.issue("server", true)
+	writeTLSFile(t, filepath.Join(dir, "server.pem"), cert, 0)
+	writeTLSFile(t, filepath.Join(dir, "server.key"), key, 0)
+	writeTLSFile(t, filepath.Join(dir, "empty-ca.pem"), []byte("no certificates here"), 0)
+
+	for name, config := range map[string]TLSConfig{
+		"missing key": {CertFile: filepath.Join(dir, "server.pem"), KeyFile: filepath.Join(dir, "missing.key")},
+		"key as cert": {CertFile: filepath.Join(dir, "server.key"), KeyFile: filepath.Join(dir, "server.key")},
+		"empty client CA": {
+			CertFile: filepath.Join(dir, "server.pem"), KeyFile: filepath.Join(dir, "server.key"),
+			ClientCAFile: filepath.Join(dir, "empty-ca.pem"),
+		},
+	} {
+		if _, err := NewTLSReloader(config); err == nil {
+			t.Errorf("%s: NewTLSReloader succeeded, want an error", name)
+		}
+	}
+}
+
+func TestMutualTLSAuthenticatesUser(t *testing.T) {
+	serverCA := newTestCA(t, "server-ca")
+	clientCA := newTestCA(t, "client-ca")
+	otherCA := newTestCA(t, "other-ca")
+
+	dir := t.TempDir()
+	config := TLSConfig{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "clients.pem"),
+	}
+	cert, key := serverCA.issue("gateway", true)
+	writeTLSFile(t, config.CertFile, cert, 0)
+	writeTLSFile(t, config.KeyFile, key, 0)
+	writeTLSFile(t, config.ClientCAFile, clientCA.pem, 0)
+
+	reloader, err := NewTLSReloader(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := startGateway(t, "gw1", NewMemoryBackend(offline.DefaultConfig()), WithTLS(reloader))
+
+	// dialTLS connects with an optional client certificate
+	dialTLS := func(certPEM, keyPEM []byte) (*testClient, error) {
+		tlsConfig := &tls.Config{RootCAs: serverCA.pool()}
+		if certPEM != nil {
+			pair, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Sent even when the server asks for another CA, as a client might
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &pair, nil
+			}
+		}
+		dialer := websocket.Dialer{TLSClientConfig: tlsConfig, HandshakeTimeout: readTimeout}
+		ws, _, err := dialer.Dial(fmt.Sprintf("wss://127.0.0.1:%d/ws", gw.port), nil)
+		if err != nil {
+			return nil, err
+		}
+		t.Cleanup(func() { ws.Close() })
+		return &testClient{t: t, ws: ws}, nil
+	}
+
+	// 证书 CN 即用户 / The certificate's CN is the user
+	alice, err := dialTLS(clientCA.issue("alice", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.send(ClientMessage{Type: msgTypeRegister, UserID: "bob", ClientID: "r1"})
+	if msg := alice.expect(msgTypeError); msg.Code != errCodeIdentityMismatch {
+		t.Fatalf("registering as another user got %s, want %s", msg.Code, errCodeIdentityMismatch)
+	}
+	alice.send(ClientMessage{Type: msgTypeRegister})
+	alice.expect("registered")
+	waitConnections(t, gw, "alice", 1)
+
+	// 其他 CA 签发的证书在握手时被拒绝 / A certificate from another CA fails the handshake
+	if _, err := dialTLS(otherCA.issue("mallory", false)); err == nil {
+		t.Fatal("connected with a certificate from an untrusted CA")
+	}
+
+	// 没有证书时回退到其他认证 / Without a certificate other authentication applies
+	carol, err := dialTLS(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol.send(ClientMessage{Type: msgTypeRegister, UserID: "carol"})
+	carol.expect("registered")
+}
@@ -0,0 +1,218 @@
+package group
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Member roles, in decreasing order of privilege
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+var (
+	// ErrGroupExists is returned when creating a group whose ID is taken
+	ErrGroupExists = errors.New("group already exists")
+	// ErrGroupNotFound is returned when a group has no members
+	ErrGroupNotFound = errors.New("group not found")
+	// ErrNotMember is returned when a user is not a member of the group
+	ErrNotMember = errors.New("not a group member")
+	// ErrPermissionDenied is returned when the actor's role does not allow an operation
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrInvalidRole is returned for roles other than admin or member
+	ErrInvalidRole = errors.New("invalid role")
+)
+
+// Store persists group membership
+type Store interface {
+	// Create creates a group with ownerID as its only member. Open groups
+	// may be joined without being added.
+	Create(ctx context.Context, groupID, ownerID string, open bool) error
+
+	// SetMember adds a member or changes their role. A new member's join
+	// time is recorded; a role change keeps it.
+	SetMember(ctx context.Context, groupID, userID, role string) error
+
+	// RemoveMember removes a member from the group
+	RemoveMember(ctx context.Context, groupID, userID string) error
+
+	// Role returns a member's role, or ErrNotMember
+	Role(ctx context.Context, groupID, userID string) (string, error)
+
+	// JoinedAt returns when a member joined the group, or ErrNotMember
+	JoinedAt(ctx context.Context, groupID, userID string) (time.Time, error)
+
+	// Members returns all members of a group mapped to their roles
+	Members(ctx context.Context, groupID string) (map[string]string, error)
+
+	// SetOpen sets whether users may join the group without being added
+	SetOpen(ctx context.Context, groupID string, open bool) error
+
+	// Open reports whether users may join the group without being added
+	Open(ctx context.Context, groupID string) (bool, error)
+}
+
+// Manager applies role-based rules on top of a Store:
+//   - anyone may create a group
+//   - anyone may join an open group; closed groups (the default) are
+//     joined by being added
+//   - owners may add or remove admins and members
+//   - admins may add or remove members
+//   - owners and admins may open or close the group
+//   - the owner cannot leave or be removed
+type Manager struct {
+	store Store
+}
+
+// NewManager creates a new group manager
+func NewManager(store Store) *Manager {
+	return &Manager{store: store}
+}
+
+// Create creates a group owned by actor
+func (m *Manager) Create(ctx context.Context, actor, groupID string, open bool) error {
+	return m.store.Create(ctx, groupID, actor, open)
+}
+
+// Join adds actor to an existing open group as a member
+func (m *Manager) Join(ctx context.Context, actor, groupID string) error {
+	if _, err := m.store.Role(ctx, groupID, actor); err == nil {
+		return nil
+	} else if !errors.Is(err, ErrNotMember) {
+		return err
+	}
+
+	if _, err := m.Members(ctx, groupID); err != nil {
+		return err
+	}
+
+	open, err := m.store.Open(ctx, groupID)
+	if err != nil {
+		return err
+	}
+	if !open {
+		return fmt.Errorf("group %s is closed: %w", groupID, ErrPermissionDenied)
+	}
+
+	return m.store.SetMember(ctx, groupID, actor, RoleMember)
+}
+
+// SetOpen opens or closes the group on behalf of actor, who must be an owner or admin
+func (m *Manager) SetOpen(ctx context.Context, actor, groupID string, open bool) error {
+	role, err := m.store.Role(ctx, groupID, actor)
+	if err != nil {
+		return err
+	}
+
+	if role != RoleOwner && role != RoleAdmin {
+		return ErrPermissionDenied
+	}
+
+	return m.store.SetOpen(ctx, groupID, open)
+}
+
+// Leave removes actor from the group
+func (m *Manager) Leave(ctx context.Context, actor, groupID string) error {
+	role, err := m.store.Role(ctx, groupID, actor)
+	if err != nil {
+		return err
+	}
+
+	if role == RoleOwner {
+		return fmt.Errorf("owner cannot leave group %s: %w", groupID, ErrPermissionDenied)
+	}
+
+	return m.store.RemoveMember(ctx, groupID, actor)
+}
+
+// Add adds userID to the group with the given role on behalf of actor
+func (m *Manager) Add(ctx context.Context, actor, groupID, userID, role string) error {
+	if role == "" {
+		role = RoleMember
+	}
+	if role != RoleAdmin && role != RoleMember {
+		return ErrInvalidRole
+	}
+
+	actorRole, err := m.store.Role(ctx, groupID, actor)
+	if err != nil {
+		return err
+	}
+
+	current, err := m.store.Role(ctx, groupID, userID)
+	if err != nil && !errors.Is(err, ErrNotMember) {
+		return err
+	}
+
+	if !canManage(actorRole, role) || (current != "" && !canManage(actorRole, current)) {
+		return ErrPermissionDenied
+	}
+
+	return m.store.SetMember(ctx, groupID, userID, role)
+}
+
+// Remove removes userID from the group on behalf of actor
+func (m *Manager) Remove(ctx context.Context, actor, groupID, userID string) error {
+	actorRole, err := m.store.Role(ctx, groupID, actor)
+	if err != nil {
+		return err
+	}
+
+	role, err := m.store.Role(ctx, groupID, userID)
+	if err != nil {
+		return err
+	}
+
+	if !canManage(actorRole, role) {
+		return ErrPermissionDenied
+	}
+
+	return m.store.RemoveMember(ctx, groupID, userID)
+}
+
+// Members returns the members of a group, or ErrGroupNotFound if it has none
+func (m *Manager) Members(ctx context.Context, groupID string) (map[string]string, error) {
+	members, err := m.store.Members(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(members) == 0 {
+		return nil, fmt.Errorf("group %s: %w", groupID, ErrGroupNotFound)
+	}
+
+	return members, nil
+}
+
+// IsMember reports whether userID belongs to the group
+func (m *Manager) IsMember(ctx context.Context, groupID, userID string) (bool, error) {
+	_, err := m.store.Role(ctx, groupID, userID)
+	if errors.Is(err, ErrNotMember) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// JoinedAt returns when userID joined the group, or ErrNotMember
+func (m *Manager) JoinedAt(ctx context.Context, groupID, userID string) (time.Time, error) {
+	return m.store.JoinedAt(ctx, groupID, userID)
+}
+
+// canManage reports whether a member with actorRole may add or remove a member with targetRole
+func canManage(actorRole, targetRole string) bool {
+	switch actorRole {
+	case RoleOwner:
+		return targetRole != RoleOwner
+	case RoleAdmin:
+		return targetRole == RoleMember
+	default:
+		return false
+	}
+}
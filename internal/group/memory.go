@@ -0,0 +1,136 @@
+package group
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps group membership in process memory.
+// Intended for single-process mode and tests.
+type MemoryStore struct {
+	mu     sync.RWMutex
+	groups map[string]map[string]string    // groupID -> userID -> role
+	joined map[string]map[string]time.Time // groupID -> userID -> join time
+	open   map[string]bool                 // Open groups
+}
+
+// NewMemoryStore creates an empty in-memory group store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		groups: make(map[string]map[string]string),
+		joined: make(map[string]map[string]time.Time),
+		open:   make(map[string]bool),
+	}
+}
+
+// Create creates a group with ownerID as owner
+func (s *MemoryStore) Create(ctx context.Context, groupID, ownerID string, open bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.groups[groupID]) > 0 {
+		return fmt.Errorf("group %s: %w", groupID, ErrGroupExists)
+	}
+
+	s.groups[groupID] = map[string]string{ownerID: RoleOwner}
+	s.joined[groupID] = map[string]time.Time{ownerID: time.Now()}
+	s.open[groupID] = open
+	return nil
+}
+
+// SetMember adds a member or changes their role
+func (s *MemoryStore) SetMember(ctx context.Context, groupID, userID, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	members, ok := s.groups[groupID]
+	if !ok {
+		members = make(map[string]string)
+		s.groups[groupID] = members
+		s.joined[groupID] = make(map[string]time.Time)
+	}
+	if _, ok := members[userID]; !ok {
+		s.joined[groupID][userID] = time.Now()
+	}
+	members[userID] = role
+	return nil
+}
+
+// RemoveMember removes a member from the group
+func (s *MemoryStore) RemoveMember(ctx context.Context, groupID, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if members, ok := s.groups[groupID]; ok {
+		delete(members, userID)
+		delete(s.joined[groupID], userID)
+		// Like a Redis hash, a group without members no longer exists
+		if len(members) == 0 {
+			delete(s.groups, groupID)
+			delete(s.joined, groupID)
+			delete(s.open, groupID)
+		}
+	}
+	return nil
+}
+
+// Role returns a member's role
+func (s *MemoryStore) Role(ctx context.Context, groupID, userID string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	role, ok := s.groups[groupID][userID]
+	if !ok {
+		return "", ErrNotMember
+	}
+	return role, nil
+}
+
+// JoinedAt returns when a member joined the group
+func (s *MemoryStore) JoinedAt(ctx context.Context, groupID, userID string) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	at, ok := s.joined[groupID][userID]
+	if !ok {
+		return time.Time{}, ErrNotMember
+	}
+	return at, nil
+}
+
+// Members returns all members of a group mapped to their roles
+func (s *MemoryStore) Members(ctx context.Context, groupID string) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	members := make(map[string]string, len(s.groups[groupID]))
+	for userID, role := range s.groups[groupID] {
+		members[userID] = role
+	}
+	return members, nil
+}
+
+// SetOpen sets whether users may join the group without being added
+func (s *MemoryStore) SetOpen(ctx context.Context, groupID string, open bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.groups[groupID]) == 0 {
+		return fmt.Errorf("group %s: %w", groupID, ErrGroupNotFound)
+	}
+	s.open[groupID] = open
+	return nil
+}
+
+// Open reports whether users may join the group without being added
+func (s *MemoryStore) Open(ctx context.Context, groupID string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.open[groupID], nil
+}
+
+// Ensure MemoryStore implements Store
+var _ Store = (*MemoryStore)(nil)
@@ -0,0 +1,166 @@
+package group
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const groupKeyPrefix = "group:"
+
+// createScript creates the membership hash only if the group does not exist,
+// resetting the join times and open flag left by an earlier group of that ID
+var createScript = redis.NewScript(`
+	if redis.call('EXISTS', KEYS[1]) == 1 then
+		return 0
+	end
+	redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+	redis.call('DEL', KEYS[2])
+	redis.call('HSET', KEYS[2], ARGV[1], ARGV[3])
+	if ARGV[4] == '1' then
+		redis.call('SET', KEYS[3], '1')
+	else
+		redis.call('DEL', KEYS[3])
+	end
+	return 1
+`)
+
+// RedisStore keeps each group's members in a hash group:<groupID>:members
+// (userID -> role), their join times in group:<groupID>:joined (userID -> Unix
+// ms) and the open flag in group:<groupID>:open
+type RedisStore struct {
+	redis *redis.Client
+}
+
+// NewRedisStore creates a new Redis-backed group store
+func NewRedisStore(redisClient *redis.Client) *RedisStore {
+	return &RedisStore{redis: redisClient}
+}
+
+// Create creates a group with ownerID as owner
+func (s *RedisStore) Create(ctx context.Context, groupID, ownerID string, open bool) error {
+	keys := []string{membersKey(groupID), joinedKey(groupID), openKey(groupID)}
+	openArg := "0"
+	if open {
+		openArg = "1"
+	}
+
+	created, err := createScript.Run(ctx, s.redis, keys, ownerID, RoleOwner, time.Now().UnixMilli(), openArg).Int()
+	if err != nil {
+		return fmt.Errorf("failed to create group: %w", err)
+	}
+
+	if created == 0 {
+		return fmt.Errorf("group %s: %w", groupID, ErrGroupExists)
+	}
+
+	return nil
+}
+
+// SetMember adds a member or changes their role
+func (s *RedisStore) SetMember(ctx context.Context, groupID, userID, role string) error {
+	_, err := s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, membersKey(groupID), userID, role)
+		pipe.HSetNX(ctx, joinedKey(groupID), userID, time.Now().UnixMilli())
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set group member: %w", err)
+	}
+	return nil
+}
+
+// RemoveMember removes a member from the group
+func (s *RedisStore) RemoveMember(ctx context.Context, groupID, userID string) error {
+	_, err := s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, membersKey(groupID), userID)
+		pipe.HDel(ctx, joinedKey(groupID), userID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove group member: %w", err)
+	}
+	return nil
+}
+
+// Role returns a member's role
+func (s *RedisStore) Role(ctx context.Context, groupID, userID string) (string, error) {
+	role, err := s.redis.HGet(ctx, membersKey(groupID), userID).Result()
+	if err == redis.Nil {
+		return "", ErrNotMember
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get group role: %w", err)
+	}
+	return role, nil
+}
+
+// JoinedAt returns when a member joined the group
+func (s *RedisStore) JoinedAt(ctx context.Context, groupID, userID string) (time.Time, error) {
+	value, err := s.redis.HGet(ctx, joinedKey(groupID), userID).Result()
+	if err == redis.Nil {
+		return time.Time{}, ErrNotMember
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get group join time: %w", err)
+	}
+
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid join time for %s in group %s: %w", userID, groupID, err)
+	}
+	return time.UnixMilli(ms), nil
+}
+
+// Members returns all members of a group mapped to their roles
+func (s *RedisStore) Members(ctx context.Context, groupID string) (map[string]string, error) {
+	members, err := s.redis.HGetAll(ctx, membersKey(groupID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get group members: %w", err)
+	}
+	return members, nil
+}
+
+// SetOpen sets whether users may join the group without being added
+func (s *RedisStore) SetOpen(ctx context.Context, groupID string, open bool) error {
+	var err error
+	if open {
+		err = s.redis.Set(ctx, openKey(groupID), "1", 0).Err()
+	} else {
+		err = s.redis.Del(ctx, openKey(groupID)).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set group open flag: %w", err)
+	}
+	return nil
+}
+
+// Open reports whether users may join the group without being added
+func (s *RedisStore) Open(ctx context.Context, groupID string) (bool, error) {
+	value, err := s.redis.Get(ctx, openKey(groupID)).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get group open flag: %w", err)
+	}
+	return value == "1", nil
+}
+
+func membersKey(groupID string) string {
+	return groupKeyPrefix + groupID + ":members"
+}
+
+func joinedKey(groupID string) string {
+	return groupKeyPrefix + groupID + ":joined"
+}
+
+func openKey(groupID string) string {
+	return groupKeyPrefix + groupID + ":open"
+}
+
+// Ensure RedisStore implements Store
+var _ Store = (*RedisStore)(nil)
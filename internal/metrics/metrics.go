@@ -0,0 +1,46 @@
+// Package metrics creates the Prometheus metrics exported by gateways,
+// routers and presence managers. Metrics are registered with the default
+// client_golang registry and served, together with the Go runtime and
+// process collectors, by Handler.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefaultLatencyBuckets suit in-cluster operations from sub-millisecond to seconds
+var DefaultLatencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// NewCounterVec creates and registers a counter family
+func NewCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	return promauto.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+}
+
+// NewGaugeVec creates and registers a gauge family
+func NewGaugeVec(name, help string, labels ...string) *prometheus.GaugeVec {
+	return promauto.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+}
+
+// NewHistogramVec creates and registers a histogram family; nil buckets
+// default to DefaultLatencyBuckets
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *prometheus.HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	return promauto.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels)
+}
+
+// ObserveSince records the seconds elapsed since start
+func ObserveSince(o prometheus.Observer, start time.Time) {
+	o.Observe(time.Since(start).Seconds())
+}
+
+// Handler serves the default registry for Prometheus scrapes
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerExposesRegisteredMetrics(t *testing.T) {
+	counter := NewCounterVec("test_frames_total", "Frames by kind.", "kind")
+	counter.WithLabelValues(`quote"and\slash`).Add(2)
+
+	histogram := NewHistogramVec("test_latency_seconds", "Latency.", nil, "op")
+	histogram.WithLabelValues("get").Observe(0.003)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	text := string(body)
+
+	for _, want := range []string{
+		`test_frames_total{kind="quote\"and\\slash"} 2`,
+		`test_latency_seconds_bucket{op="get",le="0.0025"} 0`,
+		`test_latency_seconds_bucket{op="get",le="0.005"} 1`,
+		`test_latency_seconds_bucket{op="get",le="+Inf"} 1`,
+		`test_latency_seconds_count{op="get"} 1`,
+		"go_goroutines ",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("exposition lacks %q", want)
+		}
+	}
+	if got := strings.Count(text, `test_latency_seconds_bucket{op="get"`); got != len(DefaultLatencyBuckets)+1 {
+		t.Errorf("%d histogram buckets, want the %d defaults and +Inf", got, len(DefaultLatencyBuckets))
+	}
+}
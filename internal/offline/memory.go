@@ -0,0 +1,115 @@
+package offline
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"websocket-demo/internal/router"
+)
+
+// memoryQueue is one recipient's queued messages
+type memoryQueue struct {
+	messages []*router.Message
+	expires  time.Time
+}
+
+// MemoryStore keeps offline messages in process memory, applying the same
+// cap and TTL as RedisStore. Intended for single-process mode and tests.
+type MemoryStore struct {
+	mu     sync.Mutex
+	config Config
+	queues map[string]*memoryQueue
+}
+
+// NewMemoryStore creates an empty in-memory offline store
+func NewMemoryStore(config Config) *MemoryStore {
+	return &MemoryStore{
+		config: config,
+		queues: make(map[string]*memoryQueue),
+	}
+}
+
+// Push appends a message to the recipient's queue, dropping the oldest beyond the cap
+func (s *MemoryStore) Push(ctx context.Context, userID string, msg *router.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queue := s.queue(userID)
+	if queue == nil {
+		queue = &memoryQueue{}
+		s.queues[userID] = queue
+	}
+
+	copied := *msg
+	queue.messages = append(queue.messages, &copied)
+	if s.config.MaxPerUser > 0 && int64(len(queue.messages)) > s.config.MaxPerUser {
+		queue.messages = queue.messages[int64(len(queue.messages))-s.config.MaxPerUser:]
+	}
+	if s.config.TTL > 0 {
+		queue.expires = time.Now().Add(s.config.TTL)
+	}
+
+	return nil
+}
+
+// Drain returns the queued messages in arrival order and clears the queue
+func (s *MemoryStore) Drain(ctx context.Context, userID string) ([]*router.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queue := s.queue(userID)
+	delete(s.queues, userID)
+
+	if queue == nil {
+		return []*router.Message{}, nil
+	}
+	return queue.messages, nil
+}
+
+// Requeue puts messages back at the front of the queue, keeping the newest within the cap
+func (s *MemoryStore) Requeue(ctx context.Context, userID string, msgs []*router.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queue := s.queue(userID)
+	if queue == nil {
+		queue = &memoryQueue{}
+		s.queues[userID] = queue
+	}
+
+	messages := make([]*router.Message, 0, len(msgs)+len(queue.messages))
+	for _, msg := range msgs {
+		copied := *msg
+		messages = append(messages, &copied)
+	}
+	queue.messages = append(messages, queue.messages...)
+	if s.config.MaxPerUser > 0 && int64(len(queue.messages)) > s.config.MaxPerUser {
+		queue.messages = queue.messages[int64(len(queue.messages))-s.config.MaxPerUser:]
+	}
+	if s.config.TTL > 0 {
+		queue.expires = time.Now().Add(s.config.TTL)
+	}
+
+	return nil
+}
+
+// queue returns a user's unexpired queue, discarding it if expired
+func (s *MemoryStore) queue(userID string) *memoryQueue {
+	queue, ok := s.queues[userID]
+	if !ok {
+		return nil
+	}
+	if !queue.expires.IsZero() && time.Now().After(queue.expires) {
+		delete(s.queues, userID)
+		return nil
+	}
+	return queue
+}
+
+// Ensure MemoryStore implements Store
+var _ Store = (*MemoryStore)(nil)
@@ -0,0 +1,35 @@
+package offline
+
+import (
+	"context"
+	"time"
+
+	"websocket-demo/internal/router"
+)
+
+// Config controls how many messages are kept per user and for how long
+type Config struct {
+	MaxPerUser int64         // Oldest messages are dropped beyond this cap
+	TTL        time.Duration // Queue expires this long after the last push
+}
+
+// DefaultConfig returns the default offline queue settings
+func DefaultConfig() Config {
+	return Config{
+		MaxPerUser: 1000,
+		TTL:        7 * 24 * time.Hour,
+	}
+}
+
+// Store queues messages for recipients that are offline
+type Store interface {
+	// Push appends a message to the recipient's queue
+	Push(ctx context.Context, userID string, msg *router.Message) error
+
+	// Drain returns all queued messages for a user in order and clears the queue
+	Drain(ctx context.Context, userID string) ([]*router.Message, error)
+
+	// Requeue puts drained messages that could not be delivered back at the
+	// front of the recipient's queue, in order
+	Requeue(ctx context.Context, userID string, msgs []*router.Message) error
+}
@@ -0,0 +1,120 @@
+package offline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"websocket-demo/internal/router"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const offlineKeyPrefix = "offline:"
+
+// drainScript reads and deletes a queue atomically so concurrent
+// registrations of the same user never receive a message twice
+var drainScript = redis.NewScript(`
+	local items = redis.call('LRANGE', KEYS[1], 0, -1)
+	redis.call('DEL', KEYS[1])
+	return items
+`)
+
+// RedisStore keeps offline messages in a Redis list per recipient
+type RedisStore struct {
+	redis  *redis.Client
+	config Config
+}
+
+// NewRedisStore creates a new Redis-backed offline store
+func NewRedisStore(redisClient *redis.Client, config Config) *RedisStore {
+	return &RedisStore{
+		redis:  redisClient,
+		config: config,
+	}
+}
+
+// Push appends a message to the recipient's list, trimming it to the cap
+func (s *RedisStore) Push(ctx context.Context, userID string, msg *router.Message) error {
+	key := offlineKeyPrefix + userID
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	pipe := s.redis.TxPipeline()
+	pipe.RPush(ctx, key, data)
+	if s.config.MaxPerUser > 0 {
+		pipe.LTrim(ctx, key, -s.config.MaxPerUser, -1)
+	}
+	if s.config.TTL > 0 {
+		pipe.Expire(ctx, key, s.config.TTL)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to queue offline message: %w", err)
+	}
+
+	return nil
+}
+
+// Drain returns the queued messages in arrival order and clears the list
+func (s *RedisStore) Drain(ctx context.Context, userID string) ([]*router.Message, error) {
+	key := offlineKeyPrefix + userID
+
+	items, err := drainScript.Run(ctx, s.redis, []string{key}).StringSlice()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to drain offline messages: %w", err)
+	}
+
+	messages := make([]*router.Message, 0, len(items))
+	for _, item := range items {
+		var msg router.Message
+		if err := json.Unmarshal([]byte(item), &msg); err != nil {
+			log.Printf("[Offline] Failed to unmarshal queued message: %v", err)
+			continue
+		}
+		messages = append(messages, &msg)
+	}
+
+	return messages, nil
+}
+
+// Requeue pushes messages back onto the head of the list, keeping their order
+func (s *RedisStore) Requeue(ctx context.Context, userID string, msgs []*router.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	key := offlineKeyPrefix + userID
+
+	// LPUSH prepends one value at a time, so push the last message first
+	values := make([]interface{}, 0, len(msgs))
+	for i := len(msgs) - 1; i >= 0; i-- {
+		data, err := json.Marshal(msgs[i])
+		if err != nil {
+			return fmt.Errorf("failed to marshal message: %w", err)
+		}
+		values = append(values, data)
+	}
+
+	pipe := s.redis.TxPipeline()
+	pipe.LPush(ctx, key, values...)
+	if s.config.MaxPerUser > 0 {
+		pipe.LTrim(ctx, key, -s.config.MaxPerUser, -1)
+	}
+	if s.config.TTL > 0 {
+		pipe.Expire(ctx, key, s.config.TTL)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to requeue offline messages: %w", err)
+	}
+
+	return nil
+}
+
+// Ensure RedisStore implements Store
+var _ Store = (*RedisStore)(nil)
@@ -0,0 +1,133 @@
+package policy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCacheTTL bounds how long a rule change takes to apply on every gateway
+	DefaultCacheTTL = 10 * time.Second
+
+	// maxCacheEntries caps the cache; it is emptied when full
+	maxCacheEntries = 100000
+)
+
+// Cached remembers another policy's decisions for a TTL. Errors are not
+// cached. Changes made through Cached's Manager methods apply locally at
+// once; other gateways see them once their entries expire.
+type Cached struct {
+	policy Policy
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	entries map[cacheKey]cacheEntry
+}
+
+type cacheKey struct {
+	from, to string
+}
+
+type cacheEntry struct {
+	decision Decision
+	expires  time.Time
+}
+
+// NewCached wraps policy with a decision cache
+func NewCached(policy Policy, ttl time.Duration) *Cached {
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+
+	return &Cached{
+		policy:  policy,
+		ttl:     ttl,
+		entries: make(map[cacheKey]cacheEntry),
+	}
+}
+
+// CanMessage returns a cached decision, asking the wrapped policy on a miss
+func (c *Cached) CanMessage(ctx context.Context, from, to string) (Decision, error) {
+	key := cacheKey{from: from, to: to}
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.decision, nil
+	}
+
+	decision, err := c.policy.CanMessage(ctx, from, to)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	c.mu.Lock()
+	if len(c.entries) >= maxCacheEntries {
+		c.entries = make(map[cacheKey]cacheEntry)
+	}
+	c.entries[key] = cacheEntry{decision: decision, expires: now.Add(c.ttl)}
+	c.mu.Unlock()
+
+	return decision, nil
+}
+
+// Invalidate drops every cached decision involving userID
+func (c *Cached) Invalidate(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.entries {
+		if key.from == userID || key.to == userID {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Block adds target to userID's block list
+func (c *Cached) Block(ctx context.Context, userID, target string) error {
+	return c.update(func(m Manager) error { return m.Block(ctx, userID, target) }, userID, target)
+}
+
+// Unblock removes target from userID's block list
+func (c *Cached) Unblock(ctx context.Context, userID, target string) error {
+	return c.update(func(m Manager) error { return m.Unblock(ctx, userID, target) }, userID, target)
+}
+
+// AddContact adds contact to userID's contacts
+func (c *Cached) AddContact(ctx context.Context, userID, contact string) error {
+	return c.update(func(m Manager) error { return m.AddContact(ctx, userID, contact) }, userID, contact)
+}
+
+// RemoveContact removes contact from userID's contacts
+func (c *Cached) RemoveContact(ctx context.Context, userID, contact string) error {
+	return c.update(func(m Manager) error { return m.RemoveContact(ctx, userID, contact) }, userID, contact)
+}
+
+// SetRules replaces userID's tenant and contacts-only mode
+func (c *Cached) SetRules(ctx context.Context, userID string, rules Rules) error {
+	return c.update(func(m Manager) error { return m.SetRules(ctx, userID, rules) }, userID)
+}
+
+// update applies a change to the wrapped policy and drops the cached
+// decisions of the users it affects
+func (c *Cached) update(change func(Manager) error, userIDs ...string) error {
+	m, ok := c.policy.(Manager)
+	if !ok {
+		return ErrReadOnly
+	}
+
+	err := change(m)
+	for _, userID := range userIDs {
+		c.Invalidate(userID)
+	}
+	return err
+}
+
+// Ensure Cached implements Policy and Manager
+var (
+	_ Policy  = (*Cached)(nil)
+	_ Manager = (*Cached)(nil)
+)
@@ -0,0 +1,93 @@
+package policy
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryPolicy applies the built-in rules to state kept in process memory.
+// Intended for single-process mode and tests.
+type MemoryPolicy struct {
+	mu       sync.RWMutex
+	blocked  map[string]map[string]bool // userID -> blocked user IDs
+	contacts map[string]map[string]bool // userID -> contact user IDs
+	rules    map[string]Rules
+}
+
+// NewMemoryPolicy creates a policy that allows everything until rules are added
+func NewMemoryPolicy() *MemoryPolicy {
+	return &MemoryPolicy{
+		blocked:  make(map[string]map[string]bool),
+		contacts: make(map[string]map[string]bool),
+		rules:    make(map[string]Rules),
+	}
+}
+
+// CanMessage applies the built-in rules
+func (p *MemoryPolicy) CanMessage(ctx context.Context, from, to string) (Decision, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return evaluate(p.blocked[from][to], p.blocked[to][from], p.contacts[to][from],
+		p.rules[from], p.rules[to]), nil
+}
+
+// Block adds target to userID's block list
+func (p *MemoryPolicy) Block(ctx context.Context, userID, target string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	addToSet(p.blocked, userID, target)
+	return nil
+}
+
+// Unblock removes target from userID's block list
+func (p *MemoryPolicy) Unblock(ctx context.Context, userID, target string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.blocked[userID], target)
+	return nil
+}
+
+// AddContact adds contact to userID's contacts
+func (p *MemoryPolicy) AddContact(ctx context.Context, userID, contact string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	addToSet(p.contacts, userID, contact)
+	return nil
+}
+
+// RemoveContact removes contact from userID's contacts
+func (p *MemoryPolicy) RemoveContact(ctx context.Context, userID, contact string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.contacts[userID], contact)
+	return nil
+}
+
+// SetRules replaces userID's tenant and contacts-only mode
+func (p *MemoryPolicy) SetRules(ctx context.Context, userID string, rules Rules) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.rules[userID] = rules
+	return nil
+}
+
+func addToSet(sets map[string]map[string]bool, key, member string) {
+	set, ok := sets[key]
+	if !ok {
+		set = make(map[string]bool)
+		sets[key] = set
+	}
+	set[member] = true
+}
+
+// Ensure MemoryPolicy implements Policy and Manager
+var (
+	_ Policy  = (*MemoryPolicy)(nil)
+	_ Manager = (*MemoryPolicy)(nil)
+)
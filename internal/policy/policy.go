@@ -0,0 +1,74 @@
+package policy
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrDenied is wrapped by callers that refuse a message because of a policy decision
+var ErrDenied = errors.New("not allowed to message this user")
+
+// ErrReadOnly is returned when changing the state of a policy that is not a Manager
+var ErrReadOnly = errors.New("policy does not support changes")
+
+// Reasons a message is denied, carried in Decision.Reason
+const (
+	ReasonBlocked      = "blocked"       // One user blocked the other
+	ReasonContactsOnly = "contacts_only" // Recipient only accepts messages from contacts
+	ReasonTenant       = "tenant"        // Sender and recipient belong to different tenants
+)
+
+// Decision is the outcome of an authorization check
+type Decision struct {
+	Allowed bool
+	Reason  string // Why the message was denied; empty when allowed
+}
+
+// Allow is the decision for permitted messages
+var Allow = Decision{Allowed: true}
+
+// Deny returns a denial for reason
+func Deny(reason string) Decision {
+	return Decision{Reason: reason}
+}
+
+// Policy decides who may message whom. The gateway consults it before
+// routing a direct message or signal; an error fails the send.
+type Policy interface {
+	// CanMessage reports whether from may send a message to to
+	CanMessage(ctx context.Context, from, to string) (Decision, error)
+}
+
+// Manager changes the state read by the built-in policies. MemoryPolicy and
+// RedisPolicy implement it; Cached forwards changes to the policy it wraps.
+type Manager interface {
+	Block(ctx context.Context, userID, target string) error
+	Unblock(ctx context.Context, userID, target string) error
+	AddContact(ctx context.Context, userID, contact string) error
+	RemoveContact(ctx context.Context, userID, contact string) error
+	SetRules(ctx context.Context, userID string, rules Rules) error
+}
+
+// Rules holds the policy state of one user, as used by the built-in policies:
+//   - either user blocking the other denies messages both ways
+//   - a ContactsOnly recipient accepts messages only from their contacts
+//   - users of different tenants cannot message each other; users without
+//     a tenant form their own tenant
+type Rules struct {
+	Tenant       string
+	ContactsOnly bool
+}
+
+// evaluate applies the built-in rules
+func evaluate(senderBlocked, recipientBlocked, isContact bool, sender, recipient Rules) Decision {
+	if senderBlocked || recipientBlocked {
+		return Deny(ReasonBlocked)
+	}
+	if sender.Tenant != recipient.Tenant {
+		return Deny(ReasonTenant)
+	}
+	if recipient.ContactsOnly && !isContact {
+		return Deny(ReasonContactsOnly)
+	}
+	return Allow
+}
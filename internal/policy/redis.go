@@ -0,0 +1,107 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	blockedKeyPrefix  = "policy:blocked:"  // Set of users a user blocked
+	contactsKeyPrefix = "policy:contacts:" // Set of a user's contacts
+	rulesKeyPrefix    = "policy:rules:"    // Hash: tenant, contactsOnly
+)
+
+// RedisPolicy applies the built-in rules to state kept in Redis:
+//   - policy:blocked:<userID>  set of blocked user IDs
+//   - policy:contacts:<userID> set of contact user IDs
+//   - policy:rules:<userID>    hash with "tenant" and "contactsOnly" ("1")
+type RedisPolicy struct {
+	redis *redis.Client
+}
+
+// NewRedisPolicy creates a new Redis-backed policy
+func NewRedisPolicy(redisClient *redis.Client) *RedisPolicy {
+	return &RedisPolicy{redis: redisClient}
+}
+
+// CanMessage reads both users' state in one round trip
+func (p *RedisPolicy) CanMessage(ctx context.Context, from, to string) (Decision, error) {
+	pipe := p.redis.Pipeline()
+	senderBlocked := pipe.SIsMember(ctx, blockedKeyPrefix+from, to)
+	recipientBlocked := pipe.SIsMember(ctx, blockedKeyPrefix+to, from)
+	isContact := pipe.SIsMember(ctx, contactsKeyPrefix+to, from)
+	senderRules := pipe.HMGet(ctx, rulesKeyPrefix+from, "tenant", "contactsOnly")
+	recipientRules := pipe.HMGet(ctx, rulesKeyPrefix+to, "tenant", "contactsOnly")
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Decision{}, fmt.Errorf("failed to load policy for %s -> %s: %w", from, to, err)
+	}
+
+	return evaluate(senderBlocked.Val(), recipientBlocked.Val(), isContact.Val(),
+		parseRules(senderRules.Val()), parseRules(recipientRules.Val())), nil
+}
+
+// Block adds target to userID's block list
+func (p *RedisPolicy) Block(ctx context.Context, userID, target string) error {
+	if err := p.redis.SAdd(ctx, blockedKeyPrefix+userID, target).Err(); err != nil {
+		return fmt.Errorf("failed to block user: %w", err)
+	}
+	return nil
+}
+
+// Unblock removes target from userID's block list
+func (p *RedisPolicy) Unblock(ctx context.Context, userID, target string) error {
+	if err := p.redis.SRem(ctx, blockedKeyPrefix+userID, target).Err(); err != nil {
+		return fmt.Errorf("failed to unblock user: %w", err)
+	}
+	return nil
+}
+
+// AddContact adds contact to userID's contacts
+func (p *RedisPolicy) AddContact(ctx context.Context, userID, contact string) error {
+	if err := p.redis.SAdd(ctx, contactsKeyPrefix+userID, contact).Err(); err != nil {
+		return fmt.Errorf("failed to add contact: %w", err)
+	}
+	return nil
+}
+
+// RemoveContact removes contact from userID's contacts
+func (p *RedisPolicy) RemoveContact(ctx context.Context, userID, contact string) error {
+	if err := p.redis.SRem(ctx, contactsKeyPrefix+userID, contact).Err(); err != nil {
+		return fmt.Errorf("failed to remove contact: %w", err)
+	}
+	return nil
+}
+
+// SetRules replaces userID's tenant and contacts-only mode
+func (p *RedisPolicy) SetRules(ctx context.Context, userID string, rules Rules) error {
+	contactsOnly := "0"
+	if rules.ContactsOnly {
+		contactsOnly = "1"
+	}
+
+	err := p.redis.HSet(ctx, rulesKeyPrefix+userID, "tenant", rules.Tenant, "contactsOnly", contactsOnly).Err()
+	if err != nil {
+		return fmt.Errorf("failed to set policy rules: %w", err)
+	}
+	return nil
+}
+
+// parseRules decodes an HMGET of tenant and contactsOnly
+func parseRules(values []interface{}) Rules {
+	var rules Rules
+	if len(values) == 2 {
+		rules.Tenant, _ = values[0].(string)
+		contactsOnly, _ := values[1].(string)
+		rules.ContactsOnly = contactsOnly == "1"
+	}
+	return rules
+}
+
+// Ensure RedisPolicy implements Policy and Manager
+var (
+	_ Policy  = (*RedisPolicy)(nil)
+	_ Manager = (*RedisPolicy)(nil)
+)
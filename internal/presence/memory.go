@@ -0,0 +1,201 @@
+package presence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryManager keeps presence in process memory. Gateways running in the
+// same process can share one MemoryManager, e.g. in single-process mode or tests.
+type MemoryManager struct {
+	mu    sync.RWMutex
+	users map[string]map[string]session // userID -> deviceID -> session
+}
+
+// NewMemoryManager creates an empty in-memory presence manager
+func NewMemoryManager() *MemoryManager {
+	return &MemoryManager{
+		users: make(map[string]map[string]session),
+	}
+}
+
+// Register records a device session, rejecting updates older than the current one
+func (m *MemoryManager) Register(ctx context.Context, userID, deviceID, gatewayID, connID string) error {
+	timestamp := time.Now().UnixMilli()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	devices, ok := m.users[userID]
+	if !ok {
+		devices = make(map[string]session)
+		m.users[userID] = devices
+	}
+
+	if current, ok := devices[deviceID]; ok && current.Timestamp > timestamp {
+		return fmt.Errorf("stale update rejected for user %s device %s: %w", userID, deviceID, ErrNotOwner)
+	}
+
+	devices[deviceID] = session{
+		GatewayID: gatewayID,
+		ConnID:    connID,
+		Timestamp: timestamp,
+	}
+
+	return nil
+}
+
+// Refresh updates a device session's timestamp (heartbeat), only while
+// gatewayID and connID still own the session
+func (m *MemoryManager) Refresh(ctx context.Context, userID, deviceID, gatewayID, connID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.users[userID][deviceID]
+	if !ok || s.Timestamp < time.Now().Add(-presenceTTL).UnixMilli() {
+		return fmt.Errorf("refresh of user %s device %s: %w", userID, deviceID, ErrNoSession)
+	}
+	if s.GatewayID != gatewayID || s.ConnID != connID {
+		return fmt.Errorf("refresh of user %s device %s: %w", userID, deviceID, ErrNotOwner)
+	}
+
+	s.Timestamp = time.Now().UnixMilli()
+	m.users[userID][deviceID] = s
+
+	return nil
+}
+
+// Sessions returns all of a user's live sessions, most recent first
+func (m *MemoryManager) Sessions(ctx context.Context, userID string) ([]*Info, error) {
+	cutoff := time.Now().Add(-presenceTTL).UnixMilli()
+
+	m.mu.RLock()
+	sessions := make([]*Info, 0, len(m.users[userID]))
+	for deviceID, s := range m.users[userID] {
+		if s.Timestamp < cutoff {
+			continue
+		}
+		sessions = append(sessions, &Info{
+			UserID:    userID,
+			DeviceID:  deviceID,
+			GatewayID: s.GatewayID,
+			ConnID:    s.ConnID,
+			Timestamp: s.Timestamp,
+		})
+	}
+	m.mu.RUnlock()
+
+	if len(sessions) == 0 {
+		return nil, fmt.Errorf("user %s: %w", userID, ErrUserOffline)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Timestamp > sessions[j].Timestamp
+	})
+
+	return sessions, nil
+}
+
+// Get retrieves a user's most recent session
+func (m *MemoryManager) Get(ctx context.Context, userID string) (*Info, error) {
+	sessions, err := m.Sessions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions[0], nil
+}
+
+// Remove deletes a device session (on disconnect), only if gatewayID and connID own it
+func (m *MemoryManager) Remove(ctx context.Context, userID, deviceID, gatewayID, connID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	devices := m.users[userID]
+	s, ok := devices[deviceID]
+	if !ok || s.GatewayID != gatewayID || s.ConnID != connID {
+		return fmt.Errorf("remove of user %s device %s: %w", userID, deviceID, ErrNotOwner)
+	}
+
+	delete(devices, deviceID)
+	if len(devices) == 0 {
+		delete(m.users, userID)
+	}
+
+	return nil
+}
+
+// RemoveGateway deletes the sessions a dead gateway registered before the given time
+func (m *MemoryManager) RemoveGateway(ctx context.Context, gatewayID string, before time.Time) (int, error) {
+	cutoff := before.UnixMilli()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	removed := 0
+	for userID, devices := range m.users {
+		for deviceID, s := range devices {
+			if s.GatewayID == gatewayID && s.Timestamp < cutoff {
+				delete(devices, deviceID)
+				removed++
+			}
+		}
+		if len(devices) == 0 {
+			delete(m.users, userID)
+		}
+	}
+
+	return removed, nil
+}
+
+// PruneGateway deletes the gateway's sessions that expired without a heartbeat
+func (m *MemoryManager) PruneGateway(ctx context.Context, gatewayID string) (int, error) {
+	cutoff := time.Now().Add(-presenceTTL).UnixMilli()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pruned := 0
+	for userID, devices := range m.users {
+		expired, remaining := 0, false
+		for deviceID, s := range devices {
+			if s.GatewayID != gatewayID {
+				continue
+			}
+			if s.Timestamp < cutoff {
+				delete(devices, deviceID)
+				expired++
+			} else {
+				remaining = true
+			}
+		}
+		if expired > 0 && !remaining {
+			pruned++
+		}
+		if len(devices) == 0 {
+			delete(m.users, userID)
+		}
+	}
+
+	return pruned, nil
+}
+
+// IsOnline checks if a user has at least one live session
+func (m *MemoryManager) IsOnline(ctx context.Context, userID string) (bool, error) {
+	_, err := m.Sessions(ctx, userID)
+	if errors.Is(err, ErrUserOffline) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Ensure MemoryManager implements Manager
+var _ Manager = (*MemoryManager)(nil)
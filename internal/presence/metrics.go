@@ -0,0 +1,24 @@
+package presence
+
+import (
+	"errors"
+	"time"
+
+	"websocket-demo/internal/metrics"
+)
+
+var (
+	opDuration = metrics.NewHistogramVec("presence_operation_duration_seconds",
+		"Latency of presence operations against Redis, by operation.", nil, "op")
+	opErrors = metrics.NewCounterVec("presence_operation_errors_total",
+		"Failed presence operations, by operation.", "op")
+)
+
+// observe records an operation's latency and counts it as failed unless
+// it succeeded, found the user offline or lost ownership of the session
+func observe(op string, start time.Time, err error) {
+	metrics.ObserveSince(opDuration.WithLabelValues(op), start)
+	if err != nil && !errors.Is(err, ErrUserOffline) && !errors.Is(err, ErrNotOwner) {
+		opErrors.WithLabelValues(op).Inc()
+	}
+}
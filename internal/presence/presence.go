@@ -2,140 +2,77 @@ package presence
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"time"
-
-	"github.com/redis/go-redis/v9"
 )
 
-const (
-	presenceKeyPrefix = "presence:"
-	presenceTTL       = 90 * time.Second // 3x heartbeat interval
-)
+// presenceTTL is how long a session stays live without a heartbeat (3x heartbeat interval)
+const presenceTTL = 90 * time.Second
+
+// ErrUserOffline is returned by Get when the user has no presence record
+var ErrUserOffline = errors.New("user is offline")
+
+// ErrNotOwner is returned when a device's presence record belongs to another
+// connection, e.g. after the device reconnected on another gateway
+var ErrNotOwner = errors.New("presence owned by another connection")
+
+// ErrNoSession is returned by Refresh when a device has no presence record,
+// e.g. after its gateway's sessions were reaped or the record expired
+var ErrNoSession = errors.New("no presence session")
 
-// Info represents a user's presence information
+// Info represents one of a user's live sessions
 type Info struct {
 	UserID    string
+	DeviceID  string
 	GatewayID string
 	ConnID    string
-	Timestamp int64
-}
-
-// Manager handles user presence using Redis
-type Manager struct {
-	redis *redis.Client
-}
-
-// NewManager creates a new presence manager
-func NewManager(redisClient *redis.Client) *Manager {
-	return &Manager{
-		redis: redisClient,
-	}
+	Timestamp int64 // Unix milliseconds of registration or the last heartbeat
 }
 
-// Register registers a user's presence with CAS (Compare-And-Set) to handle race conditions
-func (m *Manager) Register(ctx context.Context, userID, gatewayID, connID string) error {
-	key := presenceKeyPrefix + userID
-	timestamp := time.Now().Unix()
+// Manager tracks which gateway and connection hold each of a user's device sessions
+type Manager interface {
+	// Register records a device session, rejecting updates older than the
+	// current one with ErrNotOwner
+	Register(ctx context.Context, userID, deviceID, gatewayID, connID string) error
 
-	// Lua script to ensure atomic update with timestamp check
-	script := `
-		local key = KEYS[1]
-		local new_gw = ARGV[1]
-		local new_conn = ARGV[2]
-		local new_ts = tonumber(ARGV[3])
-		local ttl = tonumber(ARGV[4])
+	// Refresh updates a device session's timestamp (heartbeat). It returns
+	// ErrNoSession if the device has no session and ErrNotOwner unless
+	// gatewayID and connID own it.
+	Refresh(ctx context.Context, userID, deviceID, gatewayID, connID string) error
 
-		local current_ts = redis.call('HGET', key, 'ts')
+	// Sessions returns all of a user's live sessions, most recent first,
+	// or ErrUserOffline if there are none
+	Sessions(ctx context.Context, userID string) ([]*Info, error)
 
-		-- Only update if this is newer than existing record
-		if current_ts and tonumber(current_ts) > new_ts then
-			return 0
-		end
+	// Get returns a user's most recent session
+	Get(ctx context.Context, userID string) (*Info, error)
 
-		redis.call('HSET', key, 'gwId', new_gw, 'connId', new_conn, 'ts', new_ts)
-		redis.call('EXPIRE', key, ttl)
-		return 1
-	`
+	// Remove deletes a device session (on disconnect). It returns ErrNotOwner,
+	// leaving the session in place, unless gatewayID and connID own it.
+	Remove(ctx context.Context, userID, deviceID, gatewayID, connID string) error
 
-	result, err := m.redis.Eval(ctx, script, []string{key},
-		gatewayID, connID, timestamp, int(presenceTTL.Seconds())).Result()
+	// IsOnline reports whether a user has at least one live session
+	IsOnline(ctx context.Context, userID string) (bool, error)
 
-	if err != nil {
-		return fmt.Errorf("failed to register presence: %w", err)
-	}
+	// RemoveGateway deletes the sessions a dead gateway registered before the
+	// given time and returns how many were removed
+	RemoveGateway(ctx context.Context, gatewayID string, before time.Time) (int, error)
 
-	if result.(int64) == 0 {
-		return fmt.Errorf("stale update rejected for user %s", userID)
-	}
-
-	return nil
+	// PruneGateway deletes a live gateway's sessions that expired without a
+	// heartbeat and drops their users from the gateway's index, returning
+	// how many users were dropped
+	PruneGateway(ctx context.Context, gatewayID string) (int, error)
 }
 
-// Refresh updates the TTL for a user's presence (heartbeat)
-func (m *Manager) Refresh(ctx context.Context, userID string) error {
-	key := presenceKeyPrefix + userID
-
-	// Update timestamp and refresh TTL
-	timestamp := time.Now().Unix()
-	pipe := m.redis.Pipeline()
-	pipe.HSet(ctx, key, "ts", timestamp)
-	pipe.Expire(ctx, key, presenceTTL)
-
-	_, err := pipe.Exec(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to refresh presence: %w", err)
+// GatewayIDs returns the distinct gateways holding the given sessions
+func GatewayIDs(sessions []*Info) []string {
+	seen := make(map[string]bool, len(sessions))
+	var ids []string
+	for _, s := range sessions {
+		if !seen[s.GatewayID] {
+			seen[s.GatewayID] = true
+			ids = append(ids, s.GatewayID)
+		}
 	}
-
-	return nil
-}
-
-// Get retrieves a user's presence information
-func (m *Manager) Get(ctx context.Context, userID string) (*Info, error) {
-	key := presenceKeyPrefix + userID
-
-	result, err := m.redis.HGetAll(ctx, key).Result()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get presence: %w", err)
-	}
-
-	if len(result) == 0 {
-		return nil, fmt.Errorf("user %s is offline", userID)
-	}
-
-	timestamp := int64(0)
-	if ts, ok := result["ts"]; ok {
-		fmt.Sscanf(ts, "%d", &timestamp)
-	}
-
-	return &Info{
-		UserID:    userID,
-		GatewayID: result["gwId"],
-		ConnID:    result["connId"],
-		Timestamp: timestamp,
-	}, nil
-}
-
-// Remove deletes a user's presence (on disconnect)
-func (m *Manager) Remove(ctx context.Context, userID string) error {
-	key := presenceKeyPrefix + userID
-
-	err := m.redis.Del(ctx, key).Err()
-	if err != nil {
-		return fmt.Errorf("failed to remove presence: %w", err)
-	}
-
-	return nil
-}
-
-// IsOnline checks if a user is currently online
-func (m *Manager) IsOnline(ctx context.Context, userID string) (bool, error) {
-	key := presenceKeyPrefix + userID
-
-	exists, err := m.redis.Exists(ctx, key).Result()
-	if err != nil {
-		return false, fmt.Errorf("failed to check presence: %w", err)
-	}
-
-	return exists > 0, nil
+	return ids
 }
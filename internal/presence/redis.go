@@ -0,0 +1,365 @@
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	presenceKeyPrefix = "presence:"
+
+	// gatewayIndexPrefix keys a set of the users with sessions on a gateway,
+	// so a dead gateway's sessions can be found without scanning every user
+	gatewayIndexPrefix = "presence-gateway:"
+)
+
+// session is the value stored per device in the presence hash
+type session struct {
+	GatewayID string `json:"gwId"`
+	ConnID    string `json:"connId"`
+	Timestamp int64  `json:"ts"`
+}
+
+// RedisManager handles user presence using Redis.
+// Each user has a hash presence:<userID> with one field per device.
+type RedisManager struct {
+	redis *redis.Client
+}
+
+// NewRedisManager creates a new Redis-backed presence manager
+func NewRedisManager(redisClient *redis.Client) *RedisManager {
+	return &RedisManager{
+		redis: redisClient,
+	}
+}
+
+// Register registers a device session with CAS (Compare-And-Set) to handle race conditions
+func (m *RedisManager) Register(ctx context.Context, userID, deviceID, gatewayID, connID string) (err error) {
+	defer func(start time.Time) { observe("register", start, err) }(time.Now())
+
+	key := presenceKeyPrefix + userID
+	// Milliseconds, so reconnects within the same second are ordered
+	timestamp := time.Now().UnixMilli()
+
+	value, err := json.Marshal(session{
+		GatewayID: gatewayID,
+		ConnID:    connID,
+		Timestamp: timestamp,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal presence: %w", err)
+	}
+
+	// Lua script to ensure atomic update with timestamp check
+	script := `
+		local key = KEYS[1]
+		local device = ARGV[1]
+		local new_value = ARGV[2]
+		local new_ts = tonumber(ARGV[3])
+		local ttl = tonumber(ARGV[4])
+
+		local current = redis.call('HGET', key, device)
+
+		-- Only update if this is newer than the device's existing session
+		if current then
+			local current_ts = cjson.decode(current)['ts']
+			if current_ts and tonumber(current_ts) > new_ts then
+				return 0
+			end
+		end
+
+		redis.call('HSET', key, device, new_value)
+		redis.call('EXPIRE', key, ttl)
+		redis.call('SADD', KEYS[2], ARGV[5])
+		return 1
+	`
+
+	result, err := m.redis.Eval(ctx, script, []string{key, gatewayIndexPrefix + gatewayID},
+		deviceID, value, timestamp, int(presenceTTL.Seconds()), userID).Result()
+
+	if err != nil {
+		return fmt.Errorf("failed to register presence: %w", err)
+	}
+
+	if result.(int64) == 0 {
+		return fmt.Errorf("stale update rejected for user %s device %s: %w", userID, deviceID, ErrNotOwner)
+	}
+
+	return nil
+}
+
+// Refresh updates a device session's timestamp and the key's TTL (heartbeat),
+// only while gatewayID and connID still own the session
+func (m *RedisManager) Refresh(ctx context.Context, userID, deviceID, gatewayID, connID string) (err error) {
+	defer func(start time.Time) { observe("refresh", start, err) }(time.Now())
+
+	key := presenceKeyPrefix + userID
+
+	// Update timestamp and refresh TTL if the session is still ours; a missing
+	// or expired session is not re-created, the caller decides whether to
+	// register again
+	script := `
+		local key = KEYS[1]
+		local current = redis.call('HGET', key, ARGV[1])
+		if not current then
+			return -1
+		end
+
+		local s = cjson.decode(current)
+		if tonumber(s['ts']) < tonumber(ARGV[6]) then
+			return -1
+		end
+		if s['gwId'] ~= ARGV[2] or s['connId'] ~= ARGV[3] then
+			return 0
+		end
+
+		s['ts'] = tonumber(ARGV[4])
+		redis.call('HSET', key, ARGV[1], cjson.encode(s))
+		redis.call('EXPIRE', key, tonumber(ARGV[5]))
+		return 1
+	`
+
+	now := time.Now()
+	result, err := m.redis.Eval(ctx, script, []string{key},
+		deviceID, gatewayID, connID, now.UnixMilli(), int(presenceTTL.Seconds()),
+		now.Add(-presenceTTL).UnixMilli()).Result()
+	if err != nil {
+		return fmt.Errorf("failed to refresh presence: %w", err)
+	}
+
+	switch result.(int64) {
+	case -1:
+		return fmt.Errorf("refresh of user %s device %s: %w", userID, deviceID, ErrNoSession)
+	case 0:
+		return fmt.Errorf("refresh of user %s device %s: %w", userID, deviceID, ErrNotOwner)
+	}
+
+	return nil
+}
+
+// Sessions returns all of a user's live sessions, most recent first
+func (m *RedisManager) Sessions(ctx context.Context, userID string) (_ []*Info, err error) {
+	defer func(start time.Time) { observe("sessions", start, err) }(time.Now())
+
+	key := presenceKeyPrefix + userID
+
+	result, err := m.redis.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get presence: %w", err)
+	}
+
+	// Sessions that missed their heartbeats are ignored even while
+	// another device keeps the key alive
+	cutoff := time.Now().Add(-presenceTTL).UnixMilli()
+
+	sessions := make([]*Info, 0, len(result))
+	for deviceID, value := range result {
+		var s session
+		if err := json.Unmarshal([]byte(value), &s); err != nil {
+			continue
+		}
+		if s.Timestamp < cutoff {
+			continue
+		}
+		sessions = append(sessions, &Info{
+			UserID:    userID,
+			DeviceID:  deviceID,
+			GatewayID: s.GatewayID,
+			ConnID:    s.ConnID,
+			Timestamp: s.Timestamp,
+		})
+	}
+
+	if len(sessions) == 0 {
+		return nil, fmt.Errorf("user %s: %w", userID, ErrUserOffline)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Timestamp > sessions[j].Timestamp
+	})
+
+	return sessions, nil
+}
+
+// Get retrieves a user's most recent session
+func (m *RedisManager) Get(ctx context.Context, userID string) (*Info, error) {
+	sessions, err := m.Sessions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions[0], nil
+}
+
+// Remove deletes a device session (on disconnect), only if gatewayID and
+// connID own it, so a late cleanup cannot erase the device's newer session
+func (m *RedisManager) Remove(ctx context.Context, userID, deviceID, gatewayID, connID string) (err error) {
+	defer func(start time.Time) { observe("remove", start, err) }(time.Now())
+
+	key := presenceKeyPrefix + userID
+
+	// Lua script to delete the device's field only while we own it
+	script := `
+		local key = KEYS[1]
+		local current = redis.call('HGET', key, ARGV[1])
+		if not current then
+			return 0
+		end
+
+		local s = cjson.decode(current)
+		if s['gwId'] ~= ARGV[2] or s['connId'] ~= ARGV[3] then
+			return 0
+		end
+
+		redis.call('HDEL', key, ARGV[1])
+
+		-- Drop the user from the gateway's index once no device is left on it
+		for _, v in ipairs(redis.call('HVALS', key)) do
+			local ok, other = pcall(cjson.decode, v)
+			if ok and other['gwId'] == ARGV[2] then
+				return 1
+			end
+		end
+		redis.call('SREM', KEYS[2], ARGV[4])
+		return 1
+	`
+
+	result, err := m.redis.Eval(ctx, script, []string{key, gatewayIndexPrefix + gatewayID},
+		deviceID, gatewayID, connID, userID).Result()
+	if err != nil {
+		return fmt.Errorf("failed to remove presence: %w", err)
+	}
+
+	if result.(int64) == 0 {
+		return fmt.Errorf("remove of user %s device %s: %w", userID, deviceID, ErrNotOwner)
+	}
+
+	return nil
+}
+
+// RemoveGateway deletes the sessions a dead gateway registered before the
+// given time, walking the gateway's user index. Sessions registered later
+// belong to a restart of the gateway and are kept.
+func (m *RedisManager) RemoveGateway(ctx context.Context, gatewayID string, before time.Time) (_ int, err error) {
+	defer func(start time.Time) { observe("remove_gateway", start, err) }(time.Now())
+
+	index := gatewayIndexPrefix + gatewayID
+
+	// Lua script to remove one user's sessions on the gateway, dropping the
+	// user from the index unless a newer session remains
+	script := `
+		local key = KEYS[1]
+		local fields = redis.call('HGETALL', key)
+		local removed = 0
+		local remaining = false
+
+		for i = 1, #fields, 2 do
+			local ok, s = pcall(cjson.decode, fields[i + 1])
+			if ok and s['gwId'] == ARGV[1] then
+				if tonumber(s['ts']) < tonumber(ARGV[2]) then
+					redis.call('HDEL', key, fields[i])
+					removed = removed + 1
+				else
+					remaining = true
+				end
+			end
+		end
+
+		if not remaining then
+			redis.call('SREM', KEYS[2], ARGV[3])
+		end
+		return removed
+	`
+
+	removed := 0
+	iter := m.redis.SScan(ctx, index, 0, "", 100).Iterator()
+	for iter.Next(ctx) {
+		userID := iter.Val()
+
+		n, err := m.redis.Eval(ctx, script, []string{presenceKeyPrefix + userID, index},
+			gatewayID, before.UnixMilli(), userID).Int()
+		if err != nil {
+			return removed, fmt.Errorf("failed to remove presence of %s on gateway %s: %w", userID, gatewayID, err)
+		}
+		removed += n
+	}
+	if err := iter.Err(); err != nil {
+		return removed, fmt.Errorf("failed to scan users of gateway %s: %w", gatewayID, err)
+	}
+
+	return removed, nil
+}
+
+// PruneGateway walks a live gateway's user index, deleting its sessions that
+// expired without a heartbeat and dropping users with no live session on the
+// gateway, including those whose presence key expired by TTL
+func (m *RedisManager) PruneGateway(ctx context.Context, gatewayID string) (_ int, err error) {
+	defer func(start time.Time) { observe("prune_gateway", start, err) }(time.Now())
+
+	index := gatewayIndexPrefix + gatewayID
+
+	// Lua script to prune one user, returning 1 if they were dropped from the index
+	script := `
+		local key = KEYS[1]
+		local fields = redis.call('HGETALL', key)
+		local remaining = false
+
+		for i = 1, #fields, 2 do
+			local ok, s = pcall(cjson.decode, fields[i + 1])
+			if ok and s['gwId'] == ARGV[1] then
+				if tonumber(s['ts']) < tonumber(ARGV[2]) then
+					redis.call('HDEL', key, fields[i])
+				else
+					remaining = true
+				end
+			end
+		end
+
+		if remaining then
+			return 0
+		end
+		return redis.call('SREM', KEYS[2], ARGV[3])
+	`
+
+	cutoff := time.Now().Add(-presenceTTL).UnixMilli()
+
+	pruned := 0
+	iter := m.redis.SScan(ctx, index, 0, "", 100).Iterator()
+	for iter.Next(ctx) {
+		userID := iter.Val()
+
+		n, err := m.redis.Eval(ctx, script, []string{presenceKeyPrefix + userID, index},
+			gatewayID, cutoff, userID).Int()
+		if err != nil {
+			return pruned, fmt.Errorf("failed to prune presence of %s on gateway %s: %w", userID, gatewayID, err)
+		}
+		pruned += n
+	}
+	if err := iter.Err(); err != nil {
+		return pruned, fmt.Errorf("failed to scan users of gateway %s: %w", gatewayID, err)
+	}
+
+	return pruned, nil
+}
+
+// IsOnline checks if a user has at least one live session
+func (m *RedisManager) IsOnline(ctx context.Context, userID string) (bool, error) {
+	_, err := m.Sessions(ctx, userID)
+	if errors.Is(err, ErrUserOffline) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check presence: %w", err)
+	}
+
+	return true, nil
+}
+
+// Ensure RedisManager implements Manager
+var _ Manager = (*RedisManager)(nil)
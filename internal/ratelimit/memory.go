@@ -0,0 +1,61 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often Allow drops idle buckets
+const sweepInterval = time.Minute
+
+// MemoryLimiter keeps token buckets in process memory.
+// Intended for single-process mode and tests.
+type MemoryLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*Bucket
+	lastSweep time.Time
+}
+
+// NewMemoryLimiter creates an empty in-memory limiter
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{
+		buckets:   make(map[string]*Bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from key's bucket, creating it full on first use
+func (l *MemoryLimiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	if !limit.Enabled() {
+		return Result{Allowed: true}, nil
+	}
+
+	l.mu.Lock()
+	if now := time.Now(); now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+	bucket, ok := l.buckets[key]
+	if !ok || bucket.limit != limit {
+		bucket = NewBucket(limit)
+		l.buckets[key] = bucket
+	}
+	l.mu.Unlock()
+
+	return bucket.Take(), nil
+}
+
+// sweep drops the buckets left alone long enough to be full again, as the
+// Redis limiter expires them; recreating one on next use changes nothing.
+// Callers hold l.mu.
+func (l *MemoryLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Ensure MemoryLimiter implements Limiter
+var _ Limiter = (*MemoryLimiter)(nil)
@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryLimiterDropsIdleBuckets(t *testing.T) {
+	ctx := context.Background()
+	l := NewMemoryLimiter()
+	limit := Limit{Rate: 1, Burst: 2}
+
+	for _, key := range []string{"idle", "busy"} {
+		for i := 0; i < limit.Burst; i++ {
+			if res, _ := l.Allow(ctx, key, limit); !res.Allowed {
+				t.Fatalf("%s: token %d refused", key, i)
+			}
+		}
+	}
+
+	// idle 已空闲到补满, busy 仍在补充 / idle has refilled to its burst, busy is still refilling
+	now := time.Now()
+	l.buckets["idle"].last = now.Add(-3 * time.Second)
+	l.sweep(now)
+
+	if _, ok := l.buckets["idle"]; ok {
+		t.Fatal("idle bucket kept after refilling")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Fatal("busy bucket dropped before refilling")
+	}
+	if res, _ := l.Allow(ctx, "busy", limit); res.Allowed {
+		t.Fatal("busy bucket allowed a token past its burst")
+	}
+}
+
+func TestMemoryLimiterSweepsOnAllow(t *testing.T) {
+	ctx := context.Background()
+	l := NewMemoryLimiter()
+	limit := Limit{Rate: 100, Burst: 1}
+
+	l.Allow(ctx, "a", limit)
+	l.buckets["a"].last = time.Now().Add(-time.Second)
+
+	// 距上次清理未满 sweepInterval 时保留 / Kept until sweepInterval has passed
+	l.Allow(ctx, "b", limit)
+	if _, ok := l.buckets["a"]; !ok {
+		t.Fatal("bucket dropped before sweepInterval")
+	}
+
+	l.lastSweep = time.Now().Add(-sweepInterval)
+	l.Allow(ctx, "b", limit)
+	if _, ok := l.buckets["a"]; ok {
+		t.Fatal("idle bucket kept after sweepInterval")
+	}
+}
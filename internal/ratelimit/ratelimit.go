@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit is a token bucket: up to Burst events at once, refilled at Rate per
+// second. A zero Rate or Burst disables the limit.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Enabled reports whether the limit restricts anything
+func (l Limit) Enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// Result is the outcome of taking a token
+type Result struct {
+	Allowed    bool
+	RetryAfter time.Duration // When the next token is available, if not allowed
+}
+
+// Limiter applies limits to buckets identified by key, shared by every
+// caller using the same Limiter (e.g. all gateways on one Redis)
+type Limiter interface {
+	// Allow takes a token from key's bucket
+	Allow(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// Bucket is a token bucket local to one process
+type Bucket struct {
+	mu     sync.Mutex
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket creates a full bucket
+func NewBucket(limit Limit) *Bucket {
+	return &Bucket{
+		limit:  limit,
+		tokens: float64(limit.Burst),
+		last:   time.Now(),
+	}
+}
+
+// Take takes a token if one is available
+func (b *Bucket) Take() Result {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := (1 - b.tokens) / b.limit.Rate
+		return Result{RetryAfter: time.Duration(wait * float64(time.Second))}
+	}
+
+	b.tokens--
+	return Result{Allowed: true}
+}
+
+// full reports whether the bucket has refilled to its burst by now
+func (b *Bucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate >= float64(b.limit.Burst)
+}
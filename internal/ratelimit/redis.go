@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const keyPrefix = "ratelimit:"
+
+// takeScript refills and takes from the bucket hash KEYS[1] using Redis time,
+// so gateways with skewed clocks share one bucket consistently.
+// ARGV: rate per second, burst. Returns {allowed, retry after ms}.
+var takeScript = redis.NewScript(`
+	local rate = tonumber(ARGV[1])
+	local burst = tonumber(ARGV[2])
+	local t = redis.call('TIME')
+	local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+	local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+	local tokens = tonumber(bucket[1])
+	local ts = tonumber(bucket[2])
+	if tokens == nil or ts == nil then
+		tokens = burst
+		ts = now
+	end
+
+	tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000)
+
+	local allowed = 0
+	local wait = 0
+	if tokens >= 1 then
+		tokens = tokens - 1
+		allowed = 1
+	else
+		wait = math.ceil((1 - tokens) * 1000 / rate)
+	end
+
+	redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+	-- A bucket left alone this long is full again
+	redis.call('PEXPIRE', KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+	return {allowed, wait}
+`)
+
+// RedisLimiter keeps token buckets in Redis hashes ratelimit:<key>
+type RedisLimiter struct {
+	redis *redis.Client
+}
+
+// NewRedisLimiter creates a new Redis-backed limiter
+func NewRedisLimiter(redisClient *redis.Client) *RedisLimiter {
+	return &RedisLimiter{redis: redisClient}
+}
+
+// Allow takes a token from key's bucket atomically
+func (l *RedisLimiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	if !limit.Enabled() {
+		return Result{Allowed: true}, nil
+	}
+
+	res, err := takeScript.Run(ctx, l.redis, []string{keyPrefix + key}, limit.Rate, limit.Burst).Int64Slice()
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to take rate limit token for %s: %w", key, err)
+	}
+	if len(res) != 2 {
+		return Result{}, fmt.Errorf("unexpected rate limit reply for %s: %v", key, res)
+	}
+
+	return Result{
+		Allowed:    res[0] == 1,
+		RetryAfter: time.Duration(res[1]) * time.Millisecond,
+	}, nil
+}
+
+// Ensure RedisLimiter implements Limiter
+var _ Limiter = (*RedisLimiter)(nil)
@@ -0,0 +1,189 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	registryKey = "gateways"
+
+	// HeartbeatInterval is how often a live gateway refreshes its entry
+	HeartbeatInterval = 10 * time.Second
+
+	// gatewayTTL is how long an entry stays live without a heartbeat (3x interval)
+	gatewayTTL = 30 * time.Second
+)
+
+// ErrGatewayNotFound is returned by Lookup when a gateway has no live entry
+var ErrGatewayNotFound = errors.New("gateway not registered")
+
+// Info describes a live gateway
+type Info struct {
+	GatewayID   string `json:"id"`
+	Addr        string `json:"addr"`               // HTTP/WebSocket address
+	PeerAddr    string `json:"peerAddr,omitempty"` // Address peers dial for direct routing
+	StartedAt   int64  `json:"startedAt"`          // Process start, Unix seconds
+	Connections int    `json:"connections"`        // Open connections at the last heartbeat
+	Timestamp   int64  `json:"ts"`                 // Last heartbeat, Unix seconds
+}
+
+// ExpiredAt returns when the entry stops being live without another heartbeat
+func (i *Info) ExpiredAt() time.Time {
+	return time.Unix(i.Timestamp, 0).Add(gatewayTTL)
+}
+
+// Registry tracks live gateways, their addresses and load in Redis.
+// All gateways share one hash, gateways, with one field per gateway ID.
+type Registry struct {
+	redis *redis.Client
+}
+
+// New creates a new gateway registry
+func New(redisClient *redis.Client) *Registry {
+	return &Registry{
+		redis: redisClient,
+	}
+}
+
+// Register records or refreshes a gateway's entry, stamping it with the current time
+func (r *Registry) Register(ctx context.Context, info Info) error {
+	info.Timestamp = time.Now().Unix()
+
+	value, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to marshal gateway info: %w", err)
+	}
+
+	if err := r.redis.HSet(ctx, registryKey, info.GatewayID, value).Err(); err != nil {
+		return fmt.Errorf("failed to register gateway: %w", err)
+	}
+
+	return nil
+}
+
+// Deregister removes a gateway on clean shutdown
+func (r *Registry) Deregister(ctx context.Context, gatewayID string) error {
+	if err := r.redis.HDel(ctx, registryKey, gatewayID).Err(); err != nil {
+		return fmt.Errorf("failed to deregister gateway: %w", err)
+	}
+
+	return nil
+}
+
+// Lookup returns a live gateway's entry
+func (r *Registry) Lookup(ctx context.Context, gatewayID string) (*Info, error) {
+	value, err := r.redis.HGet(ctx, registryKey, gatewayID).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("gateway %s: %w", gatewayID, ErrGatewayNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up gateway: %w", err)
+	}
+
+	info, ok := decode(gatewayID, value)
+	if !ok {
+		return nil, fmt.Errorf("gateway %s: %w", gatewayID, ErrGatewayNotFound)
+	}
+
+	return info, nil
+}
+
+// List returns all live gateways, ordered by ID
+func (r *Registry) List(ctx context.Context) ([]*Info, error) {
+	result, err := r.redis.HGetAll(ctx, registryKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list gateways: %w", err)
+	}
+
+	gateways := make([]*Info, 0, len(result))
+	for gatewayID, value := range result {
+		if info, ok := decode(gatewayID, value); ok {
+			gateways = append(gateways, info)
+		}
+	}
+
+	sort.Slice(gateways, func(i, j int) bool {
+		return gateways[i].GatewayID < gateways[j].GatewayID
+	})
+
+	return gateways, nil
+}
+
+// Expired returns the entries of gateways that stopped heartbeating without
+// deregistering, i.e. crashed or lost their Redis connection
+func (r *Registry) Expired(ctx context.Context) ([]*Info, error) {
+	result, err := r.redis.HGetAll(ctx, registryKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list gateways: %w", err)
+	}
+
+	var expired []*Info
+	for gatewayID, value := range result {
+		var info Info
+		if err := json.Unmarshal([]byte(value), &info); err != nil {
+			log.Printf("[Registry] Ignoring corrupt entry for gateway %s: %v", gatewayID, err)
+			continue
+		}
+		if !isLive(&info) {
+			info.GatewayID = gatewayID
+			expired = append(expired, &info)
+		}
+	}
+
+	return expired, nil
+}
+
+// Reap deletes an expired entry unless the gateway heartbeated since it was
+// read. Only one of several gateways reaping at once gets true, and that one
+// cleans up after the dead gateway.
+func (r *Registry) Reap(ctx context.Context, info *Info) (bool, error) {
+	// Lua script to delete the entry only if its heartbeat is unchanged
+	script := `
+		local current = redis.call('HGET', KEYS[1], ARGV[1])
+		if not current then
+			return 0
+		end
+
+		local ok, entry = pcall(cjson.decode, current)
+		if ok and tonumber(entry['ts']) ~= tonumber(ARGV[2]) then
+			return 0
+		end
+
+		redis.call('HDEL', KEYS[1], ARGV[1])
+		return 1
+	`
+
+	result, err := r.redis.Eval(ctx, script, []string{registryKey}, info.GatewayID, info.Timestamp).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to reap gateway %s: %w", info.GatewayID, err)
+	}
+
+	return result.(int64) == 1, nil
+}
+
+// decode parses an entry, reporting false for corrupt or expired ones
+func decode(gatewayID, value string) (*Info, bool) {
+	var info Info
+	if err := json.Unmarshal([]byte(value), &info); err != nil {
+		return nil, false
+	}
+	if !isLive(&info) {
+		return nil, false
+	}
+
+	info.GatewayID = gatewayID
+	return &info, true
+}
+
+// isLive reports whether an entry was refreshed within gatewayTTL
+func isLive(info *Info) bool {
+	return time.Now().Before(info.ExpiredAt())
+}
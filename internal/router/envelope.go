@@ -0,0 +1,114 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+
+	"websocket-demo/internal/wire"
+)
+
+// Message field numbers in the Envelope of proto/chat/v1/chat.proto
+const (
+	envelopeID         = 1
+	envelopeClientID   = 2
+	envelopeFrom       = 3
+	envelopeTo         = 4
+	envelopeContent    = 5
+	envelopeType       = 6
+	envelopeEvent      = 7
+	envelopeStatus     = 8
+	envelopeGateway    = 9
+	envelopeConnID     = 10
+	envelopeGroupID    = 11
+	envelopeRecipients = 12
+	envelopeTargets    = 13
+	envelopeHops       = 14
+	envelopeTimestamp  = 15
+)
+
+// MarshalBinary encodes the message as a protobuf Envelope
+func (m *Message) MarshalBinary() ([]byte, error) {
+	var b wire.Buffer
+	b.String(envelopeID, m.ID)
+	b.String(envelopeClientID, m.ClientID)
+	b.String(envelopeFrom, m.From)
+	b.String(envelopeTo, m.To)
+	b.String(envelopeContent, m.Content)
+	b.String(envelopeType, m.Type)
+	b.String(envelopeEvent, m.Event)
+	b.String(envelopeStatus, m.Status)
+	b.String(envelopeGateway, m.Gateway)
+	b.String(envelopeConnID, m.ConnID)
+	b.String(envelopeGroupID, m.GroupID)
+	b.Strings(envelopeRecipients, m.Recipients)
+	b.Strings(envelopeTargets, m.Targets)
+	b.Int64(envelopeHops, int64(m.Hops))
+	b.Int64(envelopeTimestamp, m.Timestamp)
+	return b.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a protobuf Envelope
+func (m *Message) UnmarshalBinary(data []byte) error {
+	*m = Message{}
+
+	r := wire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case envelopeID:
+			m.ID = r.String()
+		case envelopeClientID:
+			m.ClientID = r.String()
+		case envelopeFrom:
+			m.From = r.String()
+		case envelopeTo:
+			m.To = r.String()
+		case envelopeContent:
+			m.Content = r.String()
+		case envelopeType:
+			m.Type = r.String()
+		case envelopeEvent:
+			m.Event = r.String()
+		case envelopeStatus:
+			m.Status = r.String()
+		case envelopeGateway:
+			m.Gateway = r.String()
+		case envelopeConnID:
+			m.ConnID = r.String()
+		case envelopeGroupID:
+			m.GroupID = r.String()
+		case envelopeRecipients:
+			m.Recipients = append(m.Recipients, r.String())
+		case envelopeTargets:
+			m.Targets = append(m.Targets, r.String())
+		case envelopeHops:
+			m.Hops = int(r.Int64())
+		case envelopeTimestamp:
+			m.Timestamp = r.Int64()
+		default:
+			r.Skip()
+		}
+	}
+	return r.Err()
+}
+
+// DecodeMessage decodes a message from the wire. Both protobuf Envelopes and
+// the JSON written by older gateways are accepted: an encoded Envelope never
+// starts with '{', which as a protobuf tag would be a deprecated group field.
+func DecodeMessage(data []byte) (*Message, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty message")
+	}
+
+	var msg Message
+	if data[0] == '{' {
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, err
+		}
+		return &msg, nil
+	}
+
+	if err := msg.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
@@ -0,0 +1,175 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// goldenEnvelope is the message in testdata/envelope.txtpb
+var goldenEnvelope = Message{
+	ID:         "msg-1",
+	ClientID:   "c-1",
+	From:       "alice",
+	To:         "bob",
+	Content:    "你好, bob",
+	Type:       MessageTypeGroup,
+	Event:      "typing_start",
+	Status:     AckStatusDelivered,
+	Gateway:    "gw-1",
+	ConnID:     "conn-7",
+	GroupID:    "team",
+	Recipients: []string{"bob", "carol"},
+	Targets:    []string{"gw-2", "gw-3"},
+	Hops:       2,
+	Timestamp:  1700000000123,
+}
+
+func TestEnvelopeGolden(t *testing.T) {
+	golden, err := os.ReadFile("testdata/envelope.binpb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := goldenEnvelope.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, golden) {
+		t.Fatalf("encoded\n% x\nwant (protoc)\n% x", data, golden)
+	}
+
+	var msg Message
+	if err := msg.UnmarshalBinary(golden); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(msg, goldenEnvelope) {
+		t.Fatalf("decoded %+v, want %+v", msg, goldenEnvelope)
+	}
+}
+
+func TestEnvelopeJSONNames(t *testing.T) {
+	golden, err := os.ReadFile("testdata/envelope.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(goldenEnvelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 旧版 Gateway 的 JSON 与 protojson 字段名一致 / JSON from older gateways uses the protojson names
+	if got, want := jsonKeys(t, data), jsonKeys(t, golden); !reflect.DeepEqual(got, want) {
+		t.Fatalf("JSON fields %v, want (protojson) %v", got, want)
+	}
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+	}{
+		{"empty", Message{}},
+		{"direct", Message{ID: "m", From: "a", To: "b", Content: "hi", Type: MessageTypeDirect, Timestamp: 1}},
+		{"ack", Message{ID: "m", ClientID: "c", Type: MessageTypeAck, Status: AckStatusSent, Gateway: "gw-1", ConnID: "conn"}},
+		{"repeated with empty entries", Message{Type: MessageTypeGroup, Recipients: []string{"", "b"}, Targets: []string{"gw-2"}}},
+		{"negative numbers", Message{Hops: -1, Timestamp: -1700000000000}},
+		{"golden", goldenEnvelope},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.msg.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg Message
+			if err := msg.UnmarshalBinary(data); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(msg, tt.msg) {
+				t.Fatalf("round trip %+v, want %+v", msg, tt.msg)
+			}
+		})
+	}
+}
+
+func TestEnvelopeSkipsUnknownFields(t *testing.T) {
+	data, err := (&Message{ID: "m", To: "bob"}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 新版本可能添加的字段 16 (string) 与 17 (varint) / Fields 16 (string) and 17 (varint) from a newer schema
+	data = append(data, 0x82, 0x01, 2, 'x', 'y', 0x88, 0x01, 0x05)
+
+	var msg Message
+	if err := msg.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != "m" || msg.To != "bob" {
+		t.Fatalf("decoded %+v, want ID m to bob", msg)
+	}
+}
+
+func TestEnvelopeMalformedInput(t *testing.T) {
+	golden, err := os.ReadFile("testdata/envelope.binpb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated", golden[:len(golden)-1]},
+		{"truncated inside a string", golden[:4]},
+		{"wrong wire type", []byte{0x08, 0x01}}, // id as a varint
+		{"varint overflow", []byte{0x70, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeMessage(tt.data); err == nil {
+				t.Fatal("decoded malformed input without an error")
+			}
+		})
+	}
+}
+
+func TestDecodeMessageAcceptsJSON(t *testing.T) {
+	data, err := json.Marshal(goldenEnvelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := DecodeMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*msg, goldenEnvelope) {
+		t.Fatalf("decoded %+v, want %+v", *msg, goldenEnvelope)
+	}
+
+	if _, err := DecodeMessage(nil); err == nil {
+		t.Fatal("decoded an empty message without an error")
+	}
+}
+
+// jsonKeys returns the sorted field names of a JSON object
+func jsonKeys(t *testing.T, data []byte) []string {
+	t.Helper()
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,596 @@
+//go:build grpc
+
+package router
+
+import (
+	"context"
+	"encoding"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"websocket-demo/internal/registry"
+	"websocket-demo/internal/wire"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	routerGrpc = "grpc"
+
+	// grpcStreamMethod is the full method name of the peer stream
+	grpcStreamMethod = "/gateway.Peer/Stream"
+)
+
+// GrpcConfig holds configuration for direct gateway-to-gateway routing
+// GrpcConfig 保存 Gateway 直连路由的配置
+type GrpcConfig struct {
+	ListenAddr    string        // 对端监听地址 / Peer listener address (e.g., ":9090")
+	AdvertiseAddr string        // 注册到 registry 的地址 / Address other gateways dial (e.g., "10.0.0.5:9090")
+	SendTimeout   time.Duration // 无 deadline 时的发送超时 / Send timeout when ctx has no deadline
+}
+
+// DefaultGrpcConfig returns the default peer settings
+// 返回默认对端配置
+func DefaultGrpcConfig() GrpcConfig {
+	return GrpcConfig{
+		ListenAddr:    ":9090",
+		AdvertiseAddr: "localhost:9090",
+		SendTimeout:   5 * time.Second,
+	}
+}
+
+// peerFrame is sent from the dialing gateway to the peer (PeerFrame in chat.proto)
+type peerFrame struct {
+	Seq     uint64
+	Message *Message
+}
+
+// MarshalBinary encodes the frame as a protobuf PeerFrame
+func (f *peerFrame) MarshalBinary() ([]byte, error) {
+	var b wire.Buffer
+	b.Uint64(1, f.Seq)
+	if f.Message != nil {
+		data, err := f.Message.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		b.Message(2, data)
+	}
+	return b.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a protobuf PeerFrame
+func (f *peerFrame) UnmarshalBinary(data []byte) error {
+	*f = peerFrame{}
+
+	r := wire.NewReader(data)
+	for r.Next() {
+		switch r.Field() {
+		case 1:
+			f.Seq = r.Uint64()
+		case 2:
+			f.Message = &Message{}
+			if err := f.Message.UnmarshalBinary(r.Bytes()); err != nil {
+				return err
+			}
+		default:
+			r.Skip()
+		}
+	}
+	return r.Err()
+}
+
+// peerAck confirms that the peer handled a frame (PeerAck in chat.proto)
+type peerAck struct {
+	Seq uint64
+}
+
+// MarshalBinary encodes the ack as a protobuf PeerAck
+func (a *peerAck) MarshalBinary() ([]byte, error) {
+	var b wire.Buffer
+	b.Uint64(1, a.Seq)
+	return b.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a protobuf PeerAck
+func (a *peerAck) UnmarshalBinary(data []byte) error {
+	*a = peerAck{}
+
+	r := wire.NewReader(data)
+	for r.Next() {
+		if r.Field() == 1 {
+			a.Seq = r.Uint64()
+		} else {
+			r.Skip()
+		}
+	}
+	return r.Err()
+}
+
+// protoCodec carries peer frames as hand-encoded protobuf, so no generated
+// code is needed
+// protoCodec 以手写的 protobuf 编码传输对端帧，无需生成代码
+type protoCodec struct{}
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T as protobuf", v)
+	}
+	return m.MarshalBinary()
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal protobuf into %T", v)
+	}
+	return m.UnmarshalBinary(data)
+}
+
+func (protoCodec) Name() string { return "proto" }
+
+// peerStreamDesc describes the bidirectional peer stream
+var peerStreamDesc = grpc.StreamDesc{
+	StreamName:    "Stream",
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+// PeerDirectory resolves gateway IDs to the peer addresses they advertise.
+// *registry.Registry implements it.
+// 将 Gateway ID 解析为其对端地址，*registry.Registry 实现了该接口
+type PeerDirectory interface {
+	Lookup(ctx context.Context, gatewayID string) (*registry.Info, error)
+	List(ctx context.Context) ([]*registry.Info, error)
+}
+
+// GrpcRouter routes messages by dialing other gateways directly over gRPC,
+// skipping the broker hop. Peer addresses come from the gateway registry,
+// where the gateway server publishes AdvertiseAddr with its heartbeats.
+// Each peer has one pooled connection and one bidirectional stream: frames
+// go out, acks come back once the peer has handled them.
+// GrpcRouter 通过 gRPC 直连其他 Gateway 路由消息，地址来自 Gateway registry
+type GrpcRouter struct {
+	gatewayID string
+	registry  PeerDirectory
+	config    GrpcConfig
+	handler   MessageHandler
+
+	server      *grpc.Server
+	listener    net.Listener      // Used instead of ListenAddr when set (tests)
+	dialOptions []grpc.DialOption // Extra options for peer connections (tests)
+
+	mu    sync.Mutex
+	peers map[string]*grpcPeer // gatewayID -> peer
+}
+
+// NewGrpcRouter creates a new direct gRPC router
+// 创建新的 gRPC 直连路由器
+func NewGrpcRouter(gatewayID string, reg PeerDirectory, config GrpcConfig) *GrpcRouter {
+	return &GrpcRouter{
+		gatewayID: gatewayID,
+		registry:  reg,
+		config:    config,
+		peers:     make(map[string]*grpcPeer),
+	}
+}
+
+// Start serves the peer listener
+// 启动对端监听
+func (r *GrpcRouter) Start(ctx context.Context, handler MessageHandler) error {
+	r.handler = handler
+
+	lis := r.listener
+	if lis == nil {
+		var err error
+		if lis, err = net.Listen("tcp", r.config.ListenAddr); err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", r.config.ListenAddr, err)
+		}
+	}
+
+	r.server = grpc.NewServer(
+		grpc.ForceServerCodec(protoCodec{}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	)
+	r.server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "gateway.Peer",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    peerStreamDesc.StreamName,
+			Handler:       r.serveStream,
+			ServerStreams: true,
+			ClientStreams: true,
+		}},
+	}, r)
+
+	go func() {
+		if err := r.server.Serve(lis); err != nil {
+			log.Printf("[GrpcRouter] Peer listener stopped: %v", err)
+		}
+	}()
+
+	log.Printf("[GrpcRouter] Listening for peers on %s (advertised as %s)", r.config.ListenAddr, r.config.AdvertiseAddr)
+	return nil
+}
+
+// AdvertiseAddr returns the address other gateways dial; the gateway server
+// publishes it in the registry as the peer address
+// 返回其他 Gateway 拨号使用的地址，由 Gateway 服务器写入 registry
+func (r *GrpcRouter) AdvertiseAddr() string {
+	return r.config.AdvertiseAddr
+}
+
+// Stop closes peer connections and stops the listener
+// 关闭对端连接并停止监听
+func (r *GrpcRouter) Stop() error {
+	r.mu.Lock()
+	for id, peer := range r.peers {
+		peer.close()
+		delete(r.peers, id)
+	}
+	r.mu.Unlock()
+
+	// 对端流不会自行结束，GracefulStop 会一直等待；未确认的帧由发送方报错
+	// Peer streams never finish on their own, so GracefulStop would block;
+	// frames in flight are left unacked and fail on the sending side
+	if r.server != nil {
+		r.server.Stop()
+	}
+
+	log.Println("[GrpcRouter] Router stopped")
+	return nil
+}
+
+// RouteToGateway sends a message straight to the target gateway. Messages for
+// this gateway are handled locally without a network hop.
+// 将消息直接发送到目标 Gateway；发往本 Gateway 的消息在本地处理
+func (r *GrpcRouter) RouteToGateway(ctx context.Context, targetGatewayID string, msg *Message) error {
+	if targetGatewayID == r.gatewayID {
+		r.deliverLocal(msg)
+		return nil
+	}
+
+	if err := r.send(ctx, targetGatewayID, msg, publishDirect); err != nil {
+		return fmt.Errorf("failed to route message to gateway %s: %w", targetGatewayID, err)
+	}
+
+	log.Printf("[GrpcRouter] Routed message from %s to %s via gateway %s", msg.From, msg.To, targetGatewayID)
+	return nil
+}
+
+// BroadcastToAllGateways sends a message to every registered gateway
+// 向所有已注册的 Gateway 发送消息
+func (r *GrpcRouter) BroadcastToAllGateways(ctx context.Context, msg *Message) error {
+	gateways, err := r.registry.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to broadcast message: %w", err)
+	}
+
+	r.deliverLocal(msg)
+
+	var failed int
+	for _, gw := range gateways {
+		if gw.GatewayID == r.gatewayID {
+			continue
+		}
+		if err := r.send(ctx, gw.GatewayID, msg, publishBroadcast); err != nil {
+			log.Printf("[GrpcRouter] Failed to broadcast to gateway %s: %v", gw.GatewayID, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to broadcast message to %d gateways", failed)
+	}
+
+	log.Printf("[GrpcRouter] Broadcast message from %s to %d gateways", msg.From, len(gateways))
+	return nil
+}
+
+// send resolves the peer and sends a frame, bounded by the ctx deadline or SendTimeout
+func (r *GrpcRouter) send(ctx context.Context, gatewayID string, msg *Message, kind string) error {
+	if _, ok := ctx.Deadline(); !ok && r.config.SendTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.config.SendTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	err := r.sendToPeer(ctx, gatewayID, msg)
+	observePublish(routerGrpc, start)
+	if err != nil {
+		publishErrorsTotal.WithLabelValues(routerGrpc, kind).Inc()
+		return err
+	}
+
+	publishedTotal.WithLabelValues(routerGrpc, kind).Inc()
+	return nil
+}
+
+func (r *GrpcRouter) sendToPeer(ctx context.Context, gatewayID string, msg *Message) error {
+	peer, err := r.peer(ctx, gatewayID)
+	if err != nil {
+		return err
+	}
+	return peer.send(ctx, msg)
+}
+
+// peer returns the pooled peer for a gateway, replacing it if the gateway's
+// registered address has changed (e.g. after a restart on another host)
+func (r *GrpcRouter) peer(ctx context.Context, gatewayID string) (*grpcPeer, error) {
+	info, err := r.registry.Lookup(ctx, gatewayID)
+	if err != nil {
+		return nil, err
+	}
+	if info.PeerAddr == "" {
+		return nil, fmt.Errorf("gateway %s has no peer address", gatewayID)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if peer, ok := r.peers[gatewayID]; ok {
+		if peer.addr == info.PeerAddr {
+			return peer, nil
+		}
+		log.Printf("[GrpcRouter] Gateway %s moved from %s to %s", gatewayID, peer.addr, info.PeerAddr)
+		peer.close()
+		delete(r.peers, gatewayID)
+	}
+
+	peer, err := newGrpcPeer(gatewayID, info.PeerAddr, r.dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	r.peers[gatewayID] = peer
+
+	return peer, nil
+}
+
+// serveStream handles frames from one dialing peer in order, acking each
+// after it has been handed to the local handler
+func (r *GrpcRouter) serveStream(_ interface{}, stream grpc.ServerStream) error {
+	for {
+		var frame peerFrame
+		if err := stream.RecvMsg(&frame); err != nil {
+			return err
+		}
+
+		if frame.Message == nil {
+			decodeErrorsTotal.WithLabelValues(routerGrpc).Inc()
+		} else {
+			r.deliverLocal(frame.Message)
+		}
+
+		if err := stream.SendMsg(&peerAck{Seq: frame.Seq}); err != nil {
+			return err
+		}
+	}
+}
+
+// deliverLocal hands a message to the local handler
+func (r *GrpcRouter) deliverLocal(msg *Message) {
+	receivedTotal.WithLabelValues(routerGrpc).Inc()
+
+	if r.handler != nil {
+		if err := r.handler(msg); err != nil {
+			log.Printf("[GrpcRouter] Failed to deliver message %s: %v", msg.ID, err)
+		}
+	}
+}
+
+// grpcPeer is a pooled connection to one gateway. gRPC reconnects the
+// underlying connection with backoff; the stream is reopened on the next
+// send after it breaks.
+type grpcPeer struct {
+	id   string
+	addr string
+	conn *grpc.ClientConn
+
+	sendMu sync.Mutex // Serializes SendMsg on the stream
+
+	mu      sync.Mutex // Guards the fields below
+	stream  grpc.ClientStream
+	cancel  context.CancelFunc
+	seq     uint64
+	pending map[uint64]chan error
+}
+
+func newGrpcPeer(id, addr string, opts ...grpc.DialOption) (*grpcPeer, error) {
+	conn, err := grpc.Dial(addr, append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(protoCodec{})),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                30 * time.Second,
+			Timeout:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	}, opts...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial gateway %s at %s: %w", id, addr, err)
+	}
+
+	return &grpcPeer{
+		id:      id,
+		addr:    addr,
+		conn:    conn,
+		pending: make(map[uint64]chan error),
+	}, nil
+}
+
+// send writes a frame and waits for the peer's ack or the ctx deadline
+func (p *grpcPeer) send(ctx context.Context, msg *Message) error {
+	stream, seq, done, err := p.begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		p.sendMu.Lock()
+		defer p.sendMu.Unlock()
+		sent <- stream.SendMsg(&peerFrame{Seq: seq, Message: msg})
+	}()
+
+	select {
+	case err := <-sent:
+		if err != nil {
+			p.finish(seq)
+			p.reset(stream, err)
+			return fmt.Errorf("failed to send to gateway %s: %w", p.id, err)
+		}
+	case <-ctx.Done():
+		p.finish(seq)
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		p.finish(seq)
+		return ctx.Err()
+	}
+}
+
+// begin opens the stream if needed and registers a pending frame. While no
+// stream is open it first waits, bounded by ctx, for the connection to be
+// ready, so a peer that is down fails the send at its deadline instead of
+// blocking other senders.
+func (p *grpcPeer) begin(ctx context.Context) (grpc.ClientStream, uint64, chan error, error) {
+	p.mu.Lock()
+	open := p.stream != nil
+	p.mu.Unlock()
+
+	if !open {
+		if err := p.waitReady(ctx); err != nil {
+			return nil, 0, nil, err
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pending == nil {
+		return nil, 0, nil, errors.New("peer closed")
+	}
+
+	if p.stream == nil {
+		streamCtx, cancel := context.WithCancel(context.Background())
+		stream, err := p.conn.NewStream(streamCtx, &peerStreamDesc, grpcStreamMethod)
+		if err != nil {
+			cancel()
+			return nil, 0, nil, fmt.Errorf("failed to open stream to gateway %s: %w", p.id, err)
+		}
+
+		p.stream = stream
+		p.cancel = cancel
+		go p.receiveAcks(stream)
+	}
+
+	p.seq++
+	done := make(chan error, 1)
+	p.pending[p.seq] = done
+
+	return p.stream, p.seq, done, nil
+}
+
+// waitReady blocks until the connection is ready or ctx ends; gRPC keeps
+// reconnecting with backoff in the background
+func (p *grpcPeer) waitReady(ctx context.Context) error {
+	p.conn.Connect()
+
+	for {
+		state := p.conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.Shutdown:
+			return errors.New("peer closed")
+		}
+
+		if !p.conn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("gateway %s not reachable: %w", p.id, ctx.Err())
+		}
+	}
+}
+
+// receiveAcks completes pending sends until the stream breaks
+func (p *grpcPeer) receiveAcks(stream grpc.ClientStream) {
+	for {
+		var ack peerAck
+		if err := stream.RecvMsg(&ack); err != nil {
+			p.reset(stream, err)
+			return
+		}
+
+		p.mu.Lock()
+		done, ok := p.pending[ack.Seq]
+		delete(p.pending, ack.Seq)
+		p.mu.Unlock()
+
+		if ok {
+			done <- nil
+		}
+	}
+}
+
+// finish forgets a pending frame whose sender gave up
+func (p *grpcPeer) finish(seq uint64) {
+	p.mu.Lock()
+	delete(p.pending, seq)
+	p.mu.Unlock()
+}
+
+// reset drops a broken stream and fails its pending sends
+func (p *grpcPeer) reset(stream grpc.ClientStream, cause error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stream != stream {
+		return
+	}
+
+	if cause != nil {
+		log.Printf("[GrpcRouter] Stream to gateway %s closed: %v", p.id, cause)
+	}
+
+	p.cancel()
+	p.stream = nil
+	p.cancel = nil
+
+	for seq, done := range p.pending {
+		done <- fmt.Errorf("stream to gateway %s closed: %w", p.id, cause)
+		delete(p.pending, seq)
+	}
+}
+
+// close tears down the stream and the connection
+func (p *grpcPeer) close() {
+	p.mu.Lock()
+	stream := p.stream
+	p.mu.Unlock()
+
+	if stream != nil {
+		p.reset(stream, errors.New("peer closed"))
+	}
+
+	p.mu.Lock()
+	p.pending = nil
+	p.mu.Unlock()
+
+	p.conn.Close()
+}
+
+// Ensure GrpcRouter implements RouterInterface
+var _ RouterInterface = (*GrpcRouter)(nil)
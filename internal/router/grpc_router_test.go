@@ -0,0 +1,364 @@
+//go:build grpc
+
+package router
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"websocket-demo/internal/registry"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// grpcTestNet connects routers over in-memory bufconn listeners, one per
+// advertised address, and serves as their peer directory
+type grpcTestNet struct {
+	mu        sync.Mutex
+	listeners map[string]*bufconn.Listener // addr -> listener
+	gateways  map[string]*registry.Info    // gatewayID -> entry
+}
+
+func newGrpcTestNet() *grpcTestNet {
+	return &grpcTestNet{
+		listeners: make(map[string]*bufconn.Listener),
+		gateways:  make(map[string]*registry.Info),
+	}
+}
+
+func (n *grpcTestNet) Lookup(_ context.Context, gatewayID string) (*registry.Info, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	info, ok := n.gateways[gatewayID]
+	if !ok {
+		return nil, fmt.Errorf("gateway %s: %w", gatewayID, registry.ErrGatewayNotFound)
+	}
+	return info, nil
+}
+
+func (n *grpcTestNet) List(context.Context) ([]*registry.Info, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	gateways := make([]*registry.Info, 0, len(n.gateways))
+	for _, info := range n.gateways {
+		gateways = append(gateways, info)
+	}
+	return gateways, nil
+}
+
+func (n *grpcTestNet) dial(ctx context.Context, addr string) (net.Conn, error) {
+	n.mu.Lock()
+	lis, ok := n.listeners[addr]
+	n.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("no listener at %s", addr)
+	}
+	return lis.DialContext(ctx)
+}
+
+// start runs a router for gatewayID listening on addr and registers it.
+// Restarting a gateway on the same addr replaces the old listener.
+func (n *grpcTestNet) start(t *testing.T, gatewayID, addr string, handler MessageHandler) *GrpcRouter {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 20)
+
+	r := NewGrpcRouter(gatewayID, n, GrpcConfig{AdvertiseAddr: addr, SendTimeout: 2 * time.Second})
+	r.listener = lis
+	r.dialOptions = []grpc.DialOption{grpc.WithContextDialer(n.dial)}
+
+	if err := r.Start(context.Background(), handler); err != nil {
+		t.Fatalf("Start(%s): %v", gatewayID, err)
+	}
+	t.Cleanup(func() { r.Stop() })
+
+	n.mu.Lock()
+	n.listeners[addr] = lis
+	n.gateways[gatewayID] = &registry.Info{GatewayID: gatewayID, PeerAddr: addr}
+	n.mu.Unlock()
+
+	return r
+}
+
+// grpcRecorder records the IDs of handled messages
+type grpcRecorder struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func (rec *grpcRecorder) handle(msg *Message) error {
+	rec.mu.Lock()
+	rec.ids = append(rec.ids, msg.ID)
+	rec.mu.Unlock()
+	return nil
+}
+
+func (rec *grpcRecorder) received() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]string(nil), rec.ids...)
+}
+
+// pendingFrames returns the number of frames r is waiting on acks for
+func pendingFrames(r *GrpcRouter, gatewayID string) int {
+	r.mu.Lock()
+	peer := r.peers[gatewayID]
+	r.mu.Unlock()
+
+	if peer == nil {
+		return 0
+	}
+
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	return len(peer.pending)
+}
+
+func TestGrpcRouterDeliversAfterAck(t *testing.T) {
+	n := newGrpcTestNet()
+	recA, recB := &grpcRecorder{}, &grpcRecorder{}
+	gwA := n.start(t, "gw-a", "a:9090", recA.handle)
+	n.start(t, "gw-b", "b:9090", recB.handle)
+
+	ctx := context.Background()
+
+	// RouteToGateway 返回时对端已处理并确认 / Handled and acked by the peer when RouteToGateway returns
+	if err := gwA.RouteToGateway(ctx, "gw-b", &Message{ID: "m1", From: "alice", To: "bob"}); err != nil {
+		t.Fatalf("RouteToGateway: %v", err)
+	}
+	if got := recB.received(); len(got) != 1 || got[0] != "m1" {
+		t.Fatalf("gw-b received %v, want [m1]", got)
+	}
+
+	// 本 Gateway 的消息在本地处理 / Messages for this gateway are handled locally
+	if err := gwA.RouteToGateway(ctx, "gw-a", &Message{ID: "m2"}); err != nil {
+		t.Fatalf("RouteToGateway to self: %v", err)
+	}
+	if got := recA.received(); len(got) != 1 || got[0] != "m2" {
+		t.Fatalf("gw-a received %v, want [m2]", got)
+	}
+
+	if err := gwA.BroadcastToAllGateways(ctx, &Message{ID: "b1"}); err != nil {
+		t.Fatalf("BroadcastToAllGateways: %v", err)
+	}
+	if got := recA.received(); len(got) != 2 || got[1] != "b1" {
+		t.Fatalf("gw-a received %v, want [m2 b1]", got)
+	}
+	if got := recB.received(); len(got) != 2 || got[1] != "b1" {
+		t.Fatalf("gw-b received %v, want [m1 b1]", got)
+	}
+
+	if err := gwA.RouteToGateway(ctx, "gw-missing", &Message{ID: "m3"}); !errors.Is(err, registry.ErrGatewayNotFound) {
+		t.Fatalf("RouteToGateway to unregistered gateway = %v, want ErrGatewayNotFound", err)
+	}
+}
+
+func TestGrpcRouterMatchesConcurrentAcksBySeq(t *testing.T) {
+	n := newGrpcTestNet()
+	recB := &grpcRecorder{}
+	gwA := n.start(t, "gw-a", "a:9090", (&grpcRecorder{}).handle)
+	n.start(t, "gw-b", "b:9090", recB.handle)
+
+	const count = 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- gwA.RouteToGateway(context.Background(), "gw-b", &Message{ID: fmt.Sprintf("m%d", i)})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("RouteToGateway: %v", err)
+		}
+	}
+
+	seen := make(map[string]int)
+	for _, id := range recB.received() {
+		seen[id]++
+	}
+	for i := 0; i < count; i++ {
+		if id := fmt.Sprintf("m%d", i); seen[id] != 1 {
+			t.Errorf("message %s received %d times, want 1", id, seen[id])
+		}
+	}
+	if p := pendingFrames(gwA, "gw-b"); p != 0 {
+		t.Fatalf("%d frames still pending after all acks", p)
+	}
+}
+
+func TestGrpcRouterSendDeadline(t *testing.T) {
+	n := newGrpcTestNet()
+
+	// gw-b 处理消息时阻塞，不会确认 / gw-b blocks in its handler, so it never acks
+	release := make(chan struct{})
+	gwA := n.start(t, "gw-a", "a:9090", (&grpcRecorder{}).handle)
+	n.start(t, "gw-b", "b:9090", func(*Message) error {
+		<-release
+		return nil
+	})
+	t.Cleanup(func() { close(release) })
+
+	gwA.config.SendTimeout = 200 * time.Millisecond
+
+	start := time.Now()
+	err := gwA.RouteToGateway(context.Background(), "gw-b", &Message{ID: "m1"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("RouteToGateway = %v, want DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("RouteToGateway took %s, want about SendTimeout", elapsed)
+	}
+
+	// ctx 的 deadline 优先于 SendTimeout / A ctx deadline takes precedence over SendTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start = time.Now()
+	if err := gwA.RouteToGateway(ctx, "gw-b", &Message{ID: "m2"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("RouteToGateway with ctx deadline = %v, want DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Fatalf("RouteToGateway took %s, want about the ctx deadline", elapsed)
+	}
+
+	if p := pendingFrames(gwA, "gw-b"); p != 0 {
+		t.Fatalf("%d frames still pending after timeouts", p)
+	}
+}
+
+// sendEventually retries until the message is acked, as a caller would after a peer restart
+func sendEventually(t *testing.T, r *GrpcRouter, gatewayID string, msg *Message) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		err := r.RouteToGateway(ctx, gatewayID, msg)
+		cancel()
+
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("RouteToGateway(%s) still failing: %v", msg.ID, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestGrpcRouterPeerRestart(t *testing.T) {
+	n := newGrpcTestNet()
+	gwA := n.start(t, "gw-a", "a:9090", (&grpcRecorder{}).handle)
+	gwB := n.start(t, "gw-b", "b:9090", (&grpcRecorder{}).handle)
+
+	if err := gwA.RouteToGateway(context.Background(), "gw-b", &Message{ID: "m1"}); err != nil {
+		t.Fatalf("RouteToGateway: %v", err)
+	}
+
+	// gw-b 停止后发送失败 / Sends fail while gw-b is down
+	gwB.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := gwA.RouteToGateway(ctx, "gw-b", &Message{ID: "m2"}); err == nil {
+		t.Fatal("RouteToGateway to a stopped gateway succeeded")
+	}
+
+	// 在同一地址重启后，流重新建立 / Restarted on the same address, the stream is reopened
+	recB := &grpcRecorder{}
+	n.start(t, "gw-b", "b:9090", recB.handle)
+
+	sendEventually(t, gwA, "gw-b", &Message{ID: "m3"})
+	if got := recB.received(); len(got) == 0 || got[len(got)-1] != "m3" {
+		t.Fatalf("restarted gw-b received %v, want m3 last", got)
+	}
+
+	// 迁移到新地址后，连接池替换该对端 / Moved to a new address, the pooled peer is replaced
+	recMoved := &grpcRecorder{}
+	n.start(t, "gw-b", "b2:9090", recMoved.handle)
+
+	if err := gwA.RouteToGateway(context.Background(), "gw-b", &Message{ID: "m4"}); err != nil {
+		t.Fatalf("RouteToGateway after move: %v", err)
+	}
+	if got := recMoved.received(); len(got) != 1 || got[0] != "m4" {
+		t.Fatalf("moved gw-b received %v, want [m4]", got)
+	}
+	if got := recB.received(); got[len(got)-1] == "m4" {
+		t.Fatal("message routed to the gateway's old address")
+	}
+}
+
+func TestPeerFrameRoundTrip(t *testing.T) {
+	for _, frame := range []peerFrame{
+		{},
+		{Seq: 1},
+		{Seq: 1 << 40, Message: &Message{ID: "m1", From: "alice", To: "bob", Content: "hi", Type: MessageTypeDirect}},
+	} {
+		data, err := frame.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary: %v", err)
+		}
+
+		var got peerFrame
+		if err := got.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary: %v", err)
+		}
+		if got.Seq != frame.Seq || (got.Message == nil) != (frame.Message == nil) {
+			t.Fatalf("round trip of %+v = %+v", frame, got)
+		}
+		if frame.Message != nil && (got.Message.ID != frame.Message.ID || got.Message.Content != frame.Message.Content) {
+			t.Fatalf("round trip message = %+v, want %+v", got.Message, frame.Message)
+		}
+	}
+
+	data, _ := (&peerAck{Seq: 42}).MarshalBinary()
+	var ack peerAck
+	if err := ack.UnmarshalBinary(data); err != nil || ack.Seq != 42 {
+		t.Fatalf("peerAck round trip = %+v, %v", ack, err)
+	}
+}
+
+func TestPeerFrameGolden(t *testing.T) {
+	golden, err := os.ReadFile("testdata/peer_frame.binpb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := peerFrame{Seq: 300, Message: &Message{
+		ID: "msg-1", From: "alice", To: "bob", Content: "hi", Type: MessageTypeDirect, Timestamp: 1700000000123,
+	}}
+	data, err := want.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, golden) {
+		t.Fatalf("encoded\n% x\nwant (protoc)\n% x", data, golden)
+	}
+
+	var got peerFrame
+	if err := got.UnmarshalBinary(golden); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("decoded %+v, want %+v", got, want)
+	}
+}
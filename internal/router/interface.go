@@ -27,3 +27,9 @@ var _ RouterInterface = (*Router)(nil)
 
 // Ensure KafkaRouter implements RouterInterface
 var _ RouterInterface = (*KafkaRouter)(nil)
+
+// Ensure StreamRouter implements RouterInterface
+var _ RouterInterface = (*StreamRouter)(nil)
+
+// Ensure MemoryRouter implements RouterInterface
+var _ RouterInterface = (*MemoryRouter)(nil)
@@ -0,0 +1,270 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// KafkaDLQTopic receives messages that could not be delivered after all retries
+// 重试耗尽后仍无法投递的消息进入死信 topic
+const KafkaDLQTopic = "gateway-dlq"
+
+// Kafka record headers used by the retry policy and the dead-letter topic
+// 重试策略和死信 topic 使用的消息头
+const (
+	KafkaHeaderAttempt       = "attempt"        // 已失败的投递次数 / Failed delivery attempts so far
+	KafkaHeaderRetryAt       = "retry_at"       // 重试时间（Unix 毫秒）/ When the retry is due (Unix ms)
+	KafkaHeaderOriginalTopic = "original_topic" // 消息最初所在的 topic / Topic the message was first routed to
+	KafkaHeaderDLQReason     = "dlq_reason"     // 进入死信的原因 / Why the message was dead-lettered
+	KafkaHeaderFailedGateway = "failed_gateway" // 投递失败的 Gateway / Gateway that gave up on the message
+	KafkaHeaderFailedAt      = "failed_at"      // 进入死信的时间（Unix 毫秒）/ When it was dead-lettered (Unix ms)
+)
+
+// Default retry policy, used when KafkaConfig leaves the fields at zero
+// KafkaConfig 未设置时使用的默认重试策略
+const (
+	DefaultKafkaMaxAttempts     = 5
+	DefaultKafkaRetryBackoff    = time.Second
+	DefaultKafkaMaxRetryBackoff = time.Minute
+)
+
+// kafkaRetryPolicy is the retry part of KafkaConfig with defaults applied
+type kafkaRetryPolicy struct {
+	MaxAttempts     int
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+}
+
+// newKafkaRetryPolicy fills unset retry settings with the defaults
+func newKafkaRetryPolicy(config KafkaConfig) kafkaRetryPolicy {
+	policy := kafkaRetryPolicy{
+		MaxAttempts:     config.MaxAttempts,
+		RetryBackoff:    config.RetryBackoff,
+		MaxRetryBackoff: config.MaxRetryBackoff,
+	}
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = DefaultKafkaMaxAttempts
+	}
+	if policy.RetryBackoff <= 0 {
+		policy.RetryBackoff = DefaultKafkaRetryBackoff
+	}
+	if policy.MaxRetryBackoff <= 0 {
+		policy.MaxRetryBackoff = DefaultKafkaMaxRetryBackoff
+	}
+	return policy
+}
+
+// Dead-letter reasons used as the "reason" metric label
+const (
+	deadLetterDecode        = "decode"
+	deadLetterUndeliverable = "undeliverable"
+)
+
+// retryBackoff returns the delay before retrying after the given failed attempt,
+// doubling from RetryBackoff up to MaxRetryBackoff
+// 计算第 attempt 次失败后的重试延迟（指数退避）
+func (r *KafkaRouter) retryBackoff(attempt int) time.Duration {
+	backoff := r.retry.RetryBackoff
+	for i := 1; i < attempt && backoff < r.retry.MaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > r.retry.MaxRetryBackoff {
+		backoff = r.retry.MaxRetryBackoff
+	}
+	return backoff
+}
+
+// retryOrDeadLetter republishes a message that failed delivery to this
+// gateway's retry topic, or to the DLQ once MaxAttempts is reached
+// 将投递失败的消息发布到重试 topic，达到最大次数后发布到死信 topic
+func (r *KafkaRouter) retryOrDeadLetter(msg *sarama.ConsumerMessage, cause error) error {
+	attempt := int(headerInt(msg.Headers, KafkaHeaderAttempt)) + 1
+
+	if attempt >= r.retry.MaxAttempts {
+		return r.deadLetter(msg, attempt, deadLetterUndeliverable, cause)
+	}
+
+	retryAt := time.Now().Add(r.retryBackoff(attempt))
+
+	headers := copyHeaders(msg.Headers, KafkaHeaderAttempt, KafkaHeaderRetryAt, KafkaHeaderOriginalTopic)
+	headers = append(headers,
+		header(KafkaHeaderAttempt, strconv.Itoa(attempt)),
+		header(KafkaHeaderRetryAt, strconv.FormatInt(retryAt.UnixMilli(), 10)),
+		header(KafkaHeaderOriginalTopic, originalTopic(msg)),
+	)
+
+	retryMsg := &sarama.ProducerMessage{
+		Topic:   r.retryTopic(),
+		Key:     sarama.ByteEncoder(msg.Key),
+		Value:   sarama.ByteEncoder(msg.Value),
+		Headers: headers,
+	}
+	if _, _, err := r.send(retryMsg, publishRetry); err != nil {
+		return fmt.Errorf("failed to publish retry: %w", err)
+	}
+
+	kafkaRetriesTotal.WithLabelValues(strconv.Itoa(attempt)).Inc()
+	r.stats.retried.Add(1)
+	log.Printf("[KafkaRouter] Delivery attempt %d of %s/%d/%d failed (%v), retrying at %s",
+		attempt, msg.Topic, msg.Partition, msg.Offset, cause, retryAt.Format(time.RFC3339))
+
+	return nil
+}
+
+// deadLetter publishes a message to the DLQ with its original headers, the
+// failure reason and the number of attempts
+// 将消息连同原始消息头、失败原因和尝试次数发布到死信 topic
+func (r *KafkaRouter) deadLetter(msg *sarama.ConsumerMessage, attempts int, reason string, cause error) error {
+	headers := copyHeaders(msg.Headers, KafkaHeaderAttempt, KafkaHeaderRetryAt, KafkaHeaderOriginalTopic)
+	headers = append(headers,
+		header(KafkaHeaderAttempt, strconv.Itoa(attempts)),
+		header(KafkaHeaderOriginalTopic, originalTopic(msg)),
+		header(KafkaHeaderDLQReason, cause.Error()),
+		header(KafkaHeaderFailedGateway, r.gatewayID),
+		header(KafkaHeaderFailedAt, strconv.FormatInt(time.Now().UnixMilli(), 10)),
+	)
+
+	dlqMsg := &sarama.ProducerMessage{
+		Topic:   KafkaDLQTopic,
+		Key:     sarama.ByteEncoder(msg.Key),
+		Value:   sarama.ByteEncoder(msg.Value),
+		Headers: headers,
+	}
+	if _, _, err := r.send(dlqMsg, publishDeadLetter); err != nil {
+		return fmt.Errorf("failed to publish to DLQ: %w", err)
+	}
+
+	kafkaDeadLetteredTotal.WithLabelValues(reason).Inc()
+	r.stats.deadLettered.Add(1)
+	log.Printf("[KafkaRouter] Dead-lettered %s/%d/%d after %d attempts: %v",
+		msg.Topic, msg.Partition, msg.Offset, attempts, cause)
+
+	return nil
+}
+
+// publishUntilDone calls publish until it succeeds, backing off between
+// attempts as for delivery retries. It returns false if the session ends
+// first, leaving the message unmarked so it is consumed again after the
+// rebalance rather than lost.
+// 反复发布直到成功；会话结束时返回 false，消息未标记，不会丢失
+func (r *KafkaRouter) publishUntilDone(session sarama.ConsumerGroupSession, msg *sarama.ConsumerMessage, publish func() error) bool {
+	for attempt := 1; ; attempt++ {
+		err := publish()
+		if err == nil {
+			return true
+		}
+
+		wait := r.retryBackoff(attempt)
+		log.Printf("[KafkaRouter] Failed to republish %s/%d/%d, retrying in %v: %v",
+			msg.Topic, msg.Partition, msg.Offset, wait, err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-session.Context().Done():
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// waitUntilDue blocks until a retry message's retry_at has passed. It returns
+// false if the session ends first, leaving the message unmarked so it is
+// consumed again after the rebalance.
+//
+// The wait happens inline in ConsumeClaim, so a message that is not yet due
+// holds up every message behind it on the same retry partition, even ones
+// that are due sooner. Each wait is bounded by MaxRetryBackoff, so this
+// head-of-line blocking delays retries but never loses them; giving the retry
+// topic more partitions spreads the delay.
+// 等待重试消息到期；会话结束时返回 false，消息未标记，重平衡后会重新消费。
+// 等待在 ConsumeClaim 中进行，未到期的消息会阻塞同一重试分区中其后的消息
+func waitUntilDue(session sarama.ConsumerGroupSession, msg *sarama.ConsumerMessage) bool {
+	wait := time.Until(time.UnixMilli(headerInt(msg.Headers, KafkaHeaderRetryAt)))
+	if wait <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-session.Context().Done():
+		return false
+	}
+}
+
+// ReplayHeaders returns a dead-lettered message's headers without the retry
+// and DLQ bookkeeping, so a replayed message starts with a fresh retry budget
+// 去掉重试和死信相关的消息头，重放的消息重新开始计数
+func ReplayHeaders(headers []*sarama.RecordHeader) []sarama.RecordHeader {
+	return copyHeaders(headers,
+		KafkaHeaderAttempt,
+		KafkaHeaderRetryAt,
+		KafkaHeaderOriginalTopic,
+		KafkaHeaderDLQReason,
+		KafkaHeaderFailedGateway,
+		KafkaHeaderFailedAt,
+	)
+}
+
+// HeaderValue returns the value of a record header, or "" if it is absent
+// 返回消息头的值，不存在时返回空字符串
+func HeaderValue(headers []*sarama.RecordHeader, key string) string {
+	for _, h := range headers {
+		if h != nil && string(h.Key) == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// headerInt parses an integer header, treating a missing or invalid value as 0
+func headerInt(headers []*sarama.RecordHeader, key string) int64 {
+	n, err := strconv.ParseInt(HeaderValue(headers, key), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// copyHeaders copies consumed headers for producing, skipping the given keys
+func copyHeaders(headers []*sarama.RecordHeader, drop ...string) []sarama.RecordHeader {
+	copied := make([]sarama.RecordHeader, 0, len(headers))
+
+next:
+	for _, h := range headers {
+		if h == nil {
+			continue
+		}
+		for _, key := range drop {
+			if string(h.Key) == key {
+				continue next
+			}
+		}
+		copied = append(copied, sarama.RecordHeader{Key: h.Key, Value: h.Value})
+	}
+	return copied
+}
+
+// originalTopic returns the topic a message was first routed to
+func originalTopic(msg *sarama.ConsumerMessage) string {
+	if topic := HeaderValue(msg.Headers, KafkaHeaderOriginalTopic); topic != "" {
+		return topic
+	}
+	return msg.Topic
+}
+
+func header(key, value string) sarama.RecordHeader {
+	return sarama.RecordHeader{Key: []byte(key), Value: []byte(value)}
+}
+
+// errDecode wraps message decode failures, which are dead-lettered without retrying
+var errDecode = errors.New("failed to decode message")
@@ -2,36 +2,79 @@ package router
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/IBM/sarama"
 )
 
+// broadcastTopic is consumed by every gateway
+// 所有 Gateway 都会消费的广播 topic
+const broadcastTopic = "gateway-broadcast"
+
 // KafkaRouter implements message routing using Kafka
 // Kafka Router 使用 Kafka 实现消息路由
 type KafkaRouter struct {
-	producer  sarama.SyncProducer      // Kafka 生产者 / Kafka producer
-	consumer  sarama.ConsumerGroup     // Kafka 消费者组 / Kafka consumer group
-	gatewayID string                   // 本 Gateway 的唯一 ID / This Gateway's unique ID
-	handler   MessageHandler           // 本地消息处理回调 / Local message handler callback
-	ctx       context.Context          // Context for lifecycle management
-	cancel    context.CancelFunc       // Cancel function
-	wg        sync.WaitGroup           // Wait group for goroutines
-	brokers   []string                 // Kafka broker 地址列表 / Kafka broker addresses
+	producer          sarama.SyncProducer  // Kafka 生产者 / Kafka producer
+	consumer          sarama.ConsumerGroup // Kafka 消费者组 / Kafka consumer group
+	broadcastConsumer sarama.ConsumerGroup // 本 Gateway 独占的广播消费者组 / Per-gateway consumer group for broadcasts
+	gatewayID         string               // 本 Gateway 的唯一 ID / This Gateway's unique ID
+	handler           MessageHandler       // 本地消息处理回调 / Local message handler callback
+	ctx               context.Context      // Context for lifecycle management
+	cancel            context.CancelFunc   // Cancel function
+	wg                sync.WaitGroup       // Wait group for goroutines
+	brokers           []string             // Kafka broker 地址列表 / Kafka broker addresses
+	retry             kafkaRetryPolicy     // 投递失败的重试策略 / Retry policy for failed deliveries
+	stats             kafkaStats           // 本路由器的流量统计 / This router's traffic, for GetMetrics
+}
+
+// kafkaStats counts one router's traffic for GetMetrics; the Prometheus
+// metrics aggregate every router in the process
+// kafkaStats 统计单个路由器的流量，供 GetMetrics 使用
+type kafkaStats struct {
+	produced       atomic.Uint64
+	produceErrors  atomic.Uint64
+	consumed       atomic.Uint64
+	consumerErrors atomic.Uint64
+	retried        atomic.Uint64
+	deadLettered   atomic.Uint64
+
+	mu  sync.Mutex
+	lag map[string]int64 // "topic/partition" -> 距高水位的消息数 / messages behind the high watermark
+}
+
+// setLag records how far a partition's consumer is behind
+func (s *kafkaStats) setLag(topic string, partition int32, lag int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lag == nil {
+		s.lag = make(map[string]int64)
+	}
+	s.lag[fmt.Sprintf("%s/%d", topic, partition)] = lag
 }
 
 // KafkaConfig holds Kafka-specific configuration
 // KafkaConfig 保存 Kafka 特定配置
 type KafkaConfig struct {
-	Brokers       []string      // Kafka broker 地址 / Kafka broker addresses (e.g., ["localhost:9092"])
-	ConsumerGroup string        // 消费者组 ID / Consumer group ID
-	Version       string        // Kafka 版本 / Kafka version (e.g., "3.0.0")
-	ReturnErrors  bool          // 是否返回错误 / Whether to return errors
-	Compression   string        // 压缩算法 / Compression codec ("none", "gzip", "snappy", "lz4", "zstd")
+	Brokers       []string // Kafka broker 地址 / Kafka broker addresses (e.g., ["localhost:9092"])
+	ConsumerGroup string   // 消费者组 ID / Consumer group ID
+	Version       string   // Kafka 版本 / Kafka version (e.g., "3.0.0")
+	ReturnErrors  bool     // 是否返回错误 / Whether to return errors
+	Compression   string   // 压缩算法 / Compression codec ("none", "gzip", "snappy", "lz4", "zstd")
+
+	// 投递失败的消息发布到本 Gateway 的重试 topic，按指数退避重试，
+	// 达到 MaxAttempts 后进入死信 topic。零值使用默认值。
+	// Failed deliveries are republished to this gateway's retry topic with
+	// exponential backoff, and sent to the DLQ after MaxAttempts. Zero values use the defaults.
+	MaxAttempts     int           // 进入死信前的最大投递次数 / Delivery attempts before dead-lettering
+	RetryBackoff    time.Duration // 首次重试延迟 / Delay before the first retry, doubled per attempt
+	MaxRetryBackoff time.Duration // 重试延迟上限 / Upper bound on the retry delay
 }
 
 // NewKafkaRouter creates a new Kafka-based router
@@ -47,7 +90,7 @@ func NewKafkaRouter(gatewayID string, config KafkaConfig) (*KafkaRouter, error)
 	producerConfig := sarama.NewConfig()
 	producerConfig.Version = version
 	producerConfig.Producer.RequiredAcks = sarama.WaitForAll // 等待所有副本确认 / Wait for all replicas
-	producerConfig.Producer.Retry.Max = 3                     // 重试 3 次 / Retry 3 times
+	producerConfig.Producer.Retry.Max = 3                    // 重试 3 次 / Retry 3 times
 	producerConfig.Producer.Return.Successes = true
 	producerConfig.Producer.Return.Errors = config.ReturnErrors
 	producerConfig.Producer.Partitioner = sarama.NewHashPartitioner // 使用 hash 分区保证顺序 / Use hash partitioner for ordering
@@ -86,15 +129,27 @@ func NewKafkaRouter(gatewayID string, config KafkaConfig) (*KafkaRouter, error)
 		return nil, fmt.Errorf("failed to create Kafka consumer group: %w", err)
 	}
 
+	// 广播需要每个 Gateway 都收到全部消息，因此每个 Gateway 使用独立的消费者组
+	// Every gateway must see every broadcast, so each one uses its own consumer group
+	broadcastGroup := fmt.Sprintf("%s-%s-broadcast", config.ConsumerGroup, gatewayID)
+	broadcastConsumer, err := sarama.NewConsumerGroup(config.Brokers, broadcastGroup, consumerConfig)
+	if err != nil {
+		consumer.Close()
+		producer.Close()
+		return nil, fmt.Errorf("failed to create Kafka broadcast consumer group: %w", err)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	return &KafkaRouter{
-		producer:  producer,
-		consumer:  consumer,
-		gatewayID: gatewayID,
-		ctx:       ctx,
-		cancel:    cancel,
-		brokers:   config.Brokers,
+		producer:          producer,
+		consumer:          consumer,
+		broadcastConsumer: broadcastConsumer,
+		gatewayID:         gatewayID,
+		ctx:               ctx,
+		cancel:            cancel,
+		brokers:           config.Brokers,
+		retry:             newKafkaRetryPolicy(config),
 	}, nil
 }
 
@@ -105,30 +160,44 @@ func (r *KafkaRouter) Start(ctx context.Context, handler MessageHandler) error {
 
 	// 获取本 Gateway 的 topic / Get this Gateway's topic
 	topic := r.getGatewayTopic(r.gatewayID)
+	retryTopic := r.retryTopic()
 
-	log.Printf("[KafkaRouter] Starting consumer for topic: %s", topic)
+	log.Printf("[KafkaRouter] Starting consumer for topics: %s, %s", topic, retryTopic)
+
+	consumerHandler := &kafkaConsumerHandler{
+		handler: handler,
+		router:  r,
+	}
+
+	// 启动消费者协程 / Start consumer goroutines
+	// 重试 topic 与本 Gateway 的 topic 共用消费者组 / The retry topic shares this gateway's consumer group
+	r.consume(r.consumer, []string{topic, retryTopic}, consumerHandler)
+	r.consume(r.broadcastConsumer, []string{broadcastTopic}, consumerHandler)
+
+	log.Printf("[KafkaRouter] Started consuming from topics: %s, %s, %s", topic, retryTopic, broadcastTopic)
+	return nil
+}
+
+// consume runs a consumer group on topics until the router is stopped
+// 在路由器停止前持续消费指定 topic
+func (r *KafkaRouter) consume(group sarama.ConsumerGroup, topics []string, handler sarama.ConsumerGroupHandler) {
+	topic := strings.Join(topics, ",")
 
-	// 启动消费者协程 / Start consumer goroutine
 	r.wg.Add(1)
 	go func() {
 		defer r.wg.Done()
 
-		consumerHandler := &kafkaConsumerHandler{
-			handler: handler,
-			router:  r,
-		}
-
 		for {
 			// 消费消息（会自动重连）/ Consume messages (auto-reconnects)
-			err := r.consumer.Consume(r.ctx, []string{topic}, consumerHandler)
+			err := group.Consume(r.ctx, topics, handler)
 			if err != nil {
-				log.Printf("[KafkaRouter] Consumer error: %v", err)
+				log.Printf("[KafkaRouter] Consumer error on %s: %v", topic, err)
 			}
 
 			// 检查是否应该退出 / Check if should exit
 			select {
 			case <-r.ctx.Done():
-				log.Println("[KafkaRouter] Context cancelled, stopping consumer")
+				log.Printf("[KafkaRouter] Context cancelled, stopping consumer for %s", topic)
 				return
 			default:
 				// 出错后等待 1 秒重试 / Wait 1 second before retry
@@ -141,13 +210,12 @@ func (r *KafkaRouter) Start(ctx context.Context, handler MessageHandler) error {
 	r.wg.Add(1)
 	go func() {
 		defer r.wg.Done()
-		for err := range r.consumer.Errors() {
-			log.Printf("[KafkaRouter] Consumer group error: %v", err)
+		for err := range group.Errors() {
+			kafkaConsumerErrorsTotal.WithLabelValues(topic).Inc()
+			r.stats.consumerErrors.Add(1)
+			log.Printf("[KafkaRouter] Consumer group error on %s: %v", topic, err)
 		}
 	}()
-
-	log.Printf("[KafkaRouter] Started consuming from topic: %s", topic)
-	return nil
 }
 
 // Stop gracefully stops the Kafka router
@@ -161,10 +229,13 @@ func (r *KafkaRouter) Stop() error {
 	// 等待所有 goroutine 结束 / Wait for all goroutines to finish
 	r.wg.Wait()
 
-	// 关闭消费者 / Close consumer
+	// 关闭消费者 / Close consumers
 	if err := r.consumer.Close(); err != nil {
 		log.Printf("[KafkaRouter] Error closing consumer: %v", err)
 	}
+	if err := r.broadcastConsumer.Close(); err != nil {
+		log.Printf("[KafkaRouter] Error closing broadcast consumer: %v", err)
+	}
 
 	// 关闭生产者 / Close producer
 	if err := r.producer.Close(); err != nil {
@@ -182,7 +253,7 @@ func (r *KafkaRouter) RouteToGateway(ctx context.Context, targetGatewayID string
 	topic := r.getGatewayTopic(targetGatewayID)
 
 	// 序列化消息 / Serialize message
-	data, err := json.Marshal(msg)
+	data, err := msg.MarshalBinary()
 	if err != nil {
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
@@ -191,7 +262,7 @@ func (r *KafkaRouter) RouteToGateway(ctx context.Context, targetGatewayID string
 	kafkaMsg := &sarama.ProducerMessage{
 		Topic: topic,
 		Key:   sarama.StringEncoder(msg.To), // 使用目标用户 ID 作为 key，保证同一用户的消息有序
-		                                       // Use target userId as key to ensure ordering for same user
+		// Use target userId as key to ensure ordering for same user
 		Value: sarama.ByteEncoder(data),
 		Headers: []sarama.RecordHeader{
 			{
@@ -206,7 +277,7 @@ func (r *KafkaRouter) RouteToGateway(ctx context.Context, targetGatewayID string
 	}
 
 	// 发送消息 / Send message
-	partition, offset, err := r.producer.SendMessage(kafkaMsg)
+	partition, offset, err := r.send(kafkaMsg, publishDirect)
 	if err != nil {
 		return fmt.Errorf("failed to send message to Kafka: %w", err)
 	}
@@ -221,9 +292,9 @@ func (r *KafkaRouter) RouteToGateway(ctx context.Context, targetGatewayID string
 // 向所有 Gateway 广播消息
 func (r *KafkaRouter) BroadcastToAllGateways(ctx context.Context, msg *Message) error {
 	// 使用特殊的广播 topic / Use special broadcast topic
-	topic := "gateway-broadcast"
+	topic := broadcastTopic
 
-	data, err := json.Marshal(msg)
+	data, err := msg.MarshalBinary()
 	if err != nil {
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
@@ -243,7 +314,7 @@ func (r *KafkaRouter) BroadcastToAllGateways(ctx context.Context, msg *Message)
 		},
 	}
 
-	partition, offset, err := r.producer.SendMessage(kafkaMsg)
+	partition, offset, err := r.send(kafkaMsg, publishBroadcast)
 	if err != nil {
 		return fmt.Errorf("failed to broadcast message to Kafka: %w", err)
 	}
@@ -254,12 +325,38 @@ func (r *KafkaRouter) BroadcastToAllGateways(ctx context.Context, msg *Message)
 	return nil
 }
 
+// send produces a message and records producer metrics
+// 发送消息并记录生产者指标
+func (r *KafkaRouter) send(msg *sarama.ProducerMessage, kind string) (int32, int64, error) {
+	start := time.Now()
+	partition, offset, err := r.producer.SendMessage(msg)
+	observePublish(routerKafka, start)
+
+	if err != nil {
+		kafkaProduceErrorsTotal.WithLabelValues(msg.Topic).Inc()
+		publishErrorsTotal.WithLabelValues(routerKafka, kind).Inc()
+		r.stats.produceErrors.Add(1)
+		return partition, offset, err
+	}
+
+	kafkaProducedTotal.WithLabelValues(msg.Topic).Inc()
+	r.stats.produced.Add(1)
+	publishedTotal.WithLabelValues(routerKafka, kind).Inc()
+	return partition, offset, nil
+}
+
 // getGatewayTopic returns the Kafka topic name for a gateway
 // 返回 Gateway 的 Kafka topic 名称
 func (r *KafkaRouter) getGatewayTopic(gatewayID string) string {
 	return fmt.Sprintf("gateway-%s", gatewayID)
 }
 
+// retryTopic returns the topic this gateway's failed deliveries are retried from
+// 返回本 Gateway 投递失败消息的重试 topic
+func (r *KafkaRouter) retryTopic() string {
+	return fmt.Sprintf("gateway-%s-retry", r.gatewayID)
+}
+
 // kafkaConsumerHandler implements sarama.ConsumerGroupHandler
 // kafkaConsumerHandler 实现 sarama.ConsumerGroupHandler 接口
 type kafkaConsumerHandler struct {
@@ -291,11 +388,32 @@ func (h *kafkaConsumerHandler) ConsumeClaim(session sarama.ConsumerGroupSession,
 				return nil
 			}
 
+			// 记录消费量和分区积压 / Record consumption and per-partition lag
+			partition := strconv.Itoa(int(msg.Partition))
+			lag := claim.HighWaterMarkOffset() - msg.Offset - 1
+			kafkaConsumedTotal.WithLabelValues(msg.Topic, partition).Inc()
+			kafkaConsumerLag.WithLabelValues(msg.Topic, partition).Set(float64(lag))
+			h.router.stats.consumed.Add(1)
+			h.router.stats.setLag(msg.Topic, msg.Partition, lag)
+
+			// 重试消息等到期后再处理 / Retries wait until they are due
+			if msg.Topic == h.router.retryTopic() && !waitUntilDue(session, msg) {
+				return nil
+			}
+
 			// 反序列化消息 / Deserialize message
-			var routedMsg Message
-			if err := json.Unmarshal(msg.Value, &routedMsg); err != nil {
+			routedMsg, err := DecodeMessage(msg.Value)
+			if err != nil {
+				decodeErrorsTotal.WithLabelValues(routerKafka).Inc()
 				log.Printf("[KafkaRouter] Failed to unmarshal message: %v", err)
-				// 标记为已处理，跳过错误消息 / Mark as processed, skip bad message
+				// 无法解析的消息重试无意义，直接进入死信 / Retrying cannot fix a bad payload, dead-letter it
+				attempts := int(headerInt(msg.Headers, KafkaHeaderAttempt)) + 1
+				cause := fmt.Errorf("%w: %v", errDecode, err)
+				if !h.router.publishUntilDone(session, msg, func() error {
+					return h.router.deadLetter(msg, attempts, deadLetterDecode, cause)
+				}) {
+					return nil
+				}
 				session.MarkMessage(msg, "")
 				continue
 			}
@@ -312,9 +430,18 @@ func (h *kafkaConsumerHandler) ConsumeClaim(session sarama.ConsumerGroupSession,
 			log.Printf("[KafkaRouter] Received message for delivery: from=%s to=%s (partition=%d, offset=%d)",
 				routedMsg.From, routedMsg.To, msg.Partition, msg.Offset)
 
-			// 调用处理器 / Call handler
+			receivedTotal.WithLabelValues(routerKafka).Inc()
+
+			// 调用处理器，失败则重试或进入死信 / Call handler, retrying or dead-lettering on failure
 			if h.handler != nil {
-				h.handler(&routedMsg)
+				if err := h.handler(routedMsg); err != nil {
+					// 发布失败时不标记偏移量 / Never mark the offset until the retry or DLQ copy is published
+					if !h.router.publishUntilDone(session, msg, func() error {
+						return h.router.retryOrDeadLetter(msg, err)
+					}) {
+						return nil
+					}
+				}
 			}
 
 			// 标记消息已处理 / Mark message as processed
@@ -326,12 +453,28 @@ func (h *kafkaConsumerHandler) ConsumeClaim(session sarama.ConsumerGroupSession,
 	}
 }
 
-// GetMetrics returns Kafka-specific metrics
-// 返回 Kafka 特定的指标
+// GetMetrics returns this router's configuration and live traffic counters:
+// messages produced and consumed, failures, retries, dead letters and the
+// consumer lag of each partition it has read
+// 返回本路由器的配置和实时流量统计
 func (r *KafkaRouter) GetMetrics() map[string]interface{} {
+	r.stats.mu.Lock()
+	lag := make(map[string]int64, len(r.stats.lag))
+	for partition, behind := range r.stats.lag {
+		lag[partition] = behind
+	}
+	r.stats.mu.Unlock()
+
 	return map[string]interface{}{
-		"gateway_id": r.gatewayID,
-		"brokers":    r.brokers,
-		"topic":      r.getGatewayTopic(r.gatewayID),
+		"gateway_id":      r.gatewayID,
+		"brokers":         r.brokers,
+		"topic":           r.getGatewayTopic(r.gatewayID),
+		"produced":        r.stats.produced.Load(),
+		"produce_errors":  r.stats.produceErrors.Load(),
+		"consumed":        r.stats.consumed.Load(),
+		"consumer_errors": r.stats.consumerErrors.Load(),
+		"retried":         r.stats.retried.Load(),
+		"dead_lettered":   r.stats.deadLettered.Load(),
+		"consumer_lag":    lag,
 	}
 }
@@ -0,0 +1,145 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+)
+
+func TestKafkaRouterGetMetricsCountsTraffic(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	defer producer.Close()
+
+	r := &KafkaRouter{
+		producer:  producer,
+		gatewayID: "gw1",
+		retry:     newKafkaRetryPolicy(KafkaConfig{MaxAttempts: 2}),
+	}
+
+	producer.ExpectSendMessageAndSucceed()
+	if err := r.RouteToGateway(context.Background(), "gw2", &Message{ID: "m1", From: "alice", To: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	producer.ExpectSendMessageAndFail(errors.New("broker down"))
+	if err := r.RouteToGateway(context.Background(), "gw2", &Message{ID: "m2", From: "alice", To: "bob"}); err == nil {
+		t.Fatal("RouteToGateway succeeded with a failing producer")
+	}
+
+	// A first failed delivery is retried, the second dead-lettered
+	failed := &sarama.ConsumerMessage{Topic: "gateway-gw1", Value: []byte("{}")}
+	producer.ExpectSendMessageAndSucceed()
+	if err := r.retryOrDeadLetter(failed, errors.New("not local")); err != nil {
+		t.Fatal(err)
+	}
+	failed.Headers = []*sarama.RecordHeader{{Key: []byte(KafkaHeaderAttempt), Value: []byte("1")}}
+	producer.ExpectSendMessageAndSucceed()
+	if err := r.retryOrDeadLetter(failed, errors.New("not local")); err != nil {
+		t.Fatal(err)
+	}
+
+	r.stats.setLag("gateway-gw1", 3, 7)
+
+	got := r.GetMetrics()
+	want := map[string]uint64{
+		"produced":        3,
+		"produce_errors":  1,
+		"consumed":        0,
+		"consumer_errors": 0,
+		"retried":         1,
+		"dead_lettered":   1,
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("GetMetrics()[%q] = %v, want %d", key, got[key], value)
+		}
+	}
+	if lag := got["consumer_lag"].(map[string]int64); lag["gateway-gw1/3"] != 7 {
+		t.Errorf("consumer_lag = %v, want gateway-gw1/3: 7", lag)
+	}
+}
+
+// fakeSession records marked messages; fakeClaim feeds a fixed batch
+type fakeSession struct {
+	sarama.ConsumerGroupSession
+	ctx    context.Context
+	marked []int64
+}
+
+func (s *fakeSession) Context() context.Context { return s.ctx }
+
+func (s *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, _ string) {
+	s.marked = append(s.marked, msg.Offset)
+}
+
+type fakeClaim struct {
+	sarama.ConsumerGroupClaim
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c *fakeClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+func (c *fakeClaim) HighWaterMarkOffset() int64               { return 1 }
+
+// consumeFailing consumes one message whose delivery fails with handler's error
+func consumeFailing(t *testing.T, ctx context.Context, producer *mocks.SyncProducer, backoff time.Duration, handler MessageHandler) *fakeSession {
+	t.Helper()
+	value, err := (&Message{ID: "m1", From: "alice", To: "bob"}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &kafkaConsumerHandler{
+		handler: handler,
+		router: &KafkaRouter{
+			producer:  producer,
+			gatewayID: "gw1",
+			retry:     newKafkaRetryPolicy(KafkaConfig{RetryBackoff: backoff}),
+		},
+	}
+	claim := &fakeClaim{messages: make(chan *sarama.ConsumerMessage, 1)}
+	claim.messages <- &sarama.ConsumerMessage{Topic: "gateway-gw1", Value: value}
+	close(claim.messages)
+
+	session := &fakeSession{ctx: ctx}
+	if err := h.ConsumeClaim(session, claim); err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func TestKafkaConsumerRetriesFailedRepublish(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	defer producer.Close()
+
+	// 重试 topic 发布失败两次后成功 / Publishing to the retry topic fails twice, then succeeds
+	producer.ExpectSendMessageAndFail(errors.New("broker down"))
+	producer.ExpectSendMessageAndFail(errors.New("broker down"))
+	producer.ExpectSendMessageAndSucceed()
+
+	notLocal := func(*Message) error { return errors.New("not local") }
+	session := consumeFailing(t, context.Background(), producer, time.Millisecond, notLocal)
+	if len(session.marked) != 1 {
+		t.Fatalf("marked %d messages, want 1 after the republish succeeded", len(session.marked))
+	}
+}
+
+func TestKafkaConsumerLeavesMessageUnmarkedWhenSessionEnds(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	defer producer.Close()
+
+	// 会话结束时消息保持未标记 / The message stays unmarked when the session ends
+	ctx, cancel := context.WithCancel(context.Background())
+	producer.ExpectSendMessageAndFail(errors.New("broker down"))
+
+	session := consumeFailing(t, ctx, producer, time.Minute, func(*Message) error {
+		cancel()
+		return errors.New("not local")
+	})
+	if len(session.marked) != 0 {
+		t.Fatalf("marked %v after the republish failed", session.marked)
+	}
+}
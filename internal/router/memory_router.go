@@ -0,0 +1,189 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+const (
+	routerMemory = "memory"
+
+	// memoryInboxSize bounds each gateway's queue of undelivered messages
+	memoryInboxSize = 1024
+)
+
+// MemoryBus connects MemoryRouters in the same process, standing in for
+// Redis Pub/Sub. Several in-process gateways share one bus.
+type MemoryBus struct {
+	mu       sync.RWMutex
+	gateways map[string]*MemoryRouter // gatewayID -> started router
+}
+
+// NewMemoryBus creates an empty in-memory bus
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{
+		gateways: make(map[string]*MemoryRouter),
+	}
+}
+
+func (b *MemoryBus) attach(r *MemoryRouter) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, exists := b.gateways[r.gatewayID]; exists {
+		return fmt.Errorf("gateway %s already attached to the bus", r.gatewayID)
+	}
+	b.gateways[r.gatewayID] = r
+	return nil
+}
+
+func (b *MemoryBus) detach(r *MemoryRouter) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.gateways[r.gatewayID] == r {
+		delete(b.gateways, r.gatewayID)
+	}
+}
+
+func (b *MemoryBus) lookup(gatewayID string) (*MemoryRouter, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	r, ok := b.gateways[gatewayID]
+	return r, ok
+}
+
+func (b *MemoryBus) all() []*MemoryRouter {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	routers := make([]*MemoryRouter, 0, len(b.gateways))
+	for _, r := range b.gateways {
+		routers = append(routers, r)
+	}
+	return routers
+}
+
+// MemoryRouter routes messages between gateways attached to the same
+// MemoryBus. Like Pub/Sub, messages for gateways that are not running are
+// dropped. Each router delivers from its own queue in a single goroutine,
+// so handlers run asynchronously and in order, as with a real broker.
+type MemoryRouter struct {
+	bus       *MemoryBus
+	gatewayID string
+	handler   MessageHandler
+	inbox     chan *Message
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewMemoryRouter creates a router for gatewayID on the bus
+func NewMemoryRouter(bus *MemoryBus, gatewayID string) *MemoryRouter {
+	return &MemoryRouter{
+		bus:       bus,
+		gatewayID: gatewayID,
+		inbox:     make(chan *Message, memoryInboxSize),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start attaches the router to the bus and begins delivering messages
+func (r *MemoryRouter) Start(ctx context.Context, handler MessageHandler) error {
+	r.handler = handler
+
+	if err := r.bus.attach(r); err != nil {
+		return err
+	}
+
+	r.wg.Add(1)
+	go r.processMessages()
+
+	log.Printf("[MemoryRouter] Gateway %s attached to in-memory bus", r.gatewayID)
+	return nil
+}
+
+// Stop detaches the router from the bus
+func (r *MemoryRouter) Stop() error {
+	r.bus.detach(r)
+
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
+	r.wg.Wait()
+
+	return nil
+}
+
+// RouteToGateway queues a message for a specific gateway
+func (r *MemoryRouter) RouteToGateway(ctx context.Context, targetGatewayID string, msg *Message) error {
+	target, ok := r.bus.lookup(targetGatewayID)
+	if !ok {
+		// Matches Pub/Sub: publishing to a gateway with no subscriber succeeds
+		log.Printf("[MemoryRouter] No gateway %s on the bus, dropping message from %s", targetGatewayID, msg.From)
+		publishedTotal.WithLabelValues(routerMemory, publishDirect).Inc()
+		return nil
+	}
+
+	if err := target.enqueue(ctx, msg); err != nil {
+		publishErrorsTotal.WithLabelValues(routerMemory, publishDirect).Inc()
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+	publishedTotal.WithLabelValues(routerMemory, publishDirect).Inc()
+
+	return nil
+}
+
+// BroadcastToAllGateways queues a message for every gateway on the bus, including this one
+func (r *MemoryRouter) BroadcastToAllGateways(ctx context.Context, msg *Message) error {
+	for _, target := range r.bus.all() {
+		if err := target.enqueue(ctx, msg); err != nil {
+			publishErrorsTotal.WithLabelValues(routerMemory, publishBroadcast).Inc()
+			return fmt.Errorf("failed to broadcast message: %w", err)
+		}
+	}
+	publishedTotal.WithLabelValues(routerMemory, publishBroadcast).Inc()
+
+	return nil
+}
+
+// enqueue copies a message into the inbox, blocking while it is full
+func (r *MemoryRouter) enqueue(ctx context.Context, msg *Message) error {
+	// Copy so the receiver never shares state with the sender, as with a serialized transport
+	copied := *msg
+	copied.Recipients = append([]string(nil), msg.Recipients...)
+
+	select {
+	case r.inbox <- &copied:
+		return nil
+	case <-r.done:
+		return errors.New("gateway stopped")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// processMessages delivers queued messages until the router stops
+func (r *MemoryRouter) processMessages() {
+	defer r.wg.Done()
+
+	for {
+		select {
+		case msg := <-r.inbox:
+			receivedTotal.WithLabelValues(routerMemory).Inc()
+			if r.handler != nil {
+				if err := r.handler(msg); err != nil {
+					log.Printf("[MemoryRouter] Failed to deliver message %s: %v", msg.ID, err)
+				}
+			}
+
+		case <-r.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package router
+
+import (
+	"time"
+
+	"websocket-demo/internal/metrics"
+)
+
+// Router names used as the "router" label
+const (
+	routerRedis = "redis"
+	routerKafka = "kafka"
+)
+
+// Publish kinds used as the "kind" label
+const (
+	publishDirect     = "direct"
+	publishBroadcast  = "broadcast"
+	publishRetry      = "retry"
+	publishDeadLetter = "dead_letter"
+)
+
+var (
+	publishedTotal = metrics.NewCounterVec("router_messages_published_total",
+		"Messages published to other gateways, by router and kind.", "router", "kind")
+	publishErrorsTotal = metrics.NewCounterVec("router_publish_errors_total",
+		"Failed publishes, by router and kind.", "router", "kind")
+	publishDuration = metrics.NewHistogramVec("router_publish_duration_seconds",
+		"Time to publish a message to the transport, by router.", nil, "router")
+	receivedTotal = metrics.NewCounterVec("router_messages_received_total",
+		"Messages received for local delivery, by router.", "router")
+	decodeErrorsTotal = metrics.NewCounterVec("router_decode_errors_total",
+		"Received messages that could not be decoded, by router.", "router")
+
+	redisPubSubReceivedTotal = metrics.NewCounterVec("router_redis_pubsub_received_total",
+		"Redis Pub/Sub messages received, by channel.", "channel")
+	streamReclaimedTotal = metrics.NewCounterVec("router_stream_reclaimed_total",
+		"Pending Redis Stream entries reclaimed with XAUTOCLAIM, by stream.", "stream")
+
+	kafkaProducedTotal = metrics.NewCounterVec("kafka_producer_messages_total",
+		"Messages produced to Kafka, by topic.", "topic")
+	kafkaProduceErrorsTotal = metrics.NewCounterVec("kafka_producer_errors_total",
+		"Failed Kafka produce requests, by topic.", "topic")
+	kafkaConsumedTotal = metrics.NewCounterVec("kafka_consumer_messages_total",
+		"Messages consumed from Kafka, by topic and partition.", "topic", "partition")
+	kafkaConsumerErrorsTotal = metrics.NewCounterVec("kafka_consumer_errors_total",
+		"Kafka consumer group errors, by topic.", "topic")
+	kafkaConsumerLag = metrics.NewGaugeVec("kafka_consumer_lag",
+		"Messages between the last consumed offset and the partition high watermark.", "topic", "partition")
+	kafkaRetriesTotal = metrics.NewCounterVec("kafka_retries_total",
+		"Failed deliveries republished to the retry topic, by attempt.", "attempt")
+	kafkaDeadLetteredTotal = metrics.NewCounterVec("kafka_dead_lettered_total",
+		"Messages sent to the dead-letter topic, by reason.", "reason")
+)
+
+// observePublish records the time a router took to publish a message
+func observePublish(router string, start time.Time) {
+	metrics.ObserveSince(publishDuration.WithLabelValues(router), start)
+}
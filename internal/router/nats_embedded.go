@@ -0,0 +1,39 @@
+//go:build nats
+
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// StartEmbeddedNats runs a JetStream-enabled NATS server in-process on a
+// random local port, for development and tests without an external broker.
+// An empty storeDir uses a temporary directory. Callers should Shutdown the
+// returned server and connect to its ClientURL.
+// 在进程内启动启用 JetStream 的 NATS 服务器，无需外部 broker
+func StartEmbeddedNats(storeDir string) (*server.Server, error) {
+	opts := &server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  storeDir,
+		NoSigs:    true,
+	}
+
+	ns, err := server.NewServer(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create embedded NATS server: %w", err)
+	}
+
+	go ns.Start()
+
+	if !ns.ReadyForConnections(5 * time.Second) {
+		ns.Shutdown()
+		return nil, fmt.Errorf("embedded NATS server not ready")
+	}
+
+	return ns, nil
+}
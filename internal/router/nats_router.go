@@ -0,0 +1,321 @@
+//go:build nats
+
+package router
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	routerNats = "nats"
+
+	// natsDirectPrefix is followed by the target gateway ID
+	// 定向消息 subject 前缀，后接目标 Gateway ID
+	natsDirectPrefix = "gateway.direct."
+
+	// natsBroadcastSubject is consumed by every gateway
+	// 所有 Gateway 都会消费的广播 subject
+	natsBroadcastSubject = "gateway.broadcast"
+
+	// natsDeliverPrefix is followed by the durable consumer name; it is the
+	// push consumer's deliver subject and is outside the stream's subjects
+	// 持久化消费者的投递 subject 前缀，不在 stream 的 subject 范围内
+	natsDeliverPrefix = "gateway.deliver."
+)
+
+// NatsConfig holds NATS JetStream configuration
+// NatsConfig 保存 NATS JetStream 配置
+type NatsConfig struct {
+	URL        string        // NATS 服务器地址 / NATS server URL (e.g., "nats://localhost:4222")
+	Stream     string        // JetStream stream 名称 / JetStream stream name
+	MaxAge     time.Duration // 未消费消息的保留时间 / How long messages are retained
+	Replicas   int           // Stream 副本数 / Stream replicas (1 for a single server)
+	AckWait    time.Duration // 未确认消息的重投超时 / Redelivery timeout for unacked messages
+	MaxDeliver int           // 最大投递次数 / Delivery attempts before a message is dropped
+	NakDelay   time.Duration // 投递失败后的首次重投延迟，按次数翻倍 / Redelivery delay after a failed delivery, doubled per attempt
+}
+
+// DefaultNatsConfig returns defaults suitable for a single NATS server
+// 返回适用于单节点 NATS 的默认配置
+func DefaultNatsConfig() NatsConfig {
+	return NatsConfig{
+		URL:        nats.DefaultURL,
+		Stream:     "GATEWAY",
+		MaxAge:     time.Hour,
+		Replicas:   1,
+		AckWait:    30 * time.Second,
+		MaxDeliver: 5,
+		NakDelay:   time.Second,
+	}
+}
+
+// NatsRouter implements message routing using NATS JetStream.
+// Each gateway has a durable consumer on its own subject and another on the
+// broadcast subject, so messages published while it is down are delivered
+// once it reconnects.
+// NatsRouter 使用 NATS JetStream 实现消息路由，每个 Gateway 使用持久化消费者
+type NatsRouter struct {
+	nc        *nats.Conn
+	js        nats.JetStreamContext
+	ownsConn  bool // 是否由路由器负责关闭连接 / Whether Stop closes the connection
+	gatewayID string
+	config    NatsConfig
+	handler   MessageHandler
+	subs      []*nats.Subscription
+}
+
+// NewNatsRouter connects to NATS and creates a new JetStream router
+// 连接 NATS 并创建新的 JetStream 路由器
+func NewNatsRouter(gatewayID string, config NatsConfig) (*NatsRouter, error) {
+	nc, err := nats.Connect(config.URL,
+		nats.Name("websocket-gateway-"+gatewayID),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Printf("[NatsRouter] Disconnected: %v", err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Printf("[NatsRouter] Reconnected to %s", nc.ConnectedUrl())
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+
+	r, err := NewNatsRouterWithConn(gatewayID, nc, config)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	r.ownsConn = true
+
+	return r, nil
+}
+
+// NewNatsRouterWithConn creates a router on an existing connection, such as
+// one to an embedded server. The caller keeps ownership of the connection.
+// 使用已有连接（例如内嵌服务器）创建路由器，连接由调用方关闭
+func NewNatsRouterWithConn(gatewayID string, nc *nats.Conn, config NatsConfig) (*NatsRouter, error) {
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get JetStream context: %w", err)
+	}
+
+	// 创建或更新 stream（幂等）/ Create or update the stream (idempotent)
+	streamConfig := &nats.StreamConfig{
+		Name:      config.Stream,
+		Subjects:  []string{natsDirectPrefix + "*", natsBroadcastSubject},
+		Retention: nats.LimitsPolicy,
+		MaxAge:    config.MaxAge,
+		Replicas:  config.Replicas,
+		Storage:   nats.FileStorage,
+	}
+	if _, err := js.StreamInfo(config.Stream); err == nil {
+		_, err = js.UpdateStream(streamConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update stream %s: %w", config.Stream, err)
+		}
+	} else if _, err := js.AddStream(streamConfig); err != nil {
+		return nil, fmt.Errorf("failed to create stream %s: %w", config.Stream, err)
+	}
+
+	return &NatsRouter{
+		nc:        nc,
+		js:        js,
+		gatewayID: gatewayID,
+		config:    config,
+	}, nil
+}
+
+// Start subscribes this gateway's durable consumers
+// 订阅本 Gateway 的持久化消费者
+func (r *NatsRouter) Start(ctx context.Context, handler MessageHandler) error {
+	r.handler = handler
+
+	subjects := map[string]string{
+		natsDirectPrefix + r.gatewayID: natsDurableName(r.gatewayID),
+		natsBroadcastSubject:           natsDurableName(r.gatewayID + "-broadcast"),
+	}
+
+	for subject, durable := range subjects {
+		if err := r.ensureConsumer(subject, durable); err != nil {
+			r.unsubscribe()
+			return fmt.Errorf("failed to create consumer %s: %w", durable, err)
+		}
+
+		sub, err := r.js.Subscribe(subject, r.handleMsg,
+			nats.Bind(r.config.Stream, durable),
+			nats.ManualAck(),
+		)
+		if err != nil {
+			r.unsubscribe()
+			return fmt.Errorf("failed to subscribe to %s: %w", subject, err)
+		}
+		r.subs = append(r.subs, sub)
+	}
+
+	log.Printf("[NatsRouter] Subscribed to subjects: %s%s, %s", natsDirectPrefix, r.gatewayID, natsBroadcastSubject)
+	return nil
+}
+
+// ensureConsumer creates or updates a durable push consumer. The consumer is
+// created here and bound by Subscribe, because nats.go deletes consumers it
+// created itself when their subscription is drained.
+// 创建或更新持久化推送消费者；由本方法而非 Subscribe 创建，停止订阅时不会被删除
+func (r *NatsRouter) ensureConsumer(subject, durable string) error {
+	config := &nats.ConsumerConfig{
+		Durable:        durable,
+		DeliverSubject: natsDeliverPrefix + durable,
+		FilterSubject:  subject,
+		DeliverPolicy:  nats.DeliverNewPolicy,
+		AckPolicy:      nats.AckExplicitPolicy,
+		AckWait:        r.config.AckWait,
+		MaxDeliver:     r.config.MaxDeliver,
+	}
+
+	if _, err := r.js.ConsumerInfo(r.config.Stream, durable); err == nil {
+		_, err = r.js.UpdateConsumer(r.config.Stream, config)
+		return err
+	}
+	_, err := r.js.AddConsumer(r.config.Stream, config)
+	return err
+}
+
+// Stop drains the subscriptions, keeping the durable consumers for the next start
+// 停止订阅，保留持久化消费者以便下次启动继续消费
+func (r *NatsRouter) Stop() error {
+	r.unsubscribe()
+
+	if r.ownsConn {
+		if err := r.nc.Drain(); err != nil {
+			log.Printf("[NatsRouter] Error draining connection: %v", err)
+		}
+	}
+
+	log.Println("[NatsRouter] Router stopped")
+	return nil
+}
+
+// unsubscribe drains subscriptions without deleting their durable consumers
+func (r *NatsRouter) unsubscribe() {
+	for _, sub := range r.subs {
+		if err := sub.Drain(); err != nil {
+			log.Printf("[NatsRouter] Error draining subscription %s: %v", sub.Subject, err)
+		}
+	}
+	r.subs = nil
+}
+
+// RouteToGateway publishes a message to a specific gateway's subject
+// 将消息发布到目标 Gateway 的 subject
+func (r *NatsRouter) RouteToGateway(ctx context.Context, targetGatewayID string, msg *Message) error {
+	if err := r.publish(ctx, natsDirectPrefix+targetGatewayID, msg, publishDirect); err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+
+	log.Printf("[NatsRouter] Routed message from %s to %s via gateway %s", msg.From, msg.To, targetGatewayID)
+	return nil
+}
+
+// BroadcastToAllGateways publishes a message to the broadcast subject
+// 将消息发布到广播 subject
+func (r *NatsRouter) BroadcastToAllGateways(ctx context.Context, msg *Message) error {
+	if err := r.publish(ctx, natsBroadcastSubject, msg, publishBroadcast); err != nil {
+		return fmt.Errorf("failed to broadcast message: %w", err)
+	}
+
+	log.Printf("[NatsRouter] Broadcast message from %s to all gateways", msg.From)
+	return nil
+}
+
+// publish waits for the stream to persist the message
+// 发布消息并等待 stream 持久化确认
+func (r *NatsRouter) publish(ctx context.Context, subject string, msg *Message, kind string) error {
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	start := time.Now()
+	_, err = r.js.Publish(subject, data, nats.Context(ctx))
+	observePublish(routerNats, start)
+	if err != nil {
+		publishErrorsTotal.WithLabelValues(routerNats, kind).Inc()
+		return err
+	}
+
+	publishedTotal.WithLabelValues(routerNats, kind).Inc()
+	return nil
+}
+
+// handleMsg delivers a message and acks it once the handler succeeds. A failed
+// delivery is nak'd so JetStream redelivers it after nakDelay, up to MaxDeliver
+// times; a message that is never acked is redelivered after AckWait.
+// 投递成功后确认；投递失败时 nak，由 JetStream 延迟重投
+func (r *NatsRouter) handleMsg(m *nats.Msg) {
+	routedMsg, err := DecodeMessage(m.Data)
+	if err != nil {
+		decodeErrorsTotal.WithLabelValues(routerNats).Inc()
+		log.Printf("[NatsRouter] Failed to unmarshal message: %v", err)
+		// 无法解析的消息不再重投 / Never redeliver undecodable messages
+		m.Term()
+		return
+	}
+	receivedTotal.WithLabelValues(routerNats).Inc()
+
+	delivered := uint64(1)
+	if meta, err := m.Metadata(); err == nil {
+		delivered = meta.NumDelivered
+	}
+	if delivered > 1 {
+		log.Printf("[NatsRouter] Redelivery %d of message %s", delivered, routedMsg.ID)
+	}
+
+	log.Printf("[NatsRouter] Received message for delivery: from=%s to=%s", routedMsg.From, routedMsg.To)
+
+	if r.handler != nil {
+		if err := r.handler(routedMsg); err != nil {
+			delay := r.nakDelay(delivered)
+			log.Printf("[NatsRouter] Failed to deliver message %s (attempt %d): %v, redelivering in %s",
+				routedMsg.ID, delivered, err, delay)
+			if err := m.NakWithDelay(delay); err != nil {
+				log.Printf("[NatsRouter] Failed to nak message %s: %v", routedMsg.ID, err)
+			}
+			return
+		}
+	}
+
+	if err := m.Ack(); err != nil {
+		log.Printf("[NatsRouter] Failed to ack message %s: %v", routedMsg.ID, err)
+	}
+}
+
+// nakDelay returns the redelivery delay after the given failed delivery,
+// doubling from NakDelay up to AckWait
+// 计算第 delivered 次投递失败后的重投延迟（指数退避，不超过 AckWait）
+func (r *NatsRouter) nakDelay(delivered uint64) time.Duration {
+	delay := r.config.NakDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for i := uint64(1); i < delivered && (r.config.AckWait <= 0 || delay < r.config.AckWait); i++ {
+		delay *= 2
+	}
+	if r.config.AckWait > 0 && delay > r.config.AckWait {
+		delay = r.config.AckWait
+	}
+	return delay
+}
+
+// natsDurableName makes a gateway ID safe to use as a durable consumer name
+func natsDurableName(name string) string {
+	return "gw-" + strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_").Replace(name)
+}
+
+// Ensure NatsRouter implements RouterInterface
+var _ RouterInterface = (*NatsRouter)(nil)
@@ -0,0 +1,191 @@
+//go:build nats
+
+package router
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsTestConfig keeps redelivery fast enough for tests
+func natsTestConfig() NatsConfig {
+	config := DefaultNatsConfig()
+	config.Stream = "GATEWAY_TEST"
+	config.AckWait = 2 * time.Second
+	config.NakDelay = 20 * time.Millisecond
+	return config
+}
+
+// startNatsRouter connects a router for gatewayID to the embedded server at url
+func startNatsRouter(t *testing.T, url, gatewayID string, handler MessageHandler) *NatsRouter {
+	t.Helper()
+
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatalf("connect %s: %v", gatewayID, err)
+	}
+	t.Cleanup(nc.Close)
+
+	r, err := NewNatsRouterWithConn(gatewayID, nc, natsTestConfig())
+	if err != nil {
+		t.Fatalf("NewNatsRouterWithConn(%s): %v", gatewayID, err)
+	}
+	if err := r.Start(context.Background(), handler); err != nil {
+		t.Fatalf("Start(%s): %v", gatewayID, err)
+	}
+	t.Cleanup(func() { r.Stop() })
+
+	return r
+}
+
+// startEmbeddedNats starts a JetStream server for the test and returns its URL
+func startEmbeddedNats(t *testing.T) string {
+	t.Helper()
+
+	ns, err := StartEmbeddedNats(t.TempDir())
+	if err != nil {
+		t.Fatalf("StartEmbeddedNats: %v", err)
+	}
+	t.Cleanup(ns.Shutdown)
+
+	return ns.ClientURL()
+}
+
+// recorder collects delivered messages, failing the first failures deliveries
+type recorder struct {
+	mu       sync.Mutex
+	calls    []*Message
+	failures int
+	got      chan *Message
+}
+
+func newRecorder(failures int) *recorder {
+	return &recorder{failures: failures, got: make(chan *Message, 16)}
+}
+
+func (rec *recorder) handle(msg *Message) error {
+	rec.mu.Lock()
+	rec.calls = append(rec.calls, msg)
+	fail := len(rec.calls) <= rec.failures
+	rec.mu.Unlock()
+
+	if fail {
+		return ErrRecipientNotLocal
+	}
+	rec.got <- msg
+	return nil
+}
+
+func (rec *recorder) callCount() int {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return len(rec.calls)
+}
+
+func (rec *recorder) expect(t *testing.T, id string) {
+	t.Helper()
+
+	select {
+	case msg := <-rec.got:
+		if msg.ID != id {
+			t.Fatalf("got message %q, want %q", msg.ID, id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for message %q", id)
+	}
+}
+
+func (rec *recorder) expectNone(t *testing.T, wait time.Duration) {
+	t.Helper()
+
+	select {
+	case msg := <-rec.got:
+		t.Fatalf("unexpected message %q", msg.ID)
+	case <-time.After(wait):
+	}
+}
+
+func TestNatsRouterDirectAndBroadcast(t *testing.T) {
+	url := startEmbeddedNats(t)
+
+	rec1, rec2 := newRecorder(0), newRecorder(0)
+	gw1 := startNatsRouter(t, url, "gw-1", rec1.handle)
+	startNatsRouter(t, url, "gw-2", rec2.handle)
+
+	ctx := context.Background()
+	if err := gw1.RouteToGateway(ctx, "gw-2", &Message{ID: "m1", From: "alice", To: "bob", Type: MessageTypeDirect}); err != nil {
+		t.Fatalf("RouteToGateway: %v", err)
+	}
+	rec2.expect(t, "m1")
+	rec1.expectNone(t, 200*time.Millisecond)
+
+	if err := gw1.BroadcastToAllGateways(ctx, &Message{ID: "b1", From: "alice", Type: MessageTypeBroadcast}); err != nil {
+		t.Fatalf("BroadcastToAllGateways: %v", err)
+	}
+	rec1.expect(t, "b1")
+	rec2.expect(t, "b1")
+}
+
+func TestNatsRouterRedeliversFailedDelivery(t *testing.T) {
+	url := startEmbeddedNats(t)
+
+	rec := newRecorder(2)
+	gw1 := startNatsRouter(t, url, "gw-1", newRecorder(0).handle)
+	startNatsRouter(t, url, "gw-2", rec.handle)
+
+	if err := gw1.RouteToGateway(context.Background(), "gw-2", &Message{ID: "m1", From: "alice", To: "bob"}); err != nil {
+		t.Fatalf("RouteToGateway: %v", err)
+	}
+
+	// 两次失败后第三次投递成功 / Delivered on the third attempt after two naks
+	rec.expect(t, "m1")
+	if n := rec.callCount(); n != 3 {
+		t.Fatalf("handler called %d times, want 3", n)
+	}
+
+	// 成功后已确认，不会再重投 / Acked after success, so never redelivered
+	rec.expectNone(t, natsTestConfig().AckWait+500*time.Millisecond)
+	if n := rec.callCount(); n != 3 {
+		t.Fatalf("handler called %d times after ack, want 3", n)
+	}
+}
+
+func TestNatsRouterDurableAcrossRestart(t *testing.T) {
+	url := startEmbeddedNats(t)
+
+	gw1 := startNatsRouter(t, url, "gw-1", newRecorder(0).handle)
+	gw2 := startNatsRouter(t, url, "gw-2", newRecorder(0).handle)
+	gw2.Stop()
+
+	// gw-2 停止期间发布的消息在重启后投递 / Published while gw-2 is down, delivered after it restarts
+	if err := gw1.RouteToGateway(context.Background(), "gw-2", &Message{ID: "m1", From: "alice", To: "bob"}); err != nil {
+		t.Fatalf("RouteToGateway: %v", err)
+	}
+
+	rec := newRecorder(0)
+	startNatsRouter(t, url, "gw-2", rec.handle)
+	rec.expect(t, "m1")
+}
+
+func TestNatsRouterNakDelay(t *testing.T) {
+	r := &NatsRouter{config: NatsConfig{NakDelay: time.Second, AckWait: 5 * time.Second}}
+
+	for _, tt := range []struct {
+		delivered uint64
+		want      time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{10, 5 * time.Second},
+	} {
+		if got := r.nakDelay(tt.delivered); got != tt.want {
+			t.Errorf("nakDelay(%d) = %s, want %s", tt.delivered, got, tt.want)
+		}
+	}
+}
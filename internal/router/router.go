@@ -2,23 +2,62 @@ package router
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// broadcastChannel is the Redis channel every gateway subscribes to for broadcasts
+const broadcastChannel = "gateway:broadcast"
+
+// Message types carried in Message.Type
+const (
+	MessageTypeDirect    = "direct"
+	MessageTypeBroadcast = "broadcast"
+	MessageTypeAck       = "ack"
+	MessageTypeCarbon    = "carbon" // Copy of a sent message for the sender's other devices
+	MessageTypeGroup     = "group"  // Group message for the Recipients on the target gateway
+	MessageTypeSignal    = "signal" // Ephemeral event such as typing, never stored or queued
+	MessageTypeRead      = "read"   // Read receipt: From read To's messages up to ID
+)
+
+// Ack statuses carried in Message.Status for MessageTypeAck
+const (
+	AckStatusSent      = "sent"      // Message accepted and routed by the sender's gateway
+	AckStatusQueued    = "queued"    // Recipient offline, message stored for later delivery
+	AckStatusDelivered = "delivered" // Message written to the recipient's socket
+)
+
 // Message represents a routable message
 type Message struct {
-	From    string `json:"from"`
-	To      string `json:"to"`
-	Content string `json:"content"`
-	Type    string `json:"type"` // "direct", "broadcast"
+	ID         string   `json:"id,omitempty"`       // Server-assigned message ID
+	ClientID   string   `json:"clientId,omitempty"` // Sender-supplied ID, echoed back in acks
+	From       string   `json:"from"`
+	To         string   `json:"to"`
+	Content    string   `json:"content"`
+	Type       string   `json:"type"`              // "direct", "broadcast", "ack", "carbon", "group", "signal", "read"
+	Event      string   `json:"event,omitempty"`   // Signal event: "typing_start", "typing_stop" or an application event
+	Status     string   `json:"status,omitempty"`  // Ack status for "ack" messages
+	Gateway    string   `json:"gateway,omitempty"` // Originating gateway, used to route acks back
+	ConnID     string   `json:"connId,omitempty"`  // Originating connection on that gateway
+	GroupID    string   `json:"groupId,omitempty"`
+	Recipients []string `json:"recipients,omitempty"` // Group members served by the target gateway
+	Targets    []string `json:"targets,omitempty"`    // Gateways a direct message was routed to
+	Hops       int      `json:"hops,omitempty"`       // Times the message was re-routed after the recipient moved
+	Timestamp  int64    `json:"timestamp,omitempty"`
 }
 
-// MessageHandler is called when a message is received for local delivery
-type MessageHandler func(msg *Message)
+// MessageHandler is called when a message is received for local delivery.
+// A non-nil error means the message could not be delivered; routers that
+// support redelivery use it to retry the message.
+type MessageHandler func(msg *Message) error
+
+// ErrRecipientNotLocal is returned by a MessageHandler when the recipient has
+// no connection on the gateway the message was routed to
+var ErrRecipientNotLocal = errors.New("recipient not connected to this gateway")
 
 // Router handles message routing between gateways using Redis Pub/Sub
 type Router struct {
@@ -38,21 +77,22 @@ func NewRouter(redisClient *redis.Client, gatewayID string) *Router {
 	}
 }
 
-// Start begins listening for messages on this gateway's channel
+// Start begins listening for messages on this gateway's channel and the broadcast channel
 func (r *Router) Start(ctx context.Context, handler MessageHandler) error {
 	r.handler = handler
 
-	// Subscribe to this gateway's channel
+	// Subscribe to this gateway's channel and the shared broadcast channel
 	channel := r.getGatewayChannel(r.gatewayID)
-	r.pubsub = r.redis.Subscribe(ctx, channel)
+	r.pubsub = r.redis.Subscribe(ctx, channel, broadcastChannel)
 
-	// Wait for subscription confirmation
-	_, err := r.pubsub.Receive(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to subscribe: %w", err)
+	// Wait for both subscription confirmations
+	for i := 0; i < 2; i++ {
+		if _, err := r.pubsub.Receive(ctx); err != nil {
+			return fmt.Errorf("failed to subscribe: %w", err)
+		}
 	}
 
-	log.Printf("[Router] Subscribed to channel: %s", channel)
+	log.Printf("[Router] Subscribed to channels: %s, %s", channel, broadcastChannel)
 
 	// Start message processing loop
 	go r.processMessages(ctx)
@@ -73,15 +113,19 @@ func (r *Router) Stop() error {
 func (r *Router) RouteToGateway(ctx context.Context, targetGatewayID string, msg *Message) error {
 	channel := r.getGatewayChannel(targetGatewayID)
 
-	data, err := json.Marshal(msg)
+	data, err := msg.MarshalBinary()
 	if err != nil {
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
 
+	start := time.Now()
 	err = r.redis.Publish(ctx, channel, data).Err()
+	observePublish(routerRedis, start)
 	if err != nil {
+		publishErrorsTotal.WithLabelValues(routerRedis, publishDirect).Inc()
 		return fmt.Errorf("failed to publish message: %w", err)
 	}
+	publishedTotal.WithLabelValues(routerRedis, publishDirect).Inc()
 
 	log.Printf("[Router] Routed message from %s to %s via gateway %s", msg.From, msg.To, targetGatewayID)
 
@@ -90,17 +134,21 @@ func (r *Router) RouteToGateway(ctx context.Context, targetGatewayID string, msg
 
 // BroadcastToAllGateways sends a message to all gateways
 func (r *Router) BroadcastToAllGateways(ctx context.Context, msg *Message) error {
-	channel := "gateway:broadcast"
+	channel := broadcastChannel
 
-	data, err := json.Marshal(msg)
+	data, err := msg.MarshalBinary()
 	if err != nil {
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
 
+	start := time.Now()
 	err = r.redis.Publish(ctx, channel, data).Err()
+	observePublish(routerRedis, start)
 	if err != nil {
+		publishErrorsTotal.WithLabelValues(routerRedis, publishBroadcast).Inc()
 		return fmt.Errorf("failed to broadcast message: %w", err)
 	}
+	publishedTotal.WithLabelValues(routerRedis, publishBroadcast).Inc()
 
 	log.Printf("[Router] Broadcast message from %s to all gateways", msg.From)
 
@@ -117,18 +165,23 @@ func (r *Router) processMessages(ctx context.Context) {
 			if msg == nil {
 				continue
 			}
+			redisPubSubReceivedTotal.WithLabelValues(msg.Channel).Inc()
 
-			var routedMsg Message
-			if err := json.Unmarshal([]byte(msg.Payload), &routedMsg); err != nil {
+			routedMsg, err := DecodeMessage([]byte(msg.Payload))
+			if err != nil {
+				decodeErrorsTotal.WithLabelValues(routerRedis).Inc()
 				log.Printf("[Router] Failed to unmarshal message: %v", err)
 				continue
 			}
+			receivedTotal.WithLabelValues(routerRedis).Inc()
 
 			log.Printf("[Router] Received message for delivery: from=%s to=%s", routedMsg.From, routedMsg.To)
 
 			// Deliver to local connections
 			if r.handler != nil {
-				r.handler(&routedMsg)
+				if err := r.handler(routedMsg); err != nil {
+					log.Printf("[Router] Failed to deliver message %s: %v", routedMsg.ID, err)
+				}
 			}
 
 		case <-r.done:
@@ -0,0 +1,306 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	routerStreams = "redis-streams"
+
+	// streamBroadcastKey is the stream every gateway reads broadcasts from
+	streamBroadcastKey = "stream:gateway:broadcast"
+
+	// streamGatewayGroup is the consumer group on a gateway's own stream
+	streamGatewayGroup = "gateway"
+
+	// streamDataField holds the JSON-encoded Message in each entry
+	streamDataField = "data"
+)
+
+// StreamConfig configures the Redis Streams router
+type StreamConfig struct {
+	MaxLen        int64         // Approximate max entries kept per stream (XADD MAXLEN ~)
+	BatchSize     int64         // Max entries per XREADGROUP / XAUTOCLAIM call
+	Block         time.Duration // How long XREADGROUP blocks waiting for entries
+	ClaimMinIdle  time.Duration // Pending entries idle this long are reclaimed
+	ClaimInterval time.Duration // How often pending entries are checked
+}
+
+// DefaultStreamConfig returns the default stream settings
+func DefaultStreamConfig() StreamConfig {
+	return StreamConfig{
+		MaxLen:        10000,
+		BatchSize:     100,
+		Block:         5 * time.Second,
+		ClaimMinIdle:  30 * time.Second,
+		ClaimInterval: 15 * time.Second,
+	}
+}
+
+// StreamRouter handles message routing between gateways using Redis Streams.
+// Unlike Pub/Sub, entries added while a gateway is disconnected wait in its
+// stream, and entries read but not acknowledged, because the gateway crashed
+// or the handler failed, are reclaimed with XAUTOCLAIM, giving at-least-once
+// delivery.
+type StreamRouter struct {
+	redis     *redis.Client
+	gatewayID string
+	config    StreamConfig
+	handler   MessageHandler
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// NewStreamRouter creates a new Redis Streams router
+func NewStreamRouter(redisClient *redis.Client, gatewayID string, config StreamConfig) *StreamRouter {
+	return &StreamRouter{
+		redis:     redisClient,
+		gatewayID: gatewayID,
+		config:    config,
+	}
+}
+
+// Start creates the consumer groups and begins reading this gateway's stream and the broadcast stream
+func (r *StreamRouter) Start(ctx context.Context, handler MessageHandler) error {
+	r.handler = handler
+
+	// Each gateway reads its own stream through one group, and the broadcast
+	// stream through a group of its own so it sees every entry
+	streams := map[string]string{
+		r.getGatewayStream(r.gatewayID): streamGatewayGroup,
+		streamBroadcastKey:              "gateway:" + r.gatewayID,
+	}
+
+	for stream, group := range streams {
+		if err := r.createGroup(ctx, stream, group); err != nil {
+			return err
+		}
+	}
+
+	readCtx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+
+	for stream, group := range streams {
+		r.wg.Add(1)
+		go r.readLoop(readCtx, stream, group)
+	}
+
+	log.Printf("[StreamRouter] Reading streams: %s, %s", r.getGatewayStream(r.gatewayID), streamBroadcastKey)
+	return nil
+}
+
+// Stop stops reading; unacknowledged entries stay pending for the next start
+func (r *StreamRouter) Stop() error {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.wg.Wait()
+
+	log.Println("[StreamRouter] Stopped")
+	return nil
+}
+
+// RouteToGateway appends a message to a specific gateway's stream
+func (r *StreamRouter) RouteToGateway(ctx context.Context, targetGatewayID string, msg *Message) error {
+	if err := r.add(ctx, r.getGatewayStream(targetGatewayID), msg, publishDirect); err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+
+	log.Printf("[StreamRouter] Routed message from %s to %s via gateway %s", msg.From, msg.To, targetGatewayID)
+
+	return nil
+}
+
+// BroadcastToAllGateways appends a message to the broadcast stream
+func (r *StreamRouter) BroadcastToAllGateways(ctx context.Context, msg *Message) error {
+	if err := r.add(ctx, streamBroadcastKey, msg, publishBroadcast); err != nil {
+		return fmt.Errorf("failed to broadcast message: %w", err)
+	}
+
+	log.Printf("[StreamRouter] Broadcast message from %s to all gateways", msg.From)
+
+	return nil
+}
+
+// add appends a message to a stream, trimming it to roughly MaxLen entries
+func (r *StreamRouter) add(ctx context.Context, stream string, msg *Message, kind string) error {
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	start := time.Now()
+	err = r.redis.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: r.config.MaxLen,
+		Approx: true,
+		Values: map[string]interface{}{streamDataField: data},
+	}).Err()
+	observePublish(routerStreams, start)
+	if err != nil {
+		publishErrorsTotal.WithLabelValues(routerStreams, kind).Inc()
+		return err
+	}
+
+	publishedTotal.WithLabelValues(routerStreams, kind).Inc()
+	return nil
+}
+
+// createGroup creates a consumer group reading new entries, creating the stream if needed
+func (r *StreamRouter) createGroup(ctx context.Context, stream, group string) error {
+	err := r.redis.XGroupCreateMkStream(ctx, stream, group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("failed to create consumer group %s on %s: %w", group, stream, err)
+	}
+	return nil
+}
+
+// readLoop reclaims stale pending entries, then reads and acknowledges new
+// entries until ctx is cancelled
+func (r *StreamRouter) readLoop(ctx context.Context, stream, group string) {
+	defer r.wg.Done()
+
+	// Entries left pending by a previous run of this gateway are handled first
+	r.reclaim(ctx, stream, group)
+	lastClaim := time.Now()
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(lastClaim) >= r.config.ClaimInterval {
+			r.reclaim(ctx, stream, group)
+			lastClaim = time.Now()
+		}
+
+		result, err := r.redis.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: r.gatewayID,
+			Streams:  []string{stream, ">"},
+			Count:    r.config.BatchSize,
+			Block:    r.config.Block,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.Printf("[StreamRouter] Failed to read %s: %v", stream, err)
+
+			// NOGROUP means the stream was deleted; recreate the group
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				if err := r.createGroup(ctx, stream, group); err != nil {
+					log.Printf("[StreamRouter] %v", err)
+				}
+			}
+
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		for _, s := range result {
+			r.handleEntries(ctx, stream, group, s.Messages)
+		}
+	}
+}
+
+// reclaim takes over entries that stayed pending longer than ClaimMinIdle,
+// e.g. because the gateway crashed between reading and acknowledging them or
+// the handler failed to deliver them
+func (r *StreamRouter) reclaim(ctx context.Context, stream, group string) {
+	start := "0-0"
+
+	for {
+		entries, next, err := r.redis.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   stream,
+			Group:    group,
+			Consumer: r.gatewayID,
+			MinIdle:  r.config.ClaimMinIdle,
+			Start:    start,
+			Count:    r.config.BatchSize,
+		}).Result()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("[StreamRouter] Failed to reclaim pending entries on %s: %v", stream, err)
+			}
+			return
+		}
+
+		if len(entries) > 0 {
+			streamReclaimedTotal.WithLabelValues(stream).Add(float64(len(entries)))
+			log.Printf("[StreamRouter] Reclaimed %d pending entries on %s", len(entries), stream)
+			r.handleEntries(ctx, stream, group, entries)
+		}
+
+		// XAUTOCLAIM returns 0-0 once the whole pending list has been scanned
+		if next == "0-0" || next == "" {
+			return
+		}
+		start = next
+	}
+}
+
+// handleEntries delivers entries to the handler and acknowledges those that
+// were delivered. Entries the handler fails stay pending, so reclaim retries
+// them once they have been idle for ClaimMinIdle.
+func (r *StreamRouter) handleEntries(ctx context.Context, stream, group string, entries []redis.XMessage) {
+	ids := make([]string, 0, len(entries))
+
+	for _, entry := range entries {
+		data, _ := entry.Values[streamDataField].(string)
+
+		routedMsg, err := DecodeMessage([]byte(data))
+		if err != nil {
+			// Acknowledge undecodable entries so they are not reclaimed forever;
+			// this includes entries trimmed while pending, which come back empty
+			decodeErrorsTotal.WithLabelValues(routerStreams).Inc()
+			log.Printf("[StreamRouter] Failed to unmarshal entry %s: %v", entry.ID, err)
+			ids = append(ids, entry.ID)
+			continue
+		}
+		receivedTotal.WithLabelValues(routerStreams).Inc()
+
+		log.Printf("[StreamRouter] Received message for delivery: from=%s to=%s", routedMsg.From, routedMsg.To)
+
+		if r.handler != nil {
+			if err := r.handler(routedMsg); err != nil {
+				log.Printf("[StreamRouter] Failed to deliver entry %s, leaving it pending: %v", entry.ID, err)
+				continue
+			}
+		}
+		ids = append(ids, entry.ID)
+	}
+
+	if len(ids) == 0 {
+		return
+	}
+
+	// Acknowledge with a fresh context so entries handled during shutdown are not redelivered
+	ackCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+
+	if err := r.redis.XAck(ackCtx, stream, group, ids...).Err(); err != nil {
+		log.Printf("[StreamRouter] Failed to ack %d entries on %s: %v", len(ids), stream, err)
+	}
+}
+
+// getGatewayStream returns the Redis stream key for a gateway
+func (r *StreamRouter) getGatewayStream(gatewayID string) string {
+	return fmt.Sprintf("stream:gateway:%s", gatewayID)
+}
@@ -0,0 +1,151 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// streamTestConfig keeps reads and reclaims fast enough for tests
+func streamTestConfig() StreamConfig {
+	return StreamConfig{
+		MaxLen:        3,
+		BatchSize:     10,
+		Block:         20 * time.Millisecond,
+		ClaimMinIdle:  100 * time.Millisecond,
+		ClaimInterval: 20 * time.Millisecond,
+	}
+}
+
+func newStreamTestClient(t *testing.T) *redis.Client {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// pending returns the number of entries read but not acknowledged on a gateway's stream
+func pending(t *testing.T, client *redis.Client, gatewayID string) int64 {
+	t.Helper()
+	p, err := client.XPending(context.Background(), "stream:gateway:"+gatewayID, streamGatewayGroup).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.Count
+}
+
+func TestStreamRouterReclaimsFailedEntries(t *testing.T) {
+	client := newStreamTestClient(t)
+	ctx := context.Background()
+
+	// 第一次投递失败，之后成功 / The first delivery fails, later ones succeed
+	var attempts atomic.Int32
+	delivered := make(chan string, 10)
+	handler := func(msg *Message) error {
+		if attempts.Add(1) == 1 {
+			return errors.New("not local")
+		}
+		delivered <- msg.ID
+		return nil
+	}
+
+	r := NewStreamRouter(client, "gw1", streamTestConfig())
+	if err := r.Start(ctx, handler); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	if err := r.RouteToGateway(ctx, "gw1", &Message{ID: "m1", From: "alice", To: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 失败的条目保持待处理，直到被重新认领 / The failed entry stays pending until it is reclaimed
+	deadline := time.Now().Add(time.Second)
+	for pending(t, client, "gw1") == 0 || attempts.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("failed entry was not left pending")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	select {
+	case id := <-delivered:
+		if id != "m1" {
+			t.Fatalf("delivered %s, want m1", id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("failed entry was never reclaimed")
+	}
+
+	deadline = time.Now().Add(time.Second)
+	for pending(t, client, "gw1") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("reclaimed entry was not acknowledged")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Fatalf("m1 delivered in %d attempts, want 2", n)
+	}
+}
+
+func TestStreamRouterAcksUndecodableEntries(t *testing.T) {
+	client := newStreamTestClient(t)
+	ctx := context.Background()
+
+	r := NewStreamRouter(client, "gw1", streamTestConfig())
+	if err := r.Start(ctx, func(*Message) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	// 无法解析的条目重试无意义 / Retrying cannot fix a bad payload
+	err := client.XAdd(ctx, &redis.XAddArgs{
+		Stream: "stream:gateway:gw1",
+		Values: map[string]interface{}{streamDataField: "not a message"},
+	}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := pending(t, client, "gw1"); n != 0 {
+		t.Fatalf("%d undecodable entries left pending", n)
+	}
+}
+
+func TestStreamRouterTrimsStreams(t *testing.T) {
+	client := newStreamTestClient(t)
+	ctx := context.Background()
+
+	r := NewStreamRouter(client, "gw1", streamTestConfig())
+	for i := 1; i <= 5; i++ {
+		if err := r.RouteToGateway(ctx, "gw2", &Message{ID: fmt.Sprintf("m%d", i), From: "alice", To: "bob"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 只保留最近的 MaxLen 条 / Only the newest MaxLen entries are kept
+	entries, err := client.XRange(ctx, "stream:gateway:gw2", "-", "+").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, entry := range entries {
+		msg, err := DecodeMessage([]byte(entry.Values[streamDataField].(string)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+	if fmt.Sprint(ids) != "[m3 m4 m5]" {
+		t.Fatalf("stream holds %v, want [m3 m4 m5]", ids)
+	}
+}
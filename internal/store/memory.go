@@ -0,0 +1,305 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"websocket-demo/internal/router"
+)
+
+// Delivery is the in-memory equivalent of a message_delivery row
+type Delivery struct {
+	Status      string
+	DeliveredAt time.Time
+	ReadAt      time.Time
+}
+
+// MemoryStore is a MessageStore kept in process memory, intended for tests
+// and single-process demos
+type MemoryStore struct {
+	mu         sync.RWMutex
+	messages   []*router.Message          // In insertion order
+	byID       map[string]*router.Message // messageID -> message
+	deliveries map[string]*Delivery       // messageID + "/" + recipientID -> delivery
+	readUpTo   map[string]string          // userID + "/" + conversation -> last read message ID
+	noReceipts map[string]bool            // Users who disabled read receipts
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		byID:       make(map[string]*router.Message),
+		deliveries: make(map[string]*Delivery),
+		readUpTo:   make(map[string]string),
+		noReceipts: make(map[string]bool),
+	}
+}
+
+// SaveMessage stores a copy of the message and its delivery record
+func (s *MemoryStore) SaveMessage(ctx context.Context, msg *router.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.byID[msg.ID]; exists {
+		return nil
+	}
+
+	stored := *msg
+	s.messages = append(s.messages, &stored)
+	s.byID[msg.ID] = &stored
+
+	status := msg.Status
+	if status == "" {
+		status = StatusSent
+	}
+
+	recipients := []string{msg.To}
+	if msg.GroupID != "" {
+		recipients = msg.Recipients
+	}
+	for _, recipient := range recipients {
+		s.deliveries[deliveryKey(msg.ID, recipient)] = &Delivery{Status: status}
+	}
+
+	return nil
+}
+
+// MarkDelivered records delivery without downgrading a read message
+func (s *MemoryStore) MarkDelivered(ctx context.Context, messageID, recipientID string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.deliveries[deliveryKey(messageID, recipientID)]
+	if !ok {
+		return ErrNotFound
+	}
+
+	if d.Status != StatusRead {
+		d.Status = StatusDelivered
+	}
+	if d.DeliveredAt.IsZero() {
+		d.DeliveredAt = at
+	}
+
+	return nil
+}
+
+// MarkReadUpTo marks the user's unread messages in the conversation read, up to UpTo
+func (s *MemoryStore) MarkReadUpTo(ctx context.Context, q ReadQuery) ([]*router.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	end := s.indexOf(q.UpTo)
+	if end < 0 || !s.inReadConversation(s.messages[end], q) {
+		return nil, ErrNotFound
+	}
+
+	var read []*router.Message
+	for _, msg := range s.messages[:end+1] {
+		if !s.inReadConversation(msg, q) {
+			continue
+		}
+		d, ok := s.deliveries[deliveryKey(msg.ID, q.UserID)]
+		if !ok || !d.ReadAt.IsZero() {
+			continue
+		}
+
+		d.Status = StatusRead
+		if d.DeliveredAt.IsZero() {
+			d.DeliveredAt = q.At
+		}
+		d.ReadAt = q.At
+		read = append(read, s.withStatus(msg, q.UserID))
+	}
+
+	// The marker only moves forward
+	key := deliveryKey(q.UserID, conversationKey(q.PeerID, q.GroupID))
+	if current, ok := s.readUpTo[key]; !ok || s.indexOf(current) < end {
+		s.readUpTo[key] = q.UpTo
+	}
+
+	return read, nil
+}
+
+// SetReadReceipts sets the user's read receipt privacy setting
+func (s *MemoryStore) SetReadReceipts(ctx context.Context, userID string, enabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if enabled {
+		delete(s.noReceipts, userID)
+	} else {
+		s.noReceipts[userID] = true
+	}
+	return nil
+}
+
+// ReadReceipts reports whether the user sends read receipts
+func (s *MemoryStore) ReadReceipts(ctx context.Context, userID string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return !s.noReceipts[userID], nil
+}
+
+// History pages backwards through the conversation between two users
+func (s *MemoryStore) History(ctx context.Context, q HistoryQuery) (*Page, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	limit := clampLimit(q.Limit)
+
+	// Find where the cursor sits in insertion order
+	end := len(s.messages)
+	if q.Before != "" {
+		end = -1
+		for i, msg := range s.messages {
+			if msg.ID == q.Before {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return nil, ErrNotFound
+		}
+	}
+
+	page := &Page{}
+	for i := end - 1; i >= 0; i-- {
+		msg := s.messages[i]
+		if q.GroupID != "" && msg.GroupID != q.GroupID {
+			continue
+		}
+		if q.GroupID == "" && !inConversation(msg, q.UserID, q.PeerID) {
+			continue
+		}
+		if q.Before == "" && q.BeforeTs > 0 && msg.Timestamp >= q.BeforeTs {
+			continue
+		}
+		if msg.Timestamp < q.Since {
+			continue
+		}
+		if len(page.Messages) == limit {
+			page.HasMore = true
+			break
+		}
+		page.Messages = append(page.Messages, s.withStatus(msg, q.UserID))
+	}
+
+	// Collected newest first; return the page in chronological order
+	for i, j := 0, len(page.Messages)-1; i < j; i, j = i+1, j-1 {
+		page.Messages[i], page.Messages[j] = page.Messages[j], page.Messages[i]
+	}
+	page.ReadUpTo = s.readUpTo[deliveryKey(q.UserID, conversationKey(q.PeerID, q.GroupID))]
+
+	return page, nil
+}
+
+// Sync returns messages to or from the user after the watermark, oldest first
+func (s *MemoryStore) Sync(ctx context.Context, q SyncQuery) (*Page, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	limit := clampLimit(q.Limit)
+
+	// Messages are appended in timestamp order, so resume just after the
+	// tie-breaking message when one is given
+	start := 0
+	if q.AfterID != "" {
+		for i, msg := range s.messages {
+			if msg.ID == q.AfterID {
+				start = i + 1
+				break
+			}
+		}
+	}
+
+	page := &Page{}
+	for _, msg := range s.messages[start:] {
+		if msg.From != q.UserID && msg.To != q.UserID && !s.hasDelivery(msg.ID, q.UserID) {
+			continue
+		}
+		if msg.Timestamp < q.Since || (q.AfterID == "" && msg.Timestamp == q.Since) {
+			continue
+		}
+		if len(page.Messages) == limit {
+			page.HasMore = true
+			break
+		}
+		page.Messages = append(page.Messages, s.withStatus(msg, q.UserID))
+	}
+
+	return page, nil
+}
+
+// withStatus returns a copy of msg carrying its delivery status for the
+// direct recipient, or for userID in group messages
+func (s *MemoryStore) withStatus(msg *router.Message, userID string) *router.Message {
+	out := *msg
+	out.Recipients = nil
+	out.Status = ""
+
+	recipient := msg.To
+	if msg.GroupID != "" {
+		recipient = userID
+	}
+	if d, ok := s.deliveries[deliveryKey(msg.ID, recipient)]; ok {
+		out.Status = d.Status
+		if d.Status == StatusRead && recipient != userID && s.noReceipts[recipient] {
+			out.Status = StatusDelivered
+		}
+	}
+	return &out
+}
+
+// inReadConversation reports whether msg belongs to the conversation being marked read
+func (s *MemoryStore) inReadConversation(msg *router.Message, q ReadQuery) bool {
+	if q.GroupID != "" {
+		return msg.GroupID == q.GroupID
+	}
+	return msg.GroupID == "" && inConversation(msg, q.UserID, q.PeerID)
+}
+
+// indexOf returns the position of a message in insertion order, or -1
+func (s *MemoryStore) indexOf(messageID string) int {
+	for i, msg := range s.messages {
+		if msg.ID == messageID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *MemoryStore) hasDelivery(messageID, recipientID string) bool {
+	_, ok := s.deliveries[deliveryKey(messageID, recipientID)]
+	return ok
+}
+
+func inConversation(msg *router.Message, userID, peerID string) bool {
+	return (msg.From == userID && msg.To == peerID) || (msg.From == peerID && msg.To == userID)
+}
+
+// GetDelivery returns a copy of a delivery record
+func (s *MemoryStore) GetDelivery(messageID, recipientID string) (Delivery, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	d, ok := s.deliveries[deliveryKey(messageID, recipientID)]
+	if !ok {
+		return Delivery{}, false
+	}
+	return *d, true
+}
+
+// Close is a no-op for the in-memory store
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func deliveryKey(messageID, recipientID string) string {
+	return messageID + "/" + recipientID
+}
+
+// Ensure MemoryStore implements MessageStore
+var _ MessageStore = (*MemoryStore)(nil)
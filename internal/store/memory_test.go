@@ -0,0 +1,261 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"websocket-demo/internal/router"
+)
+
+// seed saves n messages alternating between alice and bob, one millisecond apart
+func seed(t *testing.T, s *MemoryStore, n int) {
+	t.Helper()
+	for i := 1; i <= n; i++ {
+		from, to := "alice", "bob"
+		if i%2 == 0 {
+			from, to = to, from
+		}
+		msg := &router.Message{ID: fmt.Sprintf("m%d", i), From: from, To: to, Content: "hi", Timestamp: int64(1000 + i)}
+		if err := s.SaveMessage(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// ids returns the IDs of a page's messages
+func ids(page *Page) []string {
+	var out []string
+	for _, msg := range page.Messages {
+		out = append(out, msg.ID)
+	}
+	return out
+}
+
+func expectIDs(t *testing.T, page *Page, want ...string) {
+	t.Helper()
+	got := ids(page)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("page %v, want %v", got, want)
+	}
+}
+
+func TestSaveMessageCreatesDeliveries(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+
+	if err := s.SaveMessage(ctx, &router.Message{ID: "m1", From: "alice", To: "bob", Timestamp: 1}); err != nil {
+		t.Fatal(err)
+	}
+	group := &router.Message{ID: "g1", From: "alice", GroupID: "team", Recipients: []string{"bob", "carol"}, Status: StatusQueued, Timestamp: 2}
+	if err := s.SaveMessage(ctx, group); err != nil {
+		t.Fatal(err)
+	}
+
+	if d, ok := s.GetDelivery("m1", "bob"); !ok || d.Status != StatusSent {
+		t.Fatalf("m1 delivery for bob = %+v, %v, want sent", d, ok)
+	}
+	for _, member := range []string{"bob", "carol"} {
+		if d, ok := s.GetDelivery("g1", member); !ok || d.Status != StatusQueued {
+			t.Fatalf("g1 delivery for %s = %+v, %v, want queued", member, d, ok)
+		}
+	}
+	if _, ok := s.GetDelivery("g1", "alice"); ok {
+		t.Fatal("the sender of a group message got a delivery record")
+	}
+
+	// 重复保存不会覆盖 / Saving the same ID again changes nothing
+	if err := s.SaveMessage(ctx, &router.Message{ID: "m1", From: "mallory", To: "bob", Timestamp: 3}); err != nil {
+		t.Fatal(err)
+	}
+	page, err := s.History(ctx, HistoryQuery{UserID: "alice", PeerID: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIDs(t, page, "m1")
+}
+
+func TestMarkDelivered(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	seed(t, s, 2)
+
+	first := time.UnixMilli(5000)
+	if err := s.MarkDelivered(ctx, "m1", "bob", first); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MarkDelivered(ctx, "m1", "bob", first.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	d, _ := s.GetDelivery("m1", "bob")
+	if d.Status != StatusDelivered || !d.DeliveredAt.Equal(first) {
+		t.Fatalf("delivery = %+v, want delivered at the first time", d)
+	}
+
+	// 已读消息不会降级为已送达 / A read message is not downgraded to delivered
+	if _, err := s.MarkReadUpTo(ctx, ReadQuery{UserID: "bob", PeerID: "alice", UpTo: "m1", At: first}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MarkDelivered(ctx, "m1", "bob", first); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := s.GetDelivery("m1", "bob"); d.Status != StatusRead {
+		t.Fatalf("status after a late delivery = %q, want read", d.Status)
+	}
+
+	for _, tt := range []struct{ id, recipient string }{{"m1", "alice"}, {"missing", "bob"}} {
+		if err := s.MarkDelivered(ctx, tt.id, tt.recipient, first); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("MarkDelivered(%s, %s) = %v, want ErrNotFound", tt.id, tt.recipient, err)
+		}
+	}
+}
+
+func TestHistoryPagesBackwards(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	seed(t, s, 5)
+	if err := s.SaveMessage(ctx, &router.Message{ID: "other", From: "alice", To: "carol", Timestamp: 2000}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 最新一页按时间顺序返回 / The newest page comes back in chronological order
+	page, err := s.History(ctx, HistoryQuery{UserID: "bob", PeerID: "alice", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIDs(t, page, "m4", "m5")
+	if !page.HasMore {
+		t.Fatal("HasMore = false with older messages left")
+	}
+
+	// 用最早的消息 ID 作为游标继续翻页 / The oldest ID on a page is the cursor for the next
+	page, err = s.History(ctx, HistoryQuery{UserID: "bob", PeerID: "alice", Before: "m4", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIDs(t, page, "m2", "m3")
+
+	page, err = s.History(ctx, HistoryQuery{UserID: "bob", PeerID: "alice", Before: "m2", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIDs(t, page, "m1")
+	if page.HasMore {
+		t.Fatal("HasMore = true on the last page")
+	}
+
+	// 时间戳游标，ID 游标优先 / Timestamp cursor, with the ID cursor taking precedence
+	page, err = s.History(ctx, HistoryQuery{UserID: "bob", PeerID: "alice", BeforeTs: 1004})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIDs(t, page, "m1", "m2", "m3")
+	page, err = s.History(ctx, HistoryQuery{UserID: "bob", PeerID: "alice", Before: "m3", BeforeTs: 1002})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIDs(t, page, "m1", "m2")
+
+	page, err = s.History(ctx, HistoryQuery{UserID: "bob", PeerID: "alice", Since: 1003})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIDs(t, page, "m3", "m4", "m5")
+
+	if _, err := s.History(ctx, HistoryQuery{UserID: "bob", PeerID: "alice", Before: "missing"}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("History with an unknown cursor = %v, want ErrNotFound", err)
+	}
+}
+
+func TestHistoryStatusAndReadMarker(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	seed(t, s, 3)
+
+	if err := s.MarkDelivered(ctx, "m1", "bob", time.UnixMilli(5000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.MarkReadUpTo(ctx, ReadQuery{UserID: "bob", PeerID: "alice", UpTo: "m2", At: time.UnixMilli(6000)}); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := s.History(ctx, HistoryQuery{UserID: "bob", PeerID: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// m2 was sent by bob, so marking it read only moves the marker
+	want := []string{StatusRead, StatusSent, StatusSent}
+	for i, msg := range page.Messages {
+		if msg.Status != want[i] {
+			t.Fatalf("%s status = %q, want %q", msg.ID, msg.Status, want[i])
+		}
+	}
+	if page.ReadUpTo != "m2" {
+		t.Fatalf("ReadUpTo = %q, want m2", page.ReadUpTo)
+	}
+
+	// 关闭已读回执后发送方只看到已送达 / With receipts off the sender sees delivered
+	if err := s.SetReadReceipts(ctx, "bob", false); err != nil {
+		t.Fatal(err)
+	}
+	page, err = s.History(ctx, HistoryQuery{UserID: "alice", PeerID: "bob", Limit: 1, Before: "m2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Messages[0].Status != StatusDelivered {
+		t.Fatalf("m1 status for alice = %q, want delivered", page.Messages[0].Status)
+	}
+}
+
+func TestHistoryGroup(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	for i, groupID := range []string{"team", "other", "team"} {
+		msg := &router.Message{ID: fmt.Sprintf("g%d", i+1), From: "alice", GroupID: groupID, Recipients: []string{"bob"}, Timestamp: int64(i + 1)}
+		if err := s.SaveMessage(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.MarkDelivered(ctx, "g3", "bob", time.UnixMilli(10)); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := s.History(ctx, HistoryQuery{UserID: "bob", GroupID: "team"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIDs(t, page, "g1", "g3")
+	if page.Messages[0].Status != StatusSent || page.Messages[1].Status != StatusDelivered {
+		t.Fatalf("statuses %q, %q, want sent, delivered", page.Messages[0].Status, page.Messages[1].Status)
+	}
+	if page.Messages[0].Recipients != nil {
+		t.Fatal("history exposed the group's recipients")
+	}
+}
+
+func TestSyncResumesAfterWatermark(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	seed(t, s, 4)
+	// 与 m4 同一时间戳 / Shares m4's timestamp
+	if err := s.SaveMessage(ctx, &router.Message{ID: "m5", From: "carol", To: "bob", Timestamp: 1004}); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := s.Sync(ctx, SyncQuery{UserID: "bob", Since: 1001, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIDs(t, page, "m2", "m3")
+	if !page.HasMore {
+		t.Fatal("HasMore = false with newer messages left")
+	}
+
+	page, err = s.Sync(ctx, SyncQuery{UserID: "bob", Since: 1004, AfterID: "m4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIDs(t, page, "m5")
+}
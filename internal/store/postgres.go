@@ -0,0 +1,369 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"websocket-demo/internal/router"
+)
+
+// PostgresStore implements MessageStore on the schema in schema/001_initial_schema.sql.
+// The caller must link a "postgres" database/sql driver (e.g. github.com/lib/pq).
+type PostgresStore struct {
+	db *sql.DB
+}
+
+// NewPostgresStore creates a store on an existing database handle
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// OpenPostgres opens a connection pool for the DSN and verifies it
+func OpenPostgres(ctx context.Context, dsn string) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open postgres: %w", err)
+	}
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+
+	return NewPostgresStore(db), nil
+}
+
+// SaveMessage inserts the message and its delivery rows in one transaction
+func (s *PostgresStore) SaveMessage(ctx context.Context, msg *router.Message) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	createdAt := time.UnixMilli(msg.Timestamp).UTC()
+	recipients := []string{msg.To}
+	if msg.GroupID != "" {
+		recipients = msg.Recipients
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO messages (message_id, from_user_id, to_user_id, group_id, content, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (message_id) DO NOTHING`,
+		msg.ID, msg.From, nullString(msg.To), nullString(msg.GroupID), msg.Content, createdAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert message: %w", err)
+	}
+
+	status := msg.Status
+	if status == "" {
+		status = StatusSent
+	}
+
+	for _, recipient := range recipients {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO users (user_id, username) VALUES ($1, $1)
+			ON CONFLICT (user_id) DO NOTHING`, recipient)
+		if err != nil {
+			return fmt.Errorf("failed to ensure recipient exists: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO message_delivery (message_id, recipient_id, status)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (message_id, recipient_id) DO NOTHING`,
+			msg.ID, recipient, status)
+		if err != nil {
+			return fmt.Errorf("failed to insert delivery record: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit message: %w", err)
+	}
+
+	return nil
+}
+
+// MarkDelivered sets the delivered timestamp without downgrading a read message
+func (s *PostgresStore) MarkDelivered(ctx context.Context, messageID, recipientID string, at time.Time) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE message_delivery
+		SET status = CASE WHEN status = $3 THEN status ELSE $4 END,
+		    delivered_at = COALESCE(delivered_at, $5)
+		WHERE message_id = $1 AND recipient_id = $2`,
+		messageID, recipientID, StatusRead, StatusDelivered, at.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to mark delivered: %w", err)
+	}
+
+	return checkAffected(result)
+}
+
+// MarkReadUpTo marks the user's unread messages in the conversation read and
+// moves the read marker forward, in one transaction
+func (s *PostgresStore) MarkReadUpTo(ctx context.Context, q ReadQuery) ([]*router.Message, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// $1 user, $2 peer or group
+	conversation := `((m.from_user_id = $1 AND m.to_user_id = $2) OR (m.from_user_id = $2 AND m.to_user_id = $1))`
+	peer := q.PeerID
+	if q.GroupID != "" {
+		conversation = `m.group_id = $2`
+		peer = q.GroupID
+	}
+
+	var upToTs time.Time
+	err = tx.QueryRowContext(ctx, `
+		SELECT m.created_at FROM messages m
+		WHERE m.message_id = $3 AND `+conversation,
+		q.UserID, peer, q.UpTo).Scan(&upToTs)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve read marker: %w", err)
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		UPDATE message_delivery d
+		SET status = $6,
+		    delivered_at = COALESCE(d.delivered_at, $5),
+		    read_at = $5
+		FROM messages m
+		WHERE d.message_id = m.message_id
+		  AND d.recipient_id = $1
+		  AND d.read_at IS NULL
+		  AND `+conversation+`
+		  AND (m.created_at < $4 OR (m.created_at = $4 AND m.message_id <= $3))
+		RETURNING m.message_id, m.from_user_id, COALESCE(m.to_user_id, ''), COALESCE(m.group_id, ''),
+		          m.content, m.created_at, d.status`,
+		q.UserID, peer, q.UpTo, upToTs, q.At.UTC(), StatusRead)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mark read: %w", err)
+	}
+
+	read, err := scanMessages(rows)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// The marker only moves forward
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO conversation_reads (user_id, conversation_id, last_read_id, last_read_created_at, read_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, conversation_id) DO UPDATE
+		SET last_read_id = EXCLUDED.last_read_id,
+		    last_read_created_at = EXCLUDED.last_read_created_at,
+		    read_at = EXCLUDED.read_at
+		WHERE conversation_reads.last_read_created_at < EXCLUDED.last_read_created_at
+		   OR (conversation_reads.last_read_created_at = EXCLUDED.last_read_created_at
+		       AND conversation_reads.last_read_id < EXCLUDED.last_read_id)`,
+		q.UserID, conversationKey(q.PeerID, q.GroupID), q.UpTo, upToTs, q.At.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to update read marker: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit read marker: %w", err)
+	}
+
+	return read, nil
+}
+
+// SetReadReceipts stores the user's read receipt privacy setting
+func (s *PostgresStore) SetReadReceipts(ctx context.Context, userID string, enabled bool) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO users (user_id, username, read_receipts) VALUES ($1, $1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET read_receipts = EXCLUDED.read_receipts`,
+		userID, enabled)
+	if err != nil {
+		return fmt.Errorf("failed to set read receipts: %w", err)
+	}
+
+	return nil
+}
+
+// ReadReceipts reports whether the user sends read receipts; unknown users do
+func (s *PostgresStore) ReadReceipts(ctx context.Context, userID string) (bool, error) {
+	enabled := true
+	err := s.db.QueryRowContext(ctx,
+		`SELECT read_receipts FROM users WHERE user_id = $1`, userID).Scan(&enabled)
+	if err != nil && err != sql.ErrNoRows {
+		return false, fmt.Errorf("failed to read read receipts setting: %w", err)
+	}
+
+	return enabled, nil
+}
+
+// selectMessages is the column list read by scanMessages. The delivery join
+// is for the direct recipient, or for the querying user ($1) in groups. Reads
+// by other users who disabled read receipts are reported as delivered.
+const selectMessages = `
+	SELECT m.message_id, m.from_user_id, COALESCE(m.to_user_id, ''), COALESCE(m.group_id, ''),
+	       m.content, m.created_at,
+	       CASE WHEN d.status = '` + StatusRead + `' AND d.recipient_id <> $1 AND NOT COALESCE(r.read_receipts, TRUE)
+	            THEN '` + StatusDelivered + `'
+	            ELSE COALESCE(d.status, '') END
+	FROM messages m
+	LEFT JOIN message_delivery d
+	       ON d.message_id = m.message_id AND d.recipient_id = COALESCE(m.to_user_id, $1)
+	LEFT JOIN users r ON r.user_id = d.recipient_id`
+
+// History pages backwards through a conversation using (created_at, message_id) as the cursor
+func (s *PostgresStore) History(ctx context.Context, q HistoryQuery) (*Page, error) {
+	limit := clampLimit(q.Limit)
+
+	cursorTs := time.Now().Add(time.Hour).UTC()
+	cursorID := ""
+	if q.Before != "" {
+		err := s.db.QueryRowContext(ctx,
+			`SELECT created_at FROM messages WHERE message_id = $1`, q.Before).Scan(&cursorTs)
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve history cursor: %w", err)
+		}
+		cursorID = q.Before
+	} else if q.BeforeTs > 0 {
+		cursorTs = time.UnixMilli(q.BeforeTs).UTC()
+	}
+
+	conversation := `((m.from_user_id = $1 AND m.to_user_id = $2) OR (m.from_user_id = $2 AND m.to_user_id = $1))`
+	peer := q.PeerID
+	if q.GroupID != "" {
+		conversation = `m.group_id = $2`
+		peer = q.GroupID
+	}
+
+	rows, err := s.db.QueryContext(ctx, selectMessages+`
+		WHERE `+conversation+`
+		  AND (m.created_at < $3 OR (m.created_at = $3 AND $4 <> '' AND m.message_id < $4))
+		  AND m.created_at >= $6
+		ORDER BY m.created_at DESC, m.message_id DESC
+		LIMIT $5`,
+		q.UserID, peer, cursorTs, cursorID, limit+1, time.UnixMilli(q.Since).UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query history: %w", err)
+	}
+	defer rows.Close()
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &Page{}
+	if len(messages) > limit {
+		messages = messages[:limit]
+		page.HasMore = true
+	}
+
+	// Rows come newest first; return the page in chronological order
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	page.Messages = messages
+
+	err = s.db.QueryRowContext(ctx, `
+		SELECT last_read_id FROM conversation_reads
+		WHERE user_id = $1 AND conversation_id = $2`,
+		q.UserID, conversationKey(q.PeerID, q.GroupID)).Scan(&page.ReadUpTo)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to load read marker: %w", err)
+	}
+
+	return page, nil
+}
+
+// Sync returns messages to or from the user after the watermark, oldest first
+func (s *PostgresStore) Sync(ctx context.Context, q SyncQuery) (*Page, error) {
+	limit := clampLimit(q.Limit)
+	since := time.UnixMilli(q.Since).UTC()
+
+	rows, err := s.db.QueryContext(ctx, selectMessages+`
+		WHERE (m.from_user_id = $1 OR d.recipient_id = $1)
+		  AND (m.created_at > $2 OR (m.created_at = $2 AND $3 <> '' AND m.message_id > $3))
+		ORDER BY m.created_at ASC, m.message_id ASC
+		LIMIT $4`,
+		q.UserID, since, q.AfterID, limit+1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sync: %w", err)
+	}
+	defer rows.Close()
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &Page{}
+	if len(messages) > limit {
+		messages = messages[:limit]
+		page.HasMore = true
+	}
+	page.Messages = messages
+
+	return page, nil
+}
+
+// scanMessages reads rows selected with selectMessages
+func scanMessages(rows *sql.Rows) ([]*router.Message, error) {
+	var messages []*router.Message
+
+	for rows.Next() {
+		var (
+			msg       router.Message
+			createdAt time.Time
+		)
+		if err := rows.Scan(&msg.ID, &msg.From, &msg.To, &msg.GroupID, &msg.Content, &createdAt, &msg.Status); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		msg.Type = router.MessageTypeDirect
+		if msg.GroupID != "" {
+			msg.Type = router.MessageTypeGroup
+		}
+		msg.Timestamp = createdAt.UnixMilli()
+		messages = append(messages, &msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read messages: %w", err)
+	}
+
+	return messages, nil
+}
+
+// nullString maps empty strings to SQL NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// Close closes the connection pool
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+// checkAffected maps an update that matched no rows to ErrNotFound
+func checkAffected(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to read affected rows: %w", err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Ensure PostgresStore implements MessageStore
+var _ MessageStore = (*PostgresStore)(nil)
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"websocket-demo/internal/router"
+)
+
+// Delivery statuses stored in message_delivery.status
+const (
+	StatusSent      = "sent"
+	StatusQueued    = "queued"
+	StatusDelivered = "delivered"
+	StatusRead      = "read"
+)
+
+// Pagination limits for history and sync queries
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+)
+
+// ErrNotFound is returned when a message or delivery record does not exist
+var ErrNotFound = errors.New("not found")
+
+// MessageStore persists routed messages and their delivery state
+type MessageStore interface {
+	// SaveMessage persists a message and creates its delivery records:
+	// one for To, or one per Recipients entry for group messages
+	SaveMessage(ctx context.Context, msg *router.Message) error
+
+	// MarkDelivered records that a message reached the recipient's socket
+	MarkDelivered(ctx context.Context, messageID, recipientID string, at time.Time) error
+
+	// MarkReadUpTo marks every unread message UserID received in a
+	// conversation, up to and including UpTo, as read and moves the user's
+	// read marker forward. It returns the messages that were newly read.
+	MarkReadUpTo(ctx context.Context, q ReadQuery) ([]*router.Message, error)
+
+	// SetReadReceipts sets whether senders are told when userID reads their messages
+	SetReadReceipts(ctx context.Context, userID string, enabled bool) error
+
+	// ReadReceipts reports whether userID sends read receipts (the default)
+	ReadReceipts(ctx context.Context, userID string) (bool, error)
+
+	// History returns a page of a conversation, newest page first, in chronological order
+	History(ctx context.Context, q HistoryQuery) (*Page, error)
+
+	// Sync returns messages sent to or from a user after a watermark, oldest first
+	Sync(ctx context.Context, q SyncQuery) (*Page, error)
+
+	// Close releases the underlying resources
+	Close() error
+}
+
+// HistoryQuery selects messages exchanged between UserID and PeerID, or the
+// messages of GroupID when it is set. Before (a message ID) takes precedence
+// over BeforeTs (Unix ms) as the cursor; with neither set the most recent
+// messages are returned. Messages older than Since (Unix ms), when set, are
+// left out.
+type HistoryQuery struct {
+	UserID   string
+	PeerID   string
+	GroupID  string
+	Before   string
+	BeforeTs int64
+	Since    int64
+	Limit    int
+}
+
+// ReadQuery marks the conversation between UserID and PeerID, or GroupID when
+// it is set, as read up to the message UpTo. UpTo may be any message in the
+// conversation, including one UserID sent.
+type ReadQuery struct {
+	UserID  string
+	PeerID  string
+	GroupID string
+	UpTo    string
+	At      time.Time
+}
+
+// SyncQuery selects messages sent by or to UserID (including group messages)
+// newer than the watermark Since (Unix ms).
+// AfterID breaks ties between messages sharing the watermark timestamp.
+type SyncQuery struct {
+	UserID  string
+	Since   int64
+	AfterID string
+	Limit   int
+}
+
+// Page is one batch of messages. Each message's Status holds its delivery
+// status for the direct recipient, or for UserID in group messages; a
+// recipient who disabled read receipts shows "delivered" instead of "read".
+type Page struct {
+	Messages []*router.Message
+	HasMore  bool
+	ReadUpTo string // UserID's read marker in the conversation (history only)
+}
+
+// conversationKey identifies a conversation in read markers
+func conversationKey(peerID, groupID string) string {
+	if groupID != "" {
+		return "group:" + groupID
+	}
+	return peerID
+}
+
+// clampLimit applies the default and maximum page sizes
+func clampLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		return MaxPageSize
+	}
+	return limit
+}
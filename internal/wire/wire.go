@@ -0,0 +1,251 @@
+// Package wire encodes and decodes the Protocol Buffers wire format. It covers
+// the field types used by proto/chat/v1/chat.proto (strings, bytes, varints,
+// bools and embedded messages), so frames can be hand-coded without generated
+// code or a protobuf runtime.
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Wire types
+const (
+	TypeVarint = 0
+	TypeI64    = 1
+	TypeBytes  = 2
+	TypeI32    = 5
+)
+
+// ErrTruncated is returned for input that ends inside a field
+var ErrTruncated = errors.New("wire: truncated input")
+
+// Buffer appends fields to an encoded message. Zero values are skipped, as
+// in proto3.
+type Buffer struct {
+	b []byte
+}
+
+// Bytes returns the encoded message
+func (b *Buffer) Bytes() []byte {
+	return b.b
+}
+
+func (b *Buffer) tag(field, wireType int) {
+	b.b = binary.AppendUvarint(b.b, uint64(field)<<3|uint64(wireType))
+}
+
+// String appends a string field
+func (b *Buffer) String(field int, s string) {
+	if s == "" {
+		return
+	}
+	b.tag(field, TypeBytes)
+	b.b = binary.AppendUvarint(b.b, uint64(len(s)))
+	b.b = append(b.b, s...)
+}
+
+// Strings appends a repeated string field
+func (b *Buffer) Strings(field int, values []string) {
+	for _, s := range values {
+		b.tag(field, TypeBytes)
+		b.b = binary.AppendUvarint(b.b, uint64(len(s)))
+		b.b = append(b.b, s...)
+	}
+}
+
+// Message appends an embedded message; unlike other fields an empty message
+// is still written, so its presence survives the round trip
+func (b *Buffer) Message(field int, m []byte) {
+	b.tag(field, TypeBytes)
+	b.b = binary.AppendUvarint(b.b, uint64(len(m)))
+	b.b = append(b.b, m...)
+}
+
+// Int64 appends an int64 field
+func (b *Buffer) Int64(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	b.tag(field, TypeVarint)
+	b.b = binary.AppendUvarint(b.b, uint64(v))
+}
+
+// Uint64 appends a uint64 field
+func (b *Buffer) Uint64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.tag(field, TypeVarint)
+	b.b = binary.AppendUvarint(b.b, v)
+}
+
+// Bool appends a bool field
+func (b *Buffer) Bool(field int, v bool) {
+	if !v {
+		return
+	}
+	b.tag(field, TypeVarint)
+	b.b = append(b.b, 1)
+}
+
+// OptionalBool appends an optional bool field; false is written, nil is not
+func (b *Buffer) OptionalBool(field int, v *bool) {
+	if v == nil {
+		return
+	}
+	b.tag(field, TypeVarint)
+	if *v {
+		b.b = append(b.b, 1)
+	} else {
+		b.b = append(b.b, 0)
+	}
+}
+
+// Reader iterates over the fields of an encoded message. Errors are sticky:
+// after the first one Next returns false and Err reports it.
+//
+//	r := wire.NewReader(data)
+//	for r.Next() {
+//		switch r.Field() {
+//		case 1:
+//			m.Name = r.String()
+//		default:
+//			r.Skip()
+//		}
+//	}
+//	if err := r.Err(); err != nil { ... }
+type Reader struct {
+	data     []byte
+	field    int
+	wireType int
+	err      error
+}
+
+// NewReader creates a reader over an encoded message
+func NewReader(data []byte) *Reader {
+	return &Reader{data: data}
+}
+
+// Next reads the next field's tag
+func (r *Reader) Next() bool {
+	if r.err != nil || len(r.data) == 0 {
+		return false
+	}
+
+	tag := r.uvarint()
+	if r.err != nil {
+		return false
+	}
+	r.field = int(tag >> 3)
+	r.wireType = int(tag & 7)
+	if r.field == 0 {
+		r.err = errors.New("wire: invalid field number 0")
+		return false
+	}
+	return true
+}
+
+// Field returns the number of the current field
+func (r *Reader) Field() int {
+	return r.field
+}
+
+// Err returns the first error encountered
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// String reads the current field as a string
+func (r *Reader) String() string {
+	return string(r.Bytes())
+}
+
+// Bytes reads the current field as bytes or an embedded message. The result
+// aliases the input.
+func (r *Reader) Bytes() []byte {
+	if !r.expect(TypeBytes) {
+		return nil
+	}
+
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.data)) {
+		r.err = ErrTruncated
+		return nil
+	}
+
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// Int64 reads the current field as an int64
+func (r *Reader) Int64() int64 {
+	return int64(r.Uint64())
+}
+
+// Uint64 reads the current field as a uint64
+func (r *Reader) Uint64() uint64 {
+	if !r.expect(TypeVarint) {
+		return 0
+	}
+	return r.uvarint()
+}
+
+// Bool reads the current field as a bool
+func (r *Reader) Bool() bool {
+	return r.Uint64() != 0
+}
+
+// Skip discards the current field, e.g. one added by a newer schema
+func (r *Reader) Skip() {
+	switch r.wireType {
+	case TypeVarint:
+		r.uvarint()
+	case TypeI64:
+		r.skip(8)
+	case TypeBytes:
+		r.Bytes()
+	case TypeI32:
+		r.skip(4)
+	default:
+		r.err = fmt.Errorf("wire: unsupported wire type %d in field %d", r.wireType, r.field)
+	}
+}
+
+func (r *Reader) expect(wireType int) bool {
+	if r.err != nil {
+		return false
+	}
+	if r.wireType != wireType {
+		r.err = fmt.Errorf("wire: field %d has wire type %d, want %d", r.field, r.wireType, wireType)
+		return false
+	}
+	return true
+}
+
+func (r *Reader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		if n == 0 {
+			r.err = ErrTruncated
+		} else {
+			r.err = errors.New("wire: varint overflows 64 bits")
+		}
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *Reader) skip(n int) {
+	if len(r.data) < n {
+		r.err = ErrTruncated
+		return
+	}
+	r.data = r.data[n:]
+}
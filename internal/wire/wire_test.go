@@ -0,0 +1,217 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// field is one decoded field; value holds the string or varint
+type field struct {
+	num   int
+	value any
+}
+
+// decode reads every field of a message, reading field numbers in strings as
+// strings, those in varints as varints and skipping the rest
+func decode(data []byte, strings, varints map[int]bool) ([]field, error) {
+	var fields []field
+	r := NewReader(data)
+	for r.Next() {
+		switch {
+		case strings[r.Field()]:
+			fields = append(fields, field{r.Field(), r.String()})
+		case varints[r.Field()]:
+			fields = append(fields, field{r.Field(), r.Uint64()})
+		default:
+			r.Skip()
+		}
+	}
+	return fields, r.Err()
+}
+
+func TestBufferEncoding(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(b *Buffer)
+		want  []byte
+	}{
+		{"string", func(b *Buffer) { b.String(1, "hi") }, []byte{0x0a, 2, 'h', 'i'}},
+		{"empty string skipped", func(b *Buffer) { b.String(1, "") }, nil},
+		{"repeated strings keep empties", func(b *Buffer) { b.Strings(12, []string{"a", ""}) },
+			[]byte{0x62, 1, 'a', 0x62, 0}},
+		{"int64", func(b *Buffer) { b.Int64(15, 300) }, []byte{0x78, 0xac, 0x02}},
+		{"zero int64 skipped", func(b *Buffer) { b.Int64(15, 0) }, nil},
+		// 负数按 proto 的 int64/int32 编码为 10 字节 / Negative values take 10 bytes, as proto int64/int32 do
+		{"negative int64", func(b *Buffer) { b.Int64(1, -1) },
+			[]byte{0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{"uint64", func(b *Buffer) { b.Uint64(1, 1<<63) },
+			[]byte{0x08, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}},
+		{"bool", func(b *Buffer) { b.Bool(3, true) }, []byte{0x18, 1}},
+		{"false bool skipped", func(b *Buffer) { b.Bool(3, false) }, nil},
+		{"optional false written", func(b *Buffer) { v := false; b.OptionalBool(19, &v) }, []byte{0x98, 0x01, 0}},
+		{"optional nil skipped", func(b *Buffer) { b.OptionalBool(19, nil) }, nil},
+		{"empty message written", func(b *Buffer) { b.Message(10, nil) }, []byte{0x52, 0}},
+		{"field 16 takes a two-byte tag", func(b *Buffer) { b.String(16, "x") }, []byte{0x82, 0x01, 1, 'x'}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b Buffer
+			tt.write(&b)
+			if !bytes.Equal(b.Bytes(), tt.want) {
+				t.Fatalf("encoded % x, want % x", b.Bytes(), tt.want)
+			}
+		})
+	}
+}
+
+func TestReaderRoundTrip(t *testing.T) {
+	var nested Buffer
+	nested.String(1, "inner")
+
+	var b Buffer
+	b.String(1, "你好")
+	b.Int64(2, -42)
+	b.Uint64(3, 1<<64-1)
+	b.Bool(4, true)
+	b.Strings(5, []string{"a", "", "c"})
+	b.Message(6, nested.Bytes())
+	v := false
+	b.OptionalBool(7, &v)
+
+	r := NewReader(b.Bytes())
+	var got []any
+	for r.Next() {
+		switch r.Field() {
+		case 1, 5:
+			got = append(got, r.String())
+		case 2:
+			got = append(got, r.Int64())
+		case 3:
+			got = append(got, r.Uint64())
+		case 4, 7:
+			got = append(got, r.Bool())
+		case 6:
+			inner := NewReader(r.Bytes())
+			for inner.Next() {
+				got = append(got, inner.String())
+			}
+			if err := inner.Err(); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			t.Fatalf("unexpected field %d", r.Field())
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []any{"你好", int64(-42), uint64(1<<64 - 1), true, "a", "", "c", "inner", false}
+	if len(got) != len(want) {
+		t.Fatalf("decoded %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("field %d decoded %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestReaderSkipsUnknownFields(t *testing.T) {
+	// 新版本 schema 可能添加的各类字段 / Fields of every wire type a newer schema might add
+	data := []byte{
+		0x0a, 2, 'h', 'i', // 1: "hi"
+		0x10, 0x96, 0x01, // 2: varint 150
+		0x19, 1, 2, 3, 4, 5, 6, 7, 8, // 3: fixed64
+		0x25, 1, 2, 3, 4, // 4: fixed32
+		0x2a, 3, 0x01, 0x96, 0x01, // 5: packed varints [1, 150]
+		0x32, 2, 0x08, 0x01, // 6: embedded message
+		0x3a, 3, 'e', 'n', 'd', // 7: "end"
+	}
+
+	fields, err := decode(data, map[int]bool{1: true, 7: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []field{{1, "hi"}, {7, "end"}}
+	if len(fields) != len(want) || fields[0] != want[0] || fields[1] != want[1] {
+		t.Fatalf("decoded %v, want %v", fields, want)
+	}
+}
+
+func TestReaderPackedField(t *testing.T) {
+	// 打包的 repeated 标量以 bytes 读出 / A packed repeated scalar reads as bytes
+	data := []byte{0x0a, 4, 0x01, 0x96, 0x01, 0x00}
+
+	r := NewReader(data)
+	if !r.Next() {
+		t.Fatalf("no field: %v", r.Err())
+	}
+	packed := NewReader(r.Bytes())
+	var values []uint64
+	for len(packed.data) > 0 {
+		values = append(values, packed.uvarint())
+	}
+	if err := packed.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 3 || values[0] != 1 || values[1] != 150 || values[2] != 0 {
+		t.Fatalf("packed values %v, want [1 150 0]", values)
+	}
+	if r.Next() {
+		t.Fatalf("unexpected field %d after the packed field", r.Field())
+	}
+}
+
+func TestReaderMalformedInput(t *testing.T) {
+	overflow := []byte{0x10, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}
+
+	tests := []struct {
+		name      string
+		data      []byte
+		truncated bool
+	}{
+		{"truncated tag", []byte{0x82}, true},
+		{"truncated varint", []byte{0x10, 0x96}, true},
+		{"truncated length", []byte{0x0a}, true},
+		{"length past end", []byte{0x0a, 5, 'a', 'b'}, true},
+		{"truncated fixed64", []byte{0x19, 1, 2, 3}, true},
+		{"truncated fixed32", []byte{0x25, 1}, true},
+		{"truncated embedded length", []byte{0x32, 0x80}, true},
+		{"varint overflow", overflow, false},
+		{"field number 0", []byte{0x02, 0}, false},
+		{"group wire type", []byte{0x0b, 0x0c}, false},
+		{"string field as varint", []byte{0x08, 1}, false},
+		{"varint field as bytes", []byte{0x12, 1, 'x'}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decode(tt.data, map[int]bool{1: true}, map[int]bool{2: true})
+			if err == nil {
+				t.Fatal("decoded malformed input without an error")
+			}
+			if truncated := errors.Is(err, ErrTruncated); truncated != tt.truncated {
+				t.Fatalf("error %v, want ErrTruncated = %v", err, tt.truncated)
+			}
+		})
+	}
+}
+
+func TestReaderErrorIsSticky(t *testing.T) {
+	r := NewReader([]byte{0x0a, 5, 'a', 0x0a, 1, 'b'})
+	if !r.Next() {
+		t.Fatal("no first field")
+	}
+	if s := r.String(); s != "" {
+		t.Fatalf("truncated string read as %q", s)
+	}
+	if r.Next() {
+		t.Fatal("Next continued after an error")
+	}
+	if !errors.Is(r.Err(), ErrTruncated) {
+		t.Fatalf("Err() = %v, want ErrTruncated", r.Err())
+	}
+}
@@ -0,0 +1,8 @@
+-- WebSocket Demo - Group message persistence
+-- Group messages have no single recipient: to_user_id is NULL and each
+-- member gets a row in message_delivery.
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS group_id VARCHAR(64);
+
+CREATE INDEX IF NOT EXISTS idx_messages_group ON messages(group_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_delivery_recipient ON message_delivery(recipient_id, message_id);
@@ -0,0 +1,18 @@
+-- WebSocket Demo - Read receipts
+-- Per-conversation read markers and the read receipt privacy setting.
+-- conversation_id is the peer's user ID for direct chats, or 'group:' || group_id.
+
+CREATE TABLE IF NOT EXISTS conversation_reads (
+    user_id VARCHAR(64) REFERENCES users(user_id),
+    conversation_id VARCHAR(80) NOT NULL,
+    last_read_id VARCHAR(64) NOT NULL,
+    last_read_created_at TIMESTAMP NOT NULL,
+    read_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, conversation_id)
+);
+
+-- Users who turn this off still record what they read, but senders are not
+-- told: no receipts are routed and history reports their reads as delivered
+ALTER TABLE users ADD COLUMN IF NOT EXISTS read_receipts BOOLEAN NOT NULL DEFAULT TRUE;
+
+CREATE INDEX IF NOT EXISTS idx_delivery_unread ON message_delivery(recipient_id, message_id) WHERE read_at IS NULL;
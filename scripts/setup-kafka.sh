@@ -42,6 +42,22 @@ for gw in "${GATEWAYS[@]}"; do
         --config compression.type=snappy
 
     echo "✅ Topic $TOPIC created successfully"
+
+    # 重试 topic：投递失败的消息在这里等待退避 / Retry topic: failed deliveries wait out their backoff here
+    RETRY_TOPIC="gateway-$gw-retry"
+
+    echo "📝 Creating retry topic: $RETRY_TOPIC"
+
+    docker exec websocket-kafka kafka-topics --create \
+        --bootstrap-server $KAFKA_BROKER \
+        --topic $RETRY_TOPIC \
+        --partitions 3 \
+        --replication-factor 1 \
+        --if-not-exists \
+        --config retention.ms=86400000 \
+        --config compression.type=snappy
+
+    echo "✅ Topic $RETRY_TOPIC created successfully"
 done
 
 # 创建广播 topic / Create broadcast topic
@@ -57,6 +73,19 @@ docker exec websocket-kafka kafka-topics --create \
 
 echo "✅ Broadcast topic created successfully"
 
+# 创建死信 topic / Create dead-letter topic
+echo "📝 Creating dead-letter topic: gateway-dlq"
+docker exec websocket-kafka kafka-topics --create \
+    --bootstrap-server $KAFKA_BROKER \
+    --topic gateway-dlq \
+    --partitions 3 \
+    --replication-factor 1 \
+    --if-not-exists \
+    --config retention.ms=1209600000 \
+    --config compression.type=snappy
+
+echo "✅ Dead-letter topic created successfully"
+
 # 列出所有 topics / List all topics
 echo ""
 echo "📋 All topics:"
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"log"
+	"net/http"
+	"os"
 	"time"
 
+	"websocket-demo/internal/auth"
+
 	"github.com/gorilla/websocket"
 )
 
@@ -23,7 +28,7 @@ type ServerMessage struct {
 }
 
 func connectAndRegister(userID, gatewayURL string) (*websocket.Conn, error) {
-	conn, _, err := websocket.DefaultDialer.Dial(gatewayURL, nil)
+	conn, _, err := websocket.DefaultDialer.Dial(gatewayURL, devTokenHeader(userID))
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect: %w", err)
 	}
@@ -55,6 +60,36 @@ func connectAndRegister(userID, gatewayURL string) (*websocket.Conn, error) {
 	return conn, nil
 }
 
+// devTokenHeader mints a short-lived token for userID when DEV_JWT_KEY points
+// at the gateway's HMAC dev key, so the script also runs against -jwt-hmac-secret gateways
+func devTokenHeader(userID string) http.Header {
+	keyFile := os.Getenv("DEV_JWT_KEY")
+	if keyFile == "" {
+		return nil
+	}
+
+	secret, err := os.ReadFile(keyFile)
+	if err != nil {
+		log.Fatalf("Failed to read DEV_JWT_KEY: %v", err)
+	}
+
+	claims := &auth.Claims{
+		Subject:   userID,
+		IssuedAt:  time.Now().Unix(),
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}
+	if aud := os.Getenv("DEV_JWT_AUDIENCE"); aud != "" {
+		claims.Audience = auth.Audience{aud}
+	}
+
+	token, err := auth.Sign(claims, "HS256", bytes.TrimSpace(secret))
+	if err != nil {
+		log.Fatalf("Failed to mint dev token: %v", err)
+	}
+
+	return http.Header{"Authorization": []string{"Bearer " + token}}
+}
+
 func sendMessage(conn *websocket.Conn, to, content string) error {
 	msg := ClientMessage{
 		Type:    "message",
@@ -64,10 +99,17 @@ func sendMessage(conn *websocket.Conn, to, content string) error {
 	return conn.WriteJSON(msg)
 }
 
+// readMessage returns the next frame, skipping delivery acks
 func readMessage(conn *websocket.Conn) (*ServerMessage, error) {
-	var msg ServerMessage
-	err := conn.ReadJSON(&msg)
-	return &msg, err
+	for {
+		var msg ServerMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return &msg, err
+		}
+		if msg.Type != "ack" {
+			return &msg, nil
+		}
+	}
 }
 
 func main() {